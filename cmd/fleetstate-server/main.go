@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/narqo/ree-fleet-sim/internal/fleetstate"
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
 	"github.com/narqo/ree-fleet-sim/internal/middleware"
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
 )
 
 func main() {
@@ -35,22 +39,220 @@ func run(ctx context.Context, args []string) error {
 	flags := flag.NewFlagSet("", flag.ExitOnError)
 
 	var (
-		httpAddr        string
-		shutdownTimeout time.Duration
+		httpAddr          string
+		shutdownTimeout   time.Duration
+		storeType         string
+		storeDir          string
+		storeSyncInterval time.Duration
+		storeMaxAge       time.Duration
+		storeMaxRecords   int
+		storeMaxLateness  time.Duration
+		storeFeedSize     int
+		storeChunkSize    int
+		storeShards       int
+		maxSpeed          float64
+		flagImplausible   bool
+		quarantineSize    int
+		distanceType      string
+		geofenceEvents    int
+		webhookDir        string
+		webhookAttempts   int
+		speedLimit        float64
+		offlineAfter      time.Duration
+		stopRadius        float64
+		stopDuration      time.Duration
+		odometerThreshold float64
+		usageMaxAge       time.Duration
+		wsAllowedOrigins  string
+		wsMaxSubs         int
 	)
 	flags.StringVar(&httpAddr, "http-addr", "127.0.0.1:10080", "address to listen on")
 	flags.DurationVar(&shutdownTimeout, "http-shutdown-timeout", 5*time.Second, "server shutdown timeout")
+	flags.StringVar(&storeType, "store", "mem", "type of the store: mem, file")
+	flags.StringVar(&storeDir, "store-dir", "data", "directory for the file store's data")
+	flags.DurationVar(&storeSyncInterval, "store-sync-interval", 0, "interval the file store fsyncs its log (0 - after every write, negative - never)")
+	flags.DurationVar(&storeMaxAge, "store-max-age", 0, "max age of a record the store keeps in memory (0 - no limit)")
+	flags.IntVar(&storeMaxRecords, "store-max-records", 0, "max number of records per vehicle the store keeps in memory (0 - no limit)")
+	flags.DurationVar(&storeMaxLateness, "store-max-lateness", 0, "how much older than the latest record of a vehicle a back-filled record can be (0 - no back-filling)")
+	flags.IntVar(&storeChunkSize, "store-chunk-size", fleetstate.DefaultChunkSize, "number of older records of a vehicle the store compresses in a chunk (negative - no compression)")
+	flags.IntVar(&storeShards, "store-shards", 1, "number of shards the store splits the vehicles between by their VINs")
+	flags.IntVar(&storeFeedSize, "store-feed-size", 1024, "number of latest positions of all vehicles buffered for the fleet-wide streams")
+	flags.Float64Var(&maxSpeed, "max-speed", 0, "max plausible speed of a vehicle in km/h, faster jumps are rejected (0 - no limit)")
+	flags.BoolVar(&flagImplausible, "flag-implausible", false, "store implausible positions, only adding them to quarantine")
+	flags.IntVar(&quarantineSize, "quarantine-size", 1000, "number of latest implausible positions kept for inspection")
+	flags.IntVar(&geofenceEvents, "geofence-events-size", 10000, "number of latest geofence events kept for the queries")
+	flags.StringVar(&webhookDir, "webhook-dir", "", "directory for the webhooks and their delivery queue (empty - in memory)")
+	flags.IntVar(&webhookAttempts, "webhook-max-attempts", 10, "number of attempts to deliver an event to a webhook")
+	flags.Float64Var(&speedLimit, "speed-limit", 0, "speed in km/h, above which a vehicle is speeding (0 - no speeding events)")
+	flags.DurationVar(&offlineAfter, "offline-after", time.Minute, "how long after its latest position a vehicle is offline (0 - don't track the status)")
+	flags.Float64Var(&stopRadius, "trip-stop-radius", 50, "distance in meters, a stopped vehicle stays within")
+	flags.DurationVar(&stopDuration, "trip-stop-duration", 3*time.Minute, "how long a vehicle stays within the stop radius, before it's stopped")
+	flags.Float64Var(&odometerThreshold, "odometer-threshold", 10, "distance in meters, a vehicle must move before the odometer counts the move (0 - count every move)")
+	flags.DurationVar(&usageMaxAge, "usage-max-age", 0, "max age of the hourly usage rollups of a vehicle (0 - no limit)")
+	flags.StringVar(&distanceType, "distance", "haversine", "distance formula the speed is calculated with: haversine, vincenty")
+	flags.StringVar(&wsAllowedOrigins, "ws-allowed-origins", "", "comma-separated origins of the pages, besides the server's own, that can open WebSocket connections")
+	flags.IntVar(&wsMaxSubs, "ws-max-subscriptions", fleetstate.DefaultMaxSubscriptions, "max number of vehicles a WebSocket client can subscribe to")
 
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 
+	var handlerOpts fleetstate.HandlerOptions
+	switch distanceType {
+	case "haversine":
+		handlerOpts.Distance = geoutil.Distance
+	case "vincenty":
+		handlerOpts.Distance = geoutil.VincentyDistance
+	default:
+		return fmt.Errorf("unknown distance formula %q", distanceType)
+	}
+	if wsAllowedOrigins != "" {
+		handlerOpts.AllowedOrigins = strings.Split(wsAllowedOrigins, ",")
+	}
+	handlerOpts.MaxSubscriptions = wsMaxSubs
+
+	memOpts := fleetstate.MemStoreOptions{
+		MaxAge:      storeMaxAge,
+		MaxRecords:  storeMaxRecords,
+		MaxLateness: storeMaxLateness,
+		FeedSize:    storeFeedSize,
+		ChunkSize:   storeChunkSize,
+
+		OdometerThreshold: odometerThreshold,
+		UsageMaxAge:       usageMaxAge,
+	}
+
+	var store interface {
+		fleetstate.Store
+		Expire(now time.Time) int
+	}
+	switch storeType {
+	case "mem":
+		if storeShards > 1 {
+			store = fleetstate.NewShardedMemStore(storeShards, memOpts)
+		} else {
+			store = fleetstate.NewMemStoreWithOptions(memOpts)
+		}
+	case "file":
+		fileOpts := fleetstate.FileStoreOptions{
+			MemStoreOptions: memOpts,
+			SyncInterval:    storeSyncInterval,
+		}
+		// the store refuses to open the directory, that was created with a different number of the shards
+		fileStore, err := fleetstate.OpenShardedFileStore(storeDir, storeShards, fileOpts)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := fileStore.Close(); err != nil {
+				log.Printf("failed to close store: %s", err)
+			}
+		}()
+		store = fileStore
+	default:
+		return fmt.Errorf("unknown store type %q", storeType)
+	}
+
+	if storeMaxAge > 0 {
+		// drop the expired records of the vehicles, that stopped reporting
+		go func() {
+			ticker := time.NewTicker(storeMaxAge / 10)
+			defer ticker.Stop()
+			for {
+				select {
+				case now := <-ticker.C:
+					store.Expire(now)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var plausibilityChecks []fleetstate.PlausibilityCheck
+	if maxSpeed > 0 {
+		plausibilityChecks = append(plausibilityChecks, fleetstate.MaxSpeedCheck(maxSpeed))
+	}
+	plausibleStore := fleetstate.NewPlausibleStore(store, fleetstate.PlausibilityOptions{
+		Checks:         plausibilityChecks,
+		FlagOnly:       flagImplausible,
+		QuarantineSize: quarantineSize,
+	})
+
+	geofenceStore := fleetstate.NewGeofenceStore(plausibleStore, fleetstate.GeofenceOptions{
+		EventsSize: geofenceEvents,
+	})
+
+	tripStore := fleetstate.NewTripStore(geofenceStore, fleetstate.TripOptions{
+		StopRadius:   stopRadius,
+		StopDuration: stopDuration,
+		Distance:     handlerOpts.Distance,
+	})
+	handlerOpts.Trips = tripStore
+	if storeType == "file" {
+		if err := tripStore.Rebuild(ctx); err != nil {
+			return fmt.Errorf("could not rebuild trips: %w", err)
+		}
+	}
+
+	if offlineAfter > 0 {
+		handlerOpts.Status = fleetstate.NewStatusMonitor(geofenceStore, fleetstate.StatusOptions{
+			OfflineAfter: offlineAfter,
+		})
+		go func() {
+			if err := handlerOpts.Status.Run(ctx); err != nil {
+				log.Printf("failed to track vehicles status: %s", err)
+			}
+		}()
+	}
+
+	dispatcher, err := webhook.Open(webhook.Options{
+		Dir:         webhookDir,
+		MaxAttempts: webhookAttempts,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dispatcher.Close(); err != nil {
+			log.Printf("failed to close webhooks: %s", err)
+		}
+	}()
+
+	go func() {
+		err := fleetstate.PublishFleetEvents(ctx, geofenceStore, dispatcher, fleetstate.FleetEventsOptions{
+			SpeedLimit: speedLimit,
+			Status:     handlerOpts.Status,
+			Distance:   handlerOpts.Distance,
+		})
+		if err != nil {
+			log.Printf("failed to publish fleet events: %s", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 
-	store := fleetstate.NewMemStore()
-	vh := fleetstate.NewVehicleHandler(store)
+	vh := fleetstate.NewVehicleHandlerWithOptions(tripStore, handlerOpts)
 	mux.Handle("/vehicle/", http.StripPrefix("/vehicle", vh.Handler()))
 
+	fh := fleetstate.NewFleetHandlerWithOptions(tripStore, handlerOpts)
+	mux.Handle("/vehicles", http.StripPrefix("/vehicles", fh.Handler()))
+	mux.Handle("/vehicles/", http.StripPrefix("/vehicles", fh.Handler()))
+
+	qh := fleetstate.NewQuarantineHandler(plausibleStore)
+	mux.Handle("/quarantine", qh.Handler())
+
+	gh := fleetstate.NewGeofenceHandler(geofenceStore)
+	mux.Handle("/geofences", http.StripPrefix("/geofences", gh.Handler()))
+	mux.Handle("/geofences/", http.StripPrefix("/geofences", gh.Handler()))
+
+	th := fleetstate.NewTripHandler(tripStore)
+	mux.Handle("/trips/", http.StripPrefix("/trips", th.Handler()))
+
+	wh := fleetstate.NewWebhookHandler(dispatcher)
+	mux.Handle("/webhooks", http.StripPrefix("/webhooks", wh.Handler()))
+	mux.Handle("/webhooks/", http.StripPrefix("/webhooks", wh.Handler()))
+
 	server := &http.Server{
 		Addr:    httpAddr,
 		Handler: middleware.LoggingHandler(os.Stdout, mux),
@@ -43,11 +43,15 @@ func run(ctx context.Context, args []string) error {
 		vehiclesTotal      int
 		tickInterval       time.Duration
 		maxDistancePerTick float64
+		batchSize          int
+		batchInterval      time.Duration
 	)
 	flags.StringVar(&fleetStateAddr, "fleetstate-server-addr", "http://127.0.0.1:10080", "address of fleetstate server")
 	flags.IntVar(&vehiclesTotal, "vehicles-total", 20, "total number of vehicles to simulate")
 	flags.DurationVar(&tickInterval, "vehicle-tick-interval", time.Second, "interval a vehicle sends an update to server")
 	flags.Float64Var(&maxDistancePerTick, "vehicle-max-distance-per-tick", 13, "max distance in meters a vehicle moves per tick")
+	flags.IntVar(&batchSize, "batch-size", 0, "max number of positions the vehicles report to server in a single batch (0 - no batching)")
+	flags.DurationVar(&batchInterval, "batch-interval", 0, "interval the vehicles report the batch of positions to server (0 - no batching)")
 
 	if err := flags.Parse(args); err != nil {
 		return err
@@ -55,12 +59,31 @@ func run(ctx context.Context, args []string) error {
 
 	client := vehicle.NewFleetStateClient(fleetStateAddr)
 
+	report := func(ctx context.Context, vc *vehicle.Vehicle) error {
+		return vc.ReportPosition(ctx)
+	}
+
+	var wg sync.WaitGroup
+
+	if batchSize > 0 || batchInterval > 0 {
+		batcher := vehicle.NewBatcher(client, batchSize, batchInterval)
+		report = func(ctx context.Context, vc *vehicle.Vehicle) error {
+			batcher.Add(vc.Position(time.Now().UTC()))
+			return nil
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batcher.Run(ctx)
+		}()
+	}
+
 	var vcs []*vehicle.Vehicle
 	for n := vehiclesTotal; n > 0; n-- {
 		vcs = append(vcs, vehicle.NewVehicle(client))
 	}
 
-	var wg sync.WaitGroup
 	for _, vc := range vcs {
 		log.Printf("starting simulation for %s", vc)
 
@@ -68,7 +91,7 @@ func run(ctx context.Context, args []string) error {
 		go func(vc *vehicle.Vehicle) {
 			defer wg.Done()
 
-			if err := vc.ReportPosition(ctx); err != nil {
+			if err := report(ctx, vc); err != nil {
 				log.Printf("failed to report position for %s: %s", vc, err)
 			}
 
@@ -76,9 +99,9 @@ func run(ctx context.Context, args []string) error {
 			for {
 				select {
 				case <-ticker.C:
-					vc.MoveNearby(rand.Float64() * maxDistancePerTick)
+					vc.Move(rand.Float64() * maxDistancePerTick)
 
-					if err := vc.ReportPosition(ctx); err != nil {
+					if err := report(ctx, vc); err != nil {
 						log.Printf("failed to report position for %s: %s", vc, err)
 					}
 				case <-ctx.Done():
@@ -0,0 +1,112 @@
+package fleetstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
+)
+
+// Codes of the errors, the API responds with.
+const (
+	CodeBadRequest          = "bad_request"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeConflict            = "conflict"
+	CodeUnprocessableEntity = "unprocessable_entity"
+	CodeInternal            = "internal"
+)
+
+// APIError is an error, the API responds with. The API encodes the error as a JSON object:
+//
+//	{"error":{"code":"bad_request","message":"bad lat: ···","field":"lat"}}
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Field is the name of the request's field, the error is about, if any.
+	Field string `json:"field,omitempty"`
+
+	err error
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// badRequest reports the request's field, that can't be parsed.
+func badRequest(field string, err error) error {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeBadRequest,
+		Message: fmt.Sprintf("bad %s: %s", field, err),
+		Field:   field,
+		err:     err,
+	}
+}
+
+// unprocessable reports the request's field, that was parsed, but has an invalid value.
+func unprocessable(field string, err error) error {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeUnprocessableEntity,
+		Message: fmt.Sprintf("bad %s: %s", field, err),
+		Field:   field,
+		err:     err,
+	}
+}
+
+// toAPIError converts err to APIError, mapping the errors of the store to the corresponding response statuses.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	apiErr = &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: err.Error(),
+		err:     err,
+	}
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrUnknownVIN), errors.Is(err, ErrUnknownGeofence),
+		errors.Is(err, ErrUnknownTrip), errors.Is(err, webhook.ErrUnknownSubscription):
+		apiErr.Status = http.StatusNotFound
+		apiErr.Code = CodeNotFound
+	case errors.Is(err, ErrOldRecord):
+		apiErr.Status = http.StatusConflict
+		apiErr.Code = CodeConflict
+	case errors.Is(err, ErrImplausible):
+		apiErr.Status = http.StatusUnprocessableEntity
+		apiErr.Code = CodeUnprocessableEntity
+	case errors.Is(err, ErrBadCursor):
+		apiErr.Status = http.StatusBadRequest
+		apiErr.Code = CodeBadRequest
+		apiErr.Field = "cursor"
+	}
+	return apiErr
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+
+	if err := json.NewEncoder(w).Encode(ErrorResponse{apiErr}); err != nil {
+		log.Printf("failed to encode error response: %s", err)
+	}
+}
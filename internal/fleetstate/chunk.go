@@ -0,0 +1,550 @@
+package fleetstate
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// DefaultChunkSize is the number of records of a vehicle, MemStore seals in a compressed chunk.
+const DefaultChunkSize = 128
+
+// track is the time-ordered records of a vehicle. The older records are sealed in the compressed chunks,
+// the latest ones are kept in head as is, so the writes, and the readers, that follow the vehicle,
+// don't decode the chunks. Once the vehicle has any records, head has at least one of them.
+type track struct {
+	// chunkSize is the number of records in a sealed chunk; zero value keeps all records in head
+	chunkSize int
+	chunks    []*chunk
+	// off is the number of the dropped records at the start of the first chunk
+	off int
+	// sealed is the number of the records in the chunks, not counting the dropped ones
+	sealed int
+	head   []Record
+}
+
+func newTrack(chunkSize int) track {
+	if chunkSize < 0 {
+		chunkSize = 0
+	}
+	return track{chunkSize: chunkSize}
+}
+
+func (t *track) len() int {
+	return t.sealed + len(t.head)
+}
+
+// last returns the latest record of the track.
+func (t *track) last() (Record, bool) {
+	if len(t.head) == 0 {
+		return Record{}, false
+	}
+	return t.head[len(t.head)-1], true
+}
+
+// at returns the record with the index i. A sealed record is decoded along with the ones before it in its chunk,
+// but not the ones after it.
+func (t *track) at(i int) Record {
+	if i >= t.sealed {
+		return t.head[i-t.sealed]
+	}
+	i += t.off
+	for _, c := range t.chunks {
+		if i < c.n {
+			cr := c.reader()
+			for ; i > 0; i-- {
+				cr.next()
+			}
+			return cr.next()
+		}
+		i -= c.n
+	}
+	panic("track: index out of range")
+}
+
+// search returns the index of the first record at or after the position p.
+func (t *track) search(p position) int {
+	i, _, _ := t.find(p, nil)
+	return i
+}
+
+// seek returns the first record at or after the position p. If cache isn't nil, the records of the sealed chunk
+// are looked up in, and kept in, the cache, so the sequential seeks decode the chunk once.
+func (t *track) seek(p position, cache *chunkCache) (Record, bool) {
+	_, rec, ok := t.find(p, cache)
+	return rec, ok
+}
+
+func (t *track) find(p position, cache *chunkCache) (i int, rec Record, ok bool) {
+	if len(t.head) > 0 && t.head[0].position().Before(p) {
+		j := sort.Search(len(t.head), func(j int) bool {
+			return !t.head[j].position().Before(p)
+		})
+		if j == len(t.head) {
+			return t.len(), Record{}, false
+		}
+		return t.sealed + j, t.head[j], true
+	}
+
+	k := sort.Search(len(t.chunks), func(k int) bool {
+		return !t.chunks[k].last.Before(p)
+	})
+	if k == len(t.chunks) {
+		if len(t.head) == 0 {
+			return t.sealed, Record{}, false
+		}
+		return t.sealed, t.head[0], true
+	}
+
+	start := 0
+	if k == 0 {
+		start = t.off
+	}
+	var j int
+	if cache != nil {
+		recs := cache.records(t.chunks[k])
+		j = start + sort.Search(len(recs)-start, func(j int) bool {
+			return !recs[start+j].position().Before(p)
+		})
+		rec = recs[j]
+	} else {
+		// the chunk's last record is at or after p, so the scan stops in the chunk
+		cr := t.chunks[k].reader()
+		for j = 0; ; j++ {
+			rec = cr.next()
+			if j >= start && !rec.position().Before(p) {
+				break
+			}
+		}
+	}
+
+	i = j - t.off
+	for _, c := range t.chunks[:k] {
+		i += c.n
+	}
+	return i, rec, true
+}
+
+// chunkCache keeps the records of the chunk, decoded last.
+type chunkCache struct {
+	c    *chunk
+	recs []Record
+}
+
+func (cache *chunkCache) records(c *chunk) []Record {
+	// the chunks are immutable, a re-encoded chunk is a new one
+	if cache.c != c {
+		cache.c = c
+		cache.recs = c.records(cache.recs[:0])
+	}
+	return cache.recs
+}
+
+// slice returns a copy of the records with the indexes in the interval [start, end).
+func (t *track) slice(start, end int) []Record {
+	res := make([]Record, 0, end-start)
+
+	// the interval in the records of the chunks, including the dropped ones
+	from, to := start+t.off, end+t.off
+	if to > t.sealed+t.off {
+		to = t.sealed + t.off
+	}
+	var buf []Record
+	for _, c := range t.chunks {
+		if from >= to {
+			break
+		}
+		if from < c.n {
+			buf = c.records(buf[:0])
+			n := c.n
+			if to < n {
+				n = to
+			}
+			res = append(res, buf[from:n]...)
+		}
+		from, to = from-c.n, to-c.n
+		if from < 0 {
+			from = 0
+		}
+	}
+
+	if end > t.sealed {
+		if start < t.sealed {
+			start = t.sealed
+		}
+		res = append(res, t.head[start-t.sealed:end-t.sealed]...)
+	}
+	return res
+}
+
+// append adds the record after the latest one. Once head has more records, than the chunk's size,
+// the oldest of them are sealed.
+func (t *track) append(rec Record) {
+	t.head = append(t.head, rec)
+	if t.chunkSize == 0 || len(t.head) <= t.chunkSize {
+		return
+	}
+
+	t.chunks = append(t.chunks, encodeChunk(t.head[:t.chunkSize]))
+	t.sealed += t.chunkSize
+
+	n := copy(t.head, t.head[t.chunkSize:])
+	// clear the sealed records, so the array doesn't hold their fields
+	for i := n; i < len(t.head); i++ {
+		t.head[i] = Record{}
+	}
+	t.head = t.head[:n]
+}
+
+// insert inserts the back-filled record at the index i. If the index falls into a sealed chunk,
+// the chunk is re-encoded with the record.
+func (t *track) insert(i int, rec Record) {
+	if i >= t.sealed {
+		i -= t.sealed
+		t.head = append(t.head, Record{})
+		copy(t.head[i+1:], t.head[i:])
+		t.head[i] = rec
+		return
+	}
+
+	i += t.off
+	for k, c := range t.chunks {
+		if i >= c.n {
+			i -= c.n
+			continue
+		}
+
+		recs := c.records(nil)
+		if k == 0 {
+			recs, i = recs[t.off:], i-t.off
+			t.off = 0
+		}
+		recs = append(recs, Record{})
+		copy(recs[i+1:], recs[i:])
+		recs[i] = rec
+
+		t.chunks[k] = encodeChunk(recs)
+		t.sealed++
+		return
+	}
+}
+
+// drop drops the n oldest records.
+func (t *track) drop(n int) {
+	for n > 0 && len(t.chunks) > 0 {
+		rest := t.chunks[0].n - t.off
+		if n < rest {
+			t.off += n
+			t.sealed -= n
+			return
+		}
+		t.chunks[0] = nil
+		t.chunks = t.chunks[1:]
+		t.off = 0
+		t.sealed -= rest
+		n -= rest
+	}
+	if n == 0 {
+		return
+	}
+
+	// clear the dropped records, so the underlying array doesn't hold their data until it's reallocated
+	for i := 0; i < n; i++ {
+		t.head[i] = Record{}
+	}
+	t.head = t.head[n:]
+}
+
+// chunk is a sealed sequence of the records, compressed in the style of Gorilla time series: a record is encoded
+// as the delta-of-delta of its timestamp, and the differences of its coordinates from the previous record's.
+// The coordinates, that have at most 7 decimal digits, as GPS reports them, are encoded as the delta of the fixed-point
+// values, the others as XOR of their bits. Every field is encoded with a variable number of bits, so the
+// repeating values take a bit or two.
+type chunk struct {
+	// n is the number of the records in the chunk
+	n int
+	// last is the position of the last record, to search the chunks without decoding them
+	last position
+	data []byte
+	// fields are the optional fields of the records; nil if none of the records has them
+	fields []*vehicle.TelemetryFields
+	// versions are the telemetry versions of the records; nil if all records are of the latest version
+	versions []int
+}
+
+// coordScale is the scale of the fixed-point coordinates, i.e. 7 decimal digits
+const coordScale = 1e7
+
+func encodeChunk(recs []Record) *chunk {
+	c := &chunk{
+		n:    len(recs),
+		last: recs[len(recs)-1].position(),
+	}
+
+	var (
+		w              bitWriter
+		ts, delta      int64
+		seq            uint64
+		latEnc, lonEnc coordCodec
+	)
+	for i, rec := range recs {
+		t := rec.Ts.UnixNano()
+		d := t - ts
+		w.writeInt(d - delta)
+		ts, delta = t, d
+
+		if rec.Seq == seq+1 {
+			w.writeBit(false)
+		} else {
+			w.writeBit(true)
+			w.writeBits(rec.Seq, 64)
+		}
+		seq = rec.Seq
+
+		latEnc.encode(&w, rec.Lat)
+		lonEnc.encode(&w, rec.Lon)
+
+		if rec.Fields != nil {
+			if c.fields == nil {
+				c.fields = make([]*vehicle.TelemetryFields, len(recs))
+			}
+			c.fields[i] = rec.Fields
+		}
+		if rec.Version != vehicle.TelemetryVersion && c.versions == nil {
+			c.versions = make([]int, len(recs))
+			for j := range c.versions {
+				c.versions[j] = recs[j].Version
+			}
+		}
+	}
+
+	// the chunk is immutable, trim the spare capacity of the buffer
+	c.data = append([]byte(nil), w.buf...)
+	return c
+}
+
+// records decodes the records of the chunk, appending them to dst.
+func (c *chunk) records(dst []Record) []Record {
+	cr := c.reader()
+	for i := 0; i < c.n; i++ {
+		dst = append(dst, cr.next())
+	}
+	return dst
+}
+
+func (c *chunk) reader() chunkReader {
+	return chunkReader{
+		c: c,
+		r: bitReader{buf: c.data},
+	}
+}
+
+// chunkReader decodes the records of the chunk one by one, in order.
+type chunkReader struct {
+	c *chunk
+	r bitReader
+	// i is the index of the next record
+	i              int
+	ts, delta      int64
+	seq            uint64
+	latDec, lonDec coordCodec
+}
+
+// next decodes the next record. The caller must not read past the chunk's last record.
+func (cr *chunkReader) next() Record {
+	cr.delta += cr.r.readInt()
+	cr.ts += cr.delta
+
+	if cr.r.readBit() {
+		cr.seq = cr.r.readBits(64)
+	} else {
+		cr.seq++
+	}
+
+	rec := Record{
+		Ts:      time.Unix(0, cr.ts).UTC(),
+		Lat:     cr.latDec.decode(&cr.r),
+		Lon:     cr.lonDec.decode(&cr.r),
+		Seq:     cr.seq,
+		Version: vehicle.TelemetryVersion,
+	}
+	if cr.c.fields != nil {
+		rec.Fields = cr.c.fields[cr.i]
+	}
+	if cr.c.versions != nil {
+		rec.Version = cr.c.versions[cr.i]
+	}
+	cr.i++
+	return rec
+}
+
+// coordCodec is the state of a coordinate's encoding, i.e. the previous value, and the window of the meaningful
+// bits of the last XOR-ed value.
+type coordCodec struct {
+	prev              uint64
+	leading, trailing uint64
+	window            bool
+}
+
+// fixed returns the fixed-point coordinate, and reports whether it's exact.
+func fixed(v float64) (int64, bool) {
+	q := math.Round(v * coordScale)
+	if math.Abs(q) >= 1<<53 {
+		return 0, false
+	}
+	return int64(q), math.Float64bits(float64(int64(q))/coordScale) == math.Float64bits(v)
+}
+
+func (cc *coordCodec) encode(w *bitWriter, v float64) {
+	b := math.Float64bits(v)
+	defer func() { cc.prev = b }()
+
+	if q, ok := fixed(v); ok {
+		prev, _ := fixed(math.Float64frombits(cc.prev))
+		w.writeBit(false)
+		w.writeInt(q - prev)
+		return
+	}
+
+	w.writeBit(true)
+	x := b ^ cc.prev
+	if x == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+
+	leading, trailing := uint64(bits.LeadingZeros64(x)), uint64(bits.TrailingZeros64(x))
+	if cc.window && leading >= cc.leading && trailing >= cc.trailing {
+		w.writeBit(false)
+		w.writeBits(x>>cc.trailing, uint(64-cc.leading-cc.trailing))
+		return
+	}
+	cc.leading, cc.trailing, cc.window = leading, trailing, true
+	w.writeBit(true)
+	w.writeBits(leading, 6)
+	w.writeBits(64-leading-trailing-1, 6)
+	w.writeBits(x>>trailing, uint(64-leading-trailing))
+}
+
+func (cc *coordCodec) decode(r *bitReader) float64 {
+	if !r.readBit() {
+		prev, _ := fixed(math.Float64frombits(cc.prev))
+		v := float64(prev+r.readInt()) / coordScale
+		cc.prev = math.Float64bits(v)
+		return v
+	}
+
+	if r.readBit() {
+		if r.readBit() {
+			cc.leading = r.readBits(6)
+			cc.trailing = 64 - cc.leading - (r.readBits(6) + 1)
+			cc.window = true
+		}
+		x := r.readBits(uint(64-cc.leading-cc.trailing)) << cc.trailing
+		cc.prev ^= x
+	}
+	return math.Float64frombits(cc.prev)
+}
+
+// bitWriter writes the bits, the most significant first.
+type bitWriter struct {
+	buf []byte
+	// free is the number of the unused bits in the last byte
+	free uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	var v uint64
+	if bit {
+		v = 1
+	}
+	w.writeBits(v, 1)
+}
+
+// writeBits writes the n low bits of v.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		k := n
+		if k > w.free {
+			k = w.free
+		}
+		b := byte(v>>(n-k)) & byte(1<<k-1)
+		w.buf[len(w.buf)-1] |= b << (w.free - k)
+		w.free -= k
+		n -= k
+	}
+}
+
+// writeInt writes the signed integer, with the number of bits depending on its magnitude:
+// zero takes a single bit, the values within ±128 take 10 bits, and so on.
+func (w *bitWriter) writeInt(v int64) {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	switch {
+	case u == 0:
+		w.writeBits(0, 1)
+	case u < 1<<8:
+		w.writeBits(0b10, 2)
+		w.writeBits(u, 8)
+	case u < 1<<16:
+		w.writeBits(0b110, 3)
+		w.writeBits(u, 16)
+	case u < 1<<32:
+		w.writeBits(0b1110, 4)
+		w.writeBits(u, 32)
+	default:
+		w.writeBits(0b1111, 4)
+		w.writeBits(u, 64)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	// pos is the position of the next bit
+	pos uint
+}
+
+func (r *bitReader) readBit() bool {
+	return r.readBits(1) == 1
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	var v uint64
+	for n > 0 {
+		off := r.pos % 8
+		k := 8 - off
+		if k > n {
+			k = n
+		}
+		b := uint64(r.buf[r.pos/8]>>(8-off-k)) & (1<<k - 1)
+		v = v<<k | b
+		r.pos += k
+		n -= k
+	}
+	return v
+}
+
+func (r *bitReader) readInt() int64 {
+	var n uint
+	switch {
+	case !r.readBit():
+		return 0
+	case !r.readBit():
+		n = 8
+	case !r.readBit():
+		n = 16
+	case !r.readBit():
+		n = 32
+	default:
+		n = 64
+	}
+	u := r.readBits(n)
+	return int64(u>>1) ^ -int64(u&1)
+}
@@ -0,0 +1,243 @@
+package fleetstate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestChunk_Records(t *testing.T) {
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	fields := &vehicle.TelemetryFields{Battery: vehicle.Float64(50)}
+
+	want := []Record{
+		{Ts: now, Lat: 52.518898, Lon: 13.401797, Seq: 1},
+		// same interval
+		{Ts: now.Add(time.Second), Lat: 52.518898, Lon: 13.401797, Seq: 2},
+		{Ts: now.Add(2 * time.Second), Lat: 52.5189, Lon: 13.4018, Seq: 3, Fields: fields},
+		// same timestamp, back-filled
+		{Ts: now.Add(2 * time.Second), Lat: 52.52, Lon: 13.41, Seq: 7},
+		// jitter
+		{Ts: now.Add(3*time.Second + 123456789), Lat: -61.698146, Lon: -58.585985, Seq: 8},
+		// the coordinates, that aren't fixed-point
+		{Ts: now.Add(time.Hour), Lat: 52.52064512345678, Lon: 13.409779123456789, Seq: 9},
+		{Ts: now.Add(time.Hour + time.Second), Lat: 52.52064512345679, Lon: 13.409779123456789, Seq: 10},
+		{Ts: now.Add(time.Hour + 2*time.Second), Lat: math.Copysign(0, -1), Lon: math.Pi, Seq: 11},
+		{Ts: now.Add(48 * time.Hour), Lat: 1e300, Lon: -180, Seq: math.MaxUint64},
+	}
+
+	c := encodeChunk(want)
+	got := c.records(nil)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("records: want %v got %v", want, got)
+	}
+	if !math.Signbit(got[7].Lat) {
+		t.Fatalf("records: want negative zero got %v", got[7].Lat)
+	}
+	if want, got := want[len(want)-1].position(), c.last; want != got {
+		t.Fatalf("last: want %v got %v", want, got)
+	}
+}
+
+// TestTrack compares the track with the plain slice of the records, the store kept before the track.
+func TestTrack(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	tr := newTrack(4)
+	var want []Record
+	// the cache lives across the writes, as a reader's does
+	var cache chunkCache
+
+	var seq uint64
+	ts := now
+	for i := 0; i < 2000; i++ {
+		switch op := rnd.Intn(10); {
+		case op < 6:
+			seq++
+			ts = ts.Add(time.Duration(rnd.Intn(3)) * time.Second)
+			rec := Record{Ts: ts, Lat: float64(rnd.Intn(1e6)) / 1e6, Lon: rnd.Float64(), Seq: seq}
+			tr.append(rec)
+			want = append(want, rec)
+		case op < 8:
+			// back-fill within the last 20 seconds
+			seq++
+			bts := ts.Add(-time.Duration(rnd.Intn(20)) * time.Second)
+			rec := Record{Ts: bts, Lat: 1, Lon: 1, Seq: seq}
+			k := tr.search(position{Ts: bts, Seq: math.MaxUint64})
+			tr.insert(k, rec)
+
+			j := sort.Search(len(want), func(j int) bool {
+				return want[j].Ts.After(bts)
+			})
+			if k != j {
+				t.Fatalf("%d: search: want %d got %d", i, j, k)
+			}
+			want = append(want, Record{})
+			copy(want[j+1:], want[j:])
+			want[j] = rec
+		default:
+			n := rnd.Intn(len(want)/4 + 1)
+			tr.drop(n)
+			want = want[n:]
+		}
+
+		if want, got := len(want), tr.len(); want != got {
+			t.Fatalf("%d: len: want %d got %d", i, want, got)
+		}
+		if len(want) == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(want, tr.slice(0, tr.len())) {
+			t.Fatalf("%d: slice: want %v got %v", i, want, tr.slice(0, tr.len()))
+		}
+		start, end := rnd.Intn(len(want)), rnd.Intn(len(want)+1)
+		if start > end {
+			start, end = end, start
+		}
+		if got := tr.slice(start, end); !reflect.DeepEqual(want[start:end], got) {
+			t.Fatalf("%d: slice [%d, %d): want %v got %v", i, start, end, want[start:end], got)
+		}
+
+		rec := want[rnd.Intn(len(want))]
+		if got := tr.at(tr.search(rec.position())); !reflect.DeepEqual(rec, got) {
+			t.Fatalf("%d: at: want %v got %v", i, rec, got)
+		}
+		p := position{Ts: rec.Ts, Seq: rec.Seq + 1}
+		j := sort.Search(len(want), func(j int) bool {
+			return !want[j].position().Before(p)
+		})
+		for _, c := range []*chunkCache{nil, &cache} {
+			got, ok := tr.seek(p, c)
+			if ok != (j < len(want)) {
+				t.Fatalf("%d: seek %v: want ok %v got %v", i, p, j < len(want), ok)
+			}
+			if ok && !reflect.DeepEqual(want[j], got) {
+				t.Fatalf("%d: seek %v: want %v got %v", i, p, want[j], got)
+			}
+		}
+		if last, _ := tr.last(); !reflect.DeepEqual(want[len(want)-1], last) {
+			t.Fatalf("%d: last: want %v got %v", i, want[len(want)-1], last)
+		}
+	}
+}
+
+var benchRecords []Record
+
+// benchmarkWrite writes the records of the vehicles, moving along a street, as GPS reports them:
+// every second, with the coordinates of 6 decimal digits.
+func benchmarkWrite(b *testing.B, store *MemStore, vehicles, points int) {
+	b.Helper()
+
+	ctx := context.Background()
+	now := time.Now().UTC().Add(-time.Duration(points) * time.Second)
+	rnd := rand.New(rand.NewSource(1))
+
+	for v := 0; v < vehicles; v++ {
+		vin := vehicle.VIN(fmt.Sprintf("VIN%06d", v))
+		lat, lon := 52.518898, 13.401797
+		for i := 0; i < points; i++ {
+			lat += float64(rnd.Intn(100)) / 1e6
+			lon += float64(rnd.Intn(100)) / 1e6
+			t := vehicle.Telemetry{
+				Ts:  now.Add(time.Duration(i) * time.Second),
+				Lat: math.Round(lat*1e6) / 1e6,
+				Lon: math.Round(lon*1e6) / 1e6,
+			}
+			if err := store.Write(ctx, vin, t); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+var benchChunkSizes = []struct {
+	name      string
+	chunkSize int
+}{
+	{"uncompressed", -1},
+	{"compressed", DefaultChunkSize},
+}
+
+func BenchmarkMemStore_MemoryPerPoint(b *testing.B) {
+	const vehicles, points = 100, 3600
+
+	for _, bc := range benchChunkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			var bytes uint64
+			for i := 0; i < b.N; i++ {
+				before := heapAlloc()
+				store := NewMemStoreWithOptions(MemStoreOptions{ChunkSize: bc.chunkSize, FeedSize: 1})
+				benchmarkWrite(b, store, vehicles, points)
+				bytes += heapAlloc() - before
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(bytes)/float64(b.N*vehicles*points), "B/point")
+		})
+	}
+}
+
+func BenchmarkMemStore_Range(b *testing.B) {
+	const points = 3600
+
+	for _, bc := range benchChunkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			store := NewMemStoreWithOptions(MemStoreOptions{ChunkSize: bc.chunkSize})
+			benchmarkWrite(b, store, 1, points)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				recs, _, err := store.Range(context.Background(), "VIN000000", RangeQuery{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				benchRecords = recs
+			}
+		})
+	}
+}
+
+func BenchmarkMemStore_Reader(b *testing.B) {
+	const points = 3600
+
+	for _, bc := range benchChunkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			store := NewMemStoreWithOptions(MemStoreOptions{ChunkSize: bc.chunkSize})
+			benchmarkWrite(b, store, 1, points)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader, err := store.ReaderFromCursor(ctx, "VIN000000", "0-0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for n := 0; n < points; n++ {
+					if _, err := reader.Read(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
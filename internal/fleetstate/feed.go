@@ -0,0 +1,119 @@
+package fleetstate
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const defaultFeedSize = 1024
+
+// Update is the record of the vehicle, written to the store.
+type Update struct {
+	VIN vehicle.VIN
+	Record
+}
+
+// Subscription reads the updates of all vehicles, including the ones, that appear after the subscription started.
+type Subscription interface {
+	// Read blocks until the next update is available.
+	Read() (Update, error)
+}
+
+// feed is the fleet-wide log of the latest updates, the subscriptions read from. The log is a ring buffer:
+// a subscription, that falls behind by more than the size of the buffer, skips the overwritten updates.
+type feed struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	buf  []Update
+	// seq is the number of the updates ever published to the feed
+	seq uint64
+}
+
+func newFeed(size int) *feed {
+	if size <= 0 {
+		size = defaultFeedSize
+	}
+	f := &feed{
+		buf: make([]Update, size),
+	}
+	f.cond.L = &f.mu
+	return f
+}
+
+func (f *feed) publish(upd Update) {
+	f.mu.Lock()
+	f.buf[f.seq%uint64(len(f.buf))] = upd
+	f.seq++
+	f.mu.Unlock()
+
+	f.cond.Broadcast()
+}
+
+// subscribe returns the subscription, that reads the updates of the vehicles with VINs starting with prefix,
+// published after the call.
+func (f *feed) subscribe(ctx context.Context, prefix string) *subscription {
+	f.mu.Lock()
+	next := f.seq
+	f.mu.Unlock()
+
+	s := &subscription{
+		feed:   f,
+		prefix: strings.ToUpper(prefix),
+		next:   next,
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		f.mu.Lock()
+		close(s.closed)
+		f.mu.Unlock()
+		f.cond.Broadcast()
+	}()
+
+	return s
+}
+
+type subscription struct {
+	feed   *feed
+	prefix string
+	// next is the sequence number of the next update to read
+	next   uint64
+	closed chan struct{}
+}
+
+func (s *subscription) Read() (Update, error) {
+	f := s.feed
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		select {
+		case <-s.closed:
+			return Update{}, ErrReaderClosed
+		default:
+		}
+
+		if s.next == f.seq {
+			f.cond.Wait()
+			continue
+		}
+
+		// if the updates the subscription was about to read were overwritten, fast-forward it
+		// to the oldest one in the buffer
+		if size := uint64(len(f.buf)); f.seq-s.next > size {
+			s.next = f.seq - size
+		}
+
+		upd := f.buf[s.next%uint64(len(f.buf))]
+		s.next++
+		if strings.HasPrefix(string(upd.VIN), s.prefix) {
+			return upd, nil
+		}
+	}
+}
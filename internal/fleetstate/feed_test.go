@@ -0,0 +1,135 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func testSubscriptionRead(t *testing.T, sub Subscription, wantVIN vehicle.VIN, wantLat float64) {
+	t.Helper()
+
+	upd, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantVIN != upd.VIN || wantLat != upd.Lat {
+		t.Fatalf("Read: want %s %v, got %s %v", wantVIN, wantLat, upd.VIN, upd.Lat)
+	}
+}
+
+func TestMemStore_Subscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		MaxLateness: time.Hour,
+	})
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	// the records written before subscribing aren't read
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := store.Subscribe(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the vehicle, that didn't report before subscribing, is read
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 2, Lon: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 3, Lon: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// the back-filled record isn't read
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-time.Second), Lat: 4, Lon: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(2 * time.Second), Lat: 5, Lon: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	testSubscriptionRead(t, sub, "THE2VIN", 2)
+	testSubscriptionRead(t, sub, "THE1VIN", 3)
+	testSubscriptionRead(t, sub, "THE1VIN", 5)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Write(ctx, "THE3VIN", vehicle.Telemetry{Ts: now, Lat: 6, Lon: 6})
+	}()
+	testSubscriptionRead(t, sub, "THE3VIN", 6)
+}
+
+func TestMemStore_Subscribe_Prefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStore()
+
+	sub, err := store.Subscribe(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	for i, vin := range []vehicle.VIN{"ABC1", "XYZ1", "ABC2", "AB3"} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: float64(i), Lon: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testSubscriptionRead(t, sub, "ABC1", 0)
+	testSubscriptionRead(t, sub, "ABC2", 2)
+}
+
+func TestMemStore_Subscribe_FallBehind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		FeedSize: 2,
+	})
+
+	sub, err := store.Subscribe(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Second), Lat: float64(i), Lon: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the subscription skips the records, that were overwritten in the feed
+	testSubscriptionRead(t, sub, "THE1VIN", 3)
+	testSubscriptionRead(t, sub, "THE1VIN", 4)
+}
+
+func TestMemStore_Subscribe_Close(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	store := NewMemStore()
+
+	sub, err := store.Subscribe(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err := sub.Read(); !errors.Is(err, ErrReaderClosed) {
+		t.Fatalf("Read: want %v, got %v", ErrReaderClosed, err)
+	}
+}
@@ -0,0 +1,379 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+var ErrStoreClosed = errors.New("store is closed")
+
+const DefaultSegmentSize = 64 << 20
+
+// FileStore is a durable implementation of Store.
+//
+// FileStore appends every record to a segmented write-ahead log, shared by all vehicles,
+// and serves the reads from the in-memory index. The index is rebuilt from the log when the store is opened.
+// If the index has a retention policy, the sealed segments of the log, all records of which the index dropped,
+// are removed; the usage of the vehicles is saved before, and restored, when the store is opened.
+type FileStore struct {
+	mem *MemStore
+
+	// protects log and segments; also serializes writes, so the order of records in the log matches the order
+	// they were accepted by the index
+	mu     sync.Mutex
+	log    *wal
+	closed bool
+	// segments are the latest timestamps of the vehicles in every segment of the log; nil, if the index
+	// keeps all records
+	segments map[uint64]map[vehicle.VIN]time.Time
+
+	// serializes the fsyncs, so an fsync commits the records of all writes, that appended before it started
+	syncMu sync.Mutex
+	// synced is the position, the log was fsync-ed up to
+	synced     walPos
+	syncAlways bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ Store = (*FileStore)(nil)
+
+type FileStoreOptions struct {
+	// MemStoreOptions configures the retention policy of the in-memory index. The log keeps the records,
+	// until the index drops them. The vehicles' usage is kept regardless; the latest positions of the vehicles,
+	// whose records were all dropped, are restored without their optional fields, after the store is reopened.
+	MemStoreOptions
+
+	// SegmentSize is the size in bytes, after which the log starts a new segment file.
+	// Zero means DefaultSegmentSize.
+	SegmentSize int64
+	// SyncInterval is the interval the log is fsync-ed to the disk.
+	// Zero means the log is fsync-ed after every write. Negative value means the store never calls fsync,
+	// leaving it to the operating system.
+	SyncInterval time.Duration
+}
+
+// OpenFileStore opens the store in the directory dir, replaying the existing log into the index.
+// Caller must call Close after the store is no longer used.
+func OpenFileStore(dir string, opts FileStoreOptions) (*FileStore, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+
+	mem := NewMemStoreWithOptions(opts.MemStoreOptions)
+
+	saved, err := readUsage(dir)
+	if err != nil {
+		return nil, err
+	}
+	for vin, u := range saved {
+		mem.restoreUsage(vin, u)
+	}
+
+	var segments map[uint64]map[vehicle.VIN]time.Time
+	if opts.MaxAge > 0 || opts.MaxRecords > 0 {
+		segments = make(map[uint64]map[vehicle.VIN]time.Time)
+	}
+
+	// the logged records were accepted, when they were written; they are replayed without the lateness check,
+	// so lowering MaxLateness doesn't make the log unreadable
+	replay := func(segment uint64, rec walRecord) error {
+		mem.insert(rec.VIN, rec.Telemetry, rec.Seq)
+		indexSegment(segments, segment, rec)
+		return nil
+	}
+	// the store fsyncs the log itself, see commit
+	l, err := openWAL(dir, opts.SegmentSize, false, replay)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log in %s: %w", dir, err)
+	}
+	for vin := range saved {
+		mem.restoreLatest(vin)
+	}
+
+	store := &FileStore{
+		mem:        mem,
+		log:        l,
+		segments:   segments,
+		synced:     l.pos(),
+		syncAlways: opts.SyncInterval == 0,
+		done:       make(chan struct{}),
+	}
+	// the retention policy could have changed since the store was closed
+	store.compact()
+
+	if opts.SyncInterval > 0 {
+		store.wg.Add(1)
+		go func() {
+			defer store.wg.Done()
+			store.syncLoop(opts.SyncInterval)
+		}()
+	}
+
+	return store, nil
+}
+
+func (store *FileStore) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.mu.Lock()
+			pos := store.log.pos()
+			store.mu.Unlock()
+			if err := store.commit(pos); err != nil {
+				log.Printf("FileStore: failed to sync log: %s", err)
+			}
+		case <-store.done:
+			return
+		}
+	}
+}
+
+func (store *FileStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	store.mu.Lock()
+
+	if store.closed {
+		store.mu.Unlock()
+		return ErrStoreClosed
+	}
+
+	// NOTE: the index checks the record first, so only the records it accepts end up in the log; the record
+	// goes to the index only after it's in the log. The writes are serialized, so the check still holds,
+	// when the record is inserted, and the record gets the sequence number, it's logged with.
+	seq, err := store.mem.check(vin, t)
+	if err != nil {
+		store.mu.Unlock()
+		return err
+	}
+
+	rec := walRecord{
+		VIN:       vin,
+		Seq:       seq,
+		Telemetry: t,
+	}
+	segment := store.log.segment
+	if err := store.log.Append(rec); err != nil {
+		store.mu.Unlock()
+		return fmt.Errorf("could not append to log: %w", err)
+	}
+	store.mem.insert(vin, t, seq)
+
+	indexSegment(store.segments, store.log.segment, rec)
+	if store.log.segment != segment {
+		store.compact()
+	}
+
+	pos := store.log.pos()
+	store.mu.Unlock()
+
+	if store.syncAlways {
+		return store.commit(pos)
+	}
+	return nil
+}
+
+// commit fsyncs the log up to the position pos, unless a concurrent fsync already did. The fsync runs outside
+// of mu, so the writes go on, while it waits for the disk; the writes, that wait for their fsync meanwhile,
+// are committed together by the next one.
+func (store *FileStore) commit(pos walPos) error {
+	store.syncMu.Lock()
+	defer store.syncMu.Unlock()
+
+	if !store.synced.before(pos) {
+		return nil
+	}
+
+	store.mu.Lock()
+	if store.closed {
+		// Close fsyncs the log
+		store.mu.Unlock()
+		return nil
+	}
+	f, end := store.log.f, store.log.pos()
+	store.mu.Unlock()
+
+	// rotating the segment or closing the log fsyncs the file, before it's closed
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("could not sync log: %w", err)
+	}
+	store.synced = end
+	return nil
+}
+
+// indexSegment updates the latest timestamp of the record's vehicle in the segment.
+func indexSegment(segments map[uint64]map[vehicle.VIN]time.Time, segment uint64, rec walRecord) {
+	if segments == nil {
+		return
+	}
+	vins := segments[segment]
+	if vins == nil {
+		vins = make(map[vehicle.VIN]time.Time)
+		segments[segment] = vins
+	}
+	if ts, ok := vins[rec.VIN]; !ok || rec.Ts.After(ts) {
+		vins[rec.VIN] = rec.Ts
+	}
+}
+
+// compact removes the sealed segments of the log, all records of which the index dropped. The usage,
+// the index counted over the records, is saved first. The caller must hold mu.
+func (store *FileStore) compact() {
+	var segments []uint64
+	for segment, vins := range store.segments {
+		if segment < store.log.segment && store.mem.dropped(vins) {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return
+	}
+
+	if err := store.saveUsage(); err != nil {
+		log.Printf("FileStore: failed to save usage: %s", err)
+		return
+	}
+	for _, segment := range segments {
+		if err := store.log.remove(segment); err != nil {
+			log.Printf("FileStore: failed to remove segment %d: %s", segment, err)
+			continue
+		}
+		delete(store.segments, segment)
+	}
+}
+
+// usageFile is the file in the store's directory, the usage of the vehicles is saved to.
+const usageFile = "usage.json"
+
+// saveUsage saves the usage of the vehicles. The usage counts the records, the log has appended, so the log
+// is fsync-ed first. The caller must hold mu.
+func (store *FileStore) saveUsage() error {
+	if err := store.log.Sync(); err != nil {
+		return fmt.Errorf("could not sync log: %w", err)
+	}
+
+	data, err := json.Marshal(store.mem.savedUsage())
+	if err != nil {
+		return err
+	}
+
+	// the usage is written to a temporary file first, so a crash doesn't leave it half-written
+	path := filepath.Join(store.log.dir, usageFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(store.log.dir)
+}
+
+// readUsage reads the usage of the vehicles, saved in dir. The store, that never removed a segment, has none.
+func readUsage(dir string) (map[vehicle.VIN]savedUsage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, usageFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved map[vehicle.VIN]savedUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("bad usage in %s: %w", dir, err)
+	}
+	return saved, nil
+}
+
+func (store *FileStore) Reader(ctx context.Context, vin vehicle.VIN) (Reader, error) {
+	return store.mem.Reader(ctx, vin)
+}
+
+func (store *FileStore) ReaderFromCursor(ctx context.Context, vin vehicle.VIN, cursor string) (Reader, error) {
+	return store.mem.ReaderFromCursor(ctx, vin, cursor)
+}
+
+func (store *FileStore) Range(ctx context.Context, vin vehicle.VIN, q RangeQuery) ([]Record, string, error) {
+	return store.mem.Range(ctx, vin, q)
+}
+
+func (store *FileStore) Latest(ctx context.Context, vin vehicle.VIN) (Snapshot, error) {
+	return store.mem.Latest(ctx, vin)
+}
+
+func (store *FileStore) Vehicles(ctx context.Context, q VehiclesQuery) ([]Snapshot, string, error) {
+	return store.mem.Vehicles(ctx, q)
+}
+
+func (store *FileStore) Nearby(ctx context.Context, lat, lon, radius float64, limit int) ([]VehicleDistance, error) {
+	return store.mem.Nearby(ctx, lat, lon, radius, limit)
+}
+
+func (store *FileStore) Within(ctx context.Context, bbox geoutil.BBox, limit int) ([]VehicleDistance, error) {
+	return store.mem.Within(ctx, bbox, limit)
+}
+
+func (store *FileStore) Usage(ctx context.Context, vin vehicle.VIN, q UsageQuery) (Usage, error) {
+	return store.mem.Usage(ctx, vin, q)
+}
+
+func (store *FileStore) Subscribe(ctx context.Context, vinPrefix string) (Subscription, error) {
+	return store.mem.Subscribe(ctx, vinPrefix)
+}
+
+// Expire drops the records from the in-memory index, and removes the segments of the log, all records of which
+// were dropped. See MemStore.Expire.
+func (store *FileStore) Expire(now time.Time) int {
+	n := store.mem.Expire(now)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.closed {
+		store.compact()
+	}
+	return n
+}
+
+// Close flushes the log to the disk and closes the store.
+func (store *FileStore) Close() error {
+	store.mu.Lock()
+	if store.closed {
+		store.mu.Unlock()
+		return nil
+	}
+	store.closed = true
+	close(store.done)
+	store.mu.Unlock()
+
+	store.wg.Wait()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.log.Close()
+}
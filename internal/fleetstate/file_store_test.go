@@ -0,0 +1,543 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestFileStore_Reopen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+
+	for i := 1; i <= 3; i++ {
+		ts := now.Add(time.Duration(i) * time.Second)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i) * 10, Lon: float64(i) * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(4 * time.Second), Lat: 40, Lon: 40}); err != ErrStoreClosed {
+		t.Fatalf("write closed: want err %v got %v", ErrStoreClosed, err)
+	}
+
+	store, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// must read starting the last record, that was written before the store was reopened
+	reader, err := store.Reader(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(3*time.Second), 3*10, 3*10)
+
+	// old records are still rejected after the index was rebuilt
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err == nil {
+		t.Fatal("write old record: want err got nil")
+	}
+
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(5 * time.Second), Lat: 50, Lon: 50}); err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(5*time.Second), 50, 50)
+}
+
+func TestFileStore_Reopen_BackFill(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, FileStoreOptions{MemStoreOptions: MemStoreOptions{MaxLateness: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+	for _, i := range []int{0, 20, 10} {
+		ts := now.Add(time.Duration(i) * time.Minute)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the back-filled record was accepted, it's replayed, after the lateness was lowered
+	store, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	recs, _, err := store.Range(ctx, vin, RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 0, 10, 20)
+
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(15 * time.Minute), Lat: 15, Lon: 15}); err == nil {
+		t.Fatal("write late record: want err got nil")
+	}
+}
+
+func TestFileStore_Reopen_Fields(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vin := vehicle.VIN("THE1VIN")
+	fields := vehicle.TelemetryFields{
+		Battery:    vehicle.Float64(42),
+		Locked:     vehicle.Bool(false),
+		Attributes: map[string]string{"firmware": "1.2.3"},
+	}
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1, TelemetryFields: fields}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	recs, _, err := store.Range(ctx, vin, RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(recs); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
+	}
+	if !reflect.DeepEqual(&fields, recs[0].Fields) {
+		t.Fatalf("fields: want %+v got %+v", fields, recs[0].Fields)
+	}
+}
+
+func TestFileStore_Reopen_Version(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := FileStoreOptions{MemStoreOptions: MemStoreOptions{ChunkSize: 2}}
+
+	store, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// zero version is the latest one; the store keeps the version, the handlers validated
+	versions := []int{0, 1, 2, 1, 0}
+	now := time.Now().UTC()
+	for i, version := range versions {
+		tm := vehicle.Telemetry{Version: version, Ts: now.Add(time.Duration(i) * time.Second), Lat: 1, Lon: 1}
+		if err := store.Write(ctx, "THE1VIN", tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	recs, _, err := store.Range(ctx, "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{vehicle.TelemetryVersion, 1, 2, 1, vehicle.TelemetryVersion}
+	var got []int
+	for _, rec := range recs {
+		got = append(got, rec.Version)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("versions: want %v got %v", want, got)
+	}
+}
+
+func TestFileStore_SyncInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, FileStoreOptions{SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	reader, err := store.Reader(ctx, "THE1VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now, 1, 1)
+}
+
+func TestFileStore_Reopen_Usage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	// Berlin, Cathedral and Fernsehturm
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Minute), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the usage is rebuilt from the log
+	got, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Odometer == 0 || want.Odometer != got.Odometer {
+		t.Fatalf("odometer: want %v got %v", want.Odometer, got.Odometer)
+	}
+	if len(got.Buckets) != 1 || got.Buckets[0] != want.Buckets[0] {
+		t.Fatalf("buckets: want %+v got %+v", want.Buckets, got.Buckets)
+	}
+}
+
+func TestFileStore_Write_AppendFailed(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := OpenFileStore(t.TempDir(), FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the record is larger than the log accepts, it must not be visible to the readers
+	attrs := map[string]string{"blob": strings.Repeat("x", walMaxPayloadSize)}
+	tm := vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1, TelemetryFields: vehicle.TelemetryFields{Attributes: attrs}}
+	if err := store.Write(ctx, "THE1VIN", tm); err == nil {
+		t.Fatal("write: want err got nil")
+	}
+	if _, err := store.Latest(ctx, "THE1VIN"); !errors.Is(err, ErrUnknownVIN) {
+		t.Fatalf("latest: want err %v got %v", ErrUnknownVIN, err)
+	}
+}
+
+func TestFileStore_Concurrent(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := OpenFileStore(t.TempDir(), FileStoreOptions{SegmentSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			vin := testVIN(g)
+			for i := 0; i < 100; i++ {
+				if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 0; g < 4; g++ {
+		recs, _, err := store.Range(ctx, testVIN(g), RangeQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := 100, len(recs); want != got {
+			t.Fatalf("records %s: want %d got %d", testVIN(g), want, got)
+		}
+	}
+}
+
+func TestFileStore_Reopen_Cursor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	// every two records have the same timestamp, so they are told apart by their sequence numbers only;
+	// the log's oldest segments are removed, so the replayed records would be numbered differently
+	opts := FileStoreOptions{
+		MemStoreOptions: MemStoreOptions{MaxRecords: 10},
+		SegmentSize:     1 << 10,
+	}
+	store, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 200; i++ {
+		ts := now.Add(time.Duration(i/2-100) * time.Second)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, cursor, err := store.Range(ctx, "THE1VIN", RangeQuery{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 190, 191, 192, 193, 194)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	recs, _, err = store.Range(ctx, "THE1VIN", RangeQuery{Cursor: cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 195, 196, 197, 198, 199)
+
+	reader, err := store.ReaderFromCursor(ctx, "THE1VIN", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(-3*time.Second), 195, 1)
+
+	// the new records continue the numbering
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 200, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := store.Latest(ctx, "THE1VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := uint64(201), snap.Latest.Seq; want != got {
+		t.Fatalf("latest seq: want %d got %d", want, got)
+	}
+}
+
+func TestFileStore_Retention(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	opts := FileStoreOptions{
+		MemStoreOptions: MemStoreOptions{MaxAge: time.Hour, MaxRecords: 10},
+		SegmentSize:     1 << 10,
+	}
+	store, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 200; i++ {
+		ts := now.Add(time.Duration(i-200) * time.Second)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the segments with the dropped records of THE1VIN only are removed, as the log rotates
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 2 {
+		t.Fatalf("segments: want at most 2 got %v", segments)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, _, err := store.Range(ctx, "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 190, 191, 192, 193, 194, 195, 196, 197, 198, 199)
+
+	// THE2VIN's record expires, the segment, that has the records of both vehicles, is removed
+	if want, got := 11, store.Expire(now.Add(2*time.Hour)); want != got {
+		t.Fatalf("expire: want %d got %d", want, got)
+	}
+	segments, err = listWALSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("segments: want 1 got %v", segments)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStore_Reopen_UsageCompacted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	opts := FileStoreOptions{
+		MemStoreOptions: MemStoreOptions{MaxAge: time.Hour, MaxRecords: 10, OdometerThreshold: 10},
+		SegmentSize:     1 << 10,
+	}
+	store, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	lat, lon := 52.518898, 13.401797
+
+	// THE2VIN's records expire, as soon as they're written
+	for i := 0; i < 2; i++ {
+		ts := now.Add(-3*time.Hour + time.Duration(i)*time.Minute)
+		if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: ts, Lat: lat + float64(i)*0.01, Lon: lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// THE1VIN drives 100 meters every 10 seconds, its older records are dropped
+	write := func(i int) {
+		t.Helper()
+		ts := now.Add(time.Duration(i-200) * 10 * time.Second)
+		lat, lon := geoutil.Destination(lat, lon, 90, float64(i)*0.1)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: lat, Lon: lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		write(i)
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments[0] == 1 {
+		t.Fatalf("segments: want the first segments removed got %v", segments)
+	}
+
+	want := make(map[vehicle.VIN]Usage)
+	for _, vin := range []vehicle.VIN{"THE1VIN", "THE2VIN"} {
+		usage, err := store.Usage(ctx, vin, UsageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[vin] = usage
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the usage, counted over the removed segments, is restored
+	for vin, want := range want {
+		got, err := store.Usage(ctx, vin, UsageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want.Odometer == 0 || math.Abs(want.Odometer-got.Odometer) > 1e-6 {
+			t.Fatalf("%s odometer: want %v got %v", vin, want.Odometer, got.Odometer)
+		}
+		if !reflect.DeepEqual(want.Buckets, got.Buckets) {
+			t.Fatalf("%s buckets: want %+v got %+v", vin, want.Buckets, got.Buckets)
+		}
+	}
+
+	// the vehicle, whose records were all dropped, keeps its latest position
+	snap, err := store.Latest(ctx, "THE2VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := lat+0.01, snap.Latest.Lat; want != got {
+		t.Fatalf("latest: want lat %v got %v", want, got)
+	}
+
+	// the odometer goes on from where it was
+	write(200)
+	usage, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := want["THE1VIN"].Odometer+100, usage.Odometer; math.Abs(want-got) > 1 {
+		t.Fatalf("odometer after write: want %v got %v", want, got)
+	}
+}
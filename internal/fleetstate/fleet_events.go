@@ -0,0 +1,159 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
+)
+
+// Types of the fleet events.
+const (
+	EventGeofenceEnter   = "geofence.enter"
+	EventGeofenceExit    = "geofence.exit"
+	EventVehicleNew      = "vehicle.new"
+	EventVehicleOffline  = "vehicle.offline"
+	EventVehicleOnline   = "vehicle.online"
+	EventVehicleSpeeding = "vehicle.speeding"
+)
+
+// EventTypes are all types of the fleet events.
+var EventTypes = []string{
+	EventGeofenceEnter,
+	EventGeofenceExit,
+	EventVehicleNew,
+	EventVehicleOffline,
+	EventVehicleOnline,
+	EventVehicleSpeeding,
+}
+
+// EventPublisher publishes the fleet events, e.g. to the webhooks.
+type EventPublisher interface {
+	Publish(ev webhook.Event) error
+}
+
+// VehicleEvent is the data of the vehicle's event. Ts, Lat, Lon are the vehicle's record, the event was detected at.
+type VehicleEvent struct {
+	VIN vehicle.VIN `json:"vin"`
+	Ts  time.Time   `json:"ts"`
+	Lat float64     `json:"lat"`
+	Lon float64     `json:"lon"`
+	// Speed and SpeedLimit are set for the speeding events, in km/h.
+	Speed      float64 `json:"speed,omitempty"`
+	SpeedLimit float64 `json:"speed_limit,omitempty"`
+}
+
+type FleetEventsOptions struct {
+	// SpeedLimit is the speed in km/h, above which a vehicle is speeding. Zero value means no speeding events.
+	SpeedLimit float64
+	// Status is the monitor, the vehicles' status events come from. Nil Status means no status events.
+	Status *StatusMonitor
+	// Distance is the function the speed of a vehicle is calculated with (geoutil.Distance, by default).
+	Distance geoutil.DistanceFunc
+}
+
+// fleetVehicle is the state of the vehicle, the events are detected from.
+type fleetVehicle struct {
+	last     Record
+	speeding bool
+}
+
+// PublishFleetEvents detects the fleet events in the records, written to the store after the call, and publishes
+// them, until the context is canceled:
+//
+//   - the vehicle's first record is "vehicle.new";
+//   - the vehicle, that drove faster than the speed limit since its previous record, is "vehicle.speeding";
+//     the vehicle is speeding again, only after it slowed down;
+//   - the status monitor's events are "vehicle.offline" and "vehicle.online";
+//   - the store's geofence events are "geofence.enter" and "geofence.exit".
+//
+// Like other subscriptions to the store, PublishFleetEvents skips the records, if it falls behind the fleet.
+func PublishFleetEvents(ctx context.Context, store *GeofenceStore, pub EventPublisher, opts FleetEventsOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	distance := HandlerOptions{Distance: opts.Distance}.distance()
+
+	sub, err := store.Subscribe(ctx, "")
+	if err != nil {
+		return err
+	}
+	updates := readUpdates(ctx, sub)
+	geofenceEvents := readGeofenceEvents(ctx, store.SubscribeEvents(ctx, GeofenceEventsQuery{}))
+	statuses := readStatusEvents(ctx, subscribeStatus(ctx, opts.Status, ""))
+
+	publish := func(typ string, ts time.Time, data interface{}) {
+		ev, err := webhook.NewEvent(typ, ts, data)
+		if err == nil {
+			err = pub.Publish(ev)
+		}
+		if err != nil {
+			log.Printf("failed to publish %s event: %s", typ, err)
+		}
+	}
+
+	vehicles := make(map[vehicle.VIN]*fleetVehicle)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case res := <-updates:
+			if res.err != nil {
+				if errors.Is(res.err, ErrReaderClosed) {
+					return nil
+				}
+				return res.err
+			}
+
+			vin, rec := res.upd.VIN, res.upd.Record
+			v := vehicles[vin]
+			if v == nil {
+				v = &fleetVehicle{last: rec}
+				vehicles[vin] = v
+				// the first record of the vehicle, ever written to the store
+				if rec.Seq == 1 {
+					publish(EventVehicleNew, rec.Ts, VehicleEvent{VIN: vin, Ts: rec.Ts, Lat: rec.Lat, Lon: rec.Lon})
+				}
+			}
+
+			if opts.SpeedLimit > 0 {
+				speed := positionResponse(distance, v.last, rec).Speed
+				if speed > opts.SpeedLimit && !v.speeding {
+					publish(EventVehicleSpeeding, rec.Ts, VehicleEvent{
+						VIN:        vin,
+						Ts:         rec.Ts,
+						Lat:        rec.Lat,
+						Lon:        rec.Lon,
+						Speed:      speed,
+						SpeedLimit: opts.SpeedLimit,
+					})
+				}
+				v.speeding = speed > opts.SpeedLimit
+			}
+
+			v.last = rec
+		case ev, ok := <-geofenceEvents:
+			if !ok {
+				return nil
+			}
+			typ := EventGeofenceEnter
+			if ev.Type == GeofenceExit {
+				typ = EventGeofenceExit
+			}
+			publish(typ, ev.Ts, ev)
+		case ev, ok := <-statuses:
+			if !ok {
+				return nil
+			}
+			typ := EventVehicleOnline
+			if ev.Status == StatusOffline {
+				typ = EventVehicleOffline
+			}
+			publish(typ, ev.Ts, ev)
+		}
+	}
+}
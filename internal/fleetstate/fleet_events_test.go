@@ -0,0 +1,132 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
+)
+
+type testPublisher struct {
+	mu     sync.Mutex
+	events []webhook.Event
+}
+
+func (pub *testPublisher) Publish(ev webhook.Event) error {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	pub.events = append(pub.events, ev)
+	return nil
+}
+
+// Types returns the types of the published events, with the VINs of the vehicles.
+func (pub *testPublisher) Types(t *testing.T) []string {
+	t.Helper()
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	types := make([]string, 0, len(pub.events))
+	for _, ev := range pub.events {
+		var data struct {
+			VIN string `json:"vin"`
+		}
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, fmt.Sprintf("%s %s", ev.Type, data.VIN))
+	}
+	return types
+}
+
+func TestPublishFleetEvents(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	store.CreateGeofence(Geofence{Polygon: testGeofencePolygon})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var pub testPublisher
+
+	monitor := NewStatusMonitor(store, StatusOptions{
+		OfflineAfter: 500 * time.Millisecond,
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := monitor.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		err := PublishFleetEvents(ctx, store, &pub, FleetEventsOptions{
+			SpeedLimit: 200,
+			Status:     monitor,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give the publisher and the monitor some time to subscribe
+	time.Sleep(100 * time.Millisecond)
+
+	// the positions are recent, so the vehicles are online, until they stop reporting
+	base := time.Now().UTC().Add(-450 * time.Millisecond)
+	positions := []struct {
+		vin      vehicle.VIN
+		dt       time.Duration
+		lat, lon float64
+	}{
+		{"THE1VIN", 0, 52.518898, 13.401797},
+		// ~570 m in 100 ms
+		{"THE1VIN", 100 * time.Millisecond, 52.520645, 13.409779},
+		// still speeding, and enters the geofence
+		{"THE1VIN", 200 * time.Millisecond, 52.522000, 13.417000},
+		// slows down
+		{"THE1VIN", 300 * time.Millisecond, 52.522010, 13.417000},
+		{"THE2VIN", 300 * time.Millisecond, 52.540000, 13.415000},
+		// speeding again
+		{"THE1VIN", 400 * time.Millisecond, 52.529000, 13.415000},
+	}
+	for _, p := range positions {
+		if err := store.Write(ctx, p.vin, vehicle.Telemetry{Ts: base.Add(p.dt), Lat: p.lat, Lon: p.lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wait for the vehicles to go offline
+	time.Sleep(800 * time.Millisecond)
+
+	cancel()
+	wg.Wait()
+
+	want := []string{
+		"geofence.enter THE1VIN",
+		"vehicle.new THE1VIN",
+		"vehicle.new THE2VIN",
+		"vehicle.offline THE1VIN",
+		"vehicle.offline THE2VIN",
+		"vehicle.online THE1VIN",
+		"vehicle.online THE2VIN",
+		"vehicle.speeding THE1VIN",
+		"vehicle.speeding THE1VIN",
+	}
+	// the geofence and status events are detected independently of the records, so the order of the events
+	// is undefined
+	got := pub.Types(t)
+	sort.Strings(got)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want events %v got %v", want, got)
+	}
+}
@@ -0,0 +1,510 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const (
+	maxBatchSize     = 1000
+	maxBatchBodySize = 10 << 20
+
+	defaultVehiclesLimit = 100
+	maxVehiclesLimit     = 1000
+
+	// maxNearbyRadius is the max radius in meters of the nearby query
+	maxNearbyRadius = 100000
+)
+
+// FleetHandler handles the requests, that concern the whole fleet rather than a single vehicle.
+type FleetHandler struct {
+	store Store
+
+	keepAliveInterval time.Duration
+	trackIdle         time.Duration
+	distance          geoutil.DistanceFunc
+	status            *StatusMonitor
+	allowedOrigins    []string
+	maxSubscriptions  int
+}
+
+func NewFleetHandler(store Store) *FleetHandler {
+	return NewFleetHandlerWithOptions(store, HandlerOptions{})
+}
+
+func NewFleetHandlerWithOptions(store Store, opts HandlerOptions) *FleetHandler {
+	if opts.MaxSubscriptions <= 0 {
+		opts.MaxSubscriptions = DefaultMaxSubscriptions
+	}
+	return &FleetHandler{
+		store:             store,
+		keepAliveInterval: defaultKeepAliveInterval,
+		trackIdle:         defaultStreamTrackIdle,
+		distance:          opts.distance(),
+		status:            opts.Status,
+		allowedOrigins:    opts.AllowedOrigins,
+		maxSubscriptions:  opts.MaxSubscriptions,
+	}
+}
+
+func (h *FleetHandler) Handler() http.Handler {
+	return errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p := path.Clean("/" + r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && p == "/":
+			return h.HandleVehicles(w, r)
+		case r.Method == http.MethodGet && p == "/nearby":
+			return h.HandleNearby(w, r)
+		case r.Method == http.MethodGet && p == "/within":
+			return h.HandleWithin(w, r)
+		case r.Method == http.MethodPost && p == "/positions":
+			return h.HandleUpdatePositions(w, r)
+		case r.Method == http.MethodGet && p == "/stream":
+			return h.HandleStreamPositions(w, r)
+		case r.Method == http.MethodGet && p == "/ws":
+			return h.HandleWebSocket(w, r)
+		}
+		return ErrNotFound
+	})
+}
+
+type VehiclesResponse struct {
+	Vehicles []VehicleResponse `json:"vehicles"`
+	// Next is the cursor to request the next page of the vehicles
+	Next string `json:"next,omitempty"`
+}
+
+// HandleVehicles responds with the latest known positions of all vehicles, in the order of their VINs.
+// The response is paginated: "limit" sets the size of a page, "cursor" requests the next page.
+func (h *FleetHandler) HandleVehicles(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"), defaultVehiclesLimit, maxVehiclesLimit)
+	if err != nil {
+		return err
+	}
+
+	q := VehiclesQuery{
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+	}
+
+	snaps, next, err := h.store.Vehicles(r.Context(), q)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	resp := VehiclesResponse{
+		Vehicles: make([]VehicleResponse, 0, len(snaps)),
+		Next:     next,
+	}
+	for _, snap := range snaps {
+		resp.Vehicles = append(resp.Vehicles, vehicleResponse(h.distance, h.status, snap, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+type NearbyResponse struct {
+	Vehicles []NearbyVehicleResponse `json:"vehicles"`
+}
+
+type NearbyVehicleResponse struct {
+	VehicleResponse
+	// Distance is the distance in meters from the query's point.
+	Distance float64 `json:"distance"`
+}
+
+// HandleNearby responds with the vehicles, whose latest positions are within "radius" meters from the point
+// "lat", "lon", sorted by the distance. "limit" sets the max number of vehicles in the response.
+func (h *FleetHandler) HandleNearby(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		return badRequest("lat", err)
+	}
+	lon, err := strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil {
+		return badRequest("lon", err)
+	}
+	if field, err := validateLatLon(lat, lon); err != nil {
+		return unprocessable(field, err)
+	}
+
+	radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+	if err != nil {
+		return badRequest("radius", err)
+	}
+	if !(radius > 0 && radius <= maxNearbyRadius) {
+		return unprocessable("radius", fmt.Errorf("must be in range (0, %d]", maxNearbyRadius))
+	}
+
+	limit, err := parseLimit(query.Get("limit"), defaultVehiclesLimit, maxVehiclesLimit)
+	if err != nil {
+		return err
+	}
+
+	vehicles, err := h.store.Nearby(r.Context(), lat, lon, radius/1000, limit)
+	if err != nil {
+		return err
+	}
+	return h.writeNearbyResponse(w, vehicles)
+}
+
+// HandleWithin responds with the vehicles, whose latest positions are inside the box "bbox", sorted by
+// the distance from the box's center. The box is "west,south,east,north"; if west is greater than east,
+// the box crosses the antimeridian. "limit" sets the max number of vehicles in the response.
+func (h *FleetHandler) HandleWithin(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	bbox, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseLimit(query.Get("limit"), defaultVehiclesLimit, maxVehiclesLimit)
+	if err != nil {
+		return err
+	}
+
+	vehicles, err := h.store.Within(r.Context(), bbox, limit)
+	if err != nil {
+		return err
+	}
+	return h.writeNearbyResponse(w, vehicles)
+}
+
+func parseBBox(s string) (geoutil.BBox, error) {
+	var bbox geoutil.BBox
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return bbox, badRequest("bbox", fmt.Errorf("want west,south,east,north, got %q", s))
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox, badRequest("bbox", err)
+		}
+		v[i] = f
+	}
+
+	bbox = geoutil.BBox{
+		MinLon: v[0],
+		MinLat: v[1],
+		MaxLon: v[2],
+		MaxLat: v[3],
+	}
+	if _, err := validateLatLon(bbox.MinLat, bbox.MinLon); err != nil {
+		return bbox, unprocessable("bbox", err)
+	}
+	if _, err := validateLatLon(bbox.MaxLat, bbox.MaxLon); err != nil {
+		return bbox, unprocessable("bbox", err)
+	}
+	if bbox.MinLat > bbox.MaxLat {
+		return bbox, unprocessable("bbox", fmt.Errorf("south %v is greater than north %v", bbox.MinLat, bbox.MaxLat))
+	}
+	return bbox, nil
+}
+
+func (h *FleetHandler) writeNearbyResponse(w http.ResponseWriter, vehicles []VehicleDistance) error {
+	now := time.Now().UTC()
+	resp := NearbyResponse{
+		Vehicles: make([]NearbyVehicleResponse, 0, len(vehicles)),
+	}
+	for _, v := range vehicles {
+		resp.Vehicles = append(resp.Vehicles, NearbyVehicleResponse{
+			VehicleResponse: vehicleResponse(h.distance, h.status, v.Snapshot, now),
+			Distance:        v.Distance * 1000,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// parseLimit parses the "limit" query parameter, that must be in range [1, maxLimit].
+// Empty value means defaultLimit.
+func parseLimit(v string, defaultLimit, maxLimit int) (int, error) {
+	if v == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, badRequest("limit", err)
+	}
+	if limit <= 0 || limit > maxLimit {
+		return 0, unprocessable("limit", fmt.Errorf("must be in range 1-%d", maxLimit))
+	}
+	return limit, nil
+}
+
+// PositionRequest is the telemetry of a vehicle in the batch. Like in UpdatePositionRequest, the coordinates
+// are required.
+type PositionRequest struct {
+	VIN string `json:"vin"`
+	UpdatePositionRequest
+}
+
+type BatchResponse struct {
+	// Results are the results of writing the positions, in the order of the positions in the request.
+	Results []BatchResult `json:"results"`
+}
+
+type BatchResult struct {
+	Status int       `json:"status"`
+	Error  *APIError `json:"error,omitempty"`
+}
+
+// HandleUpdatePositions stores a batch of positions of one or many vehicles. The request's body is either
+// a JSON array of positions, or (with Content-Type "application/x-ndjson") a stream of newline-delimited positions.
+// A position, that can't be stored, doesn't fail the whole batch: the response reports the result for every position.
+func (h *FleetHandler) HandleUpdatePositions(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now().UTC()
+
+	body := http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+
+	var (
+		reqs []PositionRequest
+		err  error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" {
+		reqs, err = decodeNDJSONPositions(body)
+	} else {
+		err = json.NewDecoder(body).Decode(&reqs)
+	}
+	if err != nil {
+		return badRequest("body", err)
+	}
+	if len(reqs) > maxBatchSize {
+		return unprocessable("body", fmt.Errorf("batch of %d positions exceeds max size %d", len(reqs), maxBatchSize))
+	}
+
+	resp := BatchResponse{
+		Results: make([]BatchResult, 0, len(reqs)),
+	}
+	for _, req := range reqs {
+		res := BatchResult{
+			Status: http.StatusCreated,
+		}
+		if err := h.writePosition(r, req, now); err != nil {
+			res.Error = toAPIError(err)
+			res.Status = res.Error.Status
+		}
+		resp.Results = append(resp.Results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func (h *FleetHandler) writePosition(r *http.Request, req PositionRequest, now time.Time) error {
+	vin, err := vehicle.VINFromString(req.VIN)
+	if err != nil {
+		return badRequest("vin", err)
+	}
+
+	t, err := req.telemetry(now)
+	if err != nil {
+		return err
+	}
+
+	if err := h.store.Write(r.Context(), vin, t); err != nil {
+		return fmt.Errorf("could not write position for vin %q: %w", vin, err)
+	}
+	return nil
+}
+
+func decodeNDJSONPositions(r io.Reader) ([]PositionRequest, error) {
+	var reqs []PositionRequest
+	dec := json.NewDecoder(r)
+	for {
+		var req PositionRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return reqs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+		if len(reqs) > maxBatchSize {
+			return reqs, nil
+		}
+	}
+}
+
+// FleetPositionResponse is the position of the vehicle in the fleet-wide stream.
+type FleetPositionResponse struct {
+	VIN vehicle.VIN `json:"vin"`
+	PositionResponse
+}
+
+// HandleStreamPositions streams the positions of all vehicles, including the ones, that start reporting after
+// the stream started. The optional "prefix" query parameter selects the vehicles with VINs starting with the prefix.
+// Like the vehicle's stream, the positions are streamed as newline-delimited JSON, or as server-sent events.
+// The speed in the first position of a vehicle in the stream is zero; the stream forgets the vehicle, that didn't
+// report for a while, so its next position is the first one again. If the handler tracks the status
+// of the vehicles, the stream also sends the vehicles' status events ("status" events in the event stream).
+// With "smooth=kalman", the positions of every vehicle are smoothed, like in the vehicle's stream.
+func (h *FleetHandler) HandleStreamPositions(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("bad request: client doens't support streaming")
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" {
+		if _, err := vehicle.VINFromString(prefix); err != nil {
+			return badRequest("prefix", err)
+		}
+	}
+
+	opts, err := parseStreamOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	sub, err := h.store.Subscribe(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ew        *eventWriter
+		sw        *streamWriter
+		keepAlive <-chan time.Time
+	)
+	if acceptsEventStream(r) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		ew = &eventWriter{
+			w: w,
+			f: flusher,
+		}
+		ew.WriteRetry(eventStreamRetry)
+
+		ticker := time.NewTicker(h.keepAliveInterval)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(http.StatusOK)
+
+		sw = &streamWriter{
+			f:   flusher,
+			enc: json.NewEncoder(w),
+		}
+	}
+
+	updates := readUpdates(ctx, sub)
+	statuses := readStatusEvents(ctx, subscribeStatus(ctx, h.status, prefix))
+
+	// tracks are the tracks of the vehicles in the stream, the speed is calculated from; the idle tracks
+	// are dropped, so a long-lived stream doesn't keep every vehicle it ever saw
+	tracks := make(map[vehicle.VIN]*streamTrack)
+	evict := time.NewTicker(h.trackIdle)
+	defer evict.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// client has gone, nothing left to do
+			return nil
+		case <-keepAlive:
+			ew.WriteComment("keepalive")
+		case now := <-evict.C:
+			for vin, track := range tracks {
+				if now.Sub(track.seen) >= h.trackIdle {
+					delete(tracks, vin)
+				}
+			}
+		case ev, ok := <-statuses:
+			if !ok {
+				statuses = nil
+				continue
+			}
+			if ew != nil {
+				ew.WriteEvent("status", "", ev)
+			} else {
+				sw.WriteChunk(ev)
+			}
+		case res := <-updates:
+			if res.err != nil {
+				resp := PositionResponse{Error: res.err.Error()}
+				if ew != nil {
+					ew.WriteEvent("error", "", resp)
+				} else {
+					sw.WriteChunk(resp)
+				}
+				return nil
+			}
+
+			track, ok := tracks[res.upd.VIN]
+			if !ok {
+				track = &streamTrack{positionTrack: newPositionTrack(h.distance, opts)}
+				tracks[res.upd.VIN] = track
+			}
+			track.seen = time.Now()
+
+			resp := FleetPositionResponse{
+				VIN:              res.upd.VIN,
+				PositionResponse: track.next(res.upd.Record),
+			}
+			if ew != nil {
+				ew.WriteEvent("", "", resp)
+			} else {
+				sw.WriteChunk(resp)
+			}
+		}
+	}
+}
+
+// streamTrack is the vehicle's track in the fleet-wide stream.
+type streamTrack struct {
+	*positionTrack
+	// seen is the time the stream received the vehicle's latest record
+	seen time.Time
+}
+
+type updateResult struct {
+	upd Update
+	err error
+}
+
+func readUpdates(ctx context.Context, sub Subscription) <-chan updateResult {
+	updates := make(chan updateResult)
+	go func() {
+		for {
+			upd, err := sub.Read()
+			select {
+			case updates <- updateResult{upd, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return updates
+}
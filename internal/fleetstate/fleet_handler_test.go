@@ -0,0 +1,358 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestFleetHandler_HandleUpdatePositions(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			"json",
+			"application/json",
+			`[
+				{"vin":"the1vin","ts":"2020-10-06T10:00:00Z","lat":52.518898,"lon":13.401797},
+				{"vin":"the1vin.jpg","lat":52.520645,"lon":13.409779},
+				{"vin":"the2vin","lat":52.520645,"lon":13.409779,"battery":50},
+				{"vin":"the1vin","ts":"2020-10-06T09:00:00Z","lat":52.518898,"lon":13.401797},
+				{"vin":"the3vin"}
+			]`,
+		},
+		{
+			"ndjson",
+			"application/x-ndjson",
+			`{"vin":"the1vin","ts":"2020-10-06T10:00:00Z","lat":52.518898,"lon":13.401797}
+{"vin":"the1vin.jpg","lat":52.520645,"lon":13.409779}
+{"vin":"the2vin","lat":52.520645,"lon":13.409779,"battery":50}
+{"vin":"the1vin","ts":"2020-10-06T09:00:00Z","lat":52.518898,"lon":13.401797}
+{"vin":"the3vin","lat":52.520645}
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewMemStore()
+			handler := NewFleetHandler(store)
+
+			r := httptest.NewRequest(http.MethodPost, "/positions", strings.NewReader(tc.body))
+			r.Header.Add("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+
+			if err := handler.HandleUpdatePositions(w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			var resp BatchResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			wantStatus := []int{
+				http.StatusCreated,
+				http.StatusBadRequest, // bad vin
+				http.StatusCreated,
+				http.StatusConflict,   // old record
+				http.StatusBadRequest, // missing coordinates
+			}
+			if len(wantStatus) != len(resp.Results) {
+				t.Fatalf("results: want %d got %d", len(wantStatus), len(resp.Results))
+			}
+			for i, res := range resp.Results {
+				if wantStatus[i] != res.Status {
+					t.Errorf("result %d: want status %d got %d (%v)", i, wantStatus[i], res.Status, res.Error)
+				}
+			}
+
+			for _, vin := range []string{"THE1VIN", "THE2VIN"} {
+				recs, _, err := store.Range(context.Background(), vehicle.VIN(vin), RangeQuery{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, got := 1, len(recs); want != got {
+					t.Fatalf("records %s: want %d got %d", vin, want, got)
+				}
+				if vin == "THE2VIN" && (recs[0].Fields == nil || recs[0].Fields.Battery == nil || *recs[0].Fields.Battery != 50) {
+					t.Fatalf("records %s: want battery 50, got %+v", vin, recs[0].Fields)
+				}
+			}
+			if _, err := store.Latest(context.Background(), "THE3VIN"); !errors.Is(err, ErrUnknownVIN) {
+				t.Fatalf("latest THE3VIN: want err %v got %v", ErrUnknownVIN, err)
+			}
+		})
+	}
+}
+
+func TestFleetHandler_HandleUpdatePositions_BadRequest(t *testing.T) {
+	store := NewMemStore()
+	handler := NewFleetHandler(store)
+
+	r := httptest.NewRequest(http.MethodPost, "/positions", strings.NewReader(`{"vin":"the1vin"}`))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	if err := handler.HandleUpdatePositions(w, r); err == nil {
+		t.Fatal("HandleUpdatePositions: want error, got nil")
+	}
+}
+
+func TestFleetHandler_HandleStreamPositions(t *testing.T) {
+	store := NewMemStore()
+	handler := NewFleetHandler(store)
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	r := httptest.NewRequest(http.MethodGet, "/stream?prefix=the", nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPositions(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(100 * time.Millisecond)
+
+	// Berlin, Cathedral
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "OTHER1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	// Berlin, Fernsehturm
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	// give handler some time to progress the stream
+	time.Sleep(100 * time.Millisecond)
+
+	cancelCtx()
+	wg.Wait()
+
+	want := `{"vin":"THE1VIN","seq":1,"ts":"2020-10-06T10:00:00Z","lat":52.518898,"lon":13.401797,"speed":0,"heading":0,"acceleration":0,"dt":0,"distance":0}` + "\n" +
+		`{"vin":"THE1VIN","seq":2,"ts":"2020-10-06T10:00:01Z","lat":52.520645,"lon":13.409779,"speed":2066.191265042517,"heading":70.21363712014096,"acceleration":0,"dt":1,"distance":573.9420180673658}` + "\n" +
+		`{"vin":"THE2VIN","seq":1,"ts":"2020-10-06T10:00:00Z","lat":52.520645,"lon":13.409779,"speed":0,"heading":0,"acceleration":0,"dt":0,"distance":0}` + "\n"
+	if got := w.Body.String(); want != got {
+		t.Fatalf("HandleStreamPositions: want %q got %q", want, got)
+	}
+}
+
+func TestFleetHandler_HandleStreamPositions_IdleTrack(t *testing.T) {
+	store := NewMemStore()
+	handler := NewFleetHandler(store)
+	handler.trackIdle = 50 * time.Millisecond
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPositions(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(100 * time.Millisecond)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vehicle's track is dropped, while the vehicle doesn't report
+	time.Sleep(200 * time.Millisecond)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	// give handler some time to progress the stream
+	time.Sleep(100 * time.Millisecond)
+
+	cancelCtx()
+	wg.Wait()
+
+	want := `{"vin":"THE1VIN","seq":1,"ts":"2020-10-06T10:00:00Z","lat":52.518898,"lon":13.401797,"speed":0,"heading":0,"acceleration":0,"dt":0,"distance":0}` + "\n" +
+		`{"vin":"THE1VIN","seq":2,"ts":"2020-10-06T10:00:01Z","lat":52.520645,"lon":13.409779,"speed":0,"heading":0,"acceleration":0,"dt":0,"distance":0}` + "\n"
+	if got := w.Body.String(); want != got {
+		t.Fatalf("HandleStreamPositions: want %q got %q", want, got)
+	}
+}
+
+func TestFleetHandler_HandleStreamPositions_BadPrefix(t *testing.T) {
+	handler := NewFleetHandler(NewMemStore())
+
+	r := httptest.NewRequest(http.MethodGet, "/stream?prefix=the-", nil)
+	w := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(w, r)
+
+	if want, got := http.StatusBadRequest, w.Code; want != got {
+		t.Errorf("status: want %d got %d", want, got)
+	}
+}
+
+func TestFleetHandler_HandleVehicles(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	handler := NewFleetHandler(store)
+
+	now := time.Now().UTC()
+	for _, vin := range []vehicle.VIN{"THE2VIN", "THE1VIN", "THE3VIN"} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		vins []vehicle.VIN
+		url  = "/?limit=2"
+	)
+	for url != "" {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		w := httptest.NewRecorder()
+		handler.Handler().ServeHTTP(w, r)
+
+		if want, got := http.StatusOK, w.Code; want != got {
+			t.Fatalf("status: want %d got %d: %s", want, got, w.Body)
+		}
+
+		var resp VehiclesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range resp.Vehicles {
+			vins = append(vins, v.VIN)
+		}
+
+		url = ""
+		if resp.Next != "" {
+			url = "/?limit=2&cursor=" + resp.Next
+		}
+	}
+
+	if want, got := []vehicle.VIN{"THE1VIN", "THE2VIN", "THE3VIN"}, vins; !reflect.DeepEqual(want, got) {
+		t.Fatalf("HandleVehicles: want %v, got %v", want, got)
+	}
+}
+
+func TestFleetHandler_HandleNearby(t *testing.T) {
+	store := NewMemStore()
+	handler := NewFleetHandler(store)
+
+	testWriteVehicles(t, store, map[vehicle.VIN][2]float64{
+		"CATHEDRAL":   {52.518898, 13.401797},
+		"FERNSEHTURM": {52.520645, 13.409779},
+		"POTSDAM":     {52.390569, 13.064473},
+	})
+
+	cases := []struct {
+		url      string
+		wantVINs []vehicle.VIN
+	}{
+		{"/nearby?lat=52.518898&lon=13.401797&radius=500", []vehicle.VIN{"CATHEDRAL"}},
+		{"/nearby?lat=52.518898&lon=13.401797&radius=1000", []vehicle.VIN{"CATHEDRAL", "FERNSEHTURM"}},
+		{"/nearby?lat=52.518898&lon=13.401797&radius=50000&limit=2", []vehicle.VIN{"CATHEDRAL", "FERNSEHTURM"}},
+		{"/within?bbox=13.3,52.5,13.5,52.6", []vehicle.VIN{"FERNSEHTURM", "CATHEDRAL"}},
+		{"/within?bbox=0,0,1,1", []vehicle.VIN{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.url, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			w := httptest.NewRecorder()
+			handler.Handler().ServeHTTP(w, r)
+
+			if want, got := http.StatusOK, w.Code; want != got {
+				t.Fatalf("status: want %d got %d: %s", want, got, w.Body)
+			}
+
+			var resp NearbyResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			vins := make([]vehicle.VIN, 0, len(resp.Vehicles))
+			for _, v := range resp.Vehicles {
+				vins = append(vins, v.VIN)
+			}
+			if !reflect.DeepEqual(tc.wantVINs, vins) {
+				t.Fatalf("vins: want %v, got %v", tc.wantVINs, vins)
+			}
+		})
+	}
+}
+
+func TestFleetHandler_HandleNearby_Errors(t *testing.T) {
+	handler := NewFleetHandler(NewMemStore())
+
+	cases := []struct {
+		url        string
+		wantStatus int
+		wantField  string
+	}{
+		{"/nearby?lon=13.401797&radius=500", http.StatusBadRequest, "lat"},
+		{"/nearby?lat=92&lon=13.401797&radius=500", http.StatusUnprocessableEntity, "lat"},
+		{"/nearby?lat=52.518898&lon=13.401797&radius=-1", http.StatusUnprocessableEntity, "radius"},
+		{"/nearby?lat=52.518898&lon=13.401797&radius=500&limit=0", http.StatusUnprocessableEntity, "limit"},
+		{"/within?bbox=13.3,52.5,13.5", http.StatusBadRequest, "bbox"},
+		{"/within?bbox=13.3,52.6,13.5,52.5", http.StatusUnprocessableEntity, "bbox"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.url, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			w := httptest.NewRecorder()
+			handler.Handler().ServeHTTP(w, r)
+
+			if tc.wantStatus != w.Code {
+				t.Fatalf("status: want %d got %d: %s", tc.wantStatus, w.Code, w.Body)
+			}
+			var resp ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantField != resp.Error.Field {
+				t.Errorf("field: want %q got %q", tc.wantField, resp.Error.Field)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const defaultGeofenceEventsSize = 10000
+
+var ErrUnknownGeofence = errors.New("unknown geofence")
+
+// Geofence is a named area, the store detects the vehicles entering and leaving.
+// Exactly one of Circle and Polygon defines the area.
+type Geofence struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name"`
+	Circle  *GeofenceCircle `json:"circle,omitempty"`
+	Polygon []LatLon        `json:"polygon,omitempty"`
+}
+
+type GeofenceCircle struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// Radius is the radius of the circle in meters.
+	Radius float64 `json:"radius"`
+}
+
+type LatLon struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// validate checks the area of the geofence is valid. It returns the name of the invalid field, if any.
+func (fence Geofence) validate() (field string, err error) {
+	switch {
+	case fence.Circle == nil && len(fence.Polygon) == 0:
+		return "circle", errors.New("either circle or polygon is required")
+	case fence.Circle != nil && len(fence.Polygon) != 0:
+		return "polygon", errors.New("either circle or polygon is allowed")
+	case fence.Circle != nil:
+		if _, err := validateLatLon(fence.Circle.Lat, fence.Circle.Lon); err != nil {
+			return "circle", err
+		}
+		if !(fence.Circle.Radius > 0) {
+			return "circle", fmt.Errorf("radius %v isn't positive", fence.Circle.Radius)
+		}
+	default:
+		if len(fence.Polygon) < 3 {
+			return "polygon", fmt.Errorf("polygon has %d vertices, want at least 3", len(fence.Polygon))
+		}
+		for _, p := range fence.Polygon {
+			if _, err := validateLatLon(p.Lat, p.Lon); err != nil {
+				return "polygon", err
+			}
+		}
+	}
+	return "", nil
+}
+
+// geofence is the geofence, prepared for the point-in-area checks.
+type geofence struct {
+	Geofence
+	bbox    geoutil.BBox
+	polygon []geoutil.Point
+}
+
+func newGeofence(fence Geofence) *geofence {
+	f := &geofence{
+		Geofence: fence,
+	}
+	if c := fence.Circle; c != nil {
+		f.bbox = geoutil.BBoxAround(c.Lat, c.Lon, c.Radius/1000)
+	} else {
+		f.polygon = make([]geoutil.Point, 0, len(fence.Polygon))
+		for _, p := range fence.Polygon {
+			f.polygon = append(f.polygon, geoutil.Point{Lat: p.Lat, Lon: p.Lon})
+		}
+		f.bbox = geoutil.PolygonBBox(f.polygon)
+	}
+	return f
+}
+
+func (f *geofence) contains(lat, lon float64) bool {
+	if !f.bbox.Contains(lat, lon) {
+		return false
+	}
+	if c := f.Circle; c != nil {
+		return geoutil.Distance(c.Lat, c.Lon, lat, lon)*1000 <= c.Radius
+	}
+	return geoutil.PointInPolygon(lat, lon, f.polygon)
+}
+
+type GeofenceEventType string
+
+const (
+	GeofenceEnter GeofenceEventType = "enter"
+	GeofenceExit  GeofenceEventType = "exit"
+)
+
+// GeofenceEvent is the vehicle entering or leaving the geofence. Ts, Lat, Lon are the vehicle's record,
+// the event was detected at.
+type GeofenceEvent struct {
+	VIN        vehicle.VIN       `json:"vin"`
+	GeofenceID string            `json:"geofence"`
+	Type       GeofenceEventType `json:"type"`
+	Ts         time.Time         `json:"ts"`
+	Lat        float64           `json:"lat"`
+	Lon        float64           `json:"lon"`
+}
+
+// GeofenceEventsQuery selects the geofence events. Zero value of a field matches all events.
+type GeofenceEventsQuery struct {
+	VIN        vehicle.VIN
+	GeofenceID string
+	// Limit is the max number of the latest events to return.
+	Limit int
+}
+
+func (q GeofenceEventsQuery) match(ev GeofenceEvent) bool {
+	return (q.VIN == "" || q.VIN == ev.VIN) && (q.GeofenceID == "" || q.GeofenceID == ev.GeofenceID)
+}
+
+type GeofenceOptions struct {
+	// EventsSize is the max number of the latest events, the store keeps. Zero value means the default size.
+	EventsSize int
+}
+
+// GeofenceStore is a Store, that detects the vehicles entering and leaving the geofences, when it writes
+// their records to the underlying store. The geofences and the events are kept in memory.
+type GeofenceStore struct {
+	Store
+
+	// fencesMu guards the geofences; the writes only read them
+	fencesMu sync.RWMutex
+	lastID   uint64
+	fences   map[string]*geofence
+	// ids are the ids of the geofences, in the order they were created
+	ids []string
+
+	// shards split the state of the vehicles by their VINs
+	shards [vinShards]geofenceShard
+
+	// mu guards the events
+	mu sync.Mutex
+	// cond notifies the event subscriptions about new events
+	cond sync.Cond
+	// events is the ring buffer of the latest events
+	events []GeofenceEvent
+	// seq is the number of the events ever detected
+	seq uint64
+}
+
+type geofenceShard struct {
+	mu sync.Mutex
+	// inside are the geofences every vehicle of the shard is inside of
+	inside map[vehicle.VIN]map[string]struct{}
+	// last is the timestamp of the latest record of every vehicle of the shard, the events were detected at
+	last map[vehicle.VIN]time.Time
+}
+
+func NewGeofenceStore(store Store, opts GeofenceOptions) *GeofenceStore {
+	size := opts.EventsSize
+	if size <= 0 {
+		size = defaultGeofenceEventsSize
+	}
+	gs := &GeofenceStore{
+		Store:  store,
+		fences: make(map[string]*geofence),
+		events: make([]GeofenceEvent, size),
+	}
+	for i := range gs.shards {
+		gs.shards[i].inside = make(map[vehicle.VIN]map[string]struct{})
+		gs.shards[i].last = make(map[vehicle.VIN]time.Time)
+	}
+	gs.cond.L = &gs.mu
+	return gs
+}
+
+// Write writes the record to the underlying store, and detects the geofences the vehicle entered or left.
+// The vehicle, that wasn't seen inside a geofence before, is considered outside. Back-filled records
+// don't produce events.
+func (gs *GeofenceStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	if err := gs.Store.Write(ctx, vin, t); err != nil {
+		return err
+	}
+	ts, lat, lon := t.Ts, t.Lat, t.Lon
+
+	// NOTE: concurrent writes for the same vin may be detected out of order; the older one is skipped then,
+	// like a back-filled record.
+	shard := &gs.shards[shardOf(vin, vinShards)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if last, ok := shard.last[vin]; ok && ts.Before(last) {
+		return nil
+	}
+	shard.last[vin] = ts
+
+	inside := shard.inside[vin]
+	var events []GeofenceEvent
+	gs.fencesMu.RLock()
+	for _, id := range gs.ids {
+		_, wasInside := inside[id]
+		isInside := gs.fences[id].contains(lat, lon)
+		if wasInside == isInside {
+			continue
+		}
+
+		ev := GeofenceEvent{
+			VIN:        vin,
+			GeofenceID: id,
+			Type:       GeofenceEnter,
+			Ts:         ts,
+			Lat:        lat,
+			Lon:        lon,
+		}
+		if isInside {
+			if inside == nil {
+				inside = make(map[string]struct{})
+				shard.inside[vin] = inside
+			}
+			inside[id] = struct{}{}
+		} else {
+			ev.Type = GeofenceExit
+			delete(inside, id)
+		}
+		events = append(events, ev)
+	}
+	gs.fencesMu.RUnlock()
+
+	// the events are published under the vehicle's shard lock, so the vehicle's events are in order
+	if len(events) > 0 {
+		gs.mu.Lock()
+		for _, ev := range events {
+			gs.publish(ev)
+		}
+		gs.cond.Broadcast()
+		gs.mu.Unlock()
+	}
+	return nil
+}
+
+func (gs *GeofenceStore) publish(ev GeofenceEvent) {
+	gs.events[gs.seq%uint64(len(gs.events))] = ev
+	gs.seq++
+}
+
+// CreateGeofence adds the geofence, assigning it a new id. The geofence must be valid.
+func (gs *GeofenceStore) CreateGeofence(fence Geofence) Geofence {
+	gs.fencesMu.Lock()
+	defer gs.fencesMu.Unlock()
+
+	gs.lastID++
+	fence.ID = strconv.FormatUint(gs.lastID, 10)
+	gs.fences[fence.ID] = newGeofence(fence)
+	gs.ids = append(gs.ids, fence.ID)
+
+	return fence
+}
+
+// UpdateGeofence replaces the geofence with the id. The vehicles, that are inside the geofence, stay inside,
+// until their next records are outside of the new area.
+func (gs *GeofenceStore) UpdateGeofence(id string, fence Geofence) (Geofence, error) {
+	gs.fencesMu.Lock()
+	defer gs.fencesMu.Unlock()
+
+	if _, ok := gs.fences[id]; !ok {
+		return fence, fmt.Errorf("%w %s", ErrUnknownGeofence, id)
+	}
+	fence.ID = id
+	gs.fences[id] = newGeofence(fence)
+
+	return fence, nil
+}
+
+// DeleteGeofence removes the geofence with the id. The events of the geofence are kept.
+func (gs *GeofenceStore) DeleteGeofence(id string) error {
+	gs.fencesMu.Lock()
+	if _, ok := gs.fences[id]; !ok {
+		gs.fencesMu.Unlock()
+		return fmt.Errorf("%w %s", ErrUnknownGeofence, id)
+	}
+	delete(gs.fences, id)
+	for i := range gs.ids {
+		if gs.ids[i] == id {
+			gs.ids = append(gs.ids[:i], gs.ids[i+1:]...)
+			break
+		}
+	}
+	gs.fencesMu.Unlock()
+
+	// the writes, that follow, don't see the geofence, and the ids are never reused, so the vehicles
+	// can be cleaned up after the geofence is gone
+	for i := range gs.shards {
+		shard := &gs.shards[i]
+		shard.mu.Lock()
+		for _, inside := range shard.inside {
+			delete(inside, id)
+		}
+		shard.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (gs *GeofenceStore) Geofence(id string) (Geofence, error) {
+	gs.fencesMu.RLock()
+	defer gs.fencesMu.RUnlock()
+
+	f, ok := gs.fences[id]
+	if !ok {
+		return Geofence{}, fmt.Errorf("%w %s", ErrUnknownGeofence, id)
+	}
+	return f.Geofence, nil
+}
+
+// Geofences returns all geofences, in the order they were created.
+func (gs *GeofenceStore) Geofences() []Geofence {
+	gs.fencesMu.RLock()
+	defer gs.fencesMu.RUnlock()
+
+	fences := make([]Geofence, 0, len(gs.ids))
+	for _, id := range gs.ids {
+		fences = append(fences, gs.fences[id].Geofence)
+	}
+	return fences
+}
+
+// Events returns the latest events, that match the query, oldest first.
+func (gs *GeofenceStore) Events(q GeofenceEventsQuery) []GeofenceEvent {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	var events []GeofenceEvent
+	// scan the buffer from the latest event back
+	for seq := gs.seq; seq > gs.oldestSeq(); seq-- {
+		ev := gs.events[(seq-1)%uint64(len(gs.events))]
+		if !q.match(ev) {
+			continue
+		}
+		events = append(events, ev)
+		if q.Limit > 0 && len(events) == q.Limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// oldestSeq returns the sequence number of the oldest event in the buffer.
+func (gs *GeofenceStore) oldestSeq() uint64 {
+	if size := uint64(len(gs.events)); gs.seq > size {
+		return gs.seq - size
+	}
+	return 0
+}
+
+// SubscribeEvents returns the subscription to the events, that match the query, detected after the call.
+// The query's limit is ignored. The subscription is closed, when the context is canceled.
+func (gs *GeofenceStore) SubscribeEvents(ctx context.Context, q GeofenceEventsQuery) *GeofenceSubscription {
+	gs.mu.Lock()
+	next := gs.seq
+	gs.mu.Unlock()
+
+	s := &GeofenceSubscription{
+		store:  gs,
+		query:  q,
+		next:   next,
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		gs.mu.Lock()
+		close(s.closed)
+		gs.mu.Unlock()
+		gs.cond.Broadcast()
+	}()
+
+	return s
+}
+
+// GeofenceSubscription reads the geofence events. Like the fleet-wide subscription, a subscription,
+// that falls behind by more than the size of the store's buffer, skips the overwritten events.
+type GeofenceSubscription struct {
+	store *GeofenceStore
+	query GeofenceEventsQuery
+	// next is the sequence number of the next event to read
+	next   uint64
+	closed chan struct{}
+}
+
+// Read blocks until the next event is available.
+func (s *GeofenceSubscription) Read() (GeofenceEvent, error) {
+	gs := s.store
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for {
+		select {
+		case <-s.closed:
+			return GeofenceEvent{}, ErrReaderClosed
+		default:
+		}
+
+		if s.next == gs.seq {
+			gs.cond.Wait()
+			continue
+		}
+
+		if oldest := gs.oldestSeq(); s.next < oldest {
+			s.next = oldest
+		}
+
+		ev := gs.events[s.next%uint64(len(gs.events))]
+		s.next++
+		if s.query.match(ev) {
+			return ev, nil
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const (
+	defaultGeofenceEventsLimit = 100
+	maxGeofenceEventsLimit     = 1000
+)
+
+type GeofenceHandler struct {
+	store *GeofenceStore
+
+	keepAliveInterval time.Duration
+}
+
+func NewGeofenceHandler(store *GeofenceStore) *GeofenceHandler {
+	return &GeofenceHandler{
+		store:             store,
+		keepAliveInterval: defaultKeepAliveInterval,
+	}
+}
+
+func (h *GeofenceHandler) Handler() http.Handler {
+	return errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p := path.Clean("/" + r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && p == "/":
+			return h.HandleGeofences(w, r)
+		case r.Method == http.MethodPost && p == "/":
+			return h.HandleCreateGeofence(w, r)
+		case r.Method == http.MethodGet && p == "/events":
+			return h.HandleEvents(w, r)
+		case r.Method == http.MethodGet && p == "/events/stream":
+			return h.HandleStreamEvents(w, r)
+		case strings.Count(p, "/") == 1:
+			switch r.Method {
+			case http.MethodGet:
+				return h.HandleGeofence(w, r)
+			case http.MethodPut:
+				return h.HandleUpdateGeofence(w, r)
+			case http.MethodDelete:
+				return h.HandleDeleteGeofence(w, r)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+type GeofencesResponse struct {
+	Geofences []Geofence `json:"geofences"`
+}
+
+// HandleGeofences responds with all geofences.
+func (h *GeofenceHandler) HandleGeofences(w http.ResponseWriter, r *http.Request) error {
+	resp := GeofencesResponse{
+		Geofences: h.store.Geofences(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// HandleCreateGeofence creates the geofence from the JSON body, and responds with the created geofence.
+func (h *GeofenceHandler) HandleCreateGeofence(w http.ResponseWriter, r *http.Request) error {
+	fence, err := decodeGeofence(w, r)
+	if err != nil {
+		return err
+	}
+
+	fence = h.store.CreateGeofence(fence)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(fence)
+}
+
+// HandleGeofence responds with the geofence.
+func (h *GeofenceHandler) HandleGeofence(w http.ResponseWriter, r *http.Request) error {
+	fence, err := h.store.Geofence(geofenceIDFromURLPath(r.URL.Path))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(fence)
+}
+
+// HandleUpdateGeofence replaces the geofence with the one from the JSON body.
+func (h *GeofenceHandler) HandleUpdateGeofence(w http.ResponseWriter, r *http.Request) error {
+	fence, err := decodeGeofence(w, r)
+	if err != nil {
+		return err
+	}
+
+	fence, err = h.store.UpdateGeofence(geofenceIDFromURLPath(r.URL.Path), fence)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(fence)
+}
+
+// HandleDeleteGeofence deletes the geofence.
+func (h *GeofenceHandler) HandleDeleteGeofence(w http.ResponseWriter, r *http.Request) error {
+	if err := h.store.DeleteGeofence(geofenceIDFromURLPath(r.URL.Path)); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func decodeGeofence(w http.ResponseWriter, r *http.Request) (fence Geofence, err error) {
+	if err := decodeJSONBody(w, r, &fence); err != nil {
+		return fence, err
+	}
+	if field, err := fence.validate(); err != nil {
+		return fence, unprocessable(field, err)
+	}
+	return fence, nil
+}
+
+func geofenceIDFromURLPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+type GeofenceEventsResponse struct {
+	Events []GeofenceEvent `json:"events"`
+}
+
+// HandleEvents responds with the latest geofence events, oldest first. The optional query parameters "vin"
+// and "geofence" select the events of a single vehicle, or of a single geofence; "limit" sets the max number
+// of events.
+func (h *GeofenceHandler) HandleEvents(w http.ResponseWriter, r *http.Request) error {
+	q, err := parseGeofenceEventsQuery(r)
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultGeofenceEventsLimit, maxGeofenceEventsLimit)
+	if err != nil {
+		return err
+	}
+	q.Limit = limit
+
+	resp := GeofenceEventsResponse{
+		Events: h.store.Events(q),
+	}
+	if resp.Events == nil {
+		resp.Events = []GeofenceEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func parseGeofenceEventsQuery(r *http.Request) (q GeofenceEventsQuery, err error) {
+	query := r.URL.Query()
+	if v := query.Get("vin"); v != "" {
+		q.VIN, err = vehicle.VINFromString(v)
+		if err != nil {
+			return q, badRequest("vin", err)
+		}
+	}
+	q.GeofenceID = query.Get("geofence")
+	return q, nil
+}
+
+// HandleStreamEvents streams the geofence events, detected after the stream started. Like HandleEvents,
+// the optional query parameters "vin" and "geofence" select the events. The events are streamed
+// as newline-delimited JSON, or as server-sent events.
+func (h *GeofenceHandler) HandleStreamEvents(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("bad request: client doens't support streaming")
+	}
+
+	q, err := parseGeofenceEventsQuery(r)
+	if err != nil {
+		return err
+	}
+
+	sub := h.store.SubscribeEvents(ctx, q)
+
+	var (
+		ew        *eventWriter
+		sw        *streamWriter
+		keepAlive <-chan time.Time
+	)
+	if acceptsEventStream(r) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		ew = &eventWriter{
+			w: w,
+			f: flusher,
+		}
+		ew.WriteRetry(eventStreamRetry)
+
+		ticker := time.NewTicker(h.keepAliveInterval)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(http.StatusOK)
+
+		sw = &streamWriter{
+			f:   flusher,
+			enc: json.NewEncoder(w),
+		}
+	}
+
+	events := readGeofenceEvents(ctx, sub)
+	for {
+		select {
+		case <-ctx.Done():
+			// client has gone, nothing left to do
+			return nil
+		case <-keepAlive:
+			ew.WriteComment("keepalive")
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if ew != nil {
+				ew.WriteEvent("", "", ev)
+			} else {
+				sw.WriteChunk(ev)
+			}
+		}
+	}
+}
+
+// readGeofenceEvents reads the events from the subscription in the background, until the subscription
+// is closed.
+func readGeofenceEvents(ctx context.Context, sub *GeofenceSubscription) <-chan GeofenceEvent {
+	events := make(chan GeofenceEvent)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := sub.Read()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,222 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func testServeGeofences(t *testing.T, handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestGeofenceHandler_Handler(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	handler := NewGeofenceHandler(store).Handler()
+
+	w := testServeGeofences(t, handler, http.MethodPost, "/", `{"name":"cathedral","circle":{"lat":52.518898,"lon":13.401797,"radius":100}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: want status %d got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var fence Geofence
+	if err := json.NewDecoder(w.Body).Decode(&fence); err != nil {
+		t.Fatal(err)
+	}
+	if fence.ID == "" || fence.Name != "cathedral" || fence.Circle == nil {
+		t.Fatalf("create: unexpected geofence %+v", fence)
+	}
+
+	w = testServeGeofences(t, handler, http.MethodPut, "/"+fence.ID, `{"name":"alexanderplatz","polygon":[{"lat":52.52,"lon":13.41},{"lat":52.52,"lon":13.42},{"lat":52.53,"lon":13.42},{"lat":52.53,"lon":13.41}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: want status %d got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w = testServeGeofences(t, handler, http.MethodGet, "/"+fence.ID, "")
+	fence = Geofence{}
+	if err := json.NewDecoder(w.Body).Decode(&fence); err != nil {
+		t.Fatal(err)
+	}
+	if fence.Name != "alexanderplatz" || fence.Circle != nil || len(fence.Polygon) != 4 {
+		t.Fatalf("get: unexpected geofence %+v", fence)
+	}
+
+	w = testServeGeofences(t, handler, http.MethodGet, "/", "")
+	want := `{"geofences":[{"id":"1","name":"alexanderplatz","polygon":[{"lat":52.52,"lon":13.41},{"lat":52.52,"lon":13.42},{"lat":52.53,"lon":13.42},{"lat":52.53,"lon":13.41}]}]}` + "\n"
+	if got := w.Body.String(); want != got {
+		t.Fatalf("list: want %s got %s", want, got)
+	}
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.525, Lon: 13.415}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 52.525, Lon: 13.415}); err != nil {
+		t.Fatal(err)
+	}
+
+	w = testServeGeofences(t, handler, http.MethodGet, "/events?vin=the2vin&geofence="+fence.ID, "")
+	want = `{"events":[{"vin":"THE2VIN","geofence":"1","type":"enter","ts":"2020-10-06T10:00:00Z","lat":52.525,"lon":13.415}]}` + "\n"
+	if got := w.Body.String(); want != got {
+		t.Fatalf("events: want %s got %s", want, got)
+	}
+
+	w = testServeGeofences(t, handler, http.MethodDelete, "/"+fence.ID, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: want status %d got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	w = testServeGeofences(t, handler, http.MethodGet, "/", "")
+	if want, got := `{"geofences":[]}`+"\n", w.Body.String(); want != got {
+		t.Fatalf("list: want %s got %s", want, got)
+	}
+}
+
+func TestGeofenceHandler_Handler_Errors(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	handler := NewGeofenceHandler(store).Handler()
+
+	cases := []struct {
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantField  string
+	}{
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"name":`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "body",
+		},
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"name":"empty"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "circle",
+		},
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"polygon":[{"lat":52.52,"lon":13.41},{"lat":52.52,"lon":13.42}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "polygon",
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/42",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			method:     http.MethodPut,
+			target:     "/42",
+			body:       `{"circle":{"lat":52.518898,"lon":13.401797,"radius":100}}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			method:     http.MethodDelete,
+			target:     "/42",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/events?vin=the-vin",
+			wantStatus: http.StatusBadRequest,
+			wantField:  "vin",
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/events?limit=0",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "limit",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			w := testServeGeofences(t, handler, tc.method, tc.target, tc.body)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("want status %d got %d: %s", tc.wantStatus, w.Code, w.Body)
+			}
+
+			var resp ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Field != tc.wantField {
+				t.Fatalf("want field %q got %q", tc.wantField, resp.Error.Field)
+			}
+		})
+	}
+}
+
+func TestGeofenceHandler_HandleStreamEvents(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	handler := NewGeofenceHandler(store)
+	store.CreateGeofence(Geofence{Polygon: testGeofencePolygon})
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	r := httptest.NewRequest(http.MethodGet, "/events/stream?vin=the1vin", nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamEvents(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(100 * time.Millisecond)
+
+	for _, p := range []struct {
+		lat, lon float64
+	}{
+		{52.525, 13.415},
+		{52.540, 13.415},
+	} {
+		now = now.Add(time.Second)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: p.lat, Lon: p.lon}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: p.lat, Lon: p.lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// give handler some time to progress the stream
+	time.Sleep(100 * time.Millisecond)
+
+	cancelCtx()
+	wg.Wait()
+
+	want := `{"vin":"THE1VIN","geofence":"1","type":"enter","ts":"2020-10-06T10:00:01Z","lat":52.525,"lon":13.415}` + "\n" +
+		`{"vin":"THE1VIN","geofence":"1","type":"exit","ts":"2020-10-06T10:00:02Z","lat":52.54,"lon":13.415}` + "\n"
+	if got := w.Body.String(); want != got {
+		t.Fatalf("HandleStreamEvents: want %q got %q", want, got)
+	}
+}
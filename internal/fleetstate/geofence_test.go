@@ -0,0 +1,317 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// (Berlin, Alexanderplatz)
+var testGeofencePolygon = []LatLon{
+	{52.520, 13.410},
+	{52.520, 13.420},
+	{52.530, 13.420},
+	{52.530, 13.410},
+}
+
+func testGeofenceEventTypes(events []GeofenceEvent) []string {
+	types := make([]string, 0, len(events))
+	for _, ev := range events {
+		types = append(types, fmt.Sprintf("%s %s %s", ev.VIN, ev.Type, ev.GeofenceID))
+	}
+	return types
+}
+
+func TestGeofence_validate(t *testing.T) {
+	cases := []struct {
+		fence     Geofence
+		wantField string
+	}{
+		{
+			fence: Geofence{Circle: &GeofenceCircle{Lat: 52.52, Lon: 13.41, Radius: 100}},
+		},
+		{
+			fence: Geofence{Polygon: testGeofencePolygon},
+		},
+		{
+			fence:     Geofence{},
+			wantField: "circle",
+		},
+		{
+			fence:     Geofence{Circle: &GeofenceCircle{Lat: 52.52, Lon: 13.41, Radius: 100}, Polygon: testGeofencePolygon},
+			wantField: "polygon",
+		},
+		{
+			fence:     Geofence{Circle: &GeofenceCircle{Lat: 92.52, Lon: 13.41, Radius: 100}},
+			wantField: "circle",
+		},
+		{
+			fence:     Geofence{Circle: &GeofenceCircle{Lat: 52.52, Lon: 13.41}},
+			wantField: "circle",
+		},
+		{
+			fence:     Geofence{Polygon: testGeofencePolygon[:2]},
+			wantField: "polygon",
+		},
+		{
+			fence:     Geofence{Polygon: []LatLon{{0, 0}, {0, 1}, {1, 181}}},
+			wantField: "polygon",
+		},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			field, err := tc.fence.validate()
+			if (err != nil) != (tc.wantField != "") {
+				t.Fatalf("want field %q got err %v", tc.wantField, err)
+			}
+			if field != tc.wantField {
+				t.Fatalf("want field %q got %q", tc.wantField, field)
+			}
+		})
+	}
+}
+
+func TestGeofenceStore_Write(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+
+	square := store.CreateGeofence(Geofence{Name: "square", Polygon: testGeofencePolygon})
+	// (Berlin, Cathedral), within 100 m
+	circle := store.CreateGeofence(Geofence{Name: "circle", Circle: &GeofenceCircle{Lat: 52.518898, Lon: 13.401797, Radius: 100}})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	positions := []struct {
+		vin      vehicle.VIN
+		lat, lon float64
+	}{
+		{"THE1VIN", 52.518898, 13.401797}, // enters the circle
+		{"THE1VIN", 52.519000, 13.402000}, // stays in the circle
+		{"THE1VIN", 52.525000, 13.415000}, // leaves the circle, enters the square
+		{"THE2VIN", 52.526000, 13.416000}, // enters the square
+		{"THE1VIN", 52.540000, 13.415000}, // leaves the square
+	}
+	for i, p := range positions {
+		if err := store.Write(ctx, p.vin, vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Second), Lat: p.lat, Lon: p.lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	allEvents := []string{
+		"THE1VIN enter " + circle.ID,
+		"THE1VIN enter " + square.ID,
+		"THE1VIN exit " + circle.ID,
+		"THE2VIN enter " + square.ID,
+		"THE1VIN exit " + square.ID,
+	}
+
+	cases := []struct {
+		q    GeofenceEventsQuery
+		want []string
+	}{
+		{
+			q:    GeofenceEventsQuery{},
+			want: allEvents,
+		},
+		{
+			q:    GeofenceEventsQuery{Limit: 2},
+			want: allEvents[3:],
+		},
+		{
+			q:    GeofenceEventsQuery{VIN: "THE2VIN"},
+			want: []string{"THE2VIN enter " + square.ID},
+		},
+		{
+			q:    GeofenceEventsQuery{GeofenceID: circle.ID},
+			want: []string{allEvents[0], allEvents[2]},
+		},
+		{
+			q:    GeofenceEventsQuery{VIN: "THE2VIN", GeofenceID: circle.ID},
+			want: []string{},
+		},
+	}
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			got := testGeofenceEventTypes(store.Events(tc.q))
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Events: want %v got %v", tc.want, got)
+			}
+		})
+	}
+
+	events := store.Events(GeofenceEventsQuery{VIN: "THE2VIN"})
+	want := GeofenceEvent{
+		VIN:        "THE2VIN",
+		GeofenceID: square.ID,
+		Type:       GeofenceEnter,
+		Ts:         now.Add(3 * time.Second),
+		Lat:        52.526,
+		Lon:        13.416,
+	}
+	if events[0] != want {
+		t.Fatalf("Events: want %+v got %+v", want, events[0])
+	}
+}
+
+func TestGeofenceStore_Write_BackFill(t *testing.T) {
+	store := NewGeofenceStore(NewMemStoreWithOptions(MemStoreOptions{MaxLateness: time.Minute}), GeofenceOptions{})
+	store.CreateGeofence(Geofence{Polygon: testGeofencePolygon})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.540000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+	// the back-filled record is inside the geofence, but the vehicle already left it
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-time.Second), Lat: 52.525000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+	if events := store.Events(GeofenceEventsQuery{}); len(events) != 0 {
+		t.Fatalf("Events: want none got %v", events)
+	}
+}
+
+func TestGeofenceStore_Write_OldRecord(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	store.CreateGeofence(Geofence{Polygon: testGeofencePolygon})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.540000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-time.Second), Lat: 52.525000, Lon: 13.415000}); !errors.Is(err, ErrOldRecord) {
+		t.Fatalf("want err %v got %v", ErrOldRecord, err)
+	}
+	if events := store.Events(GeofenceEventsQuery{}); len(events) != 0 {
+		t.Fatalf("Events: want none got %v", events)
+	}
+}
+
+func TestGeofenceStore_UpdateGeofence(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	fence := store.CreateGeofence(Geofence{Name: "square", Polygon: testGeofencePolygon})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.525000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// move the geofence away from the vehicle; the vehicle leaves it with the next record
+	fence.Circle = &GeofenceCircle{Lat: 0, Lon: 0, Radius: 100}
+	fence.Polygon = nil
+	if _, err := store.UpdateGeofence(fence.ID, fence); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Geofence(fence.ID); !reflect.DeepEqual(fence, got) {
+		t.Fatalf("Geofence: want %+v got %+v", fence, got)
+	}
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.525000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"THE1VIN enter " + fence.ID, "THE1VIN exit " + fence.ID}
+	if got := testGeofenceEventTypes(store.Events(GeofenceEventsQuery{})); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Events: want %v got %v", want, got)
+	}
+
+	if _, err := store.UpdateGeofence("unknown", fence); !errors.Is(err, ErrUnknownGeofence) {
+		t.Fatalf("UpdateGeofence: want err %v got %v", ErrUnknownGeofence, err)
+	}
+}
+
+func TestGeofenceStore_DeleteGeofence(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+	fence0 := store.CreateGeofence(Geofence{Name: "first", Polygon: testGeofencePolygon})
+	fence1 := store.CreateGeofence(Geofence{Name: "second", Polygon: testGeofencePolygon})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.525000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteGeofence(fence0.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteGeofence(fence0.ID); !errors.Is(err, ErrUnknownGeofence) {
+		t.Fatalf("DeleteGeofence: want err %v got %v", ErrUnknownGeofence, err)
+	}
+	if want, got := []Geofence{fence1}, store.Geofences(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Geofences: want %v got %v", want, got)
+	}
+
+	// the deleted geofence doesn't produce the exit event, but its events are kept
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.540000, Lon: 13.415000}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"THE1VIN enter " + fence0.ID,
+		"THE1VIN enter " + fence1.ID,
+		"THE1VIN exit " + fence1.ID,
+	}
+	if got := testGeofenceEventTypes(store.Events(GeofenceEventsQuery{})); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Events: want %v got %v", want, got)
+	}
+}
+
+func TestGeofenceStore_SubscribeEvents(t *testing.T) {
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{EventsSize: 2})
+	fence := store.CreateGeofence(Geofence{Polygon: testGeofencePolygon})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	sub := store.SubscribeEvents(ctx, GeofenceEventsQuery{VIN: "THE2VIN"})
+
+	for i, vin := range []vehicle.VIN{"THE1VIN", "THE2VIN"} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Second), Lat: 52.525000, Lon: 13.415000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ev, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "THE2VIN enter "+fence.ID, testGeofenceEventTypes([]GeofenceEvent{ev})[0]; want != got {
+		t.Fatalf("Read: want %v got %v", want, got)
+	}
+
+	// the subscription, that fell behind, skips the overwritten events
+	for i := 0; i < 3; i++ {
+		lat := 52.540000
+		if i%2 == 1 {
+			lat = 52.525000
+		}
+		if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now.Add(time.Duration(i+2) * time.Second), Lat: lat, Lon: 13.415000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []GeofenceEventType{GeofenceEnter, GeofenceExit} {
+		ev, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != want {
+			t.Fatalf("Read: want %v got %v", want, ev.Type)
+		}
+	}
+
+	cancel()
+	if _, err := sub.Read(); !errors.Is(err, ErrReaderClosed) {
+		t.Fatalf("Read: want err %v got %v", ErrReaderClosed, err)
+	}
+}
@@ -0,0 +1,215 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+var ErrImplausible = errors.New("implausible position")
+
+// validateLatLon checks lat, lon are valid WGS84 coordinates. It returns the name of the invalid field, if any.
+func validateLatLon(lat, lon float64) (field string, err error) {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return "lat", fmt.Errorf("%v is out of range [-90, 90]", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return "lon", fmt.Errorf("%v is out of range [-180, 180]", lon)
+	}
+	return "", nil
+}
+
+// PlausibilityCheck checks the record of the vehicle is plausible, given the previous plausible record.
+type PlausibilityCheck interface {
+	CheckPlausibility(vin vehicle.VIN, prev, rec Record) error
+}
+
+type PlausibilityCheckFunc func(vin vehicle.VIN, prev, rec Record) error
+
+func (f PlausibilityCheckFunc) CheckPlausibility(vin vehicle.VIN, prev, rec Record) error {
+	return f(vin, prev, rec)
+}
+
+// MaxSpeedCheck rejects the "teleport" jumps, i.e. the records, that imply the vehicle moved from the previous
+// record faster than maxSpeed (km/h).
+func MaxSpeedCheck(maxSpeed float64) PlausibilityCheck {
+	return PlausibilityCheckFunc(func(vin vehicle.VIN, prev, rec Record) error {
+		d := geoutil.Distance(prev.Lat, prev.Lon, rec.Lat, rec.Lon)
+		if d == 0 {
+			return nil
+		}
+		dt := rec.Ts.Sub(prev.Ts)
+		if dt < 0 {
+			dt = -dt
+		}
+		speed := math.Inf(1)
+		if dt > 0 {
+			speed = d / dt.Hours()
+		}
+		if speed > maxSpeed {
+			return fmt.Errorf("implied speed %.1f km/h exceeds max speed %.1f km/h", speed, maxSpeed)
+		}
+		return nil
+	})
+}
+
+type PlausibilityOptions struct {
+	Checks []PlausibilityCheck
+	// FlagOnly makes the store write the implausible records, only adding them to the quarantine.
+	// By default, the implausible records are rejected.
+	FlagOnly bool
+	// QuarantineSize is the max number of the latest implausible records, the store keeps for inspection.
+	QuarantineSize int
+}
+
+// PlausibleStore is a Store, that checks the plausibility of the records, before writing them to the underlying store.
+type PlausibleStore struct {
+	Store
+
+	opts PlausibilityOptions
+
+	// shards split the latest plausible records of the vehicles by their VINs
+	shards [vinShards]plausibleShard
+
+	// mu guards the quarantine, that only the implausible records touch
+	mu         sync.Mutex
+	rejected   uint64
+	flagged    uint64
+	quarantine []QuarantinedRecord
+	// next is the index in quarantine the next record is put at, once quarantine is full
+	next int
+}
+
+type plausibleShard struct {
+	mu sync.Mutex
+	// last is the latest plausible record of every vehicle of the shard
+	last map[vehicle.VIN]Record
+}
+
+type QuarantinedRecord struct {
+	VIN      vehicle.VIN `json:"vin"`
+	Ts       time.Time   `json:"ts"`
+	Lat      float64     `json:"lat"`
+	Lon      float64     `json:"lon"`
+	Reason   string      `json:"reason"`
+	Rejected bool        `json:"rejected"`
+}
+
+type PlausibilityStats struct {
+	Rejected uint64 `json:"rejected"`
+	Flagged  uint64 `json:"flagged"`
+}
+
+func NewPlausibleStore(store Store, opts PlausibilityOptions) *PlausibleStore {
+	ps := &PlausibleStore{
+		Store: store,
+		opts:  opts,
+	}
+	for i := range ps.shards {
+		ps.shards[i].last = make(map[vehicle.VIN]Record)
+	}
+	return ps
+}
+
+func (store *PlausibleStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	rec := recordOf(t)
+
+	// NOTE: concurrent writes for the same vin may be checked against the same previous record;
+	// vehicles don't report that often for this to matter.
+	shard := &store.shards[shardOf(vin, vinShards)]
+	shard.mu.Lock()
+	prev, ok := shard.last[vin]
+	shard.mu.Unlock()
+
+	var checkErr error
+	if ok {
+		for _, check := range store.opts.Checks {
+			if checkErr = check.CheckPlausibility(vin, prev, rec); checkErr != nil {
+				break
+			}
+		}
+	}
+
+	if checkErr != nil {
+		store.addToQuarantine(vin, rec, checkErr)
+		if !store.opts.FlagOnly {
+			return fmt.Errorf("%w for vin %s: %v", ErrImplausible, vin, checkErr)
+		}
+	}
+
+	if err := store.Store.Write(ctx, vin, t); err != nil {
+		return err
+	}
+
+	if checkErr == nil {
+		shard.mu.Lock()
+		if last, ok := shard.last[vin]; !ok || !t.Ts.Before(last.Ts) {
+			shard.last[vin] = rec
+		}
+		shard.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (store *PlausibleStore) addToQuarantine(vin vehicle.VIN, rec Record, reason error) {
+	qrec := QuarantinedRecord{
+		VIN:      vin,
+		Ts:       rec.Ts,
+		Lat:      rec.Lat,
+		Lon:      rec.Lon,
+		Reason:   reason.Error(),
+		Rejected: !store.opts.FlagOnly,
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if qrec.Rejected {
+		store.rejected++
+	} else {
+		store.flagged++
+	}
+
+	size := store.opts.QuarantineSize
+	switch {
+	case size <= 0:
+	case len(store.quarantine) < size:
+		store.quarantine = append(store.quarantine, qrec)
+	default:
+		store.quarantine[store.next] = qrec
+		store.next = (store.next + 1) % size
+	}
+}
+
+// Stats returns the number of the implausible records, the store rejected or flagged.
+func (store *PlausibleStore) Stats() PlausibilityStats {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return PlausibilityStats{
+		Rejected: store.rejected,
+		Flagged:  store.flagged,
+	}
+}
+
+// Quarantine returns the latest implausible records, oldest first. If vin isn't empty, only the records
+// of this vehicle are returned.
+func (store *PlausibleStore) Quarantine(vin vehicle.VIN) []QuarantinedRecord {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	recs := make([]QuarantinedRecord, 0, len(store.quarantine))
+	for i := range store.quarantine {
+		qrec := store.quarantine[(store.next+i)%len(store.quarantine)]
+		if vin == "" || qrec.VIN == vin {
+			recs = append(recs, qrec)
+		}
+	}
+	return recs
+}
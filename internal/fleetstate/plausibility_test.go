@@ -0,0 +1,133 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestValidateLatLon(t *testing.T) {
+	cases := []struct {
+		lat, lon  float64
+		wantField string
+	}{
+		{52.518898, 13.401797, ""},
+		{-90, -180, ""},
+		{90, 180, ""},
+		{500, 0, "lat"},
+		{-90.1, 0, "lat"},
+		{math.NaN(), 0, "lat"},
+		{0, 180.1, "lon"},
+		{0, math.Inf(-1), "lon"},
+		{0, math.NaN(), "lon"},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			field, err := validateLatLon(tc.lat, tc.lon)
+			if (err != nil) != (tc.wantField != "") {
+				t.Fatalf("want field %q got err %v", tc.wantField, err)
+			}
+			if tc.wantField != field {
+				t.Fatalf("want field %q got %q", tc.wantField, field)
+			}
+		})
+	}
+}
+
+func TestPlausibleStore_Write(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewPlausibleStore(NewMemStore(), PlausibilityOptions{
+		Checks:         []PlausibilityCheck{MaxSpeedCheck(200)},
+		QuarantineSize: 2,
+	})
+
+	now := time.Now().UTC()
+
+	// Berlin, Cathedral
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	// Berlin, Fernsehturm, ~0.57 km in a minute
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Minute), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+	// Paris, a minute later
+	for i := 2; i <= 4; i++ {
+		err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Minute), Lat: 48.856613, Lon: 2.352222})
+		if !errors.Is(err, ErrImplausible) {
+			t.Fatalf("write teleport: want err %v got %v", ErrImplausible, err)
+		}
+	}
+
+	recs, _, err := store.Range(ctx, "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 52.518898, 52.520645)
+
+	if want, got := (PlausibilityStats{Rejected: 3}), store.Stats(); want != got {
+		t.Fatalf("stats: want %+v got %+v", want, got)
+	}
+
+	// quarantine keeps the latest records only
+	quarantine := store.Quarantine("THE1VIN")
+	if want, got := 2, len(quarantine); want != got {
+		t.Fatalf("quarantine: want %d records got %d", want, got)
+	}
+	if want, got := now.Add(3*time.Minute), quarantine[0].Ts; !want.Equal(got) {
+		t.Fatalf("quarantine: want ts %v got %v", want, got)
+	}
+	if !quarantine[0].Rejected || quarantine[0].Reason == "" {
+		t.Fatalf("quarantine: unexpected record %+v", quarantine[0])
+	}
+
+	if got := store.Quarantine("ANOTHER1VIN"); len(got) != 0 {
+		t.Fatalf("quarantine: want no records got %v", got)
+	}
+}
+
+func TestPlausibleStore_Write_FlagOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewPlausibleStore(NewMemStore(), PlausibilityOptions{
+		Checks:         []PlausibilityCheck{MaxSpeedCheck(200)},
+		FlagOnly:       true,
+		QuarantineSize: 10,
+	})
+
+	now := time.Now().UTC()
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	// Paris, a second later
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 48.856613, Lon: 2.352222}); err != nil {
+		t.Fatal(err)
+	}
+	// back to Berlin, it's checked against the last plausible record
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(2 * time.Second), Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, _, err := store.Range(ctx, "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 52.518898, 48.856613, 52.518898)
+
+	if want, got := (PlausibilityStats{Flagged: 1}), store.Stats(); want != got {
+		t.Fatalf("stats: want %+v got %+v", want, got)
+	}
+	if quarantine := store.Quarantine(""); len(quarantine) != 1 || quarantine[0].Rejected {
+		t.Fatalf("quarantine: unexpected records %+v", quarantine)
+	}
+}
@@ -0,0 +1,120 @@
+package fleetstate
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+// SpeedUnit is the unit of the speed in the streamed positions, a client selects with the "units" query parameter.
+type SpeedUnit string
+
+const (
+	SpeedKmh SpeedUnit = "kmh"
+	SpeedMps SpeedUnit = "mps"
+	SpeedMph SpeedUnit = "mph"
+)
+
+// fromKmh converts the speed in km/h to the unit.
+func (u SpeedUnit) fromKmh(v float64) float64 {
+	switch u {
+	case SpeedMps:
+		return v / 3.6
+	case SpeedMph:
+		return v / 1.609344
+	}
+	return v
+}
+
+// streamOptions are the options of a position stream, a client selects with the query parameters.
+type streamOptions struct {
+	// smooth reports whether the positions are smoothed
+	smooth bool
+	units  SpeedUnit
+}
+
+// parseStreamOptions parses the "smooth" and "units" query parameters of the stream.
+func parseStreamOptions(query url.Values) (streamOptions, error) {
+	smooth, err := parseSmoothing(query)
+	if err != nil {
+		return streamOptions{}, err
+	}
+
+	units := SpeedKmh
+	switch v := SpeedUnit(query.Get("units")); v {
+	case "":
+	case SpeedKmh, SpeedMps, SpeedMph:
+		units = v
+	default:
+		return streamOptions{}, unprocessable("units", fmt.Errorf("unknown speed units %q", v))
+	}
+
+	return streamOptions{
+		smooth: smooth,
+		units:  units,
+	}, nil
+}
+
+// positionTrack turns the records of a vehicle into the positions of the stream. Every stream keeps its own track
+// per vehicle, since the acceleration and the smoothed positions depend on the records, the stream has seen.
+type positionTrack struct {
+	distance geoutil.DistanceFunc
+	units    SpeedUnit
+	smoother *positionSmoother
+
+	// n is the number of the vehicle's records, the track has seen
+	n int
+	// last is the previous record of the vehicle
+	last Record
+	// lat, lon and speed are the vehicle's position, and its speed in km/h, the track returned for the last record;
+	// rawSpeed is the speed before smoothing
+	lat, lon float64
+	speed    float64
+	rawSpeed float64
+}
+
+func newPositionTrack(distance geoutil.DistanceFunc, opts streamOptions) *positionTrack {
+	return &positionTrack{
+		distance: distance,
+		units:    opts.units,
+		smoother: newPositionSmoother(opts.smooth),
+	}
+}
+
+// next returns the position for the vehicle's next record. The speed in the position of the first record is zero,
+// and the acceleration is zero, until the track knows the vehicle's previous speed.
+func (t *positionTrack) next(rec Record) PositionResponse {
+	rec0 := t.last
+	if t.n == 0 {
+		rec0 = rec
+	}
+
+	resp := t.smoother.smooth(rec, positionResponse(t.distance, rec0, rec))
+	if resp.Raw != nil && t.n > 0 {
+		// the distance the smoothed position moved
+		resp.Distance = t.distance(t.lat, t.lon, resp.Lat, resp.Lon) * 1000
+	}
+	if t.n > 1 && resp.Dt > 0 {
+		resp.Acceleration = acceleration(t.speed, resp.Speed, resp.Dt)
+		if resp.Raw != nil {
+			resp.Raw.Acceleration = acceleration(t.rawSpeed, resp.Raw.Speed, resp.Dt)
+		}
+	}
+
+	t.n++
+	t.last = rec
+	t.lat, t.lon, t.speed, t.rawSpeed = resp.Lat, resp.Lon, resp.Speed, resp.Speed
+	if resp.Raw != nil {
+		t.rawSpeed = resp.Raw.Speed
+		resp.Raw.Speed = t.units.fromKmh(resp.Raw.Speed)
+	}
+	resp.Speed = t.units.fromKmh(resp.Speed)
+	return resp
+}
+
+// acceleration returns the acceleration in m/s², of the vehicle, that changed its speed from v0 to v1 km/h
+// in dt seconds.
+func acceleration(v0, v1, dt float64) float64 {
+	return (v1 - v0) / 3.6 / dt
+}
@@ -0,0 +1,120 @@
+package fleetstate
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+func TestParseStreamOptions(t *testing.T) {
+	for query, want := range map[string]streamOptions{
+		"":                        {units: SpeedKmh},
+		"units=mps":               {units: SpeedMps},
+		"units=mph&smooth=kalman": {units: SpeedMph, smooth: true},
+		"units=kmh&smooth=none":   {units: SpeedKmh},
+	} {
+		values, _ := url.ParseQuery(query)
+		got, err := parseStreamOptions(values)
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if want != got {
+			t.Errorf("%q: want %+v got %+v", query, want, got)
+		}
+	}
+
+	for _, query := range []string{"units=knots", "smooth=median"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseStreamOptions(values); err == nil {
+			t.Errorf("%q: want error got nil", query)
+		}
+	}
+}
+
+func TestPositionTrack(t *testing.T) {
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+
+	// the vehicle drives to the north-east, 10 meters during the first second, then 20 meters
+	recs := []Record{{Ts: ts, Lat: lat, Lon: lon, Seq: 1}}
+	for i, d := range []float64{0.010, 0.020} {
+		lat, lon = geoutil.Destination(lat, lon, 45, d)
+		recs = append(recs, Record{Ts: ts.Add(time.Duration(i+1) * time.Second), Lat: lat, Lon: lon, Seq: uint64(i + 2)})
+	}
+
+	for _, tc := range []struct {
+		units SpeedUnit
+		// speeds are the vehicle's speed of 10 and 20 m/s in the units
+		speeds [2]float64
+	}{
+		{SpeedKmh, [2]float64{36, 72}},
+		{SpeedMps, [2]float64{10, 20}},
+		{SpeedMph, [2]float64{22.369, 44.739}},
+	} {
+		track := newPositionTrack(geoutil.Distance, streamOptions{units: tc.units})
+
+		resp := track.next(recs[0])
+		if resp.Seq != 1 || !resp.Ts.Equal(ts) || resp.Speed != 0 || resp.Dt != 0 || resp.Distance != 0 {
+			t.Fatalf("%s: first: want position with zero speed got %+v", tc.units, resp)
+		}
+
+		resp = track.next(recs[1])
+		if resp.Seq != 2 || resp.Dt != 1 {
+			t.Errorf("%s: want seq 2, dt 1 got %+v", tc.units, resp)
+		}
+		if math.Abs(resp.Distance-10) > 1e-2 || math.Abs(resp.Speed-tc.speeds[0]) > 1e-2 {
+			t.Errorf("%s: want distance 10, speed %v got %+v", tc.units, tc.speeds[0], resp)
+		}
+		if math.Abs(resp.Heading-45) > 1e-3 {
+			t.Errorf("%s: want heading 45 got %v", tc.units, resp.Heading)
+		}
+		// the vehicle's previous speed is unknown
+		if resp.Acceleration != 0 {
+			t.Errorf("%s: want zero acceleration got %v", tc.units, resp.Acceleration)
+		}
+
+		resp = track.next(recs[2])
+		if math.Abs(resp.Distance-20) > 1e-2 || math.Abs(resp.Speed-tc.speeds[1]) > 1e-2 {
+			t.Errorf("%s: want distance 20, speed %v got %+v", tc.units, tc.speeds[1], resp)
+		}
+		// the acceleration is in m/s², regardless of the units
+		if math.Abs(resp.Acceleration-10) > 1e-2 {
+			t.Errorf("%s: want acceleration 10 got %v", tc.units, resp.Acceleration)
+		}
+	}
+}
+
+func TestPositionTrack_Smooth(t *testing.T) {
+	track := newPositionTrack(geoutil.Distance, streamOptions{smooth: true, units: SpeedMps})
+
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+
+	var prev PositionResponse
+	for i := 0; i < 20; i++ {
+		resp := track.next(Record{Ts: ts.Add(time.Duration(i) * time.Second), Lat: lat, Lon: lon, Seq: uint64(i + 1)})
+		if resp.Raw == nil {
+			t.Fatal("raw: want raw position got nil")
+		}
+		if i > 0 {
+			// the distance is between the smoothed positions
+			if want, got := geoutil.Distance(prev.Lat, prev.Lon, resp.Lat, resp.Lon)*1000, resp.Distance; math.Abs(want-got) > 1e-9 {
+				t.Fatalf("distance: want %v got %v", want, got)
+			}
+			if want, got := 10.0, resp.Raw.Speed; math.Abs(want-got) > 1e-3 {
+				t.Fatalf("raw speed: want %v got %v", want, got)
+			}
+		}
+		prev = resp
+		lat, lon = geoutil.Destination(lat, lon, 90, 0.010)
+	}
+	if want, got := 10.0, prev.Speed; math.Abs(want-got) > 0.5 {
+		t.Errorf("speed: want %v got %v", want, got)
+	}
+	if want, got := 0.0, prev.Raw.Acceleration; math.Abs(want-got) > 1e-3 {
+		t.Errorf("raw acceleration: want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,53 @@
+package fleetstate
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+type QuarantineHandler struct {
+	store *PlausibleStore
+}
+
+func NewQuarantineHandler(store *PlausibleStore) *QuarantineHandler {
+	return &QuarantineHandler{
+		store: store,
+	}
+}
+
+func (h *QuarantineHandler) Handler() http.Handler {
+	return errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method == http.MethodGet {
+			return h.HandleQuarantine(w, r)
+		}
+		return ErrNotFound
+	})
+}
+
+type QuarantineResponse struct {
+	PlausibilityStats
+	Records []QuarantinedRecord `json:"records"`
+}
+
+// HandleQuarantine responds with the latest implausible records, the store rejected or flagged.
+// The optional query parameter "vin" selects the records of a single vehicle.
+func (h *QuarantineHandler) HandleQuarantine(w http.ResponseWriter, r *http.Request) error {
+	var vin vehicle.VIN
+	if v := r.URL.Query().Get("vin"); v != "" {
+		var err error
+		vin, err = vehicle.VINFromString(v)
+		if err != nil {
+			return badRequest("vin", err)
+		}
+	}
+
+	resp := QuarantineResponse{
+		PlausibilityStats: h.store.Stats(),
+		Records:           h.store.Quarantine(vin),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
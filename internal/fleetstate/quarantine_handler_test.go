@@ -0,0 +1,52 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestQuarantineHandler_HandleQuarantine(t *testing.T) {
+	store := NewPlausibleStore(NewMemStore(), PlausibilityOptions{
+		Checks:         []PlausibilityCheck{MaxSpeedCheck(200)},
+		QuarantineSize: 10,
+	})
+	handler := NewQuarantineHandler(store)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for _, vin := range []string{"THE1VIN", "THE2VIN"} {
+		if err := store.Write(ctx, vehicle.VIN(vin), vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Write(ctx, vehicle.VIN(vin), vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 48.856613, Lon: 2.352222}); err == nil {
+			t.Fatal("write teleport: want err got nil")
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/quarantine?vin=the2vin", nil)
+	w := httptest.NewRecorder()
+
+	if err := handler.HandleQuarantine(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp QuarantineResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := uint64(2), resp.Rejected; want != got {
+		t.Fatalf("rejected: want %d got %d", want, got)
+	}
+	if want, got := 1, len(resp.Records); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
+	}
+	if want, got := "THE2VIN", string(resp.Records[0].VIN); want != got {
+		t.Fatalf("vin: want %s got %s", want, got)
+	}
+}
@@ -0,0 +1,365 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// ShardedStore is a Store, that splits the vehicles between the independent shards by the hash of their VINs.
+// The writes and the reads of the vehicles in different shards don't contend for the shards' locks.
+// The queries over all vehicles, e.g. Vehicles or Nearby, query every shard and merge the results.
+type ShardedStore struct {
+	shards []Store
+}
+
+var _ Store = (*ShardedStore)(nil)
+
+// NewShardedStore returns the store over the shards. A vehicle always goes to the same shard,
+// given the number of the shards, so the shards, that keep the records on the disk, must be reopened
+// in the same order and number; see OpenShardedFileStore.
+func NewShardedStore(shards ...Store) *ShardedStore {
+	if len(shards) == 0 {
+		panic("fleetstate: sharded store needs at least one shard")
+	}
+	return &ShardedStore{
+		shards: shards,
+	}
+}
+
+// NewShardedMemStore returns the store over n in-memory shards, every one configured with the options.
+func NewShardedMemStore(n int, opts MemStoreOptions) *ShardedStore {
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]Store, n)
+	for i := range shards {
+		shards[i] = NewMemStoreWithOptions(opts)
+	}
+	return NewShardedStore(shards...)
+}
+
+var ErrShardsMismatch = errors.New("shards mismatch")
+
+// shardsManifestName is the name of the file in the store's directory, that records the number of the shards.
+const shardsManifestName = "shards.json"
+
+type shardsManifest struct {
+	Shards int `json:"shards"`
+}
+
+// OpenShardedFileStore opens the store in the directory dir over n file shards, every one configured with the options.
+// A single shard keeps its log in dir; n shards keep their logs in the sub-directories of dir. The vehicles' shards
+// depend on the number of the shards, so the number is recorded in dir, and the store, that was opened with
+// a different number, fails with ErrShardsMismatch. Caller must call Close after the store is no longer used.
+func OpenShardedFileStore(dir string, n int, opts FileStoreOptions) (*ShardedStore, error) {
+	if n < 1 {
+		n = 1
+	}
+
+	m, err := readShardsManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case m.Shards == 0:
+		if err := writeShardsManifest(dir, shardsManifest{Shards: n}); err != nil {
+			return nil, err
+		}
+	case m.Shards != n:
+		return nil, fmt.Errorf("%w: store in %s has %d shards, not %d", ErrShardsMismatch, dir, m.Shards, n)
+	}
+
+	if n == 1 {
+		shard, err := OpenFileStore(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewShardedStore(shard), nil
+	}
+
+	shards := make([]Store, 0, n)
+	for i := 0; i < n; i++ {
+		shard, err := OpenFileStore(shardDir(dir, i), opts)
+		if err != nil {
+			for _, shard := range shards {
+				shard.(*FileStore).Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return NewShardedStore(shards...), nil
+}
+
+func shardDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%03d", i))
+}
+
+// readShardsManifest reads the manifest of the store in dir. The directory, the store was opened in before
+// the manifest was introduced, is recognized by its layout. The new store's manifest is zero.
+func readShardsManifest(dir string) (m shardsManifest, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, shardsManifestName))
+	if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil || m.Shards < 1 {
+			return m, fmt.Errorf("bad shards manifest in %s: %s", dir, data)
+		}
+		return m, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return m, err
+	}
+
+	// a single shard keeps its log in dir, many shards keep their logs in the sub-directories
+	segments, err := listWALSegments(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if len(segments) > 0 {
+		m.Shards = 1
+	}
+	for {
+		if _, err := os.Stat(shardDir(dir, m.Shards)); err != nil {
+			break
+		}
+		m.Shards++
+	}
+	return m, nil
+}
+
+// writeShardsManifest writes the manifest to a temporary file first, so a crash doesn't leave it half-written.
+func writeShardsManifest(dir string, m shardsManifest) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, shardsManifestName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (store *ShardedStore) shard(vin vehicle.VIN) Store {
+	if len(store.shards) == 1 {
+		return store.shards[0]
+	}
+	return store.shards[shardOf(vin, len(store.shards))]
+}
+
+// vinShards is the number of the shards, the stores, that wrap a Store, split the state of the vehicles between,
+// so the writes of different vehicles rarely contend for the same lock.
+const vinShards = 64
+
+// shardOf returns the index of the vehicle's shard out of n shards.
+func shardOf(vin vehicle.VIN, n int) int {
+	h := fnv.New32a()
+	io.WriteString(h, string(vin))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (store *ShardedStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	return store.shard(vin).Write(ctx, vin, t)
+}
+
+func (store *ShardedStore) Reader(ctx context.Context, vin vehicle.VIN) (Reader, error) {
+	return store.shard(vin).Reader(ctx, vin)
+}
+
+func (store *ShardedStore) ReaderFromCursor(ctx context.Context, vin vehicle.VIN, cursor string) (Reader, error) {
+	return store.shard(vin).ReaderFromCursor(ctx, vin, cursor)
+}
+
+func (store *ShardedStore) Range(ctx context.Context, vin vehicle.VIN, q RangeQuery) ([]Record, string, error) {
+	return store.shard(vin).Range(ctx, vin, q)
+}
+
+func (store *ShardedStore) Latest(ctx context.Context, vin vehicle.VIN) (Snapshot, error) {
+	return store.shard(vin).Latest(ctx, vin)
+}
+
+func (store *ShardedStore) Usage(ctx context.Context, vin vehicle.VIN, q UsageQuery) (Usage, error) {
+	return store.shard(vin).Usage(ctx, vin, q)
+}
+
+// Vehicles returns the page of the vehicles of all shards, in the order of their VINs. Every shard returns
+// up to the query's limit of its vehicles, starting from the cursor; the page is the first of them.
+func (store *ShardedStore) Vehicles(ctx context.Context, q VehiclesQuery) ([]Snapshot, string, error) {
+	var (
+		snaps []Snapshot
+		next  string
+	)
+	for _, shard := range store.shards {
+		s, n, err := shard.Vehicles(ctx, q)
+		if err != nil {
+			return nil, "", err
+		}
+		snaps = append(snaps, s...)
+		// the shard's vehicles after its page aren't in the merged results, the page must end before them
+		if n != "" && (next == "" || n < next) {
+			next = n
+		}
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].VIN < snaps[j].VIN
+	})
+	if q.Limit > 0 && len(snaps) > q.Limit {
+		if n := string(snaps[q.Limit].VIN); next == "" || n < next {
+			next = n
+		}
+		snaps = snaps[:q.Limit]
+	}
+
+	return snaps, next, nil
+}
+
+func (store *ShardedStore) Nearby(ctx context.Context, lat, lon, radius float64, limit int) ([]VehicleDistance, error) {
+	var res []VehicleDistance
+	for _, shard := range store.shards {
+		vds, err := shard.Nearby(ctx, lat, lon, radius, limit)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, vds...)
+	}
+	return mergeVehicleDistances(res, limit), nil
+}
+
+func (store *ShardedStore) Within(ctx context.Context, bbox geoutil.BBox, limit int) ([]VehicleDistance, error) {
+	var res []VehicleDistance
+	for _, shard := range store.shards {
+		vds, err := shard.Within(ctx, bbox, limit)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, vds...)
+	}
+	return mergeVehicleDistances(res, limit), nil
+}
+
+// mergeVehicleDistances sorts the vehicles of all shards by the distance, like MemStore does, and keeps
+// up to limit of them.
+func mergeVehicleDistances(res []VehicleDistance, limit int) []VehicleDistance {
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Distance != res[j].Distance {
+			return res[i].Distance < res[j].Distance
+		}
+		return res[i].VIN < res[j].VIN
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// Subscribe returns the subscription, that reads the records of all shards. The records of a vehicle are read
+// in the order they were written, since the vehicle is in a single shard.
+func (store *ShardedStore) Subscribe(ctx context.Context, vinPrefix string) (Subscription, error) {
+	if len(store.shards) == 1 {
+		return store.shards[0].Subscribe(ctx, vinPrefix)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	subs := make([]Subscription, len(store.shards))
+	for i, shard := range store.shards {
+		sub, err := shard.Subscribe(ctx, vinPrefix)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		subs[i] = sub
+	}
+
+	s := &shardedSubscription{
+		updates: make(chan Update),
+		errs:    make(chan error, len(subs)),
+		done:    ctx.Done(),
+		cancel:  cancel,
+	}
+	for _, sub := range subs {
+		go s.forward(sub)
+	}
+
+	return s, nil
+}
+
+// shardedSubscription merges the subscriptions of the shards. Every shard's subscription is read by its own
+// goroutine, that forwards the updates, until the subscription is closed. If a shard's subscription fails,
+// the others are closed too.
+type shardedSubscription struct {
+	updates chan Update
+	errs    chan error
+	done    <-chan struct{}
+	// cancel closes the subscriptions of all shards
+	cancel context.CancelFunc
+}
+
+func (s *shardedSubscription) forward(sub Subscription) {
+	for {
+		upd, err := sub.Read()
+		if err != nil {
+			s.errs <- err
+			s.cancel()
+			return
+		}
+		select {
+		case s.updates <- upd:
+		case <-s.done:
+			// the subscription is closed, the shard's subscription returns the error on the next read
+		}
+	}
+}
+
+func (s *shardedSubscription) Read() (Update, error) {
+	select {
+	case upd := <-s.updates:
+		return upd, nil
+	case err := <-s.errs:
+		return Update{}, err
+	case <-s.done:
+		return Update{}, ErrReaderClosed
+	}
+}
+
+// Expire drops the expired records of the shards, that support the retention policy. See MemStore.Expire.
+func (store *ShardedStore) Expire(now time.Time) int {
+	var n int
+	for _, shard := range store.shards {
+		if s, ok := shard.(interface{ Expire(now time.Time) int }); ok {
+			n += s.Expire(now)
+		}
+	}
+	return n
+}
+
+// Close closes the shards, that keep the records on the disk. It returns the first error.
+func (store *ShardedStore) Close() error {
+	var firstErr error
+	for _, shard := range store.shards {
+		if c, ok := shard.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,427 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func testVIN(i int) vehicle.VIN {
+	return vehicle.VIN(fmt.Sprintf("VIN%06d", i))
+}
+
+func TestShardedStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewShardedMemStore(4, MemStoreOptions{})
+
+	now := time.Now().UTC()
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 2; j++ {
+			ts := now.Add(time.Duration(j) * time.Second)
+			if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(j)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// every shard has its part of the vehicles
+	for i, shard := range store.shards {
+		snaps, _, err := shard.Vehicles(ctx, VehiclesQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snaps) == 0 || len(snaps) == 100 {
+			t.Errorf("shard %d: unexpected number of vehicles %d", i, len(snaps))
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		snap, err := store.Latest(ctx, testVIN(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap.Latest.Lat != float64(i) || snap.Latest.Lon != 1 {
+			t.Fatalf("latest %s: unexpected record %+v", testVIN(i), snap.Latest)
+		}
+
+		recs, _, err := store.Range(ctx, testVIN(i), RangeQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRecordsLat(t, recs, float64(i), float64(i))
+	}
+
+	reader, err := store.Reader(ctx, testVIN(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(time.Second), 42, 1)
+
+	if _, err := store.Latest(ctx, "UNKNOWN1VIN"); !errors.Is(err, ErrUnknownVIN) {
+		t.Fatalf("latest: want err %v got %v", ErrUnknownVIN, err)
+	}
+}
+
+func TestShardedStore_Vehicles(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewShardedMemStore(4, MemStoreOptions{})
+
+	var want []vehicle.VIN
+	for i := 0; i < 50; i++ {
+		if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, testVIN(i))
+	}
+
+	for _, limit := range []int{0, 1, 3, 7, 50, 100} {
+		var got []vehicle.VIN
+		q := VehiclesQuery{Limit: limit}
+		for {
+			snaps, next, err := store.Vehicles(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if limit > 0 && len(snaps) > limit {
+				t.Fatalf("limit %d: page of %d vehicles", limit, len(snaps))
+			}
+			for _, snap := range snaps {
+				got = append(got, snap.VIN)
+			}
+			if next == "" {
+				break
+			}
+			q.Cursor = next
+		}
+
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Fatalf("limit %d: want %v got %v", limit, want, got)
+		}
+	}
+}
+
+func TestShardedStore_Nearby(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewShardedMemStore(4, MemStoreOptions{})
+
+	// the vehicles to the north of Berlin, Cathedral, every one further than the previous
+	for i := 0; i < 20; i++ {
+		tm := vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 52.518898 + float64(i)*0.001, Lon: 13.401797}
+		if err := store.Write(ctx, testVIN(i), tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Nearby(ctx, 52.518898, 13.401797, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 5, len(res); want != got {
+		t.Fatalf("nearby: want %d got %d", want, got)
+	}
+	for i, vd := range res {
+		if want := testVIN(i); want != vd.VIN {
+			t.Fatalf("nearby %d: want %s got %s", i, want, vd.VIN)
+		}
+	}
+}
+
+func TestShardedStore_Subscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewShardedMemStore(4, MemStoreOptions{})
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	sub, err := store.Subscribe(subCtx, "VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := store.Write(ctx, "OTHER1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var got []string
+	for i := 0; i < 10; i++ {
+		upd, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(upd.VIN))
+	}
+	sort.Strings(got)
+	for i, vin := range got {
+		if want := string(testVIN(i)); want != vin {
+			t.Fatalf("update %d: want %s got %s", i, want, vin)
+		}
+	}
+
+	subCancel()
+	if _, err := sub.Read(); !errors.Is(err, ErrReaderClosed) {
+		t.Fatalf("read closed: want err %v got %v", ErrReaderClosed, err)
+	}
+}
+
+func TestShardedStore_Expire(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewShardedMemStore(4, MemStoreOptions{MaxAge: time.Hour})
+
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want, got := 10, store.Expire(now.Add(2*time.Hour)); want != got {
+		t.Fatalf("expire: want %d got %d", want, got)
+	}
+}
+
+func TestShardedStore_FileStores(t *testing.T) {
+	ctx := context.Background()
+	dirs := []string{t.TempDir(), t.TempDir()}
+
+	open := func() *ShardedStore {
+		var shards []Store
+		for _, dir := range dirs {
+			shard, err := OpenFileStore(dir, FileStoreOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			shards = append(shards, shard)
+		}
+		return NewShardedStore(shards...)
+	}
+
+	store := open()
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: now, Lat: float64(i), Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vehicles are in the same shards after the store is reopened
+	store = open()
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		snap, err := store.Latest(ctx, testVIN(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := float64(i), snap.Latest.Lat; want != got {
+			t.Fatalf("latest %s: want lat %v got %v", testVIN(i), want, got)
+		}
+	}
+}
+
+func TestOpenShardedFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := OpenShardedFileStore(dir, 4, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: now, Lat: float64(i), Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the vehicles would be looked up in the wrong shards
+	for _, n := range []int{1, 2, 8} {
+		if _, err := OpenShardedFileStore(dir, n, FileStoreOptions{}); !errors.Is(err, ErrShardsMismatch) {
+			t.Fatalf("open %d shards: want %v got %v", n, ErrShardsMismatch, err)
+		}
+	}
+
+	store, err = OpenShardedFileStore(dir, 4, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		snap, err := store.Latest(ctx, testVIN(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := float64(i), snap.Latest.Lat; want != got {
+			t.Fatalf("latest %s: want lat %v got %v", testVIN(i), want, got)
+		}
+	}
+}
+
+func TestOpenShardedFileStore_NoManifest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// the store, that was opened before the manifest was introduced
+	fileStore, err := OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStore.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenShardedFileStore(dir, 4, FileStoreOptions{}); !errors.Is(err, ErrShardsMismatch) {
+		t.Fatalf("open 4 shards: want %v got %v", ErrShardsMismatch, err)
+	}
+
+	store, err := OpenShardedFileStore(dir, 1, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.Latest(ctx, "THE1VIN"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedStore_Concurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewShardedMemStore(8, MemStoreOptions{MaxRecords: 10, MaxLateness: time.Minute})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 500; i++ {
+				vin := testVIN(rnd.Intn(100))
+				if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, _, err := store.Range(ctx, vin, RangeQuery{Limit: 5}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, _, err := store.Vehicles(ctx, VehiclesQuery{Limit: 10}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	snaps, _, err := store.Vehicles(ctx, VehiclesQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 100, len(snaps); want != got {
+		t.Fatalf("vehicles: want %d got %d", want, got)
+	}
+}
+
+// BenchmarkShardedStore_Parallel writes to, and reads from, the random vehicles of the fleet of 100k vehicles
+// in parallel; every fourth operation is a read. The "wrapped" stores are wrapped, like the server wraps them,
+// with the plausibility checks, the geofences and the trips.
+func BenchmarkShardedStore_Parallel(b *testing.B) {
+	const vehicles = 100000
+
+	vins := make([]vehicle.VIN, vehicles)
+	for i := range vins {
+		vins[i] = testVIN(i)
+	}
+
+	wrap := func(store Store) Store {
+		ps := NewPlausibleStore(store, PlausibilityOptions{
+			Checks:         []PlausibilityCheck{MaxSpeedCheck(250)},
+			QuarantineSize: 1000,
+		})
+		gs := NewGeofenceStore(ps, GeofenceOptions{})
+		gs.CreateGeofence(Geofence{Name: "depot", Circle: &GeofenceCircle{Lat: 1, Lon: 1, Radius: 100}})
+		return NewTripStore(gs, TripOptions{})
+	}
+
+	for _, bc := range []struct {
+		name   string
+		shards int
+		wrap   func(Store) Store
+	}{
+		{"shards=1", 1, nil},
+		{"shards=16", 16, nil},
+		{"shards=64", 64, nil},
+		{"shards=1/wrapped", 1, wrap},
+		{"shards=16/wrapped", 16, wrap},
+		{"shards=64/wrapped", 64, wrap},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			var store Store = NewShardedMemStore(bc.shards, MemStoreOptions{MaxRecords: 16, MaxLateness: time.Hour, FeedSize: 1})
+			if bc.wrap != nil {
+				store = bc.wrap(store)
+			}
+
+			now := time.Now().UTC()
+			for _, vin := range vins {
+				if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for i := 0; pb.Next(); i++ {
+					vin := vins[rnd.Intn(len(vins))]
+					if i%4 == 3 {
+						if _, err := store.Latest(ctx, vin); err != nil {
+							b.Error(err)
+							return
+						}
+						continue
+					}
+					if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package fleetstate
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+// Smoothing of the streamed positions, a client selects with the "smooth" query parameter.
+const (
+	// SmoothNone streams the positions, as the vehicles report them.
+	SmoothNone = "none"
+	// SmoothKalman streams the positions and the speed, smoothed with a Kalman filter.
+	SmoothKalman = "kalman"
+)
+
+const (
+	// smoothAccuracy is the accuracy in meters of the vehicles' positions, the filter assumes
+	smoothAccuracy = 10
+	// smoothAcceleration is the standard deviation in m/s² of the vehicles' acceleration, the filter assumes
+	smoothAcceleration = 1
+)
+
+// parseSmoothing parses the stream's "smooth" query parameter. It reports whether the positions are smoothed.
+func parseSmoothing(query url.Values) (bool, error) {
+	switch v := query.Get("smooth"); v {
+	case "", SmoothNone:
+		return false, nil
+	case SmoothKalman:
+		return true, nil
+	default:
+		return false, unprocessable("smooth", fmt.Errorf("unknown smoothing %q", v))
+	}
+}
+
+// positionSmoother smooths the positions of a vehicle in the stream. Every stream keeps its own smoother
+// per vehicle, so the filter's state doesn't depend on the other clients. Nil smoother streams the raw positions.
+type positionSmoother struct {
+	filter *geoutil.KalmanFilter
+}
+
+// newPositionSmoother returns the smoother, or nil if the positions aren't smoothed.
+func newPositionSmoother(smooth bool) *positionSmoother {
+	if !smooth {
+		return nil
+	}
+	return &positionSmoother{
+		filter: geoutil.NewKalmanFilter(smoothAccuracy, smoothAcceleration),
+	}
+}
+
+// smooth adds the vehicle's record to the filter, and returns the smoothed position, with the raw position
+// resp kept for debugging. The stream must pass every record of the vehicle, including the ones it doesn't send.
+func (s *positionSmoother) smooth(rec Record, resp PositionResponse) PositionResponse {
+	if s == nil {
+		return resp
+	}
+	state := s.filter.Update(rec.Ts, rec.Lat, rec.Lon)
+	raw := resp
+	// the optional fields are only in the smoothed position
+	raw.TelemetryFields = nil
+	resp.Lat, resp.Lon = state.Lat, state.Lon
+	resp.Speed = state.Speed
+	resp.Heading = state.Heading
+	resp.Raw = &raw
+	return resp
+}
@@ -0,0 +1,86 @@
+package fleetstate
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+func TestParseSmoothing(t *testing.T) {
+	for query, want := range map[string]bool{
+		"":              false,
+		"smooth=none":   false,
+		"smooth=kalman": true,
+	} {
+		values, _ := url.ParseQuery(query)
+		got, err := parseSmoothing(values)
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if want != got {
+			t.Errorf("%q: want %v got %v", query, want, got)
+		}
+	}
+
+	values, _ := url.ParseQuery("smooth=median")
+	if _, err := parseSmoothing(values); err == nil {
+		t.Fatal("unknown smoothing: want error got nil")
+	}
+}
+
+func TestPositionSmoother(t *testing.T) {
+	distance := geoutil.Distance
+
+	// nil smoother streams the raw positions
+	var smoother *positionSmoother
+	raw := PositionResponse{Lat: 1, Lon: 2, Speed: 3}
+	if got := smoother.smooth(Record{}, raw); got != raw {
+		t.Fatalf("nil smoother: want %+v got %+v", raw, got)
+	}
+
+	smoother = newPositionSmoother(true)
+
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+
+	// the vehicle drives to the east at 36 km/h, and its every other position is 10 meters off to the north
+	var (
+		rec0     Record
+		maxRaw   float64
+		maxSpeed float64
+	)
+	for i := 0; i < 60; i++ {
+		ts = ts.Add(time.Second)
+		lat, lon = geoutil.Destination(lat, lon, 90, 0.010)
+		rec1 := Record{Ts: ts, Lat: lat, Lon: lon}
+		if i%2 == 1 {
+			rec1.Lat, rec1.Lon = geoutil.Destination(lat, lon, 0, 0.010)
+		}
+		if i == 0 {
+			rec0 = rec1
+		}
+
+		resp := smoother.smooth(rec1, positionResponse(distance, rec0, rec1))
+		rec0 = rec1
+
+		if resp.Raw == nil || resp.Raw.Lat != rec1.Lat || resp.Raw.Lon != rec1.Lon {
+			t.Fatalf("raw: want the position of the record got %+v", resp.Raw)
+		}
+		if i < 10 {
+			continue
+		}
+		maxRaw = math.Max(maxRaw, resp.Raw.Speed)
+		maxSpeed = math.Max(maxSpeed, resp.Speed)
+	}
+
+	// the jitter makes the raw speed spike to ~50 km/h
+	if maxRaw < 50 {
+		t.Fatalf("raw speed: want spikes above 50 got %v", maxRaw)
+	}
+	if maxSpeed > 40 {
+		t.Errorf("speed: want below 40 got %v", maxSpeed)
+	}
+}
@@ -0,0 +1,137 @@
+package fleetstate
+
+import (
+	"math"
+	"sync"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// defaultGridCellSize is the size of a cell of the spatial index in degrees, ~1.1 km of latitude.
+const defaultGridCellSize = 0.01
+
+// VehicleDistance is the snapshot of the vehicle, found by a spatial query, and the vehicle's distance
+// in km from the query's point.
+type VehicleDistance struct {
+	Snapshot
+	Distance float64
+}
+
+// gridIndex is the spatial index of the vehicles' latest positions. The index splits the map into
+// the cells of equal size in degrees; a query only scans the cells, that overlap the query's box.
+type gridIndex struct {
+	cellSize float64
+
+	mu       sync.RWMutex
+	cells    map[gridCell]map[vehicle.VIN]struct{}
+	vehicles map[vehicle.VIN]gridCell
+}
+
+type gridCell struct {
+	x, y int32
+}
+
+func newGridIndex(cellSize float64) *gridIndex {
+	if cellSize <= 0 {
+		cellSize = defaultGridCellSize
+	}
+	return &gridIndex{
+		cellSize: cellSize,
+		cells:    make(map[gridCell]map[vehicle.VIN]struct{}),
+		vehicles: make(map[vehicle.VIN]gridCell),
+	}
+}
+
+func (idx *gridIndex) cellX(lon float64) int32 {
+	return int32(math.Floor((lon + 180) / idx.cellSize))
+}
+
+func (idx *gridIndex) cellY(lat float64) int32 {
+	return int32(math.Floor((lat + 90) / idx.cellSize))
+}
+
+// update moves the vehicle to the cell of its new position.
+func (idx *gridIndex) update(vin vehicle.VIN, lat, lon float64) {
+	cell := gridCell{idx.cellX(lon), idx.cellY(lat)}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	prev, ok := idx.vehicles[vin]
+	if ok && prev == cell {
+		return
+	}
+	if ok {
+		vins := idx.cells[prev]
+		delete(vins, vin)
+		if len(vins) == 0 {
+			delete(idx.cells, prev)
+		}
+	}
+
+	vins := idx.cells[cell]
+	if vins == nil {
+		vins = make(map[vehicle.VIN]struct{})
+		idx.cells[cell] = vins
+	}
+	vins[vin] = struct{}{}
+	idx.vehicles[vin] = cell
+}
+
+// search returns the vehicles from the cells, that overlap the box. The caller filters the vehicles
+// by their exact positions.
+func (idx *gridIndex) search(bbox geoutil.BBox) []vehicle.VIN {
+	var xranges [][2]int32
+	if bbox.MinLon > bbox.MaxLon {
+		// the box crosses the antimeridian
+		xranges = [][2]int32{
+			{idx.cellX(bbox.MinLon), idx.cellX(180)},
+			{idx.cellX(-180), idx.cellX(bbox.MaxLon)},
+		}
+	} else {
+		xranges = [][2]int32{
+			{idx.cellX(bbox.MinLon), idx.cellX(bbox.MaxLon)},
+		}
+	}
+	y0, y1 := idx.cellY(bbox.MinLat), idx.cellY(bbox.MaxLat)
+
+	var ncells int64
+	for _, xr := range xranges {
+		ncells += int64(xr[1]-xr[0]+1) * int64(y1-y0+1)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var vins []vehicle.VIN
+
+	// for a large box, scanning the non-empty cells is cheaper, than probing every cell of the box
+	if ncells > int64(len(idx.cells)) {
+		for cell, cellVINs := range idx.cells {
+			if cell.y < y0 || cell.y > y1 {
+				continue
+			}
+			for _, xr := range xranges {
+				if cell.x >= xr[0] && cell.x <= xr[1] {
+					for vin := range cellVINs {
+						vins = append(vins, vin)
+					}
+					break
+				}
+			}
+		}
+		return vins
+	}
+
+	for _, xr := range xranges {
+		for x := xr[0]; x <= xr[1]; x++ {
+			for y := y0; y <= y1; y++ {
+				for vin := range idx.cells[gridCell{x, y}] {
+					vins = append(vins, vin)
+				}
+			}
+		}
+	}
+	return vins
+}
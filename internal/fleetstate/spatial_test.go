@@ -0,0 +1,139 @@
+package fleetstate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func testVehicleDistanceVINs(t *testing.T, res []VehicleDistance, wantVINs ...vehicle.VIN) {
+	t.Helper()
+
+	vins := make([]vehicle.VIN, 0, len(res))
+	for _, v := range res {
+		vins = append(vins, v.VIN)
+	}
+	if len(wantVINs) == 0 {
+		wantVINs = []vehicle.VIN{}
+	}
+	if !reflect.DeepEqual(wantVINs, vins) {
+		t.Fatalf("vins: want %v, got %v", wantVINs, vins)
+	}
+}
+
+func testWriteVehicles(t *testing.T, store Store, positions map[vehicle.VIN][2]float64) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	for vin, pos := range positions {
+		if err := store.Write(context.Background(), vin, vehicle.Telemetry{Ts: now, Lat: pos[0], Lon: pos[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemStore_Nearby(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	testWriteVehicles(t, store, map[vehicle.VIN][2]float64{
+		"CATHEDRAL":   {52.518898, 13.401797},
+		"FERNSEHTURM": {52.520645, 13.409779},
+		"GATE":        {52.516275, 13.377704},
+		"POTSDAM":     {52.390569, 13.064473},
+		"FIJI":        {-17.713371, 178.065032},
+		"SAMOA":       {-13.759029, -172.104629},
+	})
+
+	res, err := store.Nearby(ctx, 52.518898, 13.401797, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVehicleDistanceVINs(t, res, "CATHEDRAL", "FERNSEHTURM")
+	if want, got := 0.5739420180673658, res[1].Distance; want != got {
+		t.Errorf("distance: want %v, got %v", want, got)
+	}
+
+	res, err = store.Nearby(ctx, 52.518898, 13.401797, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVehicleDistanceVINs(t, res, "CATHEDRAL", "FERNSEHTURM")
+
+	res, err = store.Nearby(ctx, 52.518898, 13.401797, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVehicleDistanceVINs(t, res, "CATHEDRAL", "FERNSEHTURM", "GATE", "POTSDAM")
+
+	// the circle crosses the antimeridian
+	res, err = store.Nearby(ctx, -15, 180, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVehicleDistanceVINs(t, res, "FIJI", "SAMOA")
+
+	// the vehicle, that moved away, isn't found at its old position
+	testWriteVehicles(t, store, map[vehicle.VIN][2]float64{
+		"FERNSEHTURM": {52.390569, 13.064473},
+	})
+	res, err = store.Nearby(ctx, 52.518898, 13.401797, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVehicleDistanceVINs(t, res, "CATHEDRAL")
+}
+
+func TestMemStore_Within(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	testWriteVehicles(t, store, map[vehicle.VIN][2]float64{
+		"CATHEDRAL":   {52.518898, 13.401797},
+		"FERNSEHTURM": {52.520645, 13.409779},
+		"POTSDAM":     {52.390569, 13.064473},
+		"FIJI":        {-17.713371, 178.065032},
+		"SAMOA":       {-13.759029, -172.104629},
+	})
+
+	cases := []struct {
+		name     string
+		bbox     geoutil.BBox
+		wantVINs []vehicle.VIN
+	}{
+		{
+			"berlin",
+			geoutil.BBox{MinLat: 52.5, MinLon: 13.3, MaxLat: 52.6, MaxLon: 13.5},
+			[]vehicle.VIN{"FERNSEHTURM", "CATHEDRAL"},
+		},
+		{
+			"antimeridian",
+			geoutil.BBox{MinLat: -20, MinLon: 170, MaxLat: -10, MaxLon: -170},
+			[]vehicle.VIN{"FIJI", "SAMOA"},
+		},
+		{
+			"world",
+			geoutil.BBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180},
+			[]vehicle.VIN{"POTSDAM", "CATHEDRAL", "FERNSEHTURM", "FIJI", "SAMOA"},
+		},
+		{
+			"empty",
+			geoutil.BBox{MinLat: 0, MinLon: 0, MaxLat: 1, MaxLon: 1},
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := store.Within(ctx, tc.bbox, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testVehicleDistanceVINs(t, res, tc.wantVINs...)
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const (
+	defaultStatusEventsSize = 1024
+
+	// statusLoadPageSize is the size of the pages, the monitor loads the known vehicles with
+	statusLoadPageSize = 1000
+)
+
+type VehicleStatus string
+
+const (
+	StatusOnline  VehicleStatus = "online"
+	StatusOffline VehicleStatus = "offline"
+)
+
+// StatusEvent is the vehicle going online or offline.
+type StatusEvent struct {
+	VIN    vehicle.VIN   `json:"vin"`
+	Status VehicleStatus `json:"status"`
+	// Ts is the time the monitor detected the change.
+	Ts time.Time `json:"ts"`
+	// LastSeen is the timestamp of the vehicle's latest record.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type StatusOptions struct {
+	// OfflineAfter is how long after its latest record a vehicle is offline.
+	OfflineAfter time.Duration
+	// CheckInterval is how often the monitor looks for the vehicles, that went offline.
+	// Zero value means a tenth of OfflineAfter.
+	CheckInterval time.Duration
+	// EventsSize is the max number of the latest events, the monitor keeps for the subscriptions.
+	// Zero value means the default size.
+	EventsSize int
+}
+
+// StatusMonitor tracks the vehicles, that stopped reporting. A vehicle is online, while its latest record is
+// more recent, than the monitor's OfflineAfter, and offline after that. The monitor only knows the vehicles,
+// after Run started.
+type StatusMonitor struct {
+	store         Store
+	offlineAfter  time.Duration
+	checkInterval time.Duration
+
+	mu sync.Mutex
+	// cond notifies the subscriptions about new events
+	cond     sync.Cond
+	vehicles map[vehicle.VIN]*vehicleStatus
+	// events is the ring buffer of the latest events
+	events []StatusEvent
+	// seq is the number of the events ever detected
+	seq uint64
+}
+
+type vehicleStatus struct {
+	status   VehicleStatus
+	lastSeen time.Time
+}
+
+func NewStatusMonitor(store Store, opts StatusOptions) *StatusMonitor {
+	checkInterval := opts.CheckInterval
+	if checkInterval <= 0 {
+		checkInterval = opts.OfflineAfter / 10
+	}
+	size := opts.EventsSize
+	if size <= 0 {
+		size = defaultStatusEventsSize
+	}
+	m := &StatusMonitor{
+		store:         store,
+		offlineAfter:  opts.OfflineAfter,
+		checkInterval: checkInterval,
+		vehicles:      make(map[vehicle.VIN]*vehicleStatus),
+		events:        make([]StatusEvent, size),
+	}
+	m.cond.L = &m.mu
+	return m
+}
+
+// Run loads the vehicles, known to the store, and follows the records, written to the store, detecting
+// the vehicles going online and offline, until the context is canceled. The status of the loaded vehicles
+// is set without the events.
+func (m *StatusMonitor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe before loading the vehicles, so the records written in between aren't missed
+	sub, err := m.store.Subscribe(ctx, "")
+	if err != nil {
+		return err
+	}
+	if err := m.load(ctx); err != nil {
+		return err
+	}
+	updates := readUpdates(ctx, sub)
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case res := <-updates:
+			if res.err != nil {
+				if errors.Is(res.err, ErrReaderClosed) {
+					return nil
+				}
+				return res.err
+			}
+			m.observe(res.upd.VIN, res.upd.Ts, time.Now().UTC())
+		case now := <-ticker.C:
+			m.check(ctx, now.UTC())
+		}
+	}
+}
+
+func (m *StatusMonitor) load(ctx context.Context) error {
+	q := VehiclesQuery{
+		Limit: statusLoadPageSize,
+	}
+	for {
+		snaps, next, err := m.store.Vehicles(ctx, q)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		m.mu.Lock()
+		for _, snap := range snaps {
+			if _, ok := m.vehicles[snap.VIN]; ok {
+				continue
+			}
+			v := &vehicleStatus{
+				status:   StatusOnline,
+				lastSeen: snap.Latest.Ts,
+			}
+			if m.isOffline(v, now) {
+				v.status = StatusOffline
+			}
+			m.vehicles[snap.VIN] = v
+		}
+		m.mu.Unlock()
+
+		if next == "" {
+			return nil
+		}
+		q.Cursor = next
+	}
+}
+
+// observe updates the status of the vehicle, that reported the record with the timestamp ts. A vehicle,
+// that reported for the first time, is only online, if its record is recent.
+func (m *StatusMonitor) observe(vin vehicle.VIN, ts time.Time, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v := m.vehicles[vin]
+	if v == nil {
+		v = &vehicleStatus{
+			status: StatusOffline,
+		}
+		m.vehicles[vin] = v
+	}
+	if ts.After(v.lastSeen) {
+		v.lastSeen = ts
+	}
+
+	if v.status == StatusOffline && !m.isOffline(v, now) {
+		v.status = StatusOnline
+		m.publish(StatusEvent{VIN: vin, Status: StatusOnline, Ts: now, LastSeen: v.lastSeen})
+		m.cond.Broadcast()
+	}
+}
+
+// check marks the vehicles, that didn't report for the monitor's OfflineAfter, offline. The monitor, that
+// falls behind the store's feed, misses the records, so the vehicle's latest record is confirmed
+// with the store, before the vehicle is marked offline.
+func (m *StatusMonitor) check(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	var vins []vehicle.VIN
+	for vin, v := range m.vehicles {
+		if v.status == StatusOnline && m.isOffline(v, now) {
+			vins = append(vins, vin)
+		}
+	}
+	m.mu.Unlock()
+
+	latest := make(map[vehicle.VIN]time.Time, len(vins))
+	for _, vin := range vins {
+		snap, err := m.store.Latest(ctx, vin)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// the vehicle is judged by the records, the monitor saw
+			continue
+		}
+		latest[vin] = snap.Latest.Ts
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, vin := range vins {
+		v := m.vehicles[vin]
+		if ts := latest[vin]; ts.After(v.lastSeen) {
+			v.lastSeen = ts
+		}
+		if v.status == StatusOffline || !m.isOffline(v, now) {
+			continue
+		}
+		v.status = StatusOffline
+		m.publish(StatusEvent{VIN: vin, Status: StatusOffline, Ts: now, LastSeen: v.lastSeen})
+		n++
+	}
+
+	if n > 0 {
+		m.cond.Broadcast()
+	}
+}
+
+func (m *StatusMonitor) isOffline(v *vehicleStatus, now time.Time) bool {
+	return now.Sub(v.lastSeen) >= m.offlineAfter
+}
+
+func (m *StatusMonitor) publish(ev StatusEvent) {
+	m.events[m.seq%uint64(len(m.events))] = ev
+	m.seq++
+}
+
+// Status returns the status of the vehicle. It returns empty status, if the monitor doesn't know the vehicle.
+// A nil monitor knows no vehicles.
+func (m *StatusMonitor) Status(vin vehicle.VIN) VehicleStatus {
+	if m == nil {
+		return ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.vehicles[vin]; ok {
+		return v.status
+	}
+	return ""
+}
+
+// SubscribeStatus returns the subscription to the events of the vehicles with VINs starting with vinPrefix,
+// detected after the call. Empty vinPrefix matches all vehicles. The subscription is closed,
+// when the context is canceled.
+func (m *StatusMonitor) SubscribeStatus(ctx context.Context, vinPrefix string) *StatusSubscription {
+	m.mu.Lock()
+	next := m.seq
+	m.mu.Unlock()
+
+	s := &StatusSubscription{
+		monitor: m,
+		prefix:  strings.ToUpper(vinPrefix),
+		next:    next,
+		closed:  make(chan struct{}),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		m.mu.Lock()
+		close(s.closed)
+		m.mu.Unlock()
+		m.cond.Broadcast()
+	}()
+
+	return s
+}
+
+// StatusSubscription reads the status events. Like the fleet-wide subscription, a subscription,
+// that falls behind by more than the size of the monitor's buffer, skips the overwritten events.
+type StatusSubscription struct {
+	monitor *StatusMonitor
+	prefix  string
+	// next is the sequence number of the next event to read
+	next   uint64
+	closed chan struct{}
+}
+
+// Read blocks until the next event is available.
+func (s *StatusSubscription) Read() (StatusEvent, error) {
+	m := s.monitor
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		select {
+		case <-s.closed:
+			return StatusEvent{}, ErrReaderClosed
+		default:
+		}
+
+		if s.next == m.seq {
+			m.cond.Wait()
+			continue
+		}
+
+		if size := uint64(len(m.events)); m.seq-s.next > size {
+			s.next = m.seq - size
+		}
+
+		ev := m.events[s.next%uint64(len(m.events))]
+		s.next++
+		if strings.HasPrefix(string(ev.VIN), s.prefix) {
+			return ev, nil
+		}
+	}
+}
+
+// readStatusEvents reads the events from the subscription in the background. The returned channel is closed,
+// when the subscription is closed. A nil subscription never sends any events.
+func readStatusEvents(ctx context.Context, sub *StatusSubscription) <-chan StatusEvent {
+	if sub == nil {
+		return nil
+	}
+	events := make(chan StatusEvent)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := sub.Read()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// subscribeStatus returns the subscription to the monitor's events of the vehicles with VINs starting with
+// vinPrefix. It returns nil, if the monitor is nil.
+func subscribeStatus(ctx context.Context, m *StatusMonitor, vinPrefix string) *StatusSubscription {
+	if m == nil {
+		return nil
+	}
+	return m.SubscribeStatus(ctx, vinPrefix)
+}
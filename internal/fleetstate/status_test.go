@@ -0,0 +1,205 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func testStatusEventTypes(events []StatusEvent) []string {
+	types := make([]string, 0, len(events))
+	for _, ev := range events {
+		types = append(types, fmt.Sprintf("%s %s", ev.VIN, ev.Status))
+	}
+	return types
+}
+
+func TestStatusMonitor_observe(t *testing.T) {
+	monitor := NewStatusMonitor(NewMemStore(), StatusOptions{
+		OfflineAfter: time.Minute,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := monitor.SubscribeStatus(ctx, "THE1")
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	monitor.observe("THE1VIN", now, now)
+	// the vehicle, first seen with a stale record, is offline from the start
+	monitor.observe("THE2VIN", now.Add(-time.Hour), now)
+	if want, got := StatusOnline, monitor.Status("THE1VIN"); want != got {
+		t.Fatalf("THE1VIN: want status %q got %q", want, got)
+	}
+	if want, got := StatusOffline, monitor.Status("THE2VIN"); want != got {
+		t.Fatalf("THE2VIN: want status %q got %q", want, got)
+	}
+	if got := monitor.Status("UNKNOWN1VIN"); got != "" {
+		t.Fatalf("UNKNOWN1VIN: want empty status got %q", got)
+	}
+
+	monitor.check(ctx, now.Add(30*time.Second))
+	if want, got := StatusOnline, monitor.Status("THE1VIN"); want != got {
+		t.Fatalf("THE1VIN: want status %q got %q", want, got)
+	}
+
+	monitor.check(ctx, now.Add(time.Minute))
+	// a back-filled record doesn't bring the vehicle back online
+	monitor.observe("THE1VIN", now.Add(-time.Second), now.Add(time.Minute))
+	monitor.observe("THE2VIN", now.Add(time.Minute), now.Add(time.Minute))
+	monitor.observe("THE1VIN", now.Add(2*time.Minute), now.Add(2*time.Minute))
+
+	var events []StatusEvent
+	for i := 0; i < 3; i++ {
+		ev, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+
+	want := []string{
+		"THE1VIN online",
+		"THE1VIN offline",
+		"THE1VIN online",
+	}
+	if got := testStatusEventTypes(events); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want events %v got %v", want, got)
+	}
+	if want, got := now, events[1].LastSeen; !want.Equal(got) {
+		t.Fatalf("last seen: want %v got %v", want, got)
+	}
+
+	cancel()
+	if _, err := sub.Read(); !errors.Is(err, ErrReaderClosed) {
+		t.Fatalf("want error %v got %v", ErrReaderClosed, err)
+	}
+}
+
+func TestStatusMonitor_Run(t *testing.T) {
+	store := NewMemStore()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().UTC()
+
+	// the vehicles, known to the store before the monitor started
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-time.Hour), Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	monitor := NewStatusMonitor(store, StatusOptions{
+		OfflineAfter:  300 * time.Millisecond,
+		CheckInterval: 10 * time.Millisecond,
+	})
+	sub := monitor.SubscribeStatus(ctx, "")
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := monitor.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give the monitor some time to load the vehicles
+	time.Sleep(100 * time.Millisecond)
+
+	if want, got := StatusOffline, monitor.Status("THE1VIN"); want != got {
+		t.Fatalf("THE1VIN: want status %q got %q", want, got)
+	}
+	if want, got := StatusOnline, monitor.Status("THE2VIN"); want != got {
+		t.Fatalf("THE2VIN: want status %q got %q", want, got)
+	}
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []StatusEvent
+	for i := 0; i < 3; i++ {
+		ev, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+
+	// the loaded vehicles don't produce events
+	want := []string{
+		"THE1VIN online",
+		"THE2VIN offline",
+		"THE1VIN offline",
+	}
+	if got := testStatusEventTypes(events); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want events %v got %v", want, got)
+	}
+}
+
+func TestStatusMonitor_Run_FeedBehind(t *testing.T) {
+	// the feed is much smaller, than the bursts of the records, so the monitor misses most of them
+	store := NewMemStoreWithOptions(MemStoreOptions{FeedSize: 1})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const vehicles = 100
+
+	write := func() {
+		now := time.Now().UTC()
+		for i := 0; i < vehicles; i++ {
+			if err := store.Write(ctx, testVIN(i), vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write()
+
+	monitor := NewStatusMonitor(store, StatusOptions{
+		OfflineAfter:  300 * time.Millisecond,
+		CheckInterval: 10 * time.Millisecond,
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := monitor.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// the vehicles keep reporting for longer, than the monitor's OfflineAfter
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		write()
+	}
+
+	for i := 0; i < vehicles; i++ {
+		if want, got := StatusOnline, monitor.Status(testVIN(i)); want != got {
+			t.Fatalf("%s: want status %q got %q", testVIN(i), want, got)
+		}
+	}
+	monitor.mu.Lock()
+	n := monitor.seq
+	monitor.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("want no events got %d", n)
+	}
+}
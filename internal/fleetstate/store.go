@@ -4,29 +4,124 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
 	"github.com/narqo/ree-fleet-sim/internal/vehicle"
 )
 
 var (
 	ErrReaderClosed = errors.New("reader is closed")
+	ErrBadCursor    = errors.New("bad cursor")
+	ErrOldRecord    = errors.New("old record")
+	ErrUnknownVIN   = errors.New("unknown vin")
 )
 
 type Store interface {
-	Write(ctx context.Context, vin vehicle.VIN, ts time.Time, lat, lon float64) error
+	// Write writes the vehicle's telemetry.
+	Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error
+	// Reader returns the reader, that starts reading from the latest record of the vehicle.
 	Reader(ctx context.Context, vin vehicle.VIN) (Reader, error)
+	// ReaderFromCursor returns the reader, that starts reading from the record the cursor points to.
+	ReaderFromCursor(ctx context.Context, vin vehicle.VIN, cursor string) (Reader, error)
+	// Range returns the records of the vehicle, that match the query, in the time order.
+	// If there are more records, than the query's limit, Range returns the cursor to request the next page.
+	Range(ctx context.Context, vin vehicle.VIN, q RangeQuery) (recs []Record, next string, err error)
+	// Subscribe returns the subscription to the records of all vehicles with VINs starting with vinPrefix,
+	// written after the call. Empty vinPrefix matches all vehicles.
+	Subscribe(ctx context.Context, vinPrefix string) (Subscription, error)
+	// Latest returns the snapshot of the vehicle's latest known record.
+	Latest(ctx context.Context, vin vehicle.VIN) (Snapshot, error)
+	// Vehicles returns the snapshots of the known vehicles, in the order of their VINs.
+	// If there are more vehicles, than the query's limit, Vehicles returns the cursor to request the next page.
+	Vehicles(ctx context.Context, q VehiclesQuery) (snaps []Snapshot, next string, err error)
+	// Nearby returns the vehicles, whose latest positions are within radius in km from the point lat, lon,
+	// sorted by the distance. Limit is the max number of vehicles to return; zero value means no limit.
+	Nearby(ctx context.Context, lat, lon, radius float64, limit int) ([]VehicleDistance, error)
+	// Within returns the vehicles, whose latest positions are inside the box, sorted by the distance
+	// from the box's center. Limit is the max number of vehicles to return; zero value means no limit.
+	Within(ctx context.Context, bbox geoutil.BBox, limit int) ([]VehicleDistance, error)
+	// Usage returns the vehicle's odometer, and the rollups of its usage, that match the query.
+	Usage(ctx context.Context, vin vehicle.VIN, q UsageQuery) (Usage, error)
 }
 
+// Snapshot is the latest known state of the vehicle.
+type Snapshot struct {
+	VIN vehicle.VIN
+	// Latest is the latest record of the vehicle. Unlike the vehicle's records, the snapshot isn't dropped
+	// by the retention policy.
+	Latest Record
+	// Prev is the record, that preceded Latest. Zero value means the vehicle reported once.
+	Prev Record
+}
+
+// VehiclesQuery selects a page of the known vehicles.
+type VehiclesQuery struct {
+	// Limit is the max number of vehicles to return. Zero value means no limit.
+	Limit int
+	// Cursor is the cursor, returned by the previous call to Vehicles.
+	Cursor string
+}
+
+// RangeQuery selects the records with timestamps in the interval [From, To).
+type RangeQuery struct {
+	// From is the start of the interval. Zero value means from the oldest record.
+	From time.Time
+	// To is the end of the interval. Zero value means up to the latest record.
+	To time.Time
+	// Limit is the max number of records to return. Zero value means no limit.
+	Limit int
+	// Cursor is the cursor, returned by the previous call to Range with the same query.
+	Cursor string
+}
+
+// Reader reads the records of a single vehicle in the time order. Reader never goes back in time:
+// back-filled records, that are older than the last record it read, are skipped.
+// If the records, the reader hasn't read yet, were dropped by the store's retention policy,
+// the reader skips them, continuing from the oldest retained record.
 type Reader interface {
-	Read() (ts time.Time, lat, lon float64, err error)
+	Read() (Record, error)
 }
 
 // MemStore is an in-memory implementation of Store.
 type MemStore struct {
+	opts    MemStoreOptions
+	feed    *feed
+	spatial *gridIndex
+
 	mu   sync.Mutex
 	data map[vehicle.VIN]*Data
+	// vins are the known vehicles, sorted
+	vins []vehicle.VIN
+}
+
+// MemStoreOptions configures the retention and the back-filling policies of MemStore.
+// Zero value means no retention limits and no back-filling.
+type MemStoreOptions struct {
+	// MaxAge is the max age of a record, after which the record is dropped.
+	MaxAge time.Duration
+	// MaxRecords is the max number of records the store keeps per vin.
+	MaxRecords int
+	// MaxLateness is how much older, than the latest record of the vin, a record can be.
+	// Late records are inserted in the time order.
+	MaxLateness time.Duration
+	// FeedSize is the number of the latest records of all vehicles, the store buffers for the subscriptions.
+	// A subscription, that falls behind further, skips the records. Zero value means the default size.
+	FeedSize int
+	// OdometerThreshold is the distance in meters, the vehicle must move away from its position, before
+	// the odometer counts the move; the shorter moves are the GPS jitter. Zero value means every move is counted.
+	OdometerThreshold float64
+	// UsageMaxAge is the max age of the hourly usage rollups, after which the rollups are dropped.
+	// The odometer is kept regardless.
+	UsageMaxAge time.Duration
+	// ChunkSize is the number of the older records of a vehicle, the store seals in a compressed chunk.
+	// Zero value means DefaultChunkSize; negative value keeps the records uncompressed.
+	ChunkSize int
 }
 
 var _ Store = (*MemStore)(nil)
@@ -35,6 +130,72 @@ type Record struct {
 	Ts  time.Time
 	Lon float64
 	Lat float64
+	// Seq is the sequence number of the record, in the order the records of the vin were written.
+	Seq uint64
+	// Version is the version of the telemetry schema, the vehicle reported the record in.
+	Version int
+	// Fields are the optional fields of the vehicle's telemetry. Nil Fields means the vehicle only reported
+	// its position, that keeps the records of most vehicles small.
+	Fields *vehicle.TelemetryFields
+}
+
+// recordOf returns the record of the vehicle's telemetry. The telemetry of zero version is of the latest one.
+func recordOf(t vehicle.Telemetry) Record {
+	rec := Record{
+		Ts:      t.Ts,
+		Lat:     t.Lat,
+		Lon:     t.Lon,
+		Version: t.Version,
+	}
+	if rec.Version == 0 {
+		rec.Version = vehicle.TelemetryVersion
+	}
+	if !t.TelemetryFields.IsZero() {
+		fields := t.TelemetryFields
+		rec.Fields = &fields
+	}
+	return rec
+}
+
+// Cursor returns the cursor, that points to the record.
+func (rec Record) Cursor() string {
+	return rec.position().String()
+}
+
+func (rec Record) position() position {
+	return position{rec.Ts, rec.Seq}
+}
+
+// position identifies a record in the time-ordered records of a vin.
+// Records with the same timestamp are ordered by their sequence numbers.
+type position struct {
+	Ts  time.Time
+	Seq uint64
+}
+
+func (p position) Before(q position) bool {
+	return p.Ts.Before(q.Ts) || (p.Ts.Equal(q.Ts) && p.Seq < q.Seq)
+}
+
+// String encodes the position as an opaque cursor.
+func (p position) String() string {
+	return strconv.FormatInt(p.Ts.UnixNano(), 10) + "-" + strconv.FormatUint(p.Seq, 10)
+}
+
+func parsePosition(s string) (p position, err error) {
+	chunks := strings.SplitN(s, "-", 2)
+	if len(chunks) != 2 {
+		return p, fmt.Errorf("%w %q", ErrBadCursor, s)
+	}
+	ts, err := strconv.ParseInt(chunks[0], 10, 64)
+	if err != nil {
+		return p, fmt.Errorf("%w %q", ErrBadCursor, s)
+	}
+	seq, err := strconv.ParseUint(chunks[1], 10, 64)
+	if err != nil {
+		return p, fmt.Errorf("%w %q", ErrBadCursor, s)
+	}
+	return position{time.Unix(0, ts).UTC(), seq}, nil
 }
 
 type Data struct {
@@ -42,42 +203,325 @@ type Data struct {
 	mu sync.Mutex
 	// notifies readers about new records in recs
 	cond sync.Cond
-	recs []Record
+	// recs are ordered by their positions
+	recs track
+	// seq is the sequence number of the last written record
+	seq uint64
+	// last and prev are the latest record and the one before it, kept after the records are dropped
+	last, prev Record
+	// usage is the vehicle's odometer and usage rollups, counted over the records, that advance the track,
+	// and recounted after the back-filled ones
+	usage usage
+}
+
+func (data *Data) snapshot(vin vehicle.VIN) Snapshot {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	return Snapshot{
+		VIN:    vin,
+		Latest: data.last,
+		Prev:   data.prev,
+	}
+}
+
+// checkLate returns ErrOldRecord, if the record is older than the lateness allows. The record is checked
+// against the latest record, rather than the records held, so the old records don't go through,
+// after the vehicle's records expired.
+func (data *Data) checkLate(vin vehicle.VIN, t vehicle.Telemetry, maxLateness time.Duration) error {
+	if data.seq == 0 || !t.Ts.Before(data.last.Ts.Add(-maxLateness)) {
+		return nil
+	}
+	return fmt.Errorf("%w for vin %s: ts %d, lastTs %d, lat %f, lon %f", ErrOldRecord, vin, t.Ts.UnixNano(), data.last.Ts.UnixNano(), t.Lat, t.Lon)
+}
+
+// expire drops the records, that are beyond the retention limits.
+// It returns the number of dropped records.
+func (data *Data) expire(opts MemStoreOptions, now time.Time) int {
+	var n int
+	if opts.MaxRecords > 0 && data.recs.len() > opts.MaxRecords {
+		n = data.recs.len() - opts.MaxRecords
+	}
+	if opts.MaxAge > 0 {
+		// the first record at or after the cutoff; the sequence numbers start at 1
+		cutoff := position{Ts: now.Add(-opts.MaxAge)}
+		if m := data.recs.search(cutoff); m > n {
+			n = m
+		}
+	}
+	if opts.UsageMaxAge > 0 {
+		data.usage.expire(now.Add(-opts.UsageMaxAge))
+	}
+	// the moves of the usage are only kept, while a late record can still be inserted before them
+	data.usage.trim(data.last.Ts.Add(-opts.MaxLateness))
+	if n == 0 {
+		return 0
+	}
+
+	data.recs.drop(n)
+
+	return n
 }
 
 func NewMemStore() *MemStore {
+	return NewMemStoreWithOptions(MemStoreOptions{})
+}
+
+func NewMemStoreWithOptions(opts MemStoreOptions) *MemStore {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
 	return &MemStore{
-		data: make(map[vehicle.VIN]*Data),
+		opts:    opts,
+		feed:    newFeed(opts.FeedSize),
+		spatial: newGridIndex(defaultGridCellSize),
+		data:    make(map[vehicle.VIN]*Data),
 	}
 }
 
-func (store *MemStore) Write(ctx context.Context, vin vehicle.VIN, ts time.Time, lat, lon float64) error {
+func (store *MemStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	return store.write(vin, t, 0, true)
+}
+
+// insert writes the record, that the store already accepted, e.g. the one replayed from the log, with
+// the sequence number seq; zero seq means the next one. It skips the lateness check, so the records,
+// accepted before the options changed, aren't lost.
+func (store *MemStore) insert(vin vehicle.VIN, t vehicle.Telemetry, seq uint64) {
+	store.write(vin, t, seq, false)
+}
+
+// write writes the record; if checkLate is false, the records, that are older than the lateness allows,
+// are back-filled too.
+func (store *MemStore) write(vin vehicle.VIN, t vehicle.Telemetry, seq uint64, checkLate bool) error {
+	ts, lat, lon := t.Ts, t.Lat, t.Lon
+
 	store.mu.Lock()
 
+	data := store.vehicle(vin)
+
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	// NOTE: unlock store-level lock only after we acquired the lock on vin-level data above
+	store.mu.Unlock()
+
+	rec := recordOf(t)
+	rec.Seq = seq
+	if seq == 0 {
+		rec.Seq = data.seq + 1
+	}
+	// the records, the restored usage already counted, aren't counted again
+	counted := rec.Seq <= data.usage.seq
+
+	if checkLate {
+		if err := data.checkLate(vin, t, store.opts.MaxLateness); err != nil {
+			return err
+		}
+	}
+
+	if data.seq > 0 && data.last.Ts.After(ts) {
+		// back-fill the late record, after the records with the same or older timestamps
+		i := data.recs.search(position{Ts: ts, Seq: math.MaxUint64})
+		data.recs.insert(i, rec)
+		if !counted {
+			data.usage.backfill(rec, store.opts.OdometerThreshold)
+		}
+	} else {
+		data.recs.append(rec)
+		data.prev, data.last = data.last, rec
+		if !counted {
+			data.usage.add(rec, store.opts.OdometerThreshold)
+		}
+		store.spatial.update(vin, lat, lon)
+		// like the readers, the subscriptions only see the records, that advance the vehicle's track;
+		// publishing under the vin-level lock keeps the vehicle's records in order
+		store.feed.publish(Update{VIN: vin, Record: rec})
+	}
+	if rec.Seq > data.seq {
+		data.seq = rec.Seq
+	}
+
+	data.expire(store.opts, time.Now())
+	data.cond.Broadcast()
+
+	return nil
+}
+
+// vehicle returns the vehicle's data, adding the vehicle, if there is none. The caller must hold mu.
+func (store *MemStore) vehicle(vin vehicle.VIN) *Data {
 	data := store.data[vin]
 	if data == nil {
-		data = &Data{}
+		data = &Data{recs: newTrack(store.opts.ChunkSize)}
 		data.cond.L = &data.mu
 		store.data[vin] = data
+
+		i := sort.Search(len(store.vins), func(i int) bool {
+			return store.vins[i] >= vin
+		})
+		store.vins = append(store.vins, "")
+		copy(store.vins[i+1:], store.vins[i:])
+		store.vins[i] = vin
 	}
+	return data
+}
 
+// restoreUsage restores the vehicle's usage, that was saved before, e.g. before the FileStore removed
+// the records, it was counted over, from the log. It must be called before the records are replayed: the records,
+// the usage counted, are inserted without counting them again.
+func (store *MemStore) restoreUsage(vin vehicle.VIN, saved savedUsage) {
+	store.mu.Lock()
+	data := store.vehicle(vin)
 	data.mu.Lock()
+	store.mu.Unlock()
 	defer data.mu.Unlock()
 
-	// NOTE: unlock store-level lock only after we acquired the lock on vin-level data above
+	data.usage.restore(saved)
+	if saved.Seq > data.seq {
+		data.seq = saved.Seq
+	}
+}
+
+// restoreLatest sets the vehicle's latest record to the one, its restored usage was counted at, if no record
+// of the vehicle was replayed after the usage was restored, e.g. since the vehicle's records were all dropped.
+func (store *MemStore) restoreLatest(vin vehicle.VIN) {
+	store.mu.Lock()
+	data := store.data[vin]
 	store.mu.Unlock()
+	if data == nil {
+		return
+	}
 
-	if len(data.recs) > 0 {
-		// don't bother back-filling a missing data points, to make things simpler
-		lastTs := data.recs[len(data.recs)-1].Ts
-		if lastTs.After(ts) {
-			return fmt.Errorf("old record for vin %s: ts %d, lastTs %d, lat, %f, lon %f", vin, ts.UnixNano(), lastTs.UnixNano(), lon, lat)
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	if data.last.Seq == 0 && data.usage.last.Seq != 0 {
+		data.last = data.usage.last
+		store.spatial.update(vin, data.last.Lat, data.last.Lon)
+	}
+}
+
+// savedUsage returns the usage of all vehicles to save.
+func (store *MemStore) savedUsage() map[vehicle.VIN]savedUsage {
+	store.mu.Lock()
+	data := make(map[vehicle.VIN]*Data, len(store.data))
+	for vin, d := range store.data {
+		data[vin] = d
+	}
+	store.mu.Unlock()
+
+	saved := make(map[vehicle.VIN]savedUsage, len(data))
+	for vin, d := range data {
+		d.mu.Lock()
+		if d.usage.seq > 0 {
+			saved[vin] = d.usage.save()
 		}
+		d.mu.Unlock()
 	}
-	data.recs = append(data.recs, Record{ts, lon, lat})
-	data.cond.Broadcast()
+	return saved
+}
 
-	return nil
+// check returns the error, Write would return for the record, without writing it, and the sequence number,
+// Write would assign to it.
+func (store *MemStore) check(vin vehicle.VIN, t vehicle.Telemetry) (seq uint64, err error) {
+	store.mu.Lock()
+	data := store.data[vin]
+	store.mu.Unlock()
+	if data == nil {
+		return 1, nil
+	}
+
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	return data.seq + 1, data.checkLate(vin, t, store.opts.MaxLateness)
+}
+
+// dropped reports whether the store dropped the records of every vehicle in vins, that are at or before
+// the vehicle's timestamp.
+func (store *MemStore) dropped(vins map[vehicle.VIN]time.Time) bool {
+	for vin, ts := range vins {
+		store.mu.Lock()
+		data := store.data[vin]
+		store.mu.Unlock()
+		if data == nil {
+			continue
+		}
+
+		data.mu.Lock()
+		held := data.recs.len() > 0 && !ts.Before(data.recs.at(0).Ts)
+		data.mu.Unlock()
+		if held {
+			return false
+		}
+	}
+	return true
+}
+
+// Expire drops the records of all vehicles, that are beyond the retention limits at the time now.
+// Write applies the retention policy to the vehicle it writes to. Expire is for the vehicles,
+// that stopped reporting. It returns the number of dropped records.
+func (store *MemStore) Expire(now time.Time) int {
+	store.mu.Lock()
+	data := make([]*Data, 0, len(store.data))
+	for _, d := range store.data {
+		data = append(data, d)
+	}
+	store.mu.Unlock()
+
+	var n int
+	for _, d := range data {
+		d.mu.Lock()
+		n += d.expire(store.opts, now)
+		d.mu.Unlock()
+	}
+	return n
+}
+
+func (store *MemStore) Range(ctx context.Context, vin vehicle.VIN, q RangeQuery) ([]Record, string, error) {
+	var cursor position
+	if q.Cursor != "" {
+		var err error
+		cursor, err = parsePosition(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	store.mu.Lock()
+	data := store.data[vin]
+	store.mu.Unlock()
+	if data == nil {
+		return nil, "", fmt.Errorf("%w %s", ErrUnknownVIN, vin)
+	}
+
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	recs := &data.recs
+
+	start := 0
+	if !q.From.IsZero() {
+		start = recs.search(position{Ts: q.From})
+	}
+	// cursor is the position of the first record of the next page
+	if q.Cursor != "" {
+		if n := recs.search(cursor); n > start {
+			start = n
+		}
+	}
+
+	end := recs.len()
+	if !q.To.IsZero() {
+		end = recs.search(position{Ts: q.To})
+	}
+	if start >= end {
+		return nil, "", nil
+	}
+
+	var next string
+	if q.Limit > 0 && end-start > q.Limit {
+		end = start + q.Limit
+		next = recs.at(end).position().String()
+	}
+
+	return recs.slice(start, end), next, nil
 }
 
 func (store *MemStore) Reader(ctx context.Context, vin vehicle.VIN) (Reader, error) {
@@ -85,16 +529,140 @@ func (store *MemStore) Reader(ctx context.Context, vin vehicle.VIN) (Reader, err
 	data := store.data[vin]
 	store.mu.Unlock()
 	if data == nil {
-		return nil, fmt.Errorf("unknown vin %s", vin)
+		return nil, fmt.Errorf("%w %s", ErrUnknownVIN, vin)
 	}
 
+	// start reading from the latest record; if all records were expired, wait for the next one
+	var next position
 	data.mu.Lock()
-	offset := len(data.recs) - 1
+	if last, ok := data.recs.last(); ok {
+		next = last.position()
+	} else {
+		next.Seq = data.seq + 1
+	}
 	data.mu.Unlock()
 
+	return newReader(ctx, data, next), nil
+}
+
+func (store *MemStore) ReaderFromCursor(ctx context.Context, vin vehicle.VIN, cursor string) (Reader, error) {
+	next, err := parsePosition(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	data := store.data[vin]
+	store.mu.Unlock()
+	if data == nil {
+		return nil, fmt.Errorf("%w %s", ErrUnknownVIN, vin)
+	}
+
+	return newReader(ctx, data, next), nil
+}
+
+func (store *MemStore) Subscribe(ctx context.Context, vinPrefix string) (Subscription, error) {
+	return store.feed.subscribe(ctx, vinPrefix), nil
+}
+
+func (store *MemStore) Latest(ctx context.Context, vin vehicle.VIN) (Snapshot, error) {
+	store.mu.Lock()
+	data := store.data[vin]
+	store.mu.Unlock()
+	if data == nil {
+		return Snapshot{}, fmt.Errorf("%w %s", ErrUnknownVIN, vin)
+	}
+
+	return data.snapshot(vin), nil
+}
+
+func (store *MemStore) Vehicles(ctx context.Context, q VehiclesQuery) ([]Snapshot, string, error) {
+	store.mu.Lock()
+
+	// cursor is the vin of the first vehicle of the next page
+	start := sort.Search(len(store.vins), func(i int) bool {
+		return store.vins[i] >= vehicle.VIN(q.Cursor)
+	})
+	end := len(store.vins)
+
+	var next string
+	if q.Limit > 0 && end-start > q.Limit {
+		end = start + q.Limit
+		next = string(store.vins[end])
+	}
+
+	vins := make([]vehicle.VIN, end-start)
+	copy(vins, store.vins[start:end])
+	data := make([]*Data, len(vins))
+	for i, vin := range vins {
+		data[i] = store.data[vin]
+	}
+
+	store.mu.Unlock()
+
+	snaps := make([]Snapshot, len(vins))
+	for i, vin := range vins {
+		snaps[i] = data[i].snapshot(vin)
+	}
+
+	return snaps, next, nil
+}
+
+func (store *MemStore) Nearby(ctx context.Context, lat, lon, radius float64, limit int) ([]VehicleDistance, error) {
+	bbox := geoutil.BBoxAround(lat, lon, radius)
+	return store.searchSpatial(bbox, lat, lon, radius, limit), nil
+}
+
+func (store *MemStore) Within(ctx context.Context, bbox geoutil.BBox, limit int) ([]VehicleDistance, error) {
+	lat, lon := bbox.Center()
+	return store.searchSpatial(bbox, lat, lon, math.Inf(1), limit), nil
+}
+
+// searchSpatial returns the vehicles inside the box, that are within radius in km from the point lat, lon,
+// sorted by the distance.
+func (store *MemStore) searchSpatial(bbox geoutil.BBox, lat, lon, radius float64, limit int) []VehicleDistance {
+	vins := store.spatial.search(bbox)
+
+	store.mu.Lock()
+	data := make([]*Data, len(vins))
+	for i, vin := range vins {
+		data[i] = store.data[vin]
+	}
+	store.mu.Unlock()
+
+	res := make([]VehicleDistance, 0, len(vins))
+	for i, vin := range vins {
+		// the vehicle might have moved since the search; filter by its current position
+		snap := data[i].snapshot(vin)
+		if !bbox.Contains(snap.Latest.Lat, snap.Latest.Lon) {
+			continue
+		}
+		d := geoutil.Distance(lat, lon, snap.Latest.Lat, snap.Latest.Lon)
+		if d > radius {
+			continue
+		}
+		res = append(res, VehicleDistance{
+			Snapshot: snap,
+			Distance: d,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Distance != res[j].Distance {
+			return res[i].Distance < res[j].Distance
+		}
+		return res[i].VIN < res[j].VIN
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+func newReader(ctx context.Context, data *Data, next position) *reader {
 	r := &reader{
 		data:   data,
-		offset: offset,
+		next:   next,
 		closed: make(chan struct{}),
 	}
 
@@ -103,34 +671,43 @@ func (store *MemStore) Reader(ctx context.Context, vin vehicle.VIN) (Reader, err
 		// i.e. no goroutine leak
 		<-ctx.Done()
 
+		// broadcast under the lock, so a reader, that checked closed, but didn't wait yet, doesn't miss the wake-up
+		data.mu.Lock()
 		close(r.closed)
 		data.cond.Broadcast()
+		data.mu.Unlock()
 	}()
 
-	return r, nil
+	return r
 }
 
 type reader struct {
-	data   *Data
-	offset int
+	data *Data
+	// next is the position of the next record to read
+	next position
+	// cache keeps the chunk, the reader reads from
+	cache  chunkCache
 	closed chan struct{}
 }
 
-func (r *reader) Read() (ts time.Time, lat, lon float64, err error) {
+func (r *reader) Read() (Record, error) {
 	r.data.mu.Lock()
 	defer r.data.mu.Unlock()
-	for len(r.data.recs) <= r.offset {
-		r.data.cond.Wait()
 
+	// if the records the reader was about to read were dropped, the search fast-forwards it
+	// to the oldest retained one
+	rec, ok := r.data.recs.seek(r.next, &r.cache)
+	for !ok {
 		select {
 		case <-r.closed:
-			return time.Time{}, 0, 0, ErrReaderClosed
+			return Record{}, ErrReaderClosed
 		default:
 		}
-	}
 
-	rec := r.data.recs[r.offset]
-	r.offset++
+		r.data.cond.Wait()
+		rec, ok = r.data.recs.seek(r.next, &r.cache)
+	}
+	r.next = position{rec.Ts, rec.Seq + 1}
 
-	return rec.Ts, rec.Lat, rec.Lon, nil
+	return rec, nil
 }
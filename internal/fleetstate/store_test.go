@@ -2,6 +2,8 @@ package fleetstate
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
@@ -16,18 +18,18 @@ func TestMemStore_Write_DropOldRecords(t *testing.T) {
 
 	now := time.Now().UTC()
 
-	err := store.Write(ctx, "THE1VIN", now, 1, 1)
+	err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = store.Write(ctx, "THE1VIN", now.Add(-1*time.Second), 1, 1)
+	err = store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-1 * time.Second), Lat: 1, Lon: 1})
 	if err == nil {
 		t.Fatal("write old record: want err got nil")
 	}
 
 	// different vin is fine, it's its first data point
-	err = store.Write(ctx, "ANOTHER1VIN", now.Add(-1*time.Second), 1, 1)
+	err = store.Write(ctx, "ANOTHER1VIN", vehicle.Telemetry{Ts: now.Add(-1 * time.Second), Lat: 1, Lon: 1})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,7 +46,7 @@ func TestMemStore_Reader(t *testing.T) {
 
 	for i := 1; i <= 3; i++ {
 		ts := now.Add(time.Duration(i) * time.Second)
-		if err := store.Write(ctx, vin, ts, float64(i)*10, float64(i)*10); err != nil {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i) * 10, Lon: float64(i) * 10}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -59,7 +61,7 @@ func TestMemStore_Reader(t *testing.T) {
 	now = now.Add(10 * time.Second)
 	for i := 1; i <= 3; i++ {
 		ts := now.Add(time.Duration(i) * time.Second)
-		if err := store.Write(ctx, vin, ts, float64(i)*20, float64(i)*20); err != nil {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i) * 20, Lon: float64(i) * 20}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -82,7 +84,7 @@ func TestMemStore_Reader_ReadClosed(t *testing.T) {
 	defer cancel()
 
 	store := NewMemStore()
-	if err := store.Write(ctx, "THE1VIN", time.Now().UTC(), 1, 1); err != nil {
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -91,14 +93,14 @@ func TestMemStore_Reader_ReadClosed(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, _, _, err = reader.Read()
+	_, err = reader.Read()
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	time.AfterFunc(300*time.Millisecond, cancel)
 
-	_, _, _, err = reader.Read()
+	_, err = reader.Read()
 	if err != ErrReaderClosed {
 		t.Fatalf("read closed: want err got %v", err)
 	}
@@ -109,7 +111,7 @@ func TestMemStore_Reader_UnknownVIN(t *testing.T) {
 	defer cancel()
 
 	store := NewMemStore()
-	if err := store.Write(ctx, "THE1VIN", time.Now().UTC(), 1, 1); err != nil {
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -119,20 +121,408 @@ func TestMemStore_Reader_UnknownVIN(t *testing.T) {
 	}
 }
 
+func TestMemStore_Retention_MaxRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{MaxRecords: 2})
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 10, Lon: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := store.Reader(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		ts := now.Add(time.Duration(i) * time.Second)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i) * 10, Lon: float64(i) * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want, got := 2, store.data[vin].recs.len(); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
+	}
+
+	// reader fell behind the retained records, it must fast-forward to the oldest one
+	testReaderRead(t, reader, now.Add(4*time.Second), 40, 40)
+	testReaderRead(t, reader, now.Add(5*time.Second), 50, 50)
+}
+
+func TestMemStore_Retention_MaxAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{MaxAge: time.Hour})
+
+	now := time.Now().UTC()
+
+	// record is older than max age, it's dropped right away
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-2 * time.Hour), Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, store.data["THE1VIN"].recs.len(); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
+	}
+
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 2, Lon: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now, Lat: 3, Lon: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := store.Reader(ctx, "THE1VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, store.Expire(now.Add(2*time.Hour)); want != got {
+		t.Fatalf("expire: want %d got %d", want, got)
+	}
+
+	// the record, that is older than the latest one, is rejected, even if the vin has no records left
+	err = store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(-time.Second), Lat: 1, Lon: 1})
+	if !errors.Is(err, ErrOldRecord) {
+		t.Fatalf("write old record: want err %v got %v", ErrOldRecord, err)
+	}
+	if snap, err := store.Latest(ctx, "THE1VIN"); err != nil || snap.Latest.Lat != 2 {
+		t.Fatalf("latest: want lat 2 got %+v, %v", snap.Latest, err)
+	}
+
+	// reader of a vin with no records left, waits for the next one
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(3 * time.Hour), Lat: 4, Lon: 4}); err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(3*time.Hour), 4, 4)
+
+	reader, err = store.Reader(ctx, "THE2VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, "THE2VIN", vehicle.Telemetry{Ts: now.Add(3 * time.Hour), Lat: 5, Lon: 5}); err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(3*time.Hour), 5, 5)
+}
+
+func TestMemStore_Write_BackFill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{MaxLateness: time.Minute})
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+
+	for _, i := range []int{0, 10, 20} {
+		ts := now.Add(time.Duration(i) * time.Second)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := store.Reader(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(20*time.Second), 20, 20)
+
+	// late records are inserted in the time order
+	for _, i := range []int{15, 5} {
+		ts := now.Add(time.Duration(i) * time.Second)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// too late record is rejected
+	err = store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(-time.Hour), Lat: 1, Lon: 1})
+	if !errors.Is(err, ErrOldRecord) {
+		t.Fatalf("write too late record: want err %v got %v", ErrOldRecord, err)
+	}
+
+	recs, _, err := store.Range(ctx, vin, RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordsLat(t, recs, 0, 5, 10, 15, 20)
+
+	// reader doesn't go back in time, it continues with the records after the last one it read
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(30 * time.Second), Lat: 30, Lon: 30}); err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now.Add(30*time.Second), 30, 30)
+}
+
+func TestMemStore_Write_SameTs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStore()
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := store.Reader(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReaderRead(t, reader, now, 1, 1)
+
+	// records with the same timestamp are read in the order they were written
+	for i := 2; i <= 3; i++ {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testReaderRead(t, reader, now, 2, 2)
+	testReaderRead(t, reader, now, 3, 3)
+}
+
+func TestMemStore_Range(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStore()
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC()
+
+	for i := 0; i < 10; i++ {
+		ts := now.Add(time.Duration(i) * time.Minute)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		recs, next, err := store.Range(ctx, vin, RangeQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := 10, len(recs); want != got {
+			t.Fatalf("records: want %d got %d", want, got)
+		}
+		if next != "" {
+			t.Fatalf("next: want none got %q", next)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		q := RangeQuery{
+			From: now.Add(2 * time.Minute),
+			To:   now.Add(5 * time.Minute),
+		}
+		recs, _, err := store.Range(ctx, vin, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRecordsLat(t, recs, 2, 3, 4)
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		q := RangeQuery{
+			From:  now.Add(3 * time.Minute),
+			Limit: 3,
+		}
+		var pages [][]Record
+		for {
+			recs, next, err := store.Range(ctx, vin, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, recs)
+			if next == "" {
+				break
+			}
+			q.Cursor = next
+		}
+		if want, got := 3, len(pages); want != got {
+			t.Fatalf("pages: want %d got %d", want, got)
+		}
+		testRecordsLat(t, pages[0], 3, 4, 5)
+		testRecordsLat(t, pages[1], 6, 7, 8)
+		testRecordsLat(t, pages[2], 9)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		q := RangeQuery{
+			From: now.Add(time.Hour),
+		}
+		recs, _, err := store.Range(ctx, vin, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 0 {
+			t.Fatalf("records: want none got %v", recs)
+		}
+	})
+
+	t.Run("bad cursor", func(t *testing.T) {
+		_, _, err := store.Range(ctx, vin, RangeQuery{Cursor: "abc"})
+		if !errors.Is(err, ErrBadCursor) {
+			t.Fatalf("want err %v got %v", ErrBadCursor, err)
+		}
+	})
+
+	t.Run("unknown vin", func(t *testing.T) {
+		_, _, err := store.Range(ctx, "ANOTHER1VIN", RangeQuery{})
+		if err == nil {
+			t.Fatal("want err got nil")
+		}
+	})
+}
+
+func TestMemStore_Chunks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{ChunkSize: 3, MaxLateness: time.Hour, MaxRecords: 9})
+
+	vin := vehicle.VIN("THE1VIN")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for i := 0; i < 10; i++ {
+		ts := now.Add(time.Duration(i) * time.Minute)
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the late record is inserted into a sealed chunk
+	if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now.Add(90 * time.Second), Lat: 1.5, Lon: 1.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := RangeQuery{Limit: 4}
+	var recs []Record
+	for {
+		page, next, err := store.Range(ctx, vin, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, page...)
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	// the oldest records were dropped by the retention policy
+	testRecordsLat(t, recs, 1.5, 2, 3, 4, 5, 6, 7, 8, 9)
+
+	reader, err := store.ReaderFromCursor(ctx, vin, recs[0].Cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		testReaderRead(t, reader, rec.Ts, rec.Lat, rec.Lon)
+	}
+}
+
+func testRecordsLat(t *testing.T, recs []Record, wantLat ...float64) {
+	t.Helper()
+
+	if len(recs) != len(wantLat) {
+		t.Fatalf("records: want %d got %d", len(wantLat), len(recs))
+	}
+	for i, rec := range recs {
+		if rec.Lat != wantLat[i] {
+			t.Fatalf("record %d: want lat %v got %v", i, wantLat[i], rec.Lat)
+		}
+	}
+}
+
 func testReaderRead(t *testing.T, reader Reader, wantTs time.Time, wantLat, wantLon float64) {
 	t.Helper()
 
-	ts, lat, lon, err := reader.Read()
+	rec, err := reader.Read()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !ts.Equal(wantTs) {
-		t.Fatalf("ts: want %v got %v", wantTs, ts)
+	if !rec.Ts.Equal(wantTs) {
+		t.Fatalf("ts: want %v got %v", wantTs, rec.Ts)
 	}
-	if lat != wantLat {
-		t.Fatalf("lat: want %v got %v", wantLat, lat)
+	if rec.Lat != wantLat {
+		t.Fatalf("lat: want %v got %v", wantLat, rec.Lat)
+	}
+	if rec.Lon != wantLon {
+		t.Fatalf("lon: want %v got %v", wantLon, rec.Lon)
+	}
+}
+
+func TestMemStore_Latest(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		MaxRecords:  1,
+		MaxLateness: time.Hour,
+	})
+
+	if _, err := store.Latest(ctx, "THE1VIN"); !errors.Is(err, ErrUnknownVIN) {
+		t.Fatalf("Latest: want %v, got %v", ErrUnknownVIN, err)
 	}
-	if lon != wantLon {
-		t.Fatalf("lon: want %v got %v", wantLon, lon)
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	for i, ts := range []time.Time{now, now.Add(2 * time.Second), now.Add(time.Second)} {
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: float64(i), Lon: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the snapshot outlives the dropped records and ignores the back-filled one
+	snap, err := store.Latest(ctx, "THE1VIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1.0, snap.Latest.Lat; want != got {
+		t.Errorf("latest: want lat %v, got %v", want, got)
+	}
+	if want, got := 0.0, snap.Prev.Lat; want != got || snap.Prev.Seq == 0 {
+		t.Errorf("prev: want lat %v, got %v (seq %d)", want, got, snap.Prev.Seq)
+	}
+}
+
+func TestMemStore_Vehicles(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	for _, vin := range []vehicle.VIN{"THE3VIN", "THE1VIN", "THE2VIN", "THE1VIN"} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	var (
+		vins   []vehicle.VIN
+		cursor string
+	)
+	for {
+		snaps, next, err := store.Vehicles(ctx, VehiclesQuery{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, snap := range snaps {
+			vins = append(vins, snap.VIN)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if want, got := []vehicle.VIN{"THE1VIN", "THE2VIN", "THE3VIN"}, vins; !reflect.DeepEqual(want, got) {
+		t.Fatalf("Vehicles: want %v, got %v", want, got)
 	}
 }
@@ -0,0 +1,55 @@
+package fleetstate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const (
+	// maxAttributes is the max number of the free-form attributes in the vehicle's telemetry
+	maxAttributes = 32
+	// maxAttributeKey and maxAttributeValue are the max lengths in bytes of an attribute's key and value
+	maxAttributeKey   = 64
+	maxAttributeValue = 256
+)
+
+// validateTelemetry checks the vehicle's telemetry is of the known version, and its fields are in range.
+// It returns the name of the invalid field.
+func validateTelemetry(t vehicle.Telemetry) (field string, err error) {
+	if t.Version < 0 || t.Version > vehicle.TelemetryVersion {
+		return "version", fmt.Errorf("unknown version %d, the latest is %d", t.Version, vehicle.TelemetryVersion)
+	}
+	if field, err := validateLatLon(t.Lat, t.Lon); err != nil {
+		return field, err
+	}
+
+	f := t.TelemetryFields
+	if v := f.Battery; v != nil && (math.IsNaN(*v) || *v < 0 || *v > 100) {
+		return "battery", fmt.Errorf("%v is out of range [0, 100]", *v)
+	}
+	if v := f.Altitude; v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0)) {
+		return "altitude", fmt.Errorf("%v isn't a number", *v)
+	}
+	if v := f.Accuracy; v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0) || *v < 0) {
+		return "accuracy", fmt.Errorf("%v isn't a positive number", *v)
+	}
+	if v := f.Odometer; v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0) || *v < 0) {
+		return "odometer", fmt.Errorf("%v isn't a positive number", *v)
+	}
+
+	if len(f.Attributes) > maxAttributes {
+		return "attributes", fmt.Errorf("%d attributes exceed max %d", len(f.Attributes), maxAttributes)
+	}
+	for k, v := range f.Attributes {
+		if k == "" || len(k) > maxAttributeKey {
+			return "attributes", fmt.Errorf("key %q must be 1-%d bytes long", k, maxAttributeKey)
+		}
+		if len(v) > maxAttributeValue {
+			return "attributes", fmt.Errorf("value of %q exceeds %d bytes", k, maxAttributeValue)
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,56 @@
+package fleetstate
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestValidateTelemetry(t *testing.T) {
+	tooManyAttrs := make(map[string]string)
+	for i := 0; i <= maxAttributes; i++ {
+		tooManyAttrs[strings.Repeat("k", i+1)] = "v"
+	}
+
+	cases := []struct {
+		name   string
+		fields vehicle.TelemetryFields
+		ver    int
+		want   string
+	}{
+		{"no fields", vehicle.TelemetryFields{}, 0, ""},
+		{"all fields", vehicle.TelemetryFields{
+			Battery:    vehicle.Float64(100),
+			Altitude:   vehicle.Float64(-10),
+			Accuracy:   vehicle.Float64(0),
+			Odometer:   vehicle.Float64(1e6),
+			Locked:     vehicle.Bool(true),
+			Attributes: map[string]string{"firmware": "1.2.3"},
+		}, vehicle.TelemetryVersion, ""},
+		{"unknown version", vehicle.TelemetryFields{}, vehicle.TelemetryVersion + 1, "version"},
+		{"negative battery", vehicle.TelemetryFields{Battery: vehicle.Float64(-1)}, 0, "battery"},
+		{"nan altitude", vehicle.TelemetryFields{Altitude: vehicle.Float64(math.NaN())}, 0, "altitude"},
+		{"negative accuracy", vehicle.TelemetryFields{Accuracy: vehicle.Float64(-1)}, 0, "accuracy"},
+		{"inf odometer", vehicle.TelemetryFields{Odometer: vehicle.Float64(math.Inf(1))}, 0, "odometer"},
+		{"too many attributes", vehicle.TelemetryFields{Attributes: tooManyAttrs}, 0, "attributes"},
+		{"long key", vehicle.TelemetryFields{Attributes: map[string]string{strings.Repeat("k", maxAttributeKey+1): ""}}, 0, "attributes"},
+		{"long value", vehicle.TelemetryFields{Attributes: map[string]string{"k": strings.Repeat("v", maxAttributeValue+1)}}, 0, "attributes"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tm := vehicle.Telemetry{Version: tc.ver, Lat: 52.520008, Lon: 13.404954, TelemetryFields: tc.fields}
+			field, err := validateTelemetry(tm)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("want no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || field != tc.want {
+				t.Fatalf("want error in %q, got %q: %v", tc.want, field, err)
+			}
+		})
+	}
+}
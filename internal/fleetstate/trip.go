@@ -0,0 +1,348 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+const (
+	defaultStopRadius      = 50
+	defaultStopDuration    = 3 * time.Minute
+	defaultTripsPerVehicle = 100
+)
+
+var ErrUnknownTrip = errors.New("unknown trip")
+
+// TripPoint is the vehicle's record, a trip starts or ends at.
+type TripPoint struct {
+	Ts  time.Time `json:"ts"`
+	Lat float64   `json:"lat"`
+	Lon float64   `json:"lon"`
+}
+
+func tripPoint(rec Record) TripPoint {
+	return TripPoint{
+		Ts:  rec.Ts,
+		Lat: rec.Lat,
+		Lon: rec.Lon,
+	}
+}
+
+// Trip is the vehicle's track between two stops.
+type Trip struct {
+	ID    string      `json:"id"`
+	VIN   vehicle.VIN `json:"vin"`
+	Start TripPoint   `json:"start"`
+	End   TripPoint   `json:"end"`
+	// Distance is the distance in meters, the vehicle drove.
+	Distance float64 `json:"distance"`
+	// Duration is the time in seconds between the start and the end of the trip.
+	Duration float64 `json:"duration"`
+	// AvgSpeed and MaxSpeed are the average speed over the trip, and the max speed between two records
+	// of the trip, in km/h.
+	AvgSpeed float64 `json:"avg_speed"`
+	MaxSpeed float64 `json:"max_speed"`
+	// Ongoing is whether the vehicle hasn't stopped yet. The end of an ongoing trip is the vehicle's latest record.
+	Ongoing bool `json:"ongoing,omitempty"`
+}
+
+// extend adds the vehicle's move from the record rec0 to rec1, that is d meters, to the trip.
+func (trip *Trip) extend(rec0, rec1 Record, d float64) {
+	trip.End = tripPoint(rec1)
+	trip.Distance += d
+	if dt := rec1.Ts.Sub(rec0.Ts); d != 0 && dt > 0 {
+		if speed := d / 1000 / dt.Hours(); speed > trip.MaxSpeed {
+			trip.MaxSpeed = speed
+		}
+	}
+
+	duration := trip.End.Ts.Sub(trip.Start.Ts)
+	trip.Duration = duration.Seconds()
+	if duration > 0 {
+		trip.AvgSpeed = trip.Distance / 1000 / duration.Hours()
+	}
+}
+
+type TripOptions struct {
+	// StopRadius is the distance in meters, the vehicle stays within around a point, when it stopped.
+	// Zero value means 50 meters.
+	StopRadius float64
+	// StopDuration is how long the vehicle stays within StopRadius, before it's stopped.
+	// Zero value means 3 minutes.
+	StopDuration time.Duration
+	// MaxTrips is the max number of the latest trips of every vehicle, the store keeps.
+	// Zero value means 100 trips.
+	MaxTrips int
+	// Distance is the function the distances are calculated with (geoutil.Distance, by default).
+	Distance geoutil.DistanceFunc
+}
+
+// TripStore is a Store, that splits the records of the vehicles into trips, when it writes them
+// to the underlying store. A vehicle, that stays within the stop radius around a point for the stop duration,
+// is stopped; the vehicle, that moves out of the stop radius, starts a new trip. The records, more than
+// the stop duration apart, e.g. when the vehicle didn't report for a while, are never in the same trip.
+// The trips are detected incrementally, and are kept in memory; see Rebuild for the store, that keeps the records
+// on the disk.
+type TripStore struct {
+	Store
+
+	stopRadius   float64
+	stopDuration time.Duration
+	maxTrips     int
+	distance     geoutil.DistanceFunc
+
+	// shards split the vehicles by their VINs
+	shards [vinShards]tripShard
+}
+
+type tripShard struct {
+	mu       sync.Mutex
+	vehicles map[vehicle.VIN]*tripVehicle
+}
+
+// tripVehicle is the state of the vehicle, the trips are detected from.
+type tripVehicle struct {
+	// last is the latest record of the vehicle
+	last Record
+	// anchor is the record, the vehicle may be stopped at: all the vehicle's records since the anchor
+	// are within the stop radius around it
+	anchor Record
+	// trip is the vehicle's ongoing trip, if the vehicle isn't stopped
+	trip *Trip
+	// atAnchor is the ongoing trip, as it was at the anchor, i.e. the trip, if the vehicle stopped at the anchor
+	atAnchor Trip
+	// trips are the latest trips of the vehicle, oldest first
+	trips []*Trip
+}
+
+func NewTripStore(store Store, opts TripOptions) *TripStore {
+	s := &TripStore{
+		Store:        store,
+		stopRadius:   opts.StopRadius,
+		stopDuration: opts.StopDuration,
+		maxTrips:     opts.MaxTrips,
+		distance:     HandlerOptions{Distance: opts.Distance}.distance(),
+	}
+	for i := range s.shards {
+		s.shards[i].vehicles = make(map[vehicle.VIN]*tripVehicle)
+	}
+	if s.stopRadius <= 0 {
+		s.stopRadius = defaultStopRadius
+	}
+	if s.stopDuration <= 0 {
+		s.stopDuration = defaultStopDuration
+	}
+	if s.maxTrips <= 0 {
+		s.maxTrips = defaultTripsPerVehicle
+	}
+	return s
+}
+
+// Write writes the record to the underlying store, and updates the vehicle's trips. Back-filled records
+// don't change the trips.
+func (s *TripStore) Write(ctx context.Context, vin vehicle.VIN, t vehicle.Telemetry) error {
+	if err := s.Store.Write(ctx, vin, t); err != nil {
+		return err
+	}
+
+	shard := &s.shards[shardOf(vin, vinShards)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	s.add(shard, vin, recordOf(t))
+	return nil
+}
+
+// Rebuild detects the trips over the records, the underlying store already has, e.g. the ones a FileStore
+// replayed from its log. The trips keep their ids, since the ids are derived from the records; the trips,
+// that started before the oldest record, the store kept, are lost. Rebuild must be called before the store
+// is written to.
+func (s *TripStore) Rebuild(ctx context.Context) error {
+	snaps, _, err := s.Store.Vehicles(ctx, VehiclesQuery{})
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		recs, _, err := s.Store.Range(ctx, snap.VIN, RangeQuery{})
+		if err != nil {
+			return err
+		}
+
+		shard := &s.shards[shardOf(snap.VIN, vinShards)]
+		shard.mu.Lock()
+		for _, rec := range recs {
+			s.add(shard, snap.VIN, rec)
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// add updates the vehicle's trips with the record. The caller must hold the lock of the vehicle's shard.
+func (s *TripStore) add(shard *tripShard, vin vehicle.VIN, rec Record) {
+	v := shard.vehicles[vin]
+	if v == nil {
+		shard.vehicles[vin] = &tripVehicle{
+			last:   rec,
+			anchor: rec,
+		}
+		return
+	}
+	if rec.Ts.Before(v.last.Ts) {
+		return
+	}
+
+	if rec.Ts.Sub(v.last.Ts) >= s.stopDuration {
+		// the vehicle didn't report for a while, so it's considered stopped at its latest record
+		if v.trip != nil {
+			s.finishTrip(v, *v.trip)
+		}
+		v.last = rec
+		v.anchor = rec
+		return
+	}
+
+	d := s.distance(v.last.Lat, v.last.Lon, rec.Lat, rec.Lon) * 1000
+	if v.trip != nil {
+		v.trip.extend(v.last, rec, d)
+	}
+
+	if s.distance(v.anchor.Lat, v.anchor.Lon, rec.Lat, rec.Lon)*1000 > s.stopRadius {
+		if v.trip == nil {
+			s.startTrip(vin, v)
+			v.trip.extend(v.last, rec, d)
+		}
+		v.anchor = rec
+		v.atAnchor = *v.trip
+	} else if v.trip != nil && rec.Ts.Sub(v.anchor.Ts) >= s.stopDuration {
+		// the vehicle stayed around the anchor, so the trip ended there
+		s.finishTrip(v, v.atAnchor)
+	}
+
+	v.last = rec
+}
+
+// startTrip starts the vehicle's new trip at its latest record.
+func (s *TripStore) startTrip(vin vehicle.VIN, v *tripVehicle) {
+	trip := &Trip{
+		ID:      tripID(vin, v.last.Ts),
+		VIN:     vin,
+		Start:   tripPoint(v.last),
+		End:     tripPoint(v.last),
+		Ongoing: true,
+	}
+
+	if len(v.trips) == s.maxTrips {
+		copy(v.trips, v.trips[1:])
+		v.trips = v.trips[:len(v.trips)-1]
+	}
+	v.trips = append(v.trips, trip)
+	v.trip = trip
+}
+
+// finishTrip replaces the vehicle's ongoing trip with the final one.
+func (s *TripStore) finishTrip(v *tripVehicle, final Trip) {
+	final.Ongoing = false
+	*v.trip = final
+	v.trip = nil
+}
+
+// Trips returns the latest trips of the vehicle, oldest first. Limit is the max number of trips to return;
+// zero value means no limit.
+func (s *TripStore) Trips(ctx context.Context, vin vehicle.VIN, limit int) ([]Trip, error) {
+	shard := &s.shards[shardOf(vin, vinShards)]
+	shard.mu.Lock()
+	v, ok := shard.vehicles[vin]
+	var trips []Trip
+	if ok {
+		start := 0
+		if limit > 0 && len(v.trips) > limit {
+			start = len(v.trips) - limit
+		}
+		trips = make([]Trip, 0, len(v.trips)-start)
+		for _, trip := range v.trips[start:] {
+			trips = append(trips, *trip)
+		}
+	}
+	shard.mu.Unlock()
+
+	if !ok {
+		// the vehicle, that didn't report since the store started, has no trips
+		if _, err := s.Store.Latest(ctx, vin); err != nil {
+			return nil, err
+		}
+	}
+	return trips, nil
+}
+
+// tripID returns the id of the vehicle's trip, that started at the timestamp start. The id only depends
+// on the records, so the trips, that are rebuilt from the same records, keep their ids.
+func tripID(vin vehicle.VIN, start time.Time) string {
+	return string(vin) + "-" + strconv.FormatInt(start.UnixNano(), 10)
+}
+
+// parseTripID returns the VIN of the vehicle, the trip with the id is of, and the normalized id.
+func parseTripID(id string) (vehicle.VIN, string, bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 {
+		return "", "", false
+	}
+	vin, err := vehicle.VINFromString(id[:i])
+	if err != nil {
+		return "", "", false
+	}
+	ts, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return vin, tripID(vin, time.Unix(0, ts)), true
+}
+
+// Trip returns the trip with the id.
+func (s *TripStore) Trip(id string) (Trip, error) {
+	vin, tid, ok := parseTripID(id)
+	if !ok {
+		return Trip{}, fmt.Errorf("%w %s", ErrUnknownTrip, id)
+	}
+
+	shard := &s.shards[shardOf(vin, vinShards)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if v := shard.vehicles[vin]; v != nil {
+		for _, trip := range v.trips {
+			if trip.ID == tid {
+				return *trip, nil
+			}
+		}
+	}
+	return Trip{}, fmt.Errorf("%w %s", ErrUnknownTrip, id)
+}
+
+// Track returns the trip with the id, and the vehicle's records from the start to the end of the trip.
+// The track misses the records, dropped by the store's retention policy.
+func (s *TripStore) Track(ctx context.Context, id string) (Trip, []Record, error) {
+	trip, err := s.Trip(id)
+	if err != nil {
+		return trip, nil, err
+	}
+
+	q := RangeQuery{
+		From: trip.Start.Ts,
+		// the end of the interval is exclusive
+		To: trip.End.Ts.Add(time.Nanosecond),
+	}
+	recs, _, err := s.Store.Range(ctx, trip.VIN, q)
+	if err != nil {
+		return trip, nil, err
+	}
+	return trip, recs, nil
+}
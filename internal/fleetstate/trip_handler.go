@@ -0,0 +1,118 @@
+package fleetstate
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+const (
+	defaultTripsLimit = 100
+	maxTripsLimit     = 1000
+)
+
+// TripHandler handles the requests to the trips of all vehicles.
+type TripHandler struct {
+	trips *TripStore
+}
+
+func NewTripHandler(trips *TripStore) *TripHandler {
+	return &TripHandler{
+		trips: trips,
+	}
+}
+
+func (h *TripHandler) Handler() http.Handler {
+	return errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p := path.Clean("/" + r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && strings.Count(p, "/") == 1 && p != "/":
+			return h.HandleTrip(w, r)
+		case r.Method == http.MethodGet && strings.Count(p, "/") == 2 && path.Base(p) == "track":
+			return h.HandleTrack(w, r)
+		}
+		return ErrNotFound
+	})
+}
+
+type TripsResponse struct {
+	Trips []Trip `json:"trips"`
+}
+
+// HandleTrips responds with the latest trips of the vehicle, oldest first; "limit" sets the max number of trips.
+// The vehicle's ongoing trip, if any, is the last one.
+func (h *VehicleHandler) HandleTrips(w http.ResponseWriter, r *http.Request) error {
+	if h.trips == nil {
+		return ErrNotFound
+	}
+
+	vin, err := extractVINFromURLPath(r.URL.Path)
+	if err != nil {
+		return badRequest("vin", err)
+	}
+
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultTripsLimit, maxTripsLimit)
+	if err != nil {
+		return err
+	}
+
+	trips, err := h.trips.Trips(r.Context(), vin, limit)
+	if err != nil {
+		return err
+	}
+
+	resp := TripsResponse{
+		Trips: trips,
+	}
+	if resp.Trips == nil {
+		resp.Trips = []Trip{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// HandleTrip responds with the trip.
+func (h *TripHandler) HandleTrip(w http.ResponseWriter, r *http.Request) error {
+	trip, err := h.trips.Trip(strings.Trim(path.Clean("/"+r.URL.Path), "/"))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(trip)
+}
+
+type TrackResponse struct {
+	Trip    Trip             `json:"trip"`
+	Records []RecordResponse `json:"records"`
+	// Polyline is the track, encoded with the Encoded Polyline Algorithm.
+	Polyline string `json:"polyline"`
+}
+
+// HandleTrack responds with the trip, and the vehicle's positions from the start to the end of the trip.
+func (h *TripHandler) HandleTrack(w http.ResponseWriter, r *http.Request) error {
+	id := path.Base(path.Dir(path.Clean("/" + r.URL.Path)))
+
+	trip, recs, err := h.trips.Track(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	resp := TrackResponse{
+		Trip:    trip,
+		Records: make([]RecordResponse, 0, len(recs)),
+	}
+	points := make([]geoutil.Point, 0, len(recs))
+	for _, rec := range recs {
+		resp.Records = append(resp.Records, recordResponse(rec))
+		points = append(points, geoutil.Point{Lat: rec.Lat, Lon: rec.Lon})
+	}
+	resp.Polyline = geoutil.EncodePolyline(points)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
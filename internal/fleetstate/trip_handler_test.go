@@ -0,0 +1,93 @@
+package fleetstate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+)
+
+func TestTripHandler_Handler(t *testing.T) {
+	store := NewTripStore(NewMemStore(), TripOptions{})
+
+	w := &testTripWriter{
+		t:     t,
+		store: store,
+		vin:   "THE1VIN",
+		ts:    time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		lat:   52.518898,
+		lon:   13.401797,
+	}
+	w.Stay(1)
+	w.Drive(3, 0.150)
+
+	vehicleHandler := NewVehicleHandlerWithOptions(store, HandlerOptions{Trips: store}).Handler()
+	tripHandler := NewTripHandler(store).Handler()
+
+	resp := httptest.NewRecorder()
+	vehicleHandler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/the1vin/trips", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("trips: want status %d got %d: %s", http.StatusOK, resp.Code, resp.Body)
+	}
+	var trips TripsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&trips); err != nil {
+		t.Fatal(err)
+	}
+	// the trip started at the vehicle's first record
+	id := tripID("THE1VIN", time.Date(2020, 10, 6, 10, 0, 10, 0, time.UTC))
+	if len(trips.Trips) != 1 || trips.Trips[0].ID != id || !trips.Trips[0].Ongoing {
+		t.Fatalf("trips: want ongoing trip %s got %+v", id, trips.Trips)
+	}
+
+	resp = httptest.NewRecorder()
+	tripHandler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+id, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("trip: want status %d got %d: %s", http.StatusOK, resp.Code, resp.Body)
+	}
+	var trip Trip
+	if err := json.NewDecoder(resp.Body).Decode(&trip); err != nil {
+		t.Fatal(err)
+	}
+	if trip.ID != id || trip.VIN != "THE1VIN" {
+		t.Fatalf("trip: want trip %s of THE1VIN got %+v", id, trip)
+	}
+
+	resp = httptest.NewRecorder()
+	tripHandler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+id+"/track", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("track: want status %d got %d: %s", http.StatusOK, resp.Code, resp.Body)
+	}
+	var track TrackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&track); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, len(track.Records); want != got {
+		t.Fatalf("track: want %d records got %d", want, got)
+	}
+	points, err := geoutil.DecodePolyline(track.Polyline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := len(track.Records), len(points); want != got {
+		t.Fatalf("polyline: want %d points got %d", want, got)
+	}
+
+	for _, tc := range []struct {
+		handler http.Handler
+		target  string
+	}{
+		{vehicleHandler, "/unknown1vin/trips"},
+		{tripHandler, "/2"},
+		{tripHandler, "/2/track"},
+		{tripHandler, "/"},
+	} {
+		resp := httptest.NewRecorder()
+		tc.handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("%s: want status %d got %d: %s", tc.target, http.StatusNotFound, resp.Code, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// testTripWriter writes the records of the vehicle, every 10 seconds.
+type testTripWriter struct {
+	t     *testing.T
+	store Store
+	vin   vehicle.VIN
+	ts    time.Time
+	// lat, lon is the vehicle's position, the vehicle stays or drives from
+	lat, lon float64
+}
+
+// Stay writes n records within a few meters around the vehicle's position.
+func (w *testTripWriter) Stay(n int) {
+	w.t.Helper()
+	for i := 0; i < n; i++ {
+		lat, lon := w.lat, w.lon
+		if i%2 == 0 {
+			lat, lon = geoutil.Destination(w.lat, w.lon, 0, 0.005)
+		}
+		w.write(lat, lon)
+	}
+}
+
+// Drive writes n records, moving the vehicle by d km to the east between every two records.
+func (w *testTripWriter) Drive(n int, d float64) {
+	w.t.Helper()
+	for i := 0; i < n; i++ {
+		w.lat, w.lon = geoutil.Destination(w.lat, w.lon, 90, d)
+		w.write(w.lat, w.lon)
+	}
+}
+
+// Wait moves the time of the next record forward.
+func (w *testTripWriter) Wait(d time.Duration) {
+	w.ts = w.ts.Add(d)
+}
+
+func (w *testTripWriter) write(lat, lon float64) {
+	w.t.Helper()
+	w.ts = w.ts.Add(10 * time.Second)
+	if err := w.store.Write(context.Background(), w.vin, vehicle.Telemetry{Ts: w.ts, Lat: lat, Lon: lon}); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func TestTripStore_Trips(t *testing.T) {
+	store := NewTripStore(NewMemStore(), TripOptions{
+		StopRadius:   50,
+		StopDuration: 3 * time.Minute,
+	})
+
+	start := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	w := &testTripWriter{
+		t:     t,
+		store: store,
+		vin:   "THE1VIN",
+		ts:    start,
+		// Berlin, Cathedral
+		lat: 52.518898,
+		lon: 13.401797,
+	}
+
+	// the vehicle is parked, and its position jitters
+	w.Stay(7)
+	// drives 1.5 km at 54 km/h
+	w.Drive(10, 0.150)
+	// parks for 4 minutes
+	w.Stay(24)
+	// drives again
+	w.Drive(3, 0.300)
+
+	trips, err := store.Trips(context.Background(), "THE1VIN", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("want 2 trips got %+v", trips)
+	}
+
+	trip := trips[0]
+	if want := tripID("THE1VIN", start.Add(70*time.Second)); trip.ID != want || trip.VIN != "THE1VIN" || trip.Ongoing {
+		t.Errorf("trip: want finished trip %s of THE1VIN got %+v", want, trip)
+	}
+	if want, got := start.Add(70*time.Second), trip.Start.Ts; !want.Equal(got) {
+		t.Errorf("start: want %v got %v", want, got)
+	}
+	// the trip ended at the vehicle's first record at the parking
+	if want, got := start.Add(170*time.Second), trip.End.Ts; !want.Equal(got) {
+		t.Errorf("end: want %v got %v", want, got)
+	}
+	if want, got := 1500.0, trip.Distance; math.Abs(want-got) > 10 {
+		t.Errorf("distance: want %v got %v", want, got)
+	}
+	if want, got := 100.0, trip.Duration; want != got {
+		t.Errorf("duration: want %v got %v", want, got)
+	}
+	if want, got := 54.0, trip.AvgSpeed; math.Abs(want-got) > 0.5 {
+		t.Errorf("avg speed: want %v got %v", want, got)
+	}
+	if want, got := 54.0, trip.MaxSpeed; math.Abs(want-got) > 0.5 {
+		t.Errorf("max speed: want %v got %v", want, got)
+	}
+
+	trip = trips[1]
+	if want := tripID("THE1VIN", start.Add(410*time.Second)); trip.ID != want || !trip.Ongoing {
+		t.Errorf("trip: want ongoing trip %s got %+v", want, trip)
+	}
+	if want, got := start.Add(410*time.Second), trip.Start.Ts; !want.Equal(got) {
+		t.Errorf("start: want %v got %v", want, got)
+	}
+	if want, got := w.ts, trip.End.Ts; !want.Equal(got) {
+		t.Errorf("end: want %v got %v", want, got)
+	}
+	if want, got := 108.0, trip.MaxSpeed; math.Abs(want-got) > 1 {
+		t.Errorf("max speed: want %v got %v", want, got)
+	}
+
+	trips, err = store.Trips(context.Background(), "THE1VIN", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 1 || trips[0].ID != trip.ID {
+		t.Fatalf("limit: want trip %s got %+v", trip.ID, trips)
+	}
+
+	// the ids are case-insensitive, like the VINs
+	_, recs, err := store.Track(context.Background(), strings.ToLower(tripID("THE1VIN", start.Add(70*time.Second))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 11, len(recs); want != got {
+		t.Fatalf("track: want %d records got %d", want, got)
+	}
+}
+
+func TestTripStore_Trips_Gap(t *testing.T) {
+	store := NewTripStore(NewMemStore(), TripOptions{
+		StopDuration: 3 * time.Minute,
+		MaxTrips:     2,
+	})
+
+	w := &testTripWriter{
+		t:     t,
+		store: store,
+		vin:   "THE1VIN",
+		ts:    time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		lat:   52.518898,
+		lon:   13.401797,
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		// the trip starts at the vehicle's first record after the gap
+		ids = append(ids, tripID(w.vin, w.ts.Add(10*time.Second)))
+		w.Drive(5, 0.150)
+		// the vehicle doesn't report for a while, so the trip ended at its last record
+		w.Wait(5 * time.Minute)
+	}
+	w.Drive(1, 0.150)
+
+	trips, err := store.Trips(context.Background(), "THE1VIN", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the store keeps the latest trips
+	if len(trips) != 2 || trips[0].ID != ids[1] || trips[1].ID != ids[2] {
+		t.Fatalf("want trips %v got %+v", ids[1:], trips)
+	}
+	for _, trip := range trips {
+		if trip.Ongoing {
+			t.Errorf("trip: want finished got %+v", trip)
+		}
+		if want, got := 600.0, trip.Distance; math.Abs(want-got) > 10 {
+			t.Errorf("distance: want %v got %v", want, got)
+		}
+	}
+
+	for _, id := range []string{ids[0], "1", "THE1VIN-", "UNKNOWN1VIN-1"} {
+		if _, err := store.Trip(id); !errors.Is(err, ErrUnknownTrip) {
+			t.Fatalf("trip %s: want error %v got %v", id, ErrUnknownTrip, err)
+		}
+	}
+
+	if _, err := store.Trips(context.Background(), "UNKNOWN1VIN", 0); !errors.Is(err, ErrUnknownVIN) {
+		t.Fatalf("unknown vin: want error %v got %v", ErrUnknownVIN, err)
+	}
+}
+
+func TestTripStore_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	fileStore, err := OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewTripStore(fileStore, TripOptions{})
+
+	w1 := &testTripWriter{
+		t:     t,
+		store: store,
+		vin:   "THE1VIN",
+		ts:    time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		lat:   52.518898,
+		lon:   13.401797,
+	}
+	w2 := &testTripWriter{
+		t:     t,
+		store: store,
+		vin:   "THE2VIN",
+		ts:    time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		lat:   52.520645,
+		lon:   13.409779,
+	}
+	// the trips of the vehicles start in a different order, than they are rebuilt in
+	w2.Stay(7)
+	w2.Drive(10, 0.150)
+	w1.Stay(7)
+	w1.Drive(10, 0.150)
+	w1.Stay(24)
+	w2.Stay(24)
+	w1.Drive(5, 0.150)
+	w2.Drive(5, 0.150)
+
+	var want [][]Trip
+	for _, vin := range []vehicle.VIN{"THE1VIN", "THE2VIN"} {
+		trips, err := store.Trips(ctx, vin, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trips) != 2 {
+			t.Fatalf("%s: want 2 trips got %+v", vin, trips)
+		}
+		want = append(want, trips)
+	}
+	if err := fileStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fileStore, err = OpenFileStore(dir, FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+	store = NewTripStore(fileStore, TripOptions{})
+	if err := store.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trips are detected again over the replayed records, and keep their ids
+	for i, vin := range []vehicle.VIN{"THE1VIN", "THE2VIN"} {
+		got, err := store.Trips(ctx, vin, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want[i], got) {
+			t.Fatalf("%s: trips: want %+v got %+v", vin, want[i], got)
+		}
+		for _, trip := range want[i] {
+			got, err := store.Trip(trip.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(trip, got) {
+				t.Fatalf("trip %s: want %+v got %+v", trip.ID, trip, got)
+			}
+		}
+	}
+}
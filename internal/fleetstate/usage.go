@@ -0,0 +1,315 @@
+package fleetstate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// maxUsageGap is the max time between two records of the vehicle, that is counted as the vehicle's moving
+// or idle time. A longer gap means the vehicle didn't report, e.g. it was turned off.
+const maxUsageGap = 10 * time.Minute
+
+// UsageBucket is the usage of the vehicle over the time interval, that starts at Start.
+type UsageBucket struct {
+	Start time.Time `json:"start"`
+	// Distance is the distance in meters, the vehicle drove.
+	Distance float64 `json:"distance"`
+	// MovingTime and IdleTime are the time in seconds, the vehicle was moving, and the time it reported
+	// without moving.
+	MovingTime float64 `json:"moving_time"`
+	IdleTime   float64 `json:"idle_time"`
+}
+
+func (b *UsageBucket) add(other UsageBucket) {
+	b.Distance += other.Distance
+	b.MovingTime += other.MovingTime
+	b.IdleTime += other.IdleTime
+}
+
+// clamp drops the rounding errors, a move taken out of the bucket leaves, e.g. -1e-12 meters.
+func (b *UsageBucket) clamp() {
+	b.Distance = math.Max(b.Distance, 0)
+	b.MovingTime = math.Max(b.MovingTime, 0)
+	b.IdleTime = math.Max(b.IdleTime, 0)
+}
+
+// UsageQuery selects the usage buckets, that start in the interval [From, To).
+type UsageQuery struct {
+	// From is the start of the interval. Zero value means from the oldest bucket.
+	From time.Time
+	// To is the end of the interval. Zero value means up to the latest bucket.
+	To time.Time
+	// Bucket is the size of the buckets; it must be a multiple of an hour. Zero value means an hour.
+	Bucket time.Duration
+}
+
+// Usage is the vehicle's odometer and the rollups of its usage.
+type Usage struct {
+	VIN vehicle.VIN
+	// Odometer is the total distance in meters, the vehicle drove.
+	Odometer float64
+	// Buckets are the rollups of the vehicle's usage, in the time order. The buckets, the vehicle didn't report in,
+	// are omitted.
+	Buckets []UsageBucket
+}
+
+// usage is the vehicle's running odometer, and the hourly rollups of its usage.
+type usage struct {
+	odometer float64
+	// anchor is the record, the odometer counted the distance up to
+	anchor Record
+	// last is the latest record, the usage was counted at
+	last Record
+	// hours are the hourly buckets, in the time order
+	hours []UsageBucket
+	// moves are the latest moves, the usage counted, in the time order; a back-filled record recounts the moves
+	// after it
+	moves []usageMove
+	// seq is the sequence number of the latest record, the usage counted
+	seq uint64
+}
+
+// usageMove is the vehicle's move to the record Rec, as the usage counted it.
+type usageMove struct {
+	Rec Record `json:"rec"`
+	// Anchor and Last are the usage's anchor and latest record before the move; zero Last means Rec is
+	// the vehicle's first record
+	Anchor Record `json:"anchor"`
+	Last   Record `json:"last"`
+	// Distance is the distance in meters, the odometer counted; it's zero, if the vehicle didn't move
+	Distance float64 `json:"distance"`
+	Moving   bool    `json:"moving"`
+}
+
+// add counts the vehicle's usage since its previous record. The moves shorter, than threshold meters
+// from the record, the odometer counted the distance up to, are considered the GPS jitter of a vehicle,
+// that doesn't move.
+func (u *usage) add(rec Record, threshold float64) {
+	// the usage only needs the vehicle's position
+	rec.Fields = nil
+
+	m := usageMove{
+		Rec:    rec,
+		Anchor: u.anchor,
+		Last:   u.last,
+	}
+	if u.last.Seq != 0 {
+		m.Distance = geoutil.Distance(u.anchor.Lat, u.anchor.Lon, rec.Lat, rec.Lon) * 1000
+		m.Moving = m.Distance >= threshold
+		if !m.Moving {
+			m.Distance = 0
+		}
+	}
+	u.apply(m, 1)
+	u.moves = append(u.moves, m)
+	if rec.Seq > u.seq {
+		u.seq = rec.Seq
+	}
+}
+
+// backfill counts the vehicle's usage with the late record rec: the moves after rec are taken out, and counted
+// again after rec, the same way add counts them. The record, older than the moves, the usage keeps, is counted
+// after the usage's state before the oldest of them. The odometer never goes down.
+func (u *usage) backfill(rec Record, threshold float64) {
+	// like the records, the back-filled one goes after the moves with the same timestamp
+	i := sort.Search(len(u.moves), func(i int) bool {
+		return u.moves[i].Rec.Ts.After(rec.Ts)
+	})
+	moves := append([]usageMove(nil), u.moves[i:]...)
+	u.moves = u.moves[:i]
+
+	odometer := u.odometer
+	for j := len(moves) - 1; j >= 0; j-- {
+		u.apply(moves[j], -1)
+	}
+	u.add(rec, threshold)
+	for _, m := range moves {
+		u.add(m.Rec, threshold)
+	}
+	if u.odometer < odometer {
+		// the record, that brings the vehicle closer to the anchor, can make a move shorter, than the threshold
+		u.odometer = odometer
+	}
+}
+
+// apply counts the move; with sign -1, it takes the move, counted before, out of the usage.
+func (u *usage) apply(m usageMove, sign float64) {
+	if sign > 0 {
+		if m.Moving || m.Last.Seq == 0 {
+			u.anchor = m.Rec
+		}
+		u.last = m.Rec
+	} else {
+		u.anchor, u.last = m.Anchor, m.Last
+	}
+	if m.Last.Seq == 0 {
+		return
+	}
+
+	u.odometer += sign * m.Distance
+	u.count(m.Last.Ts, m.Rec.Ts, m.Distance, m.Moving, sign)
+}
+
+// trim drops the moves, that are older than the cutoff, so the records, that late, can't be back-filled.
+func (u *usage) trim(cutoff time.Time) {
+	n := sort.Search(len(u.moves), func(i int) bool {
+		return !u.moves[i].Rec.Ts.Before(cutoff)
+	})
+	if n > 0 {
+		u.moves = append(u.moves[:0], u.moves[n:]...)
+	}
+}
+
+// count adds the vehicle's move of d meters between the times t0 and t1 to the hourly buckets; with sign -1,
+// it takes the move, counted before, out of the buckets.
+func (u *usage) count(t0, t1 time.Time, d float64, moving bool, sign float64) {
+	if dt := t1.Sub(t0); dt <= 0 || dt > maxUsageGap {
+		// only count the distance, the vehicle drove since it reported last time
+		b := u.bucket(t1)
+		b.Distance += sign * d
+		b.clamp()
+		return
+	}
+
+	// split the interval between the hours it overlaps, in proportion to the time
+	total := t1.Sub(t0)
+	for t0.Before(t1) {
+		end := t0.Truncate(time.Hour).Add(time.Hour)
+		if end.After(t1) {
+			end = t1
+		}
+		dt := end.Sub(t0)
+
+		b := u.bucket(t0)
+		b.Distance += sign * d * float64(dt) / float64(total)
+		if moving {
+			b.MovingTime += sign * dt.Seconds()
+		} else {
+			b.IdleTime += sign * dt.Seconds()
+		}
+		b.clamp()
+
+		t0 = end
+	}
+}
+
+// bucket returns the hourly bucket for the time ts, adding the bucket, if there is none.
+func (u *usage) bucket(ts time.Time) *UsageBucket {
+	start := ts.Truncate(time.Hour)
+	n := len(u.hours)
+	if n > 0 && u.hours[n-1].Start.Equal(start) {
+		return &u.hours[n-1]
+	}
+
+	// only a back-filled record goes before the latest bucket
+	i := sort.Search(n, func(i int) bool {
+		return !u.hours[i].Start.Before(start)
+	})
+	if i < n && u.hours[i].Start.Equal(start) {
+		return &u.hours[i]
+	}
+	u.hours = append(u.hours, UsageBucket{})
+	copy(u.hours[i+1:], u.hours[i:])
+	u.hours[i] = UsageBucket{Start: start}
+	return &u.hours[i]
+}
+
+// expire drops the hourly buckets, that ended before the cutoff.
+func (u *usage) expire(cutoff time.Time) {
+	n := sort.Search(len(u.hours), func(i int) bool {
+		return !u.hours[i].Start.Add(time.Hour).Before(cutoff)
+	})
+	if n > 0 {
+		u.hours = append(u.hours[:0], u.hours[n:]...)
+	}
+}
+
+// savedUsage is the vehicle's usage, as the FileStore saves it, before it removes the records, the usage
+// was counted over, from the log.
+type savedUsage struct {
+	Seq      uint64        `json:"seq"`
+	Odometer float64       `json:"odometer"`
+	Anchor   Record        `json:"anchor"`
+	Last     Record        `json:"last"`
+	Hours    []UsageBucket `json:"hours,omitempty"`
+	Moves    []usageMove   `json:"moves,omitempty"`
+}
+
+// save returns the copy of the usage to save.
+func (u *usage) save() savedUsage {
+	return savedUsage{
+		Seq:      u.seq,
+		Odometer: u.odometer,
+		Anchor:   u.anchor,
+		Last:     u.last,
+		Hours:    append([]UsageBucket(nil), u.hours...),
+		Moves:    append([]usageMove(nil), u.moves...),
+	}
+}
+
+// restore replaces the usage with the saved one.
+func (u *usage) restore(saved savedUsage) {
+	*u = usage{
+		odometer: saved.Odometer,
+		anchor:   saved.Anchor,
+		last:     saved.Last,
+		hours:    saved.Hours,
+		moves:    saved.Moves,
+		seq:      saved.Seq,
+	}
+}
+
+// rollup returns the buckets of the size, aggregated from the hourly buckets, that match the query.
+func (u *usage) rollup(q UsageQuery) []UsageBucket {
+	size := q.Bucket
+	if size <= 0 {
+		size = time.Hour
+	}
+
+	var buckets []UsageBucket
+	for _, h := range u.hours {
+		start := h.Start.Truncate(size)
+		if !q.From.IsZero() && start.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !start.Before(q.To) {
+			break
+		}
+
+		if n := len(buckets); n == 0 || !buckets[n-1].Start.Equal(start) {
+			buckets = append(buckets, UsageBucket{Start: start})
+		}
+		buckets[len(buckets)-1].add(h)
+	}
+	return buckets
+}
+
+// Usage returns the vehicle's odometer and the rollups of its usage. A back-filled record recounts the usage
+// after it.
+func (store *MemStore) Usage(ctx context.Context, vin vehicle.VIN, q UsageQuery) (Usage, error) {
+	if q.Bucket < 0 || q.Bucket%time.Hour != 0 {
+		return Usage{}, fmt.Errorf("bucket %s isn't a multiple of an hour", q.Bucket)
+	}
+
+	store.mu.Lock()
+	data := store.data[vin]
+	store.mu.Unlock()
+	if data == nil {
+		return Usage{}, fmt.Errorf("%w %s", ErrUnknownVIN, vin)
+	}
+
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	return Usage{
+		VIN:      vin,
+		Odometer: data.usage.odometer,
+		Buckets:  data.usage.rollup(q),
+	}, nil
+}
@@ -0,0 +1,237 @@
+package fleetstate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestMemStore_Usage(t *testing.T) {
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		OdometerThreshold: 10,
+	})
+
+	ctx := context.Background()
+
+	// the vehicle reports every 10 seconds, starting 50 seconds before the end of the hour
+	ts := time.Date(2020, 10, 6, 9, 59, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+	write := func(lat, lon float64) {
+		t.Helper()
+		ts = ts.Add(10 * time.Second)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: lat, Lon: lon}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the vehicle is parked, and its position jitters by 5 meters
+	for i := 0; i < 3; i++ {
+		jlat, jlon := geoutil.Destination(lat, lon, float64(i)*90, 0.005)
+		write(jlat, jlon)
+	}
+	// drives 150 meters every 10 seconds
+	for i := 0; i < 6; i++ {
+		lat, lon = geoutil.Destination(lat, lon, 90, 0.150)
+		write(lat, lon)
+	}
+	// doesn't report for a while, and reports from 1 km further
+	ts = ts.Add(time.Hour)
+	lat, lon = geoutil.Destination(lat, lon, 90, 1)
+	write(lat, lon)
+
+	usage, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1900.0, usage.Odometer; math.Abs(want-got) > 10 {
+		t.Fatalf("odometer: want %v got %v", want, got)
+	}
+
+	if len(usage.Buckets) != 3 {
+		t.Fatalf("want 3 buckets got %+v", usage.Buckets)
+	}
+	for i, want := range []UsageBucket{
+		// 20 seconds parked and 30 seconds driving before 10:00, the rest after
+		{Start: time.Date(2020, 10, 6, 9, 0, 0, 0, time.UTC), Distance: 450, MovingTime: 30, IdleTime: 20},
+		{Start: time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC), Distance: 450, MovingTime: 30},
+		// the distance since the vehicle reported last time, without the time
+		{Start: time.Date(2020, 10, 6, 11, 0, 0, 0, time.UTC), Distance: 1000},
+	} {
+		got := usage.Buckets[i]
+		if !want.Start.Equal(got.Start) || math.Abs(want.Distance-got.Distance) > 5 ||
+			want.MovingTime != got.MovingTime || want.IdleTime != got.IdleTime {
+			t.Errorf("bucket %d: want %+v got %+v", i, want, got)
+		}
+	}
+
+	usage, err = store.Usage(ctx, "THE1VIN", UsageQuery{Bucket: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Buckets) != 1 {
+		t.Fatalf("daily: want 1 bucket got %+v", usage.Buckets)
+	}
+	if want, got := time.Date(2020, 10, 6, 0, 0, 0, 0, time.UTC), usage.Buckets[0].Start; !want.Equal(got) {
+		t.Errorf("daily: want start %v got %v", want, got)
+	}
+	if want, got := usage.Odometer, usage.Buckets[0].Distance; math.Abs(want-got) > 1e-6 {
+		t.Errorf("daily: want distance %v got %v", want, got)
+	}
+	if want, got := 60.0, usage.Buckets[0].MovingTime; want != got {
+		t.Errorf("daily: want moving time %v got %v", want, got)
+	}
+
+	usage, err = store.Usage(ctx, "THE1VIN", UsageQuery{
+		From: time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		To:   time.Date(2020, 10, 6, 11, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Buckets) != 1 || usage.Buckets[0].MovingTime != 30 {
+		t.Fatalf("from-to: want the bucket of 10:00 got %+v", usage.Buckets)
+	}
+
+	if _, err := store.Usage(ctx, "UNKNOWN1VIN", UsageQuery{}); !errors.Is(err, ErrUnknownVIN) {
+		t.Fatalf("unknown vin: want error %v got %v", ErrUnknownVIN, err)
+	}
+}
+
+func TestMemStore_Usage_BackFilled(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 9, 59, 40, 0, time.UTC)
+
+	// the vehicle drives 150 meters every 10 seconds, over the end of the hour, with the stop in between
+	var tms []vehicle.Telemetry
+	lat, lon := 52.518898, 13.401797
+	for i := 0; i < 8; i++ {
+		if i != 4 {
+			lat, lon = geoutil.Destination(lat, lon, 90, 0.150)
+		}
+		tms = append(tms, vehicle.Telemetry{Ts: now.Add(time.Duration(i) * 10 * time.Second), Lat: lat, Lon: lon})
+	}
+
+	usage := func(order []int) Usage {
+		t.Helper()
+		store := NewMemStoreWithOptions(MemStoreOptions{
+			MaxLateness:       time.Minute,
+			OdometerThreshold: 10,
+		})
+		for _, i := range order {
+			if err := store.Write(ctx, "THE1VIN", tms[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		usage, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+
+	want := usage([]int{0, 1, 2, 3, 4, 5, 6, 7})
+	// the late records are counted, as if they came in order
+	got := usage([]int{0, 3, 1, 6, 7, 2, 5, 4})
+
+	if math.Abs(want.Odometer-got.Odometer) > 1e-6 {
+		t.Fatalf("odometer: want %v got %v", want.Odometer, got.Odometer)
+	}
+	if len(want.Buckets) != 2 || len(want.Buckets) != len(got.Buckets) {
+		t.Fatalf("buckets: want %+v got %+v", want.Buckets, got.Buckets)
+	}
+	for i := range want.Buckets {
+		w, g := want.Buckets[i], got.Buckets[i]
+		if !w.Start.Equal(g.Start) || math.Abs(w.Distance-g.Distance) > 1e-6 ||
+			math.Abs(w.MovingTime-g.MovingTime) > 1e-6 || math.Abs(w.IdleTime-g.IdleTime) > 1e-6 {
+			t.Fatalf("bucket %d: want %+v got %+v", i, w, g)
+		}
+	}
+}
+
+func TestMemStore_Usage_BackFilled_Odometer(t *testing.T) {
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		MaxLateness:       time.Hour,
+		OdometerThreshold: 10,
+	})
+
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 9, 59, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+
+	var odometer float64
+	write := func(sec int, dist float64) {
+		t.Helper()
+		plat, plon := geoutil.Destination(lat, lon, 90, dist/1000)
+		ts := now.Add(time.Duration(sec) * time.Second)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: plat, Lon: plon}); err != nil {
+			t.Fatal(err)
+		}
+
+		usage, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Odometer < odometer {
+			t.Fatalf("record at %ds %vm: odometer went down from %v to %v", sec, dist, odometer, usage.Odometer)
+		}
+		odometer = usage.Odometer
+		for _, b := range usage.Buckets {
+			if b.Distance < 0 || b.MovingTime < 0 || b.IdleTime < 0 {
+				t.Fatalf("record at %ds %vm: negative bucket %+v", sec, dist, b)
+			}
+		}
+	}
+
+	// the vehicle moves 17 meters; the back-filled record in between is closer, than the threshold, to both
+	write(0, 0)
+	write(20, 17)
+	write(10, 8)
+	if math.Abs(odometer-17) > 0.5 {
+		t.Fatalf("odometer: want 17 got %v", odometer)
+	}
+
+	// the vehicle jitters around, the records come out of order
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		write(30+rnd.Intn(600), float64(rnd.Intn(40)))
+	}
+}
+
+func TestMemStore_Usage_BackFilled_Oldest(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	// the vehicle drives 150 meters every 10 seconds
+	var tms []vehicle.Telemetry
+	lat, lon := 52.518898, 13.401797
+	for i := 0; i < 4; i++ {
+		tms = append(tms, vehicle.Telemetry{Ts: now.Add(time.Duration(i) * 10 * time.Second), Lat: lat, Lon: lon})
+		lat, lon = geoutil.Destination(lat, lon, 90, 0.150)
+	}
+
+	store := NewMemStoreWithOptions(MemStoreOptions{
+		MaxRecords:        2,
+		MaxLateness:       time.Minute,
+		OdometerThreshold: 10,
+	})
+	for _, i := range []int{1, 2, 3, 0} {
+		if err := store.Write(ctx, "THE1VIN", tms[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the late record goes before the oldest record, the store kept, and its move is still counted
+	usage, err := store.Usage(ctx, "THE1VIN", UsageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 450.0, usage.Odometer; math.Abs(want-got) > 1 {
+		t.Fatalf("odometer: want %v got %v", want, got)
+	}
+}
@@ -1,10 +1,15 @@
 package fleetstate
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"path"
 	"strconv"
@@ -17,13 +22,70 @@ import (
 
 var ErrNotFound = errors.New("not found")
 
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+
+	maxBodySize = 1 << 20
+
+	defaultKeepAliveInterval = 15 * time.Second
+	// defaultStreamTrackIdle is how long the fleet-wide stream keeps the track of the vehicle, that stopped reporting
+	defaultStreamTrackIdle = 10 * time.Minute
+	// eventStreamRetry is the time the client waits before it reconnects to the event stream
+	eventStreamRetry = 3 * time.Second
+
+	// maxClockSkew is how far in the future a vehicle-reported timestamp can be
+	maxClockSkew = time.Minute
+
+	// maxUsageBucket is the max size of the usage rollups
+	maxUsageBucket = 366 * 24 * time.Hour
+)
+
+// HandlerOptions configures the handlers.
+type HandlerOptions struct {
+	// Distance is the function the speed of a vehicle is calculated with (geoutil.Distance, by default).
+	Distance geoutil.DistanceFunc
+	// Status is the monitor, the status of the vehicles comes from. Nil Status means the status isn't tracked.
+	Status *StatusMonitor
+	// Trips is the store, the trips of the vehicles come from. Nil Trips means the trips aren't tracked.
+	Trips *TripStore
+	// AllowedOrigins are the origins of the pages, besides the server's own, that can open WebSocket connections,
+	// e.g. "https://dashboard.example.com".
+	AllowedOrigins []string
+	// MaxSubscriptions is the max number of vehicles, a WebSocket client can subscribe to.
+	// Zero means DefaultMaxSubscriptions.
+	MaxSubscriptions int
+}
+
+func (opts HandlerOptions) distance() geoutil.DistanceFunc {
+	if opts.Distance == nil {
+		return geoutil.Distance
+	}
+	return opts.Distance
+}
+
 type VehicleHandler struct {
 	store Store
+
+	// interval the event stream sends a keep-alive comment
+	keepAliveInterval time.Duration
+	// distance calculates the distance in km between two positions
+	distance geoutil.DistanceFunc
+	status   *StatusMonitor
+	trips    *TripStore
 }
 
 func NewVehicleHandler(store Store) *VehicleHandler {
+	return NewVehicleHandlerWithOptions(store, HandlerOptions{})
+}
+
+func NewVehicleHandlerWithOptions(store Store, opts HandlerOptions) *VehicleHandler {
 	return &VehicleHandler{
-		store: store,
+		store:             store,
+		keepAliveInterval: defaultKeepAliveInterval,
+		distance:          opts.distance(),
+		status:            opts.Status,
+		trips:             opts.Trips,
 	}
 }
 
@@ -35,40 +97,137 @@ func (h *VehicleHandler) Handler() http.Handler {
 		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/stream") {
 			return h.HandleStreamPosition(w, r)
 		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/history") {
+			return h.HandleHistory(w, r)
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/trips") {
+			return h.HandleTrips(w, r)
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/stats") {
+			return h.HandleStats(w, r)
+		}
+		if r.Method == http.MethodGet && !strings.Contains(strings.Trim(path.Clean(r.URL.Path), "/"), "/") {
+			return h.HandleVehicle(w, r)
+		}
 		return ErrNotFound
 	})
 }
 
+// errorHandler responds with the error, handle returned, unless handle already started writing the response,
+// e.g. a stream failed after it sent some records. Then the status is already sent, and the error is only logged.
 func errorHandler(handle func(w http.ResponseWriter, r *http.Request) error) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := handle(w, r)
-		if errors.Is(err, ErrNotFound) {
-			http.NotFound(w, r)
-		} else if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		rw := &responseWriter{ResponseWriter: w}
+		if err := handle(rw, r); err != nil {
+			if rw.started {
+				log.Printf("%s %s: failed after the response started: %s", r.Method, r.URL.Path, err)
+				return
+			}
+			writeError(w, err)
 		}
 	})
 }
 
+// responseWriter records whether the handler started writing the response.
+type responseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		w.started = true
+	}
+	return conn, brw, err
+}
+
+type UpdatePositionRequest struct {
+	// Version is the version of the telemetry schema. Zero value means the latest version.
+	Version int       `json:"version"`
+	Ts      time.Time `json:"ts"`
+	Lat     *float64  `json:"lat"`
+	Lon     *float64  `json:"lon"`
+	vehicle.TelemetryFields
+}
+
+// telemetry returns the validated telemetry of the request. The position's timestamp defaults to now.
+func (req UpdatePositionRequest) telemetry(now time.Time) (vehicle.Telemetry, error) {
+	if req.Lat == nil {
+		return vehicle.Telemetry{}, badRequest("lat", errors.New("missing value"))
+	}
+	if req.Lon == nil {
+		return vehicle.Telemetry{}, badRequest("lon", errors.New("missing value"))
+	}
+	t := vehicle.Telemetry{
+		Version:         req.Version,
+		Lat:             *req.Lat,
+		Lon:             *req.Lon,
+		TelemetryFields: req.TelemetryFields,
+	}
+	if field, err := validateTelemetry(t); err != nil {
+		return vehicle.Telemetry{}, unprocessable(field, err)
+	}
+
+	ts, err := positionTs(req.Ts, now)
+	if err != nil {
+		return vehicle.Telemetry{}, unprocessable("ts", err)
+	}
+	t.Ts = ts
+	return t, nil
+}
+
+// HandleUpdatePosition stores the telemetry of the vehicle. The request's body is either a form or
+// (with Content-Type "application/json") a JSON object. The position's timestamp is taken from the optional
+// "ts" field (RFC 3339), that lets a vehicle back-fill the positions it buffered while being offline.
+// Without the field, the server's time is used. The optional fields of the telemetry, e.g. "battery",
+// and the free-form "attributes" are only accepted in a JSON object.
 func (h *VehicleHandler) HandleUpdatePosition(w http.ResponseWriter, r *http.Request) error {
-	ts := time.Now().UTC()
+	now := time.Now().UTC()
 
 	vin, err := extractVINFromURLPath(r.URL.Path)
 	if err != nil {
-		return fmt.Errorf("bad vin: %w", err)
+		return badRequest("vin", err)
 	}
 
-	lat, err := strconv.ParseFloat(r.PostFormValue("lat"), 64)
+	var req UpdatePositionRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		err = decodeJSONBody(w, r, &req)
+	} else {
+		err = parsePositionForm(r, &req)
+	}
 	if err != nil {
-		return fmt.Errorf("bad lat: %w", err)
+		return err
 	}
 
-	lon, err := strconv.ParseFloat(r.PostFormValue("lon"), 64)
+	t, err := req.telemetry(now)
 	if err != nil {
-		return fmt.Errorf("bad lon: %w", err)
+		return err
 	}
 
-	if err := h.store.Write(r.Context(), vin, ts, lat, lon); err != nil {
+	if err := h.store.Write(r.Context(), vin, t); err != nil {
 		return fmt.Errorf("could not write position for vin %q: %w", vin, err)
 	}
 
@@ -77,15 +236,87 @@ func (h *VehicleHandler) HandleUpdatePosition(w http.ResponseWriter, r *http.Req
 	return nil
 }
 
+func parsePositionForm(r *http.Request, req *UpdatePositionRequest) error {
+	if err := r.ParseForm(); err != nil {
+		return badRequest("body", err)
+	}
+
+	lat, err := strconv.ParseFloat(r.PostFormValue("lat"), 64)
+	if err != nil {
+		return badRequest("lat", err)
+	}
+	req.Lat = &lat
+
+	lon, err := strconv.ParseFloat(r.PostFormValue("lon"), 64)
+	if err != nil {
+		return badRequest("lon", err)
+	}
+	req.Lon = &lon
+
+	if v := r.PostFormValue("ts"); v != "" {
+		req.Ts, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return badRequest("ts", err)
+		}
+	}
+
+	return nil
+}
+
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body := http.MaxBytesReader(w, r.Body, maxBodySize)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return badRequest("body", err)
+	}
+	return nil
+}
+
+// positionTs returns the timestamp of the position, reported by a vehicle.
+// Zero ts means the position doesn't have a timestamp, and the server's time now is used.
+func positionTs(ts, now time.Time) (time.Time, error) {
+	if ts.IsZero() {
+		return now, nil
+	}
+	if ts.After(now.Add(maxClockSkew)) {
+		return ts, fmt.Errorf("%s is in the future", ts.Format(time.RFC3339Nano))
+	}
+	return ts.UTC(), nil
+}
+
 type PositionResponse struct {
-	Lat   float64 `json:"lat"`
-	Lon   float64 `json:"lon"`
+	// Seq is the sequence number of the vehicle's record.
+	Seq uint64    `json:"seq,omitempty"`
+	Ts  time.Time `json:"ts"`
+	Lat float64   `json:"lat"`
+	Lon float64   `json:"lon"`
+	// Speed is the vehicle's speed in the stream's units (km/h, by default).
 	Speed float64 `json:"speed"`
-	Error string  `json:"error,omitempty"`
+	// Heading is the vehicle's heading in degrees, clockwise from the north.
+	Heading float64 `json:"heading"`
+	// Acceleration is the change of the vehicle's speed since the previous position, in m/s².
+	Acceleration float64 `json:"acceleration"`
+	// Dt is the time in seconds, and Distance is the distance in meters, since the previous position.
+	Dt       float64 `json:"dt"`
+	Distance float64 `json:"distance"`
+	// Raw is the position and the speed, as the vehicle reported it, in the smoothed streams.
+	Raw *PositionResponse `json:"raw,omitempty"`
+	// TelemetryFields are the optional fields of the telemetry, the vehicle reported with the position.
+	*vehicle.TelemetryFields
+	Error string `json:"error,omitempty"`
 }
 
+// HandleStreamPosition streams the positions of the vehicle, starting with the next position the vehicle reports.
+// If the client accepts "text/event-stream", the positions are streamed as server-sent events;
+// otherwise, as chunked newline-delimited JSON. If the handler tracks the status of the vehicles, the stream
+// also sends the vehicle's status events, when the vehicle goes offline or back online. With the query parameter
+// "smooth=kalman", the positions and the speed are smoothed, with the raw values in the "raw" field.
 func (h *VehicleHandler) HandleStreamPosition(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
+	if acceptsEventStream(r) {
+		return h.HandleStreamPositionEvents(w, r)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -96,7 +327,12 @@ func (h *VehicleHandler) HandleStreamPosition(w http.ResponseWriter, r *http.Req
 
 	vin, err := extractVINFromURLPath(r.URL.Path)
 	if err != nil {
-		return fmt.Errorf("bad vin: %w", err)
+		return badRequest("vin", err)
+	}
+
+	opts, err := parseStreamOptions(r.URL.Query())
+	if err != nil {
+		return err
 	}
 
 	reader, err := h.store.Reader(ctx, vin)
@@ -109,36 +345,441 @@ func (h *VehicleHandler) HandleStreamPosition(w http.ResponseWriter, r *http.Req
 		enc: json.NewEncoder(w),
 	}
 
-	ts0, lat0, lon0, err := reader.Read()
-	if err != nil {
-		resp := PositionResponse{Error: err.Error()}
-		sw.WriteChunk(resp)
-	}
+	recs := readRecords(ctx, reader)
+	statuses := readStatusEvents(ctx, subscribeStatus(ctx, h.status, string(vin)))
+	track := newPositionTrack(h.distance, opts)
 
+	first := true
 	for {
-		var resp PositionResponse
-		ts1, lat1, lon1, err := reader.Read()
-		if err != nil {
-			resp.Error = err.Error()
-		} else {
-			resp.Lat = lat1
-			resp.Lon = lon1
-			d := geoutil.Distance(lat0, lon0, lat1, lon1)
-			if d != 0 {
-				resp.Speed = d / ts1.Sub(ts0).Hours()
+		select {
+		case <-ctx.Done():
+			// client has gone, nothing left to do
+			return nil
+		case ev, ok := <-statuses:
+			if !ok {
+				statuses = nil
+				continue
+			}
+			if ev.VIN == vin {
+				sw.WriteChunk(ev)
+			}
+		case res := <-recs:
+			if res.err != nil {
+				if ctx.Err() == nil {
+					sw.WriteChunk(PositionResponse{Error: res.err.Error()})
+				}
+				return nil
 			}
 
-			ts0, lat0, lon0 = ts1, lat1, lon1
+			resp := track.next(res.rec)
+			if first {
+				// the first record only starts the track
+				first = false
+				continue
+			}
+			sw.WriteChunk(resp)
 		}
+	}
+}
+
+// positionResponse returns the response for the record rec1, calculating the speed and the heading since
+// the previous record rec0, with the distance function. The acceleration is left to the stream, that knows
+// the vehicle's previous speed.
+func positionResponse(distance geoutil.DistanceFunc, rec0, rec1 Record) PositionResponse {
+	resp := PositionResponse{
+		Seq:             rec1.Seq,
+		Ts:              rec1.Ts,
+		Lat:             rec1.Lat,
+		Lon:             rec1.Lon,
+		TelemetryFields: rec1.Fields,
+	}
+	d := distance(rec0.Lat, rec0.Lon, rec1.Lat, rec1.Lon)
+	dt := rec1.Ts.Sub(rec0.Ts)
+	if dt > 0 {
+		resp.Dt = dt.Seconds()
+	}
+	if d != 0 {
+		resp.Distance = d * 1000
+		resp.Heading = geoutil.InitialBearing(rec0.Lat, rec0.Lon, rec1.Lat, rec1.Lon)
+		if dt > 0 {
+			resp.Speed = d / dt.Hours()
+		}
+	}
+	return resp
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(v))
+		if mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleStreamPositionEvents streams the positions of the vehicle as server-sent events.
+// The id of every event is the cursor of the position in the store. A client, that reconnects with the
+// "Last-Event-ID" header, resumes the stream from the position, that follows the last event it received.
+// The stream periodically sends a comment, to keep the idle connection open. The vehicle's status events
+// are sent as "status" events. Like the newline-delimited JSON stream, the positions are smoothed with "smooth=kalman";
+// after the client reconnects, the filter starts over.
+func (h *VehicleHandler) HandleStreamPositionEvents(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("bad request: client doens't support streaming")
+	}
+
+	vin, err := extractVINFromURLPath(r.URL.Path)
+	if err != nil {
+		return badRequest("vin", err)
+	}
 
+	opts, err := parseStreamOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+
+	var reader Reader
+	if lastEventID != "" {
+		// the reader starts from the last received record, that is used to calculate the speed of the next one
+		reader, err = h.store.ReaderFromCursor(ctx, vin, lastEventID)
+	} else {
+		reader, err = h.store.Reader(ctx, vin)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ew := &eventWriter{
+		w: w,
+		f: flusher,
+	}
+	ew.WriteRetry(eventStreamRetry)
+
+	recs := readRecords(ctx, reader)
+	statuses := readStatusEvents(ctx, subscribeStatus(ctx, h.status, string(vin)))
+
+	track := newPositionTrack(h.distance, opts)
+
+	keepAlive := time.NewTicker(h.keepAliveInterval)
+	defer keepAlive.Stop()
+
+	first := true
+	for {
 		select {
 		case <-ctx.Done():
 			// client has gone, nothing left to do
 			return nil
-		default:
-			sw.WriteChunk(resp)
+		case <-keepAlive.C:
+			ew.WriteComment("keepalive")
+		case ev, ok := <-statuses:
+			if !ok {
+				statuses = nil
+				continue
+			}
+			if ev.VIN == vin {
+				ew.WriteEvent("status", "", ev)
+			}
+		case res := <-recs:
+			if res.err != nil {
+				ew.WriteEvent("error", "", PositionResponse{Error: res.err.Error()})
+				return nil
+			}
+
+			resp := track.next(res.rec)
+			if first {
+				first = false
+				// if the last received record was dropped by the store, the reader fast-forwarded
+				// to the oldest retained one, that the client hasn't received yet
+				if lastEventID == "" || res.rec.Cursor() == lastEventID {
+					continue
+				}
+			}
+			ew.WriteEvent("", res.rec.Cursor(), resp)
+		}
+	}
+}
+
+type readResult struct {
+	rec Record
+	err error
+}
+
+// readRecords reads the records from the reader in the background, until it fails or the context is canceled.
+func readRecords(ctx context.Context, reader Reader) <-chan readResult {
+	recs := make(chan readResult)
+	go func() {
+		for {
+			rec, err := reader.Read()
+			select {
+			case recs <- readResult{rec, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return recs
+}
+
+// VehicleResponse is the latest known position of the vehicle.
+type VehicleResponse struct {
+	VIN   vehicle.VIN `json:"vin"`
+	Ts    time.Time   `json:"ts"`
+	Lat   float64     `json:"lat"`
+	Lon   float64     `json:"lon"`
+	Speed float64     `json:"speed"`
+	// Age is the time in seconds, passed since the vehicle recorded the position.
+	Age float64 `json:"age"`
+	// Status is the vehicle's status, if the server tracks it.
+	Status VehicleStatus `json:"status,omitempty"`
+	// TelemetryFields are the optional fields of the vehicle's latest telemetry.
+	*vehicle.TelemetryFields
+}
+
+// vehicleResponse returns the response for the vehicle's snapshot, with the vehicle's status from the monitor,
+// if the monitor isn't nil.
+func vehicleResponse(distance geoutil.DistanceFunc, status *StatusMonitor, snap Snapshot, now time.Time) VehicleResponse {
+	rec0 := snap.Prev
+	if rec0.Seq == 0 {
+		rec0 = snap.Latest
+	}
+	resp := positionResponse(distance, rec0, snap.Latest)
+	return VehicleResponse{
+		VIN:             snap.VIN,
+		Ts:              snap.Latest.Ts,
+		Lat:             resp.Lat,
+		Lon:             resp.Lon,
+		Speed:           resp.Speed,
+		Age:             now.Sub(snap.Latest.Ts).Seconds(),
+		Status:          status.Status(snap.VIN),
+		TelemetryFields: snap.Latest.Fields,
+	}
+}
+
+// HandleVehicle responds with the latest known position of the vehicle. The speed is calculated from
+// the two latest positions. If the handler tracks the status of the vehicles, the response includes
+// whether the vehicle is online or offline.
+func (h *VehicleHandler) HandleVehicle(w http.ResponseWriter, r *http.Request) error {
+	vin, err := extractVINFromURLPath(r.URL.Path)
+	if err != nil {
+		return badRequest("vin", err)
+	}
+
+	snap, err := h.store.Latest(r.Context(), vin)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(vehicleResponse(h.distance, h.status, snap, time.Now().UTC()))
+}
+
+type HistoryResponse struct {
+	Records []RecordResponse `json:"records"`
+	// Next is the cursor to request the next page of the history
+	Next string `json:"next,omitempty"`
+}
+
+type RecordResponse struct {
+	// Version is the version of the telemetry schema, the vehicle reported the record in.
+	Version int       `json:"version"`
+	Ts      time.Time `json:"ts"`
+	Lat     float64   `json:"lat"`
+	Lon     float64   `json:"lon"`
+	*vehicle.TelemetryFields
+}
+
+func recordResponse(rec Record) RecordResponse {
+	return RecordResponse{
+		Version:         rec.Version,
+		Ts:              rec.Ts,
+		Lat:             rec.Lat,
+		Lon:             rec.Lon,
+		TelemetryFields: rec.Fields,
+	}
+}
+
+// HandleHistory responds with the records of the vehicle in the time interval, specified by the query
+// parameters "from" and "to" (RFC 3339). The response is paginated: "limit" sets the size of a page,
+// "cursor" requests the next page.
+func (h *VehicleHandler) HandleHistory(w http.ResponseWriter, r *http.Request) error {
+	vin, err := extractVINFromURLPath(r.URL.Path)
+	if err != nil {
+		return badRequest("vin", err)
+	}
+
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"), defaultHistoryLimit, maxHistoryLimit)
+	if err != nil {
+		return err
+	}
+
+	q := RangeQuery{
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+	}
+	if v := query.Get("from"); v != "" {
+		q.From, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return badRequest("from", err)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		q.To, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return badRequest("to", err)
 		}
 	}
+
+	recs, next, err := h.store.Range(r.Context(), vin, q)
+	if err != nil {
+		return err
+	}
+
+	resp := HistoryResponse{
+		Records: make([]RecordResponse, 0, len(recs)),
+		Next:    next,
+	}
+	for _, rec := range recs {
+		resp.Records = append(resp.Records, recordResponse(rec))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+type StatsResponse struct {
+	VIN vehicle.VIN `json:"vin"`
+	// Odometer is the total distance in meters, the vehicle drove.
+	Odometer float64       `json:"odometer"`
+	Buckets  []UsageBucket `json:"buckets"`
+}
+
+// HandleStats responds with the vehicle's odometer, and the rollups of its usage. The optional query parameter
+// "bucket" sets the size of the rollups: a multiple of an hour, e.g. "1h" (by default), or "1d" for the daily
+// rollups. The optional "from" and "to" (RFC 3339) select the rollups, that start in the time interval.
+func (h *VehicleHandler) HandleStats(w http.ResponseWriter, r *http.Request) error {
+	vin, err := extractVINFromURLPath(r.URL.Path)
+	if err != nil {
+		return badRequest("vin", err)
+	}
+
+	query := r.URL.Query()
+
+	q := UsageQuery{
+		Bucket: time.Hour,
+	}
+	if v := query.Get("bucket"); v != "" {
+		q.Bucket, err = parseBucket(v)
+		if err != nil {
+			return err
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		q.From, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return badRequest("from", err)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		q.To, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return badRequest("to", err)
+		}
+	}
+
+	usage, err := h.store.Usage(r.Context(), vin, q)
+	if err != nil {
+		return err
+	}
+
+	resp := StatsResponse{
+		VIN:      usage.VIN,
+		Odometer: usage.Odometer,
+		Buckets:  usage.Buckets,
+	}
+	if resp.Buckets == nil {
+		resp.Buckets = []UsageBucket{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// parseBucket parses the size of the usage rollups: a duration, or a number of days, e.g. "1d".
+func parseBucket(v string) (time.Duration, error) {
+	var bucket time.Duration
+	if strings.HasSuffix(v, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(v, "d"), 10, 64)
+		if err != nil {
+			return 0, badRequest("bucket", err)
+		}
+		if days > int64(maxUsageBucket/(24*time.Hour)) {
+			return 0, unprocessable("bucket", fmt.Errorf("bucket %s is longer than %s", v, maxUsageBucket))
+		}
+		bucket = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		bucket, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, badRequest("bucket", err)
+		}
+	}
+
+	if bucket > maxUsageBucket {
+		return 0, unprocessable("bucket", fmt.Errorf("bucket %s is longer than %s", v, maxUsageBucket))
+	}
+	if bucket <= 0 || bucket%time.Hour != 0 {
+		return 0, unprocessable("bucket", fmt.Errorf("bucket %s isn't a positive multiple of an hour", v))
+	}
+	return bucket, nil
+}
+
+// eventWriter writes the server-sent events.
+// Refer to https://html.spec.whatwg.org/multipage/server-sent-events.html
+type eventWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w *eventWriter) WriteRetry(retry time.Duration) {
+	fmt.Fprintf(w.w, "retry: %d\n\n", retry.Milliseconds())
+	w.f.Flush()
+}
+
+func (w *eventWriter) WriteComment(comment string) {
+	fmt.Fprintf(w.w, ": %s\n\n", comment)
+	w.f.Flush()
+}
+
+func (w *eventWriter) WriteEvent(event, id string, resp interface{}) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("eventWriter: failed to encode json: %s", err)
+		return
+	}
+	if event != "" {
+		fmt.Fprintf(w.w, "event: %s\n", event)
+	}
+	if id != "" {
+		fmt.Fprintf(w.w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w.w, "data: %s\n\n", data)
+	w.f.Flush()
 }
 
 type streamWriter struct {
@@ -146,7 +787,7 @@ type streamWriter struct {
 	enc *json.Encoder
 }
 
-func (w *streamWriter) WriteChunk(resp PositionResponse) {
+func (w *streamWriter) WriteChunk(resp interface{}) {
 	if err := w.enc.Encode(resp); err != nil {
 		log.Printf("streamWriter: failed to encode json: %s", err)
 	} else {
@@ -3,7 +3,10 @@ package fleetstate
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,6 +14,9 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
 )
 
 func TestVehicleHandler_HandleUpdatePosition(t *testing.T) {
@@ -41,18 +47,54 @@ func TestVehicleHandler_HandleUpdatePosition(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ts, lat, lon, err := reader.Read()
+	rec, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Ts.IsZero() {
+		t.Errorf("unexpected ts %v", rec.Ts)
+	}
+	if want := 13.404954; want != rec.Lon {
+		t.Errorf("lon: want %v got %v", want, rec.Lon)
+	}
+	if want := 52.520008; want != rec.Lat {
+		t.Errorf("lat: want %v got %v", want, rec.Lat)
+	}
+}
+
+func TestVehicleHandler_HandleUpdatePosition_WithTs(t *testing.T) {
+	store := NewMemStoreWithOptions(MemStoreOptions{MaxLateness: time.Hour})
+	handler := NewVehicleHandler(store)
+
+	now := time.Now().UTC()
+
+	for _, ts := range []time.Time{now, now.Add(-time.Minute)} {
+		v := url.Values{
+			"ts":  []string{ts.Format(time.RFC3339Nano)},
+			"lat": []string{"52.520008"},
+			"lon": []string{"13.404954"},
+		}
+		r := httptest.NewRequest(http.MethodPost, "/the1vin", strings.NewReader(v.Encode()))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		if err := handler.HandleUpdatePosition(w, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recs, _, err := store.Range(context.Background(), "THE1VIN", RangeQuery{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if ts.IsZero() {
-		t.Errorf("unexpected ts %v", ts)
+	if want, got := 2, len(recs); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
 	}
-	if want := 13.404954; want != lon {
-		t.Errorf("lon: want %v got %v", want, lon)
+	if want, got := now.Add(-time.Minute), recs[0].Ts; !want.Equal(got) {
+		t.Fatalf("ts: want %v got %v", want, got)
 	}
-	if want := 52.520008; want != lat {
-		t.Errorf("lat: want %v got %v", want, lat)
+	if want, got := now, recs[1].Ts; !want.Equal(got) {
+		t.Fatalf("ts: want %v got %v", want, got)
 	}
 }
 
@@ -87,6 +129,23 @@ func TestVehicleHandler_HandleUpdatePosition_BadRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("bad ts", func(t *testing.T) {
+		for _, ts := range []string{"yesterday", time.Now().Add(time.Hour).Format(time.RFC3339)} {
+			v := url.Values{
+				"ts":  []string{ts},
+				"lat": []string{"52.520008"},
+				"lon": []string{"13.404954"},
+			}
+			r := httptest.NewRequest(http.MethodPost, "/the1vin", strings.NewReader(v.Encode()))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			if err := handler.HandleUpdatePosition(w, r); err == nil {
+				t.Fatalf("HandleUpdatePosition %s: want error, got nil", ts)
+			}
+		}
+	})
+
 	t.Run("bad lat", func(t *testing.T) {
 		v := url.Values{
 			"lat": []string{"abc"},
@@ -102,17 +161,275 @@ func TestVehicleHandler_HandleUpdatePosition_BadRequest(t *testing.T) {
 	})
 }
 
-func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
+func TestVehicleHandler_HandleUpdatePosition_JSON(t *testing.T) {
 	store := NewMemStore()
 	handler := NewVehicleHandler(store)
 
+	body := `{"ts":"2020-10-06T10:00:00Z","lat":52.520008,"lon":13.404954}`
+	r := httptest.NewRequest(http.MethodPost, "/the1vin", strings.NewReader(body))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	if err := handler.HandleUpdatePosition(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := http.StatusCreated; want != w.Code {
+		t.Fatalf("HandleUpdatePosition: unexpected response status: want %v got %v", want, w.Code)
+	}
+
+	recs, _, err := store.Range(context.Background(), "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(recs); want != got {
+		t.Fatalf("records: want %d got %d", want, got)
+	}
+	if want := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC); !want.Equal(recs[0].Ts) {
+		t.Errorf("ts: want %v got %v", want, recs[0].Ts)
+	}
+	if want := 52.520008; want != recs[0].Lat {
+		t.Errorf("lat: want %v got %v", want, recs[0].Lat)
+	}
+}
+
+func TestVehicleHandler_HandleUpdatePosition_Telemetry(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store).Handler()
+
+	body := `{"version":1,"ts":"2020-10-06T10:00:00Z","lat":52.520008,"lon":13.404954,` +
+		`"battery":87.5,"altitude":34,"accuracy":4.5,"odometer":1200,"locked":true,"attributes":{"firmware":"1.2.3"}}`
+	r := httptest.NewRequest(http.MethodPost, "/the1vin", strings.NewReader(body))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if want := http.StatusCreated; want != w.Code {
+		t.Fatalf("HandleUpdatePosition: unexpected response status: want %v got %v: %s", want, w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/the1vin/history", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	want := `{"records":[{"version":1,"ts":"2020-10-06T10:00:00Z","lat":52.520008,"lon":13.404954,` +
+		`"battery":87.5,"altitude":34,"accuracy":4.5,"odometer":1200,"locked":true,"attributes":{"firmware":"1.2.3"}}]}`
+	if got := strings.TrimSpace(w.Body.String()); want != got {
+		t.Fatalf("HandleHistory: want %s got %s", want, got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/the1vin", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var resp VehicleResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.TelemetryFields == nil || resp.Battery == nil || *resp.Battery != 87.5 {
+		t.Fatalf("HandleVehicle: want battery 87.5, got %+v", resp.TelemetryFields)
+	}
+	if resp.Locked == nil || !*resp.Locked {
+		t.Fatalf("HandleVehicle: want locked, got %+v", resp.TelemetryFields)
+	}
+}
+
+func TestVehicleHandler_HandleUpdatePosition_BadTelemetry(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store).Handler()
+
+	for _, body := range []string{
+		`{"version":2,"lat":52.520008,"lon":13.404954}`,
+		`{"lat":52.520008,"lon":13.404954,"battery":101}`,
+		`{"lat":52.520008,"lon":13.404954,"accuracy":-1}`,
+		`{"lat":52.520008,"lon":13.404954,"attributes":{"":"empty key"}}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/the1vin", strings.NewReader(body))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if want := http.StatusUnprocessableEntity; want != w.Code {
+			t.Errorf("HandleUpdatePosition %s: unexpected response status: want %v got %v", body, want, w.Code)
+		}
+	}
+}
+
+func TestVehicleHandler_Handler_Errors(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store).Handler()
+
 	now := time.Now().UTC()
+	if err := store.Write(context.Background(), "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+		wantField   string
+	}{
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin.jpg",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "lat=1&lon=1",
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    CodeBadRequest,
+			wantField:   "vin",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "lat=abc&lon=1",
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    CodeBadRequest,
+			wantField:   "lat",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "lat=NaN&lon=1",
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    CodeUnprocessableEntity,
+			wantField:   "lat",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/json",
+			body:        `{"lat":1,"lon":500}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    CodeUnprocessableEntity,
+			wantField:   "lon",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/json",
+			body:        `{"lat":1}`,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    CodeBadRequest,
+			wantField:   "lon",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/json",
+			body:        `{"lat":1,`,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    CodeBadRequest,
+			wantField:   "body",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/json",
+			body:        `{"lat":1,"lon":1,"ts":"` + now.Add(time.Hour).Format(time.RFC3339) + `"}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    CodeUnprocessableEntity,
+			wantField:   "ts",
+		},
+		{
+			method:      http.MethodPost,
+			target:      "/the1vin",
+			contentType: "application/json",
+			body:        `{"lat":1,"lon":1,"ts":"` + now.Add(-time.Hour).Format(time.RFC3339) + `"}`,
+			wantStatus:  http.StatusConflict,
+			wantCode:    CodeConflict,
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/another1vin/history",
+			wantStatus: http.StatusNotFound,
+			wantCode:   CodeNotFound,
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/the1vin/history?cursor=abc",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeBadRequest,
+			wantField:  "cursor",
+		},
+		{
+			method:     http.MethodDelete,
+			target:     "/the1vin",
+			wantStatus: http.StatusNotFound,
+			wantCode:   CodeNotFound,
+		},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Add("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if tc.wantStatus != w.Code {
+				t.Fatalf("status: want %d got %d (%s)", tc.wantStatus, w.Code, w.Body)
+			}
+
+			var resp ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantCode != resp.Error.Code {
+				t.Errorf("code: want %q got %q", tc.wantCode, resp.Error.Code)
+			}
+			if tc.wantField != resp.Error.Field {
+				t.Errorf("field: want %q got %q", tc.wantField, resp.Error.Field)
+			}
+			if resp.Error.Message == "" {
+				t.Error("message: want non-empty")
+			}
+		})
+	}
+}
+
+func TestErrorHandler_ResponseStarted(t *testing.T) {
+	handler := errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if _, err := io.WriteString(w, "{}\n"); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return ErrReaderClosed
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	// the error isn't written in the middle of the stream
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Fatalf("status: want %d got %d", want, got)
+	}
+	if want, got := "{}\n", w.Body.String(); want != got {
+		t.Fatalf("body: want %q got %q", want, got)
+	}
+}
+
+func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
 
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 
 	// (Berlin, Cathedral)
-	if err := store.Write(ctx, "THE1VIN", now, 52.518898, 13.401797); err != nil {
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -129,7 +446,7 @@ func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		if err := handler.HandleStreamPosition(w, r); err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -137,15 +454,15 @@ func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// same vin, same coords (Berlin, Cathedral)
-	if err := store.Write(ctx, "THE1VIN", now.Add(time.Second), 52.518898, 13.401797); err != nil {
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.518898, Lon: 13.401797}); err != nil {
 		t.Fatal(err)
 	}
 	// same vin, different coords (Berlin, Fernsehturm)
-	if err := store.Write(ctx, "THE1VIN", now.Add(2*time.Second), 52.520645, 13.409779); err != nil {
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(2 * time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
 		t.Fatal(err)
 	}
 	// different vin, same coords (Berlin, Fernsehturm)
-	if err := store.Write(ctx, "ANOTHER1VIN", now.Add(3*time.Second), 52.520645, 13.409779); err != nil {
+	if err := store.Write(ctx, "ANOTHER1VIN", vehicle.Telemetry{Ts: now.Add(3 * time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -157,8 +474,8 @@ func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
 	wg.Wait()
 
 	for i, want := range []string{
-		`{"lat":52.518898,"lon":13.401797,"speed":0}`,
-		`{"lat":52.520645,"lon":13.409779,"speed":2066.191265042517}`,
+		`{"seq":2,"ts":"2020-10-06T10:00:01Z","lat":52.518898,"lon":13.401797,"speed":0,"heading":0,"acceleration":0,"dt":1,"distance":0}`,
+		`{"seq":3,"ts":"2020-10-06T10:00:02Z","lat":52.520645,"lon":13.409779,"speed":2066.191265042517,"heading":70.21363712014096,"acceleration":573.9420180673658,"dt":1,"distance":573.9420180673658}`,
 	} {
 		got, _ := respReader.ReadString('\n')
 		if want != strings.TrimSpace(got) {
@@ -170,6 +487,334 @@ func TestVehicleHandler_HandleStreamPosition(t *testing.T) {
 	}
 }
 
+func TestVehicleHandler_HandleStreamPosition_Distance(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandlerWithOptions(store, HandlerOptions{
+		Distance: geoutil.VincentyDistance,
+	})
+
+	now := time.Now().UTC()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// (Berlin, Cathedral)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream", nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPosition(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(time.Second)
+
+	// (Berlin, Fernsehturm)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	// give handler extra time to progress the stream
+	time.Sleep(time.Second)
+
+	cancelCtx()
+	wg.Wait()
+
+	var resp PositionResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	// the speed in km/h of the vehicle, that moved during a second
+	wantSpeed := geoutil.VincentyDistance(52.518898, 13.401797, 52.520645, 13.409779) * 3600
+	if resp.Speed != wantSpeed {
+		t.Fatalf("HandleStreamPosition: want speed %v got %v", wantSpeed, resp.Speed)
+	}
+	if haversineSpeed := 2066.191265042517; resp.Speed == haversineSpeed {
+		t.Fatalf("HandleStreamPosition: speed %v is calculated with the default distance", resp.Speed)
+	}
+}
+
+func TestVehicleHandler_HandleStreamPosition_Smooth(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	now := time.Now().UTC()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// (Berlin, Cathedral)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream?smooth=kalman", nil)
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPosition(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(time.Second)
+
+	// (Berlin, Fernsehturm)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	// give handler extra time to progress the stream
+	time.Sleep(time.Second)
+
+	cancelCtx()
+	wg.Wait()
+
+	var resp PositionResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := PositionResponse{Lat: 52.520645, Lon: 13.409779, Speed: 2066.191265042517}
+	if raw := resp.Raw; raw == nil || raw.Lat != want.Lat || raw.Lon != want.Lon || raw.Speed != want.Speed {
+		t.Fatalf("raw: want %+v got %+v", want, resp.Raw)
+	}
+	// the filter doesn't trust the jump, that is way beyond the accuracy of the positions
+	if resp.Speed >= resp.Raw.Speed || resp.Lat == want.Lat || resp.Lon == want.Lon {
+		t.Errorf("smoothed: want the position between the records got %+v", resp)
+	}
+	if want, got := resp.Raw.Heading, resp.Heading; math.Abs(want-got) > 1 {
+		t.Errorf("heading: want %v got %v", want, got)
+	}
+}
+
+func TestVehicleHandler_HandleStreamPosition_BadSmooth(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store).Handler()
+
+	if err := store.Write(context.Background(), "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, accept := range []string{"", "text/event-stream"} {
+		r := httptest.NewRequest(http.MethodGet, "/the1vin/stream?smooth=median", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: want status %d got %d: %s", accept, http.StatusUnprocessableEntity, w.Code, w.Body)
+		}
+	}
+}
+
+func TestVehicleHandler_HandleStreamPosition_Status(t *testing.T) {
+	store := NewMemStore()
+	monitor := NewStatusMonitor(store, StatusOptions{
+		OfflineAfter:  300 * time.Millisecond,
+		CheckInterval: 10 * time.Millisecond,
+	})
+	handler := NewVehicleHandlerWithOptions(store, HandlerOptions{Status: monitor})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := monitor.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give the monitor some time to subscribe
+	time.Sleep(100 * time.Millisecond)
+
+	// Berlin, Cathedral
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream", nil)
+	r = r.WithContext(streamCtx)
+	w := httptest.NewRecorder()
+
+	var streamWG sync.WaitGroup
+	streamWG.Add(1)
+	go func() {
+		defer streamWG.Done()
+		if err := handler.HandleStreamPosition(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// wait for the vehicle to go offline; the stream doesn't block, waiting for the next position
+	time.Sleep(500 * time.Millisecond)
+
+	cancelStream()
+	streamWG.Wait()
+
+	// the stream may, or may not, start before the vehicle went online
+	var ev StatusEvent
+	dec := json.NewDecoder(w.Body)
+	for ev.Status != StatusOffline {
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("HandleStreamPosition: want offline event got %v", err)
+		}
+		if ev.VIN != "THE1VIN" {
+			t.Fatalf("HandleStreamPosition: want THE1VIN got %+v", ev)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/the1vin", nil)
+	w = httptest.NewRecorder()
+	handler.Handler().ServeHTTP(w, r)
+
+	var resp VehicleResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := StatusOffline, resp.Status; want != got {
+		t.Fatalf("HandleVehicle: want status %q got %q", want, got)
+	}
+}
+
+func TestVehicleHandler_HandleStreamPositionEvents(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+	handler.keepAliveInterval = 300 * time.Millisecond
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Berlin, Cathedral
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPosition(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to start processing
+	time.Sleep(100 * time.Millisecond)
+
+	// Berlin, Fernsehturm
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	// give handler extra time to progress the stream and send a keep-alive
+	time.Sleep(500 * time.Millisecond)
+
+	cancelCtx()
+	wg.Wait()
+
+	if want, got := "text/event-stream", w.Header().Get("Content-Type"); want != got {
+		t.Fatalf("content-type: want %s got %s", want, got)
+	}
+
+	want := "retry: 3000\n\n" +
+		"id: 1601978401000000000-2\n" +
+		`data: {"seq":2,"ts":"2020-10-06T10:00:01Z","lat":52.520645,"lon":13.409779,"speed":2066.191265042517,"heading":70.21363712014096,"acceleration":0,"dt":1,"distance":573.9420180673658}` + "\n\n"
+	got := w.Body.String()
+	if !strings.HasPrefix(got, want) {
+		t.Fatalf("HandleStreamPositionEvents: want %q got %q", want, got)
+	}
+	if want := ": keepalive\n\n"; !strings.HasSuffix(got, want) {
+		t.Fatalf("HandleStreamPositionEvents: want keep-alive %q got %q", want, got)
+	}
+}
+
+func TestVehicleHandler_HandleStreamPositionEvents_LastEventID(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	for i := 0; i < 3; i++ {
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Second), Lat: 52.518898, Lon: 13.401797}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, _, err := store.Range(ctx, "THE1VIN", RangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/stream", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Last-Event-ID", recs[0].Cursor())
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := handler.HandleStreamPositionEvents(w, r); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give handler some time to catch up with the records after the last event
+	time.Sleep(100 * time.Millisecond)
+
+	cancelCtx()
+	wg.Wait()
+
+	body := w.Body.String()
+	for _, rec := range recs[1:] {
+		if want := "id: " + rec.Cursor() + "\n"; !strings.Contains(body, want) {
+			t.Errorf("HandleStreamPositionEvents: want %q in %q", want, body)
+		}
+	}
+	if notWant := "id: " + recs[0].Cursor() + "\n"; strings.Contains(body, notWant) {
+		t.Errorf("HandleStreamPositionEvents: don't want %q in %q", notWant, body)
+	}
+}
+
 func TestVehicleHandler_HandleStreamPosition_UnknownVIN(t *testing.T) {
 	store := NewMemStore()
 	handler := NewVehicleHandler(store)
@@ -181,3 +826,197 @@ func TestVehicleHandler_HandleStreamPosition_UnknownVIN(t *testing.T) {
 		t.Fatal("HandleStreamPosition: want error, got nil")
 	}
 }
+
+func TestVehicleHandler_HandleHistory(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ts := now.Add(time.Duration(i) * 30 * time.Minute)
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: ts, Lat: 52.518898, Lon: 13.401797}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := url.Values{
+		"from":  []string{"2020-10-06T10:00:00Z"},
+		"to":    []string{"2020-10-06T11:00:00Z"},
+		"limit": []string{"1"},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/the1vin/history?"+v.Encode(), nil)
+	w := httptest.NewRecorder()
+
+	if err := handler.HandleHistory(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp HistoryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(resp.Records); want != got {
+		t.Fatalf("HandleHistory: records want %d got %d", want, got)
+	}
+	if want, got := now, resp.Records[0].Ts; !want.Equal(got) {
+		t.Fatalf("HandleHistory: ts want %v got %v", want, got)
+	}
+	if resp.Next == "" {
+		t.Fatal("HandleHistory: want next cursor, got none")
+	}
+
+	v.Set("cursor", resp.Next)
+	r = httptest.NewRequest(http.MethodGet, "/the1vin/history?"+v.Encode(), nil)
+	w = httptest.NewRecorder()
+
+	if err := handler.HandleHistory(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"records":[{"version":1,"ts":"2020-10-06T10:30:00Z","lat":52.518898,"lon":13.401797}]}`
+	if got := strings.TrimSpace(w.Body.String()); want != got {
+		t.Fatalf("HandleHistory: want %s got %s", want, got)
+	}
+}
+
+func TestVehicleHandler_HandleHistory_BadRequest(t *testing.T) {
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	if err := store.Write(context.Background(), "THE1VIN", vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		"from=yesterday",
+		"to=1602000000",
+		"limit=0",
+		"limit=100000",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/the1vin/history?"+query, nil)
+		w := httptest.NewRecorder()
+
+		if err := handler.HandleHistory(w, r); err == nil {
+			t.Fatalf("HandleHistory %s: want error, got nil", query)
+		}
+	}
+}
+
+func TestVehicleHandler_HandleVehicle(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	handler := NewVehicleHandler(store)
+
+	now := time.Now().UTC().Add(-time.Minute)
+	// Berlin, Cathedral
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+	// Berlin, Fernsehturm
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Second), Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/the1vin", nil)
+	w := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(w, r)
+
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Fatalf("status: want %d got %d: %s", want, got, w.Body)
+	}
+
+	var resp VehicleResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := VehicleResponse{
+		VIN:   "THE1VIN",
+		Ts:    now.Add(time.Second),
+		Lat:   52.520645,
+		Lon:   13.409779,
+		Speed: 2066.191265042517,
+	}
+	if resp.Age < 59 || resp.Age > 120 {
+		t.Errorf("age: want ~59s, got %v", resp.Age)
+	}
+	resp.Age = 0
+	if !resp.Ts.Equal(want.Ts) {
+		t.Errorf("ts: want %v, got %v", want.Ts, resp.Ts)
+	}
+	resp.Ts = want.Ts
+	if want != resp {
+		t.Errorf("HandleVehicle: want %+v, got %+v", want, resp)
+	}
+}
+
+func TestVehicleHandler_HandleStats(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	handler := NewVehicleHandler(store).Handler()
+
+	now := time.Date(2020, 10, 6, 10, 59, 30, 0, time.UTC)
+	// Berlin, Cathedral, Fernsehturm and back
+	for i, pos := range [][2]float64{
+		{52.518898, 13.401797},
+		{52.520645, 13.409779},
+		{52.518898, 13.401797},
+	} {
+		if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now.Add(time.Duration(i) * time.Minute), Lat: pos[0], Lon: pos[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query   string
+		buckets int
+	}{
+		{"", 2},
+		{"?bucket=1h", 2},
+		{"?bucket=1d", 1},
+		{"?from=2020-10-06T11:00:00Z", 1},
+		{"?to=2020-10-06T11:00:00Z", 1},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/the1vin/stats"+tc.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: want status %d got %d: %s", tc.query, http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp StatsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.VIN != "THE1VIN" {
+			t.Errorf("%q: want vin THE1VIN got %q", tc.query, resp.VIN)
+		}
+		if want, got := 2*geoutil.Distance(52.518898, 13.401797, 52.520645, 13.409779)*1000, resp.Odometer; math.Abs(want-got) > 1e-6 {
+			t.Errorf("%q: odometer: want %v got %v", tc.query, want, got)
+		}
+		if len(resp.Buckets) != tc.buckets {
+			t.Errorf("%q: want %d buckets got %+v", tc.query, tc.buckets, resp.Buckets)
+		}
+	}
+
+	for _, tc := range []struct {
+		target string
+		status int
+	}{
+		{"/the1vin/stats?bucket=1x", http.StatusBadRequest},
+		{"/the1vin/stats?from=yesterday", http.StatusBadRequest},
+		{"/the1vin/stats?bucket=30m", http.StatusUnprocessableEntity},
+		{"/the1vin/stats?bucket=0d", http.StatusUnprocessableEntity},
+		{"/the1vin/stats?bucket=400d", http.StatusUnprocessableEntity},
+		{"/unknown1vin/stats", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d got %d: %s", tc.target, tc.status, w.Code, w.Body)
+		}
+	}
+}
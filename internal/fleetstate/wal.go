@@ -0,0 +1,566 @@
+package fleetstate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+// The log is a sequence of segment files in a directory. Every segment is a sequence of frames:
+//
+//	| length (4 bytes) | crc32c of payload (4 bytes) | payload (length bytes) |
+//
+// A frame's payload starts with the version of its encoding, followed by the encoded record. Version 1 has
+// the vehicle's position only:
+//
+//	| ts (8 bytes) | lat (8 bytes) | lon (8 bytes) | vin |
+//
+// Version 2 adds the optional fields of the telemetry; the mask has a bit for every field the record has,
+// the strings are prefixed with their uvarint-encoded length:
+//
+//	| ts | lat | lon | vin | mask (1 byte) | battery | altitude | accuracy | odometer | locked (1 byte) | attributes |
+//
+// The attributes are the uvarint-encoded number of the attributes, followed by the keys and the values.
+// Version 3 appends the uvarint-encoded version of the telemetry schema; the records of the older versions
+// are of the telemetry version 1. Version 4 appends the uvarint-encoded sequence number of the record, so the cursors
+// stay valid after the log is replayed; the records of the older versions are numbered, as they are replayed.
+const (
+	walSegmentExt = ".wal"
+
+	walHeaderSize     = 8
+	walMaxPayloadSize = 1 << 16
+
+	walRecordV1 byte = 1
+	walRecordV2 byte = 2
+	walRecordV3 byte = 3
+	walRecordV4 byte = 4
+)
+
+// The bits of the mask of the fields, a record of version 2 has.
+const (
+	walFieldBattery byte = 1 << iota
+	walFieldAltitude
+	walFieldAccuracy
+	walFieldOdometer
+	walFieldLocked
+	walFieldAttributes
+)
+
+var (
+	errWALTornRecord = errors.New("torn record")
+	errWALCorrupted  = errors.New("corrupted record")
+
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// walRecord is a single entry of the write-ahead log.
+type walRecord struct {
+	VIN vehicle.VIN
+	// Seq is the sequence number of the record; zero, if the record was logged before the numbers were
+	Seq uint64
+	vehicle.Telemetry
+}
+
+func (rec walRecord) appendTo(buf []byte) []byte {
+	// reserve space for the header, it's filled in after the payload is encoded
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderSize)...)
+
+	buf = append(buf, walRecordV4)
+	buf = appendUint64(buf, uint64(rec.Ts.UnixNano()))
+	buf = appendUint64(buf, math.Float64bits(rec.Lat))
+	buf = appendUint64(buf, math.Float64bits(rec.Lon))
+	buf = appendString(buf, string(rec.VIN))
+	buf = rec.appendFields(buf)
+	version := rec.Version
+	if version == 0 {
+		version = vehicle.TelemetryVersion
+	}
+	buf = appendUvarint(buf, uint64(version))
+	buf = appendUvarint(buf, rec.Seq)
+
+	payload := buf[start+walHeaderSize:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, walCRCTable))
+
+	return buf
+}
+
+func (rec walRecord) appendFields(buf []byte) []byte {
+	f := rec.TelemetryFields
+
+	var mask byte
+	for _, field := range []struct {
+		bit byte
+		ok  bool
+	}{
+		{walFieldBattery, f.Battery != nil},
+		{walFieldAltitude, f.Altitude != nil},
+		{walFieldAccuracy, f.Accuracy != nil},
+		{walFieldOdometer, f.Odometer != nil},
+		{walFieldLocked, f.Locked != nil},
+		{walFieldAttributes, len(f.Attributes) > 0},
+	} {
+		if field.ok {
+			mask |= field.bit
+		}
+	}
+	buf = append(buf, mask)
+
+	for _, v := range []*float64{f.Battery, f.Altitude, f.Accuracy, f.Odometer} {
+		if v != nil {
+			buf = appendUint64(buf, math.Float64bits(*v))
+		}
+	}
+	if f.Locked != nil {
+		var locked byte
+		if *f.Locked {
+			locked = 1
+		}
+		buf = append(buf, locked)
+	}
+	if len(f.Attributes) > 0 {
+		keys := make([]string, 0, len(f.Attributes))
+		for k := range f.Attributes {
+			keys = append(keys, k)
+		}
+		// the order of the keys makes the encoding of the same record stable
+		sort.Strings(keys)
+
+		buf = appendUvarint(buf, uint64(len(keys)))
+		for _, k := range keys {
+			buf = appendString(buf, k)
+			buf = appendString(buf, f.Attributes[k])
+		}
+	}
+	return buf
+}
+
+func decodeWALRecord(payload []byte) (rec walRecord, err error) {
+	if len(payload) == 0 {
+		return rec, fmt.Errorf("%w: empty payload", errWALCorrupted)
+	}
+	switch payload[0] {
+	case walRecordV1:
+		payload = payload[1:]
+		if len(payload) < 3*8+1 {
+			return rec, fmt.Errorf("%w: short payload", errWALCorrupted)
+		}
+		rec.Ts = time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:]))).UTC()
+		rec.Lat = math.Float64frombits(binary.BigEndian.Uint64(payload[8:]))
+		rec.Lon = math.Float64frombits(binary.BigEndian.Uint64(payload[16:]))
+		rec.VIN = vehicle.VIN(payload[24:])
+		rec.Version = 1
+		return rec, nil
+	case walRecordV2, walRecordV3, walRecordV4:
+		d := &walDecoder{buf: payload[1:]}
+		rec.Ts = time.Unix(0, int64(d.uint64())).UTC()
+		rec.Lat = math.Float64frombits(d.uint64())
+		rec.Lon = math.Float64frombits(d.uint64())
+		rec.VIN = vehicle.VIN(d.string())
+		rec.TelemetryFields = d.fields()
+		rec.Version = 1
+		if payload[0] >= walRecordV3 {
+			rec.Version = int(d.uvarint())
+		}
+		if payload[0] >= walRecordV4 {
+			rec.Seq = d.uvarint()
+		}
+		if d.err == nil && len(d.buf) > 0 {
+			d.err = errors.New("trailing bytes")
+		}
+		if d.err != nil {
+			return rec, fmt.Errorf("%w: %v", errWALCorrupted, d.err)
+		}
+		if rec.VIN == "" {
+			return rec, fmt.Errorf("%w: empty vin", errWALCorrupted)
+		}
+		return rec, nil
+	default:
+		return rec, fmt.Errorf("%w: unknown version %d", errWALCorrupted, payload[0])
+	}
+}
+
+// walDecoder decodes the payload of a record. After the payload turns out short, the decoder returns
+// zero values, and keeps the error.
+type walDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *walDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errors.New("short payload")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *walDecoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *walDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *walDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errors.New("bad uvarint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *walDecoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.err = errors.New("short payload")
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *walDecoder) float64() *float64 {
+	v := math.Float64frombits(d.uint64())
+	return &v
+}
+
+func (d *walDecoder) fields() (f vehicle.TelemetryFields) {
+	mask := d.byte()
+	if mask&walFieldBattery != 0 {
+		f.Battery = d.float64()
+	}
+	if mask&walFieldAltitude != 0 {
+		f.Altitude = d.float64()
+	}
+	if mask&walFieldAccuracy != 0 {
+		f.Accuracy = d.float64()
+	}
+	if mask&walFieldOdometer != 0 {
+		f.Odometer = d.float64()
+	}
+	if mask&walFieldLocked != 0 {
+		locked := d.byte() != 0
+		f.Locked = &locked
+	}
+	if mask&walFieldAttributes != 0 {
+		n := d.uvarint()
+		// every attribute takes at least two bytes, so the count can't exceed the rest of the payload
+		if n > uint64(len(d.buf))/2 {
+			d.err = errors.New("short payload")
+			return f
+		}
+		f.Attributes = make(map[string]string, n)
+		for i := uint64(0); i < n; i++ {
+			k := d.string()
+			f.Attributes[k] = d.string()
+		}
+	}
+	return f
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readWALSegment reads the frames from r, calling fn for every decoded record.
+// It returns the number of bytes of valid frames read. If the segment ends with an incomplete or
+// a corrupted frame, it returns errWALTornRecord.
+func readWALSegment(r io.Reader, fn func(rec walRecord) error) (n int64, err error) {
+	br := bufio.NewReader(r)
+
+	var (
+		header  [walHeaderSize]byte
+		payload []byte
+	)
+	for {
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, errWALTornRecord
+		}
+
+		size := binary.BigEndian.Uint32(header[0:])
+		sum := binary.BigEndian.Uint32(header[4:])
+		if size == 0 || size > walMaxPayloadSize {
+			return n, errWALTornRecord
+		}
+
+		if cap(payload) < int(size) {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return n, errWALTornRecord
+		}
+		if crc32.Checksum(payload, walCRCTable) != sum {
+			return n, errWALTornRecord
+		}
+
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return n, errWALTornRecord
+		}
+		if err := fn(rec); err != nil {
+			return n, err
+		}
+
+		n += walHeaderSize + int64(size)
+	}
+}
+
+// wal is a segmented append-only write-ahead log. It's not safe for concurrent use.
+type wal struct {
+	dir         string
+	segmentSize int64
+	syncAlways  bool
+
+	f       *os.File
+	segment uint64
+	size    int64
+	dirty   bool
+	buf     []byte
+}
+
+// openWAL opens the log in the directory dir, creating the directory if needed.
+// Every record found in the log is passed to replay, along with its segment. If the last segment ends with a torn record,
+// e.g. after a crash in the middle of a write, the segment is truncated to its last complete record.
+func openWAL(dir string, segmentSize int64, syncAlways bool, replay func(segment uint64, rec walRecord) error) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		syncAlways:  syncAlways,
+	}
+
+	if len(segments) == 0 {
+		if err := l.openSegment(1); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		n, err := replayWALSegment(l.segmentPath(segment), func(rec walRecord) error {
+			return replay(segment, rec)
+		})
+		if errors.Is(err, errWALTornRecord) && last {
+			if err := os.Truncate(l.segmentPath(segment), n); err != nil {
+				return nil, fmt.Errorf("could not truncate torn segment %d: %w", segment, err)
+			}
+		} else if errors.Is(err, errWALTornRecord) {
+			return nil, fmt.Errorf("segment %d: %w at offset %d", segment, errWALCorrupted, n)
+		} else if err != nil {
+			return nil, fmt.Errorf("could not replay segment %d: %w", segment, err)
+		}
+	}
+
+	if err := l.openSegment(segments[len(segments)-1]); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func replayWALSegment(path string, replay func(rec walRecord) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return readWALSegment(f, replay)
+}
+
+func listWALSegments(dir string) ([]uint64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (l *wal) segmentPath(segment uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", segment, walSegmentExt))
+}
+
+func (l *wal) openSegment(segment uint64) error {
+	f, err := os.OpenFile(l.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// make sure the new segment's directory entry is durable
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.segment = segment
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *wal) rotate() error {
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return l.openSegment(l.segment + 1)
+}
+
+func (l *wal) Append(rec walRecord) error {
+	l.buf = rec.appendTo(l.buf[:0])
+	if len(l.buf) > walHeaderSize+walMaxPayloadSize {
+		return fmt.Errorf("record of %d bytes exceeds max size %d", len(l.buf)-walHeaderSize, walMaxPayloadSize)
+	}
+
+	if l.size > 0 && l.size+int64(len(l.buf)) > l.segmentSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("could not rotate segment: %w", err)
+		}
+	}
+
+	if _, err := l.f.Write(l.buf); err != nil {
+		// drop whatever part of the frame made it to the file, so the following appends
+		// don't end up after a torn record
+		if terr := l.f.Truncate(l.size); terr != nil {
+			return fmt.Errorf("could not write record: %v, truncate: %w", err, terr)
+		}
+		return fmt.Errorf("could not write record: %w", err)
+	}
+	l.size += int64(len(l.buf))
+
+	if l.syncAlways {
+		return l.f.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// walPos is the position in the log, right after a record.
+type walPos struct {
+	segment uint64
+	offset  int64
+}
+
+func (p walPos) before(other walPos) bool {
+	if p.segment != other.segment {
+		return p.segment < other.segment
+	}
+	return p.offset < other.offset
+}
+
+// pos returns the position after the last appended record.
+func (l *wal) pos() walPos {
+	return walPos{segment: l.segment, offset: l.size}
+}
+
+// remove removes the segment, the log no longer appends to.
+func (l *wal) remove(segment uint64) error {
+	if segment >= l.segment {
+		return fmt.Errorf("could not remove segment %d: it's not sealed", segment)
+	}
+	return os.Remove(l.segmentPath(segment))
+}
+
+// Sync commits the appended records to the stable storage.
+func (l *wal) Sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+func (l *wal) Close() error {
+	if err := l.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
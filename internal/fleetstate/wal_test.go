@@ -0,0 +1,280 @@
+package fleetstate
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+)
+
+func TestWAL_AppendReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Now().UTC()
+	want := []walRecord{
+		{VIN: "THE1VIN", Seq: 1, Telemetry: vehicle.Telemetry{Version: 1, Ts: now, Lat: 52.518898, Lon: 13.401797}},
+		{VIN: "THE2VIN", Seq: 1, Telemetry: vehicle.Telemetry{Version: 1, Ts: now.Add(time.Second), Lat: -61.698146, Lon: -58.585985}},
+		{VIN: "THE1VIN", Seq: 2, Telemetry: vehicle.Telemetry{Version: 1, Ts: now.Add(2 * time.Second), Lat: 52.520645, Lon: 13.409779}},
+	}
+
+	l, err := openWAL(dir, DefaultSegmentSize, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range want {
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testWALReplay(t, dir, DefaultSegmentSize)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("replay: want %v got %v", want, got)
+	}
+}
+
+func TestWAL_Rotate(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Now().UTC()
+	rec := walRecord{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: now, Lat: 1, Lon: 1}}
+	// every segment fits two records at most
+	segmentSize := int64(len(rec.appendTo(nil)) * 2)
+
+	l, err := openWAL(dir, segmentSize, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []walRecord
+	for i := 0; i < 5; i++ {
+		rec.Ts = now.Add(time.Duration(i) * time.Second)
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, rec)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(segments); want != got {
+		t.Fatalf("segments: want %d got %d", want, got)
+	}
+
+	got := testWALReplay(t, dir, segmentSize)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("replay: want %v got %v", want, got)
+	}
+}
+
+func TestWAL_TruncateTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Now().UTC()
+	want := []walRecord{
+		{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: now, Lat: 1, Lon: 1}},
+		{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: now.Add(time.Second), Lat: 2, Lon: 2}},
+	}
+
+	l, err := openWAL(dir, DefaultSegmentSize, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range want {
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := l.segmentPath(l.segment)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash in the middle of writing the third record
+	torn := walRecord{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: now.Add(2 * time.Second), Lat: 3, Lon: 3}}.appendTo(nil)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(torn[:len(torn)-3]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got := testWALReplay(t, dir, DefaultSegmentSize)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("replay: want %v got %v", want, got)
+	}
+
+	// the torn tail must be gone, so new records are appended after the last complete one
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2*(len(torn)), len(data); want != got {
+		t.Fatalf("segment size: want %d got %d", want, got)
+	}
+}
+
+func TestWAL_CorruptedSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	rec := walRecord{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: time.Now().UTC(), Lat: 1, Lon: 1}}
+	segmentSize := int64(len(rec.appendTo(nil)))
+
+	l, err := openWAL(dir, segmentSize, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a byte in the payload of the first (sealed) segment
+	path := filepath.Join(dir, "00000000000000000001"+walSegmentExt)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openWAL(dir, segmentSize, true, func(segment uint64, rec walRecord) error { return nil })
+	if !errors.Is(err, errWALCorrupted) {
+		t.Fatalf("open: want err %v got %v", errWALCorrupted, err)
+	}
+}
+
+func TestWAL_AppendReplay_Fields(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Now().UTC()
+	want := []walRecord{
+		{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{
+			Version: 1,
+			Ts:      now,
+			Lat:     52.518898,
+			Lon:     13.401797,
+			TelemetryFields: vehicle.TelemetryFields{
+				Battery:  vehicle.Float64(87.5),
+				Altitude: vehicle.Float64(-3.2),
+				Accuracy: vehicle.Float64(4),
+				Odometer: vehicle.Float64(12345.6),
+				Locked:   vehicle.Bool(false),
+				Attributes: map[string]string{
+					"firmware": "1.2.3",
+					"model":    "",
+				},
+			},
+		}},
+		{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{
+			Version: 1,
+			Ts:      now.Add(time.Second),
+			Lat:     52.520645,
+			Lon:     13.409779,
+			TelemetryFields: vehicle.TelemetryFields{
+				Locked: vehicle.Bool(true),
+			},
+		}},
+	}
+
+	l, err := openWAL(dir, DefaultSegmentSize, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range want {
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := testWALReplay(t, dir, DefaultSegmentSize)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("replay: want %v got %v", want, got)
+	}
+}
+
+func TestDecodeWALRecord_V1(t *testing.T) {
+	// the records of version 1 were written, before the log had the optional fields, and the telemetry versions
+	ts := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte{walRecordV1}
+	payload = appendUint64(payload, uint64(ts.UnixNano()))
+	payload = appendUint64(payload, math.Float64bits(52.518898))
+	payload = appendUint64(payload, math.Float64bits(13.401797))
+	payload = append(payload, "THE1VIN"...)
+
+	got, err := decodeWALRecord(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := walRecord{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{Version: 1, Ts: ts, Lat: 52.518898, Lon: 13.401797}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("decode: want %v got %v", want, got)
+	}
+}
+
+func TestDecodeWALRecord_Corrupted(t *testing.T) {
+	rec := walRecord{VIN: "THE1VIN", Telemetry: vehicle.Telemetry{
+		Ts: time.Now().UTC(),
+		TelemetryFields: vehicle.TelemetryFields{
+			Battery:    vehicle.Float64(50),
+			Attributes: map[string]string{"firmware": "1.2.3"},
+		},
+	}}
+	payload := rec.appendTo(nil)[walHeaderSize:]
+
+	cases := map[string][]byte{
+		"empty":           {},
+		"unknown version": append([]byte{5}, payload[1:]...),
+		"short":           payload[:len(payload)-1],
+		"trailing":        append(append([]byte(nil), payload...), 0),
+	}
+	for name, payload := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeWALRecord(payload)
+			if !errors.Is(err, errWALCorrupted) {
+				t.Fatalf("decode: want err %v got %v", errWALCorrupted, err)
+			}
+		})
+	}
+}
+
+func testWALReplay(t *testing.T, dir string, segmentSize int64) []walRecord {
+	t.Helper()
+
+	var recs []walRecord
+	l, err := openWAL(dir, segmentSize, true, func(segment uint64, rec walRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
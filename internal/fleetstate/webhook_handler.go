@@ -0,0 +1,173 @@
+package fleetstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
+)
+
+const (
+	defaultAttemptsLimit = 100
+	maxAttemptsLimit     = 1000
+)
+
+type WebhookHandler struct {
+	dispatcher *webhook.Dispatcher
+}
+
+func NewWebhookHandler(dispatcher *webhook.Dispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		dispatcher: dispatcher,
+	}
+}
+
+func (h *WebhookHandler) Handler() http.Handler {
+	return errorHandler(func(w http.ResponseWriter, r *http.Request) error {
+		p := path.Clean("/" + r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && p == "/":
+			return h.HandleWebhooks(w, r)
+		case r.Method == http.MethodPost && p == "/":
+			return h.HandleCreateWebhook(w, r)
+		case r.Method == http.MethodGet && p == "/deliveries":
+			return h.HandleDeliveries(w, r)
+		case r.Method == http.MethodGet && strings.Count(p, "/") == 1:
+			return h.HandleWebhook(w, r)
+		case r.Method == http.MethodDelete && strings.Count(p, "/") == 1:
+			return h.HandleDeleteWebhook(w, r)
+		}
+		return ErrNotFound
+	})
+}
+
+type WebhookRequest struct {
+	URL string `json:"url"`
+	// Events are the types of the events to deliver. Empty Events means all types.
+	Events []string `json:"events"`
+	// Secret is the key to sign the requests with. Empty Secret means the server generates a random one.
+	Secret string `json:"secret"`
+}
+
+type WebhooksResponse struct {
+	Webhooks []webhook.Subscription `json:"webhooks"`
+}
+
+// HandleWebhooks responds with all webhooks. The secrets of the webhooks aren't included.
+func (h *WebhookHandler) HandleWebhooks(w http.ResponseWriter, r *http.Request) error {
+	resp := WebhooksResponse{
+		Webhooks: h.dispatcher.Subscriptions(),
+	}
+	for i := range resp.Webhooks {
+		resp.Webhooks[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// HandleCreateWebhook registers the webhook from the JSON body. Only the response to this request
+// includes the webhook's secret.
+func (h *WebhookHandler) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) error {
+	var req WebhookRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return badRequest("url", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return unprocessable("url", fmt.Errorf("%q isn't an absolute http(s) URL", req.URL))
+	}
+	for _, typ := range req.Events {
+		if !isEventType(typ) {
+			return unprocessable("events", fmt.Errorf("unknown event type %q", typ))
+		}
+	}
+
+	sub, err := h.dispatcher.Subscribe(webhook.Subscription{
+		URL:    u.String(),
+		Events: req.Events,
+		Secret: req.Secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(sub)
+}
+
+func isEventType(typ string) bool {
+	for _, t := range EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleWebhook responds with the webhook. The webhook's secret isn't included.
+func (h *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) error {
+	sub, err := h.dispatcher.Subscription(webhookIDFromURLPath(r.URL.Path))
+	if err != nil {
+		return err
+	}
+	sub.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(sub)
+}
+
+// HandleDeleteWebhook deletes the webhook. The pending deliveries to the webhook are dropped.
+func (h *WebhookHandler) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	if err := h.dispatcher.Unsubscribe(webhookIDFromURLPath(r.URL.Path)); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func webhookIDFromURLPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+type DeliveriesResponse struct {
+	// Pending is the number of the deliveries, waiting for the next attempt.
+	Pending  int               `json:"pending"`
+	Attempts []webhook.Attempt `json:"attempts"`
+}
+
+// HandleDeliveries responds with the latest delivery attempts, oldest first. The optional query parameters
+// "webhook" and "event" select the attempts of a single webhook, or of a single event; "limit" sets the max number
+// of attempts.
+func (h *WebhookHandler) HandleDeliveries(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"), defaultAttemptsLimit, maxAttemptsLimit)
+	if err != nil {
+		return err
+	}
+
+	resp := DeliveriesResponse{
+		Pending: h.dispatcher.Pending(),
+		Attempts: h.dispatcher.Attempts(webhook.AttemptsQuery{
+			SubscriptionID: query.Get("webhook"),
+			EventID:        query.Get("event"),
+			Limit:          limit,
+		}),
+	}
+	if resp.Attempts == nil {
+		resp.Attempts = []webhook.Attempt{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,200 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+	"github.com/narqo/ree-fleet-sim/internal/webhook"
+)
+
+func TestWebhookHandler_Handler(t *testing.T) {
+	received := make(chan webhook.Event, 10)
+	var secret string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := webhook.Verify(secret, r.Header, body, time.Minute); err != nil {
+			t.Errorf("receiver: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var ev webhook.Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("receiver: %v", err)
+		}
+		received <- ev
+	}))
+	defer receiver.Close()
+
+	dispatcher, err := webhook.Open(webhook.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.Close()
+
+	handler := NewWebhookHandler(dispatcher).Handler()
+
+	body := `{"url":"` + receiver.URL + `/hook","events":["vehicle.new"]}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: want status %d got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var sub webhook.Subscription
+	if err := json.NewDecoder(w.Body).Decode(&sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.ID == "" || sub.Secret == "" {
+		t.Fatalf("create: want id and secret got %+v", sub)
+	}
+	secret = sub.Secret
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var list WebhooksResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Webhooks) != 1 || list.Webhooks[0].ID != sub.ID || list.Webhooks[0].Secret != "" {
+		t.Fatalf("list: want webhook %v without secret got %+v", sub.ID, list.Webhooks)
+	}
+
+	// publish the events of the fleet to the webhooks
+	store := NewGeofenceStore(NewMemStore(), GeofenceOptions{})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := PublishFleetEvents(ctx, store, dispatcher, FleetEventsOptions{}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give the publisher some time to subscribe
+	time.Sleep(100 * time.Millisecond)
+
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	if err := store.Write(ctx, "THE1VIN", vehicle.Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ev webhook.Event
+	select {
+	case ev = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+	if want := `{"vin":"THE1VIN","ts":"2020-10-06T10:00:00Z","lat":52.518898,"lon":13.401797}`; ev.Type != EventVehicleNew || string(ev.Data) != want {
+		t.Fatalf("receiver: want %s event %s got %s %s", EventVehicleNew, want, ev.Type, ev.Data)
+	}
+
+	// the attempt is logged after the response is received
+	time.Sleep(100 * time.Millisecond)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deliveries?webhook="+sub.ID, nil))
+	var deliveries DeliveriesResponse
+	if err := json.NewDecoder(w.Body).Decode(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries.Attempts) != 1 || !deliveries.Attempts[0].Delivered || deliveries.Attempts[0].EventID != ev.ID {
+		t.Fatalf("deliveries: want delivered event %s got %+v", ev.ID, deliveries.Attempts)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/"+sub.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: want status %d got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+sub.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get: want status %d got %d: %s", http.StatusNotFound, w.Code, w.Body)
+	}
+}
+
+func TestWebhookHandler_Handler_Errors(t *testing.T) {
+	dispatcher, err := webhook.Open(webhook.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dispatcher.Close()
+
+	handler := NewWebhookHandler(dispatcher).Handler()
+
+	cases := []struct {
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantField  string
+	}{
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"url":"/hook"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "url",
+		},
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"url":"ftp://example.com/hook"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "url",
+		},
+		{
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"url":"http://example.com/hook","events":["vehicle.unknown"]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantField:  "events",
+		},
+		{
+			method:     http.MethodDelete,
+			target:     "/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			method:     http.MethodGet,
+			target:     "/deliveries?limit=abc",
+			wantStatus: http.StatusBadRequest,
+			wantField:  "limit",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("want status %d got %d: %s", tc.wantStatus, w.Code, w.Body)
+			}
+
+			var resp ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Field != tc.wantField {
+				t.Fatalf("want field %q got %q", tc.wantField, resp.Error.Field)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+	"github.com/narqo/ree-fleet-sim/internal/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsMaxMessage   = 64 << 10
+)
+
+// DefaultMaxSubscriptions is the max number of vehicles, a WebSocket client can subscribe to, by default.
+const DefaultMaxSubscriptions = 1000
+
+// Actions of the subscription requests, a WebSocket client sends.
+const (
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+)
+
+// Types of the messages, the server sends over WebSocket.
+const (
+	MessageSubscribed   = "subscribed"
+	MessageUnsubscribed = "unsubscribed"
+	MessagePosition     = "position"
+	MessageStatus       = "status"
+	MessageError        = "error"
+)
+
+// SubscriptionRequest is a message, a WebSocket client sends to subscribe to, or unsubscribe from,
+// the positions of the vehicles.
+type SubscriptionRequest struct {
+	Action string   `json:"action"`
+	VINs   []string `json:"vins"`
+}
+
+// StreamMessage is a message, the server sends over WebSocket.
+type StreamMessage struct {
+	Type     string            `json:"type"`
+	VIN      vehicle.VIN       `json:"vin,omitempty"`
+	Position *PositionResponse `json:"position,omitempty"`
+	Status   *StatusEvent      `json:"status,omitempty"`
+	Error    *APIError         `json:"error,omitempty"`
+}
+
+// HandleWebSocket upgrades the connection to WebSocket, on which the client subscribes to the positions
+// of many vehicles. Every subscription reads the vehicle's positions from its own store's reader;
+// the readers are closed, when the client unsubscribes or the connection closes. If the handler tracks
+// the status of the vehicles, the client also receives the status events of the subscribed vehicles.
+// With "smooth=kalman" in the query of the upgrade request, the positions of all subscriptions are smoothed.
+// A browser's page can only open the connection, if it's served by the server, or its origin is allowed.
+func (h *FleetHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) error {
+	if err := h.checkOrigin(r); err != nil {
+		return err
+	}
+
+	opts, err := parseStreamOptions(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		var herr *websocket.HandshakeError
+		if errors.As(err, &herr) {
+			return &APIError{
+				Status:  herr.Status,
+				Code:    CodeBadRequest,
+				Message: herr.Message,
+				err:     err,
+			}
+		}
+		return err
+	}
+	conn.MaxMessageSize = wsMaxMessage
+
+	// the request's context isn't canceled, when the client of a hijacked connection goes away
+	ctx, cancel := context.WithCancel(r.Context())
+
+	sess := &wsSession{
+		conn:     conn,
+		store:    h.store,
+		distance: h.distance,
+		status:   h.status,
+		opts:     opts,
+		maxSubs:  h.maxSubscriptions,
+		subs:     make(map[vehicle.VIN]*wsSubscription),
+	}
+	defer func() {
+		cancel()
+		sess.wg.Wait()
+		conn.Close()
+	}()
+
+	sess.wg.Add(1)
+	go func() {
+		defer sess.wg.Done()
+		sess.keepAlive(ctx, h.keepAliveInterval)
+	}()
+
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			// the client has gone or broke the protocol; in the latter case, ReadMessage already sent the close
+			// with the code of the error
+			return nil
+		}
+		if typ != websocket.TextMessage {
+			sess.sendError("", badRequest("message", errors.New("expected text message")))
+			continue
+		}
+
+		var req SubscriptionRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			sess.sendError("", badRequest("message", err))
+			continue
+		}
+		sess.handleRequest(ctx, req)
+	}
+}
+
+// checkOrigin checks the origin of the WebSocket upgrade request. The requests without Origin, e.g. the ones
+// of the non-browser clients, are allowed.
+func (h *FleetHandler) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range h.allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return nil
+		}
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    CodeForbidden,
+		Message: fmt.Sprintf("origin %q isn't allowed", origin),
+	}
+}
+
+type wsSession struct {
+	conn     *websocket.Conn
+	store    Store
+	distance geoutil.DistanceFunc
+	status   *StatusMonitor
+	// opts are the options of the streams, the client selected in the upgrade request
+	opts streamOptions
+	// maxSubs is the max number of the subscriptions of the session
+	maxSubs int
+
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[vehicle.VIN]*wsSubscription
+}
+
+type wsSubscription struct {
+	cancel context.CancelFunc
+}
+
+func (sess *wsSession) handleRequest(ctx context.Context, req SubscriptionRequest) {
+	if req.Action != ActionSubscribe && req.Action != ActionUnsubscribe {
+		sess.sendError("", badRequest("action", fmt.Errorf("unknown action %q", req.Action)))
+		return
+	}
+
+	for _, s := range req.VINs {
+		vin, err := vehicle.VINFromString(s)
+		if err != nil {
+			sess.sendError("", badRequest("vin", err))
+			continue
+		}
+
+		switch req.Action {
+		case ActionSubscribe:
+			if err := sess.subscribe(ctx, vin); err != nil {
+				sess.sendError(vin, err)
+				continue
+			}
+			sess.send(StreamMessage{Type: MessageSubscribed, VIN: vin})
+		case ActionUnsubscribe:
+			sess.unsubscribe(vin)
+			sess.send(StreamMessage{Type: MessageUnsubscribed, VIN: vin})
+		}
+	}
+}
+
+func (sess *wsSession) subscribe(ctx context.Context, vin vehicle.VIN) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if _, ok := sess.subs[vin]; ok {
+		return nil
+	}
+	if len(sess.subs) >= sess.maxSubs {
+		return unprocessable("vins", fmt.Errorf("exceeds max %d subscriptions", sess.maxSubs))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	reader, err := sess.store.Reader(ctx, vin)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	sub := &wsSubscription{cancel: cancel}
+	sess.subs[vin] = sub
+
+	if sess.status != nil {
+		statuses := sess.status.SubscribeStatus(ctx, string(vin))
+		sess.wg.Add(1)
+		go func() {
+			defer sess.wg.Done()
+			sess.streamStatus(vin, statuses)
+		}()
+	}
+
+	sess.wg.Add(1)
+	go func() {
+		defer sess.wg.Done()
+		sess.streamPositions(ctx, vin, reader)
+
+		sess.mu.Lock()
+		if sess.subs[vin] == sub {
+			delete(sess.subs, vin)
+		}
+		sess.mu.Unlock()
+		cancel()
+	}()
+
+	return nil
+}
+
+func (sess *wsSession) unsubscribe(vin vehicle.VIN) {
+	sess.mu.Lock()
+	sub, ok := sess.subs[vin]
+	delete(sess.subs, vin)
+	sess.mu.Unlock()
+
+	if ok {
+		sub.cancel()
+	}
+}
+
+func (sess *wsSession) streamPositions(ctx context.Context, vin vehicle.VIN, reader Reader) {
+	track := newPositionTrack(sess.distance, sess.opts)
+
+	first := true
+	for {
+		rec, err := reader.Read()
+		if err != nil {
+			if ctx.Err() == nil {
+				sess.sendError(vin, err)
+			}
+			return
+		}
+		resp := track.next(rec)
+		if first {
+			// the first record only starts the track
+			first = false
+			continue
+		}
+
+		if err := sess.send(StreamMessage{Type: MessagePosition, VIN: vin, Position: &resp}); err != nil {
+			return
+		}
+	}
+}
+
+// streamStatus sends the vehicle's status events, until the subscription is closed.
+func (sess *wsSession) streamStatus(vin vehicle.VIN, sub *StatusSubscription) {
+	for {
+		ev, err := sub.Read()
+		if err != nil {
+			return
+		}
+		if ev.VIN != vin {
+			continue
+		}
+		if err := sess.send(StreamMessage{Type: MessageStatus, VIN: vin, Status: &ev}); err != nil {
+			return
+		}
+	}
+}
+
+// keepAlive periodically pings the client, to keep the idle connection open. It closes the connection,
+// if the ping can't be sent.
+func (sess *wsSession) keepAlive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sess.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := sess.conn.Ping(nil); err != nil {
+				sess.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (sess *wsSession) sendError(vin vehicle.VIN, err error) {
+	sess.send(StreamMessage{Type: MessageError, VIN: vin, Error: toAPIError(err)})
+}
+
+func (sess *wsSession) send(msg StreamMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("failed to encode stream message: %s", err)
+		return err
+	}
+	sess.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return sess.conn.WriteMessage(websocket.TextMessage, data)
+}
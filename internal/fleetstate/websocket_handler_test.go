@@ -0,0 +1,226 @@
+package fleetstate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
+	"github.com/narqo/ree-fleet-sim/internal/vehicle"
+	"github.com/narqo/ree-fleet-sim/internal/websocket"
+)
+
+func testReadStreamMessage(t *testing.T, conn *websocket.Conn) StreamMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg StreamMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func testSendSubscriptionRequest(t *testing.T, conn *websocket.Conn, action string, vins ...string) {
+	t.Helper()
+
+	data, err := json.Marshal(SubscriptionRequest{Action: action, VINs: vins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFleetHandler_HandleWebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStore()
+	vin1, vin2 := vehicle.VIN("THE1VIN"), vehicle.VIN("THE2VIN")
+	ts := time.Now().UTC().Add(-time.Minute)
+	for _, vin := range []vehicle.VIN{vin1, vin2} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: ts, Lat: 52.518898, Lon: 13.401797}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := NewFleetHandler(store)
+	server := httptest.NewServer(handler.Handler())
+	defer server.Close()
+
+	conn, err := websocket.Dial(ctx, server.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testSendSubscriptionRequest(t, conn, ActionSubscribe, "the1vin", "the2vin", "the3vin")
+
+	wantMsgs := []StreamMessage{
+		{Type: MessageSubscribed, VIN: vin1},
+		{Type: MessageSubscribed, VIN: vin2},
+		{Type: MessageError, VIN: "THE3VIN", Error: &APIError{Code: CodeNotFound}},
+	}
+	for _, want := range wantMsgs {
+		msg := testReadStreamMessage(t, conn)
+		if want.Type != msg.Type || want.VIN != msg.VIN {
+			t.Fatalf("message: want %s %s, got %s %s", want.Type, want.VIN, msg.Type, msg.VIN)
+		}
+		if want.Error != nil && (msg.Error == nil || want.Error.Code != msg.Error.Code) {
+			t.Fatalf("message error: want %s, got %v", want.Error.Code, msg.Error)
+		}
+	}
+
+	// the subscriptions stream the positions written after subscribing
+	ts0 := ts
+	ts = ts.Add(30 * time.Second)
+	if err := store.Write(ctx, vin2, vehicle.Telemetry{Ts: ts, Lat: 52.520645, Lon: 13.409779}); err != nil {
+		t.Fatal(err)
+	}
+	msg := testReadStreamMessage(t, conn)
+	if msg.Type != MessagePosition || msg.VIN != vin2 {
+		t.Fatalf("message: want %s %s, got %s %s", MessagePosition, vin2, msg.Type, msg.VIN)
+	}
+	if want := positionResponse(geoutil.Distance, Record{Ts: ts0, Lat: 52.518898, Lon: 13.401797}, Record{Ts: ts, Lat: 52.520645, Lon: 13.409779, Seq: 2}); msg.Position == nil || *msg.Position != want {
+		t.Fatalf("position: want %+v, got %+v", want, msg.Position)
+	}
+
+	testSendSubscriptionRequest(t, conn, ActionUnsubscribe, "the2vin")
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessageUnsubscribed || msg.VIN != vin2 {
+		t.Fatalf("message: want %s %s, got %s %s", MessageUnsubscribed, vin2, msg.Type, msg.VIN)
+	}
+
+	// the position of the unsubscribed vehicle isn't streamed
+	ts = ts.Add(30 * time.Second)
+	if err := store.Write(ctx, vin2, vehicle.Telemetry{Ts: ts, Lat: 52.521, Lon: 13.41}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, vin1, vehicle.Telemetry{Ts: ts, Lat: 52.521, Lon: 13.41}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessagePosition || msg.VIN != vin1 {
+		t.Fatalf("message: want %s %s, got %s %s", MessagePosition, vin1, msg.Type, msg.VIN)
+	}
+}
+
+func TestFleetHandler_HandleWebSocket_BadRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewFleetHandler(NewMemStore())
+	server := httptest.NewServer(handler.Handler())
+	defer server.Close()
+
+	conn, err := websocket.Dial(ctx, server.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, req := range []string{`{"action":"watch","vins":["the1vin"]}`, `not json`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		msg := testReadStreamMessage(t, conn)
+		if msg.Type != MessageError || msg.Error == nil || msg.Error.Code != CodeBadRequest {
+			t.Errorf("%s: want %s error, got %+v", req, CodeBadRequest, msg)
+		}
+	}
+}
+
+func TestFleetHandler_HandleWebSocket_NotUpgrade(t *testing.T) {
+	handler := NewFleetHandler(NewMemStore())
+
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	w := httptest.NewRecorder()
+	handler.Handler().ServeHTTP(w, r)
+
+	if want, got := http.StatusBadRequest, w.Code; want != got {
+		t.Errorf("status: want %d got %d", want, got)
+	}
+	if !strings.Contains(w.Body.String(), `"code":"bad_request"`) {
+		t.Errorf("body: unexpected %q", w.Body.String())
+	}
+}
+
+func TestFleetHandler_HandleWebSocket_Origin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewFleetHandlerWithOptions(NewMemStore(), HandlerOptions{AllowedOrigins: []string{"https://dashboard.example.com"}})
+	server := httptest.NewServer(handler.Handler())
+	defer server.Close()
+
+	cases := []struct {
+		origin string
+		wantOK bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"https://dashboard.example.com", true},
+		{"https://evil.example.com", false},
+	}
+	for _, tc := range cases {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		conn, err := websocket.Dial(ctx, server.URL+"/ws", header)
+		if tc.wantOK != (err == nil) {
+			t.Fatalf("origin %q: want ok %v, got %v", tc.origin, tc.wantOK, err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestFleetHandler_HandleWebSocket_MaxSubscriptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemStore()
+	for _, vin := range []vehicle.VIN{"THE1VIN", "THE2VIN"} {
+		if err := store.Write(ctx, vin, vehicle.Telemetry{Ts: time.Now().UTC(), Lat: 1, Lon: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := NewFleetHandlerWithOptions(store, HandlerOptions{MaxSubscriptions: 1})
+	server := httptest.NewServer(handler.Handler())
+	defer server.Close()
+
+	conn, err := websocket.Dial(ctx, server.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testSendSubscriptionRequest(t, conn, ActionSubscribe, "the1vin", "the2vin")
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessageSubscribed || msg.VIN != "THE1VIN" {
+		t.Fatalf("message: want %s THE1VIN, got %+v", MessageSubscribed, msg)
+	}
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessageError || msg.Error == nil || msg.Error.Code != CodeUnprocessableEntity {
+		t.Fatalf("message: want %s error, got %+v", CodeUnprocessableEntity, msg)
+	}
+
+	// the subscription frees its place, after the client unsubscribes
+	testSendSubscriptionRequest(t, conn, ActionUnsubscribe, "the1vin")
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessageUnsubscribed {
+		t.Fatalf("message: want %s, got %+v", MessageUnsubscribed, msg)
+	}
+	testSendSubscriptionRequest(t, conn, ActionSubscribe, "the2vin")
+	if msg := testReadStreamMessage(t, conn); msg.Type != MessageSubscribed || msg.VIN != "THE2VIN" {
+		t.Fatalf("message: want %s THE2VIN, got %+v", MessageSubscribed, msg)
+	}
+}
@@ -0,0 +1,99 @@
+package geoutil
+
+import (
+	"math"
+)
+
+// The functions below treat the Earth as a sphere, like Distance does.
+// Refer to https://www.movable-type.co.uk/scripts/latlong.html
+
+// InitialBearing returns the bearing in degrees, in range [0, 360), to follow from the point lat0, lon0
+// to reach the point lat1, lon1 along the great circle.
+func InitialBearing(lat0, lon0, lat1, lon1 float64) float64 {
+	phi0, phi1 := lat0*rad, lat1*rad
+	dlambda := (lon1 - lon0) * rad
+
+	y := math.Sin(dlambda) * math.Cos(phi1)
+	x := math.Cos(phi0)*math.Sin(phi1) - math.Sin(phi0)*math.Cos(phi1)*math.Cos(dlambda)
+	return normalizeBearing(math.Atan2(y, x) / rad)
+}
+
+// FinalBearing returns the bearing in degrees, in range [0, 360), the great circle from the point lat0, lon0
+// arrives at the point lat1, lon1 with. Unlike on a rhumb line, the bearing changes along the great circle.
+func FinalBearing(lat0, lon0, lat1, lon1 float64) float64 {
+	return normalizeBearing(InitialBearing(lat1, lon1, lat0, lon0) + 180)
+}
+
+// Destination returns the point at the distance in km from the point lat0, lon0, following the great circle
+// with the initial bearing in degrees.
+func Destination(lat0, lon0, bearing, distance float64) (lat1, lon1 float64) {
+	delta := distance / earthKm // angular distance in radians
+	phi0, lambda0 := lat0*rad, lon0*rad
+	theta := bearing * rad
+
+	sinPhi1 := math.Sin(phi0)*math.Cos(delta) + math.Cos(phi0)*math.Sin(delta)*math.Cos(theta)
+	phi1 := math.Asin(sinPhi1)
+	y := math.Sin(theta) * math.Sin(delta) * math.Cos(phi0)
+	x := math.Cos(delta) - math.Sin(phi0)*sinPhi1
+	lambda1 := lambda0 + math.Atan2(y, x)
+
+	return phi1 / rad, normalizeLon(lambda1 / rad)
+}
+
+// Interpolate returns the point at the fraction f of the way from the point lat0, lon0 to the point lat1, lon1
+// along the great circle. f of 0 is the first point, f of 1 is the second one.
+func Interpolate(lat0, lon0, lat1, lon1, f float64) (lat, lon float64) {
+	delta := Distance(lat0, lon0, lat1, lon1) / earthKm // angular distance in radians
+	if delta == 0 {
+		return lat0, lon0
+	}
+
+	phi0, lambda0 := lat0*rad, lon0*rad
+	phi1, lambda1 := lat1*rad, lon1*rad
+
+	a := math.Sin((1-f)*delta) / math.Sin(delta)
+	b := math.Sin(f*delta) / math.Sin(delta)
+	x := a*math.Cos(phi0)*math.Cos(lambda0) + b*math.Cos(phi1)*math.Cos(lambda1)
+	y := a*math.Cos(phi0)*math.Sin(lambda0) + b*math.Cos(phi1)*math.Sin(lambda1)
+	z := a*math.Sin(phi0) + b*math.Sin(phi1)
+
+	lat = math.Atan2(z, math.Sqrt(x*x+y*y)) / rad
+	lon = math.Atan2(y, x) / rad
+	return lat, normalizeLon(lon)
+}
+
+// Midpoint returns the point half of the way from the point lat0, lon0 to the point lat1, lon1
+// along the great circle.
+func Midpoint(lat0, lon0, lat1, lon1 float64) (lat, lon float64) {
+	phi0, lambda0 := lat0*rad, lon0*rad
+	phi1 := lat1 * rad
+	dlambda := (lon1 - lon0) * rad
+
+	bx := math.Cos(phi1) * math.Cos(dlambda)
+	by := math.Cos(phi1) * math.Sin(dlambda)
+	phi := math.Atan2(math.Sin(phi0)+math.Sin(phi1), math.Sqrt((math.Cos(phi0)+bx)*(math.Cos(phi0)+bx)+by*by))
+	lambda := lambda0 + math.Atan2(by, math.Cos(phi0)+bx)
+
+	return phi / rad, normalizeLon(lambda / rad)
+}
+
+// normalizeBearing maps the bearing in degrees to range [0, 360).
+func normalizeBearing(b float64) float64 {
+	b = math.Mod(b, 360)
+	if b < 0 {
+		b += 360
+	}
+	return b
+}
+
+// normalizeLon maps the longitude in degrees to range [-180, 180].
+func normalizeLon(lon float64) float64 {
+	if lon >= -180 && lon <= 180 {
+		return lon
+	}
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon - 180
+}
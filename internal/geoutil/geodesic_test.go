@@ -0,0 +1,106 @@
+package geoutil
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func assertNear(t *testing.T, name string, want, got, tolerance float64) {
+	t.Helper()
+	if math.Abs(want-got) > tolerance {
+		t.Errorf("%s: want %v got %v", name, want, got)
+	}
+}
+
+// The reference values are from https://www.movable-type.co.uk/scripts/latlong.html
+
+func TestBearing(t *testing.T) {
+	// Land's End to John o' Groats
+	lat0, lon0 := 50.06639, -5.71472
+	lat1, lon1 := 58.64389, -3.07
+
+	assertNear(t, "initial bearing", 9.1198, InitialBearing(lat0, lon0, lat1, lon1), 1e-3)
+	assertNear(t, "final bearing", 11.2752, FinalBearing(lat0, lon0, lat1, lon1), 1e-3)
+
+	cases := []struct {
+		Lat0, Lon0 float64
+		Lat1, Lon1 float64
+		Want       float64
+	}{
+		{0, 0, 1, 0, 0},
+		{0, 0, 0, 1, 90},
+		{0, 0, -1, 0, 180},
+		{0, 0, 0, -1, 270},
+		// across the antimeridian
+		{0, 179, 0, -179, 90},
+	}
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			assertNear(t, "initial bearing", tc.Want, InitialBearing(tc.Lat0, tc.Lon0, tc.Lat1, tc.Lon1), 1e-9)
+		})
+	}
+}
+
+func TestDestination(t *testing.T) {
+	lat, lon := Destination(53.3206, -1.7297, 96.0217, 124.8)
+	assertNear(t, "lat", 53.1883, lat, 1e-3)
+	assertNear(t, "lon", 0.1333, lon, 1e-3)
+
+	// across the antimeridian
+	lat, lon = Destination(0, 179.5, 90, Distance(0, 0, 0, 1))
+	assertNear(t, "lat", 0, lat, 1e-9)
+	assertNear(t, "lon", -179.5, lon, 1e-9)
+}
+
+func TestDestination_RoundTrip(t *testing.T) {
+	for _, lat0 := range []float64{0, 45, -60, 80, 89} {
+		for bearing := 0.0; bearing < 360; bearing += 30 {
+			for _, d := range []float64{0.01, 1, 100} {
+				lat1, lon1 := Destination(lat0, 13.4, bearing, d)
+
+				// Distance itself is precise to ~1 mm at short distances
+				assertNear(t, fmt.Sprintf("lat=%v bearing=%v distance", lat0, bearing), d, Distance(lat0, 13.4, lat1, lon1), math.Max(d*1e-9, 1e-6))
+				if d >= 1 {
+					assertNear(t, fmt.Sprintf("lat=%v bearing=%v bearing", lat0, bearing), bearing, InitialBearing(lat0, 13.4, lat1, lon1), 1e-6)
+				}
+			}
+		}
+	}
+}
+
+func TestMidpoint(t *testing.T) {
+	lat, lon := Midpoint(50.06639, -5.71472, 58.64389, -3.07)
+	assertNear(t, "lat", 54.3622, lat, 1e-3)
+	assertNear(t, "lon", -4.5306, lon, 1e-3)
+
+	ilat, ilon := Interpolate(50.06639, -5.71472, 58.64389, -3.07, 0.5)
+	assertNear(t, "interpolated lat", lat, ilat, 1e-9)
+	assertNear(t, "interpolated lon", lon, ilon, 1e-9)
+}
+
+func TestInterpolate(t *testing.T) {
+	lat0, lon0 := 52.518898, 13.401797 // Berlin, Cathedral
+	lat1, lon1 := 48.858370, 2.294481  // Paris, Eiffel Tower
+	d := Distance(lat0, lon0, lat1, lon1)
+
+	lat, lon := Interpolate(lat0, lon0, lat1, lon1, 0)
+	assertNear(t, "f=0 lat", lat0, lat, 1e-9)
+	assertNear(t, "f=0 lon", lon0, lon, 1e-9)
+
+	lat, lon = Interpolate(lat0, lon0, lat1, lon1, 1)
+	assertNear(t, "f=1 lat", lat1, lat, 1e-9)
+	assertNear(t, "f=1 lon", lon1, lon, 1e-9)
+
+	// the interpolated points lie on the great circle
+	for _, f := range []float64{0.1, 0.25, 0.75, 0.9} {
+		lat, lon := Interpolate(lat0, lon0, lat1, lon1, f)
+		assertNear(t, fmt.Sprintf("f=%v distance from start", f), f*d, Distance(lat0, lon0, lat, lon), 1e-6)
+		assertNear(t, fmt.Sprintf("f=%v distance to end", f), (1-f)*d, Distance(lat, lon, lat1, lon1), 1e-6)
+	}
+
+	lat, lon = Interpolate(lat0, lon0, lat0, lon0, 0.5)
+	if lat != lat0 || lon != lon0 {
+		t.Errorf("same point: want %v, %v got %v, %v", lat0, lon0, lat, lon)
+	}
+}
@@ -0,0 +1,174 @@
+package geoutil
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxGeohashPrecision is the max length of a geohash; the cell of a 12-chars geohash is ~37 x 19 mm.
+const MaxGeohashPrecision = 12
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+var geohashDecodeMap [256]int8
+
+func init() {
+	for i := range geohashDecodeMap {
+		geohashDecodeMap[i] = -1
+	}
+	for i := 0; i < len(geohashAlphabet); i++ {
+		geohashDecodeMap[geohashAlphabet[i]] = int8(i)
+	}
+}
+
+// EncodeGeohash returns the geohash of the point lat, lon with precision chars, in range [1, MaxGeohashPrecision].
+// Refer to https://en.wikipedia.org/wiki/Geohash
+func EncodeGeohash(lat, lon float64, precision int) string {
+	if precision < 1 {
+		precision = 1
+	}
+	if precision > MaxGeohashPrecision {
+		precision = MaxGeohashPrecision
+	}
+
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+
+	var (
+		buf   strings.Builder
+		bits  int
+		ch    byte
+		isLon = true
+	)
+	buf.Grow(precision)
+	for buf.Len() < precision {
+		// bits alternate starting from longitude, halving the interval every time
+		ch <<= 1
+		if isLon {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				ch |= 1
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		isLon = !isLon
+
+		bits++
+		if bits == 5 {
+			buf.WriteByte(geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return buf.String()
+}
+
+// GeohashBounds returns the cell of the geohash.
+func GeohashBounds(hash string) (BBox, error) {
+	if hash == "" || len(hash) > MaxGeohashPrecision {
+		return BBox{}, fmt.Errorf("invalid geohash %q", hash)
+	}
+
+	b := BBox{
+		MinLat: -90, MaxLat: 90,
+		MinLon: -180, MaxLon: 180,
+	}
+	isLon := true
+	for i := 0; i < len(hash); i++ {
+		v := geohashDecodeMap[hash[i]]
+		if v < 0 {
+			return BBox{}, fmt.Errorf("invalid geohash %q: bad char %q", hash, hash[i])
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := v>>uint(bit)&1 == 1
+			if isLon {
+				mid := (b.MinLon + b.MaxLon) / 2
+				if set {
+					b.MinLon = mid
+				} else {
+					b.MaxLon = mid
+				}
+			} else {
+				mid := (b.MinLat + b.MaxLat) / 2
+				if set {
+					b.MinLat = mid
+				} else {
+					b.MaxLat = mid
+				}
+			}
+			isLon = !isLon
+		}
+	}
+	return b, nil
+}
+
+// DecodeGeohash returns the center of the geohash's cell.
+func DecodeGeohash(hash string) (lat, lon float64, err error) {
+	b, err := GeohashBounds(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, lon = b.Center()
+	return lat, lon, nil
+}
+
+// Directions of the geohash's neighbors, in the order GeohashNeighbors returns them.
+const (
+	North = iota
+	NorthEast
+	East
+	SouthEast
+	South
+	SouthWest
+	West
+	NorthWest
+)
+
+// GeohashNeighbors returns the geohashes of the same precision, adjacent to the geohash, indexed by the direction.
+// The neighbors wrap around the antimeridian. The cells beyond a pole don't exist, their geohashes are empty.
+func GeohashNeighbors(hash string) ([8]string, error) {
+	var neighbors [8]string
+
+	b, err := GeohashBounds(hash)
+	if err != nil {
+		return neighbors, err
+	}
+
+	lat, lon := b.Center()
+	dlat := b.MaxLat - b.MinLat
+	dlon := b.MaxLon - b.MinLon
+
+	offsets := [8][2]float64{
+		North:     {1, 0},
+		NorthEast: {1, 1},
+		East:      {0, 1},
+		SouthEast: {-1, 1},
+		South:     {-1, 0},
+		SouthWest: {-1, -1},
+		West:      {0, -1},
+		NorthWest: {1, -1},
+	}
+	for dir, off := range offsets {
+		nlat := lat + off[0]*dlat
+		if nlat > 90 || nlat < -90 {
+			continue
+		}
+		nlon := lon + off[1]*dlon
+		if nlon > 180 {
+			nlon -= 360
+		} else if nlon < -180 {
+			nlon += 360
+		}
+		neighbors[dir] = EncodeGeohash(nlat, nlon, len(hash))
+	}
+	return neighbors, nil
+}
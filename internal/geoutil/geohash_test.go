@@ -0,0 +1,142 @@
+package geoutil
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	cases := []struct {
+		Lat, Lon  float64
+		Precision int
+		Want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{-25.382708, -49.265506, 8, "6gkzwgjz"},
+		{0, 0, 1, "s"},
+		{-90, -180, 5, "00000"},
+		{90, 180, 5, "zzzzz"},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			if got := EncodeGeohash(tc.Lat, tc.Lon, tc.Precision); tc.Want != got {
+				t.Fatalf("want %q got %q", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeGeohash_RoundTrip(t *testing.T) {
+	for precision := 1; precision <= MaxGeohashPrecision; precision++ {
+		t.Run(fmt.Sprintf("precision=%d", precision), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				lat, lon := RandLatLon()
+				hash := EncodeGeohash(lat, lon, precision)
+				if len(hash) != precision {
+					t.Fatalf("%q: want %d chars", hash, precision)
+				}
+
+				b, err := GeohashBounds(hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !b.Contains(lat, lon) {
+					t.Fatalf("%q: cell %+v doesn't contain the point %v, %v", hash, b, lat, lon)
+				}
+
+				// the center of the cell is within half of the cell's size from the point
+				clat, clon, err := DecodeGeohash(hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dlat := clat - lat; dlat < -(b.MaxLat-b.MinLat)/2 || dlat > (b.MaxLat-b.MinLat)/2 {
+					t.Fatalf("%q: lat %v is too far from %v", hash, clat, lat)
+				}
+				if dlon := clon - lon; dlon < -(b.MaxLon-b.MinLon)/2 || dlon > (b.MaxLon-b.MinLon)/2 {
+					t.Fatalf("%q: lon %v is too far from %v", hash, clon, lon)
+				}
+				if got := EncodeGeohash(clat, clon, precision); hash != got {
+					t.Fatalf("re-encode: want %q got %q", hash, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeGeohash_Precision(t *testing.T) {
+	// the cell of a 9-chars geohash is ~4.8 x 4.8 m
+	lat, lon, err := DecodeGeohash(EncodeGeohash(52.518898, 13.401797, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := Distance(lat, lon, 52.518898, 13.401797); d > 0.005 {
+		t.Fatalf("want within 5 m, got %v km", d)
+	}
+}
+
+func TestDecodeGeohash_Invalid(t *testing.T) {
+	for _, hash := range []string{"", "u33a", "u33dc0r!", "u33dc0rzqu33dc"} {
+		if _, _, err := DecodeGeohash(hash); err == nil {
+			t.Errorf("%q: want error, got nil", hash)
+		}
+	}
+}
+
+func TestGeohashNeighbors(t *testing.T) {
+	cases := []struct {
+		Hash string
+		Want [8]string
+	}{
+		{
+			"dqcjq",
+			[8]string{"dqcjw", "dqcjx", "dqcjr", "dqcjp", "dqcjn", "dqcjj", "dqcjm", "dqcjt"},
+		},
+		{
+			// the west neighbors are across the antimeridian
+			"8",
+			[8]string{"b", "c", "9", "3", "2", "r", "x", "z"},
+		},
+		{
+			// the north neighbors are beyond the pole
+			"b",
+			[8]string{"", "", "c", "9", "8", "x", "z", ""},
+		},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			got, err := GeohashNeighbors(tc.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Want != got {
+				t.Fatalf("want %q got %q", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestGeohashNeighbors_Adjacent(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		lat, lon := rnd.Float64()*170-85, rnd.Float64()*360-180
+		hash := EncodeGeohash(lat, lon, 6)
+
+		neighbors, err := GeohashNeighbors(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dir, neighbor := range neighbors {
+			nn, err := GeohashNeighbors(neighbor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the opposite neighbor of the neighbor is the hash itself
+			if opposite := nn[(dir+4)%8]; opposite != hash {
+				t.Fatalf("%q: neighbor %d %q, its opposite neighbor is %q", hash, dir, neighbor, opposite)
+			}
+		}
+	}
+}
@@ -31,14 +31,75 @@ func RandLatLon() (lat, lon float64) {
 }
 
 // RandLatLonNearby returns a random pair Lat, Lon nearby the point lat0, lon0, within distance in meters.
-// Refer to https://gis.stackexchange.com/questions/25877/generating-random-locations-nearby
+// The points are distributed uniformly over the disk around the point, at any latitude.
 func RandLatLonNearby(lat0, lon0, distance float64) (lat1, lon1 float64) {
-	r := distance / 111300 // convert meters to degrees
-	w := r * math.Sqrt(rand.Float64())
-	t := 2 * math.Pi * rand.Float64()
-	x := w * math.Cos(t)
-	y := w * math.Sin(t)
-	lat1 = lat0 + y
-	lon1 = lon0 + x/math.Cos(lat0)
-	return
+	// sqrt compensates for the area of the disk growing with the radius
+	d := distance * math.Sqrt(rand.Float64())
+	bearing := 360 * rand.Float64()
+	return Destination(lat0, lon0, bearing, d/1000)
+}
+
+// BBox is a bounding box. If MinLon is greater than MaxLon, the box crosses the antimeridian.
+type BBox struct {
+	MinLat, MinLon float64
+	MaxLat, MaxLon float64
+}
+
+// Contains reports whether the point lat, lon is inside the box.
+func (b BBox) Contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon > b.MaxLon {
+		return lon >= b.MinLon || lon <= b.MaxLon
+	}
+	return lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// Center returns the center of the box.
+func (b BBox) Center() (lat, lon float64) {
+	lat = (b.MinLat + b.MaxLat) / 2
+	maxLon := b.MaxLon
+	if b.MinLon > maxLon {
+		maxLon += 360
+	}
+	lon = (b.MinLon + maxLon) / 2
+	if lon > 180 {
+		lon -= 360
+	}
+	return lat, lon
+}
+
+// BBoxAround returns the smallest box, that contains all points within distance in km from the point lat, lon.
+// Refer to http://janmatuschek.de/LatitudeLongitudeBoundingCoordinates
+func BBoxAround(lat, lon, distance float64) BBox {
+	r := distance / earthKm // angular distance in radians
+	dlat := r / rad
+
+	b := BBox{
+		MinLat: lat - dlat,
+		MaxLat: lat + dlat,
+	}
+	if b.MinLat <= -90 || b.MaxLat >= 90 {
+		// the box contains a pole, so it spans all longitudes
+		b.MinLat = math.Max(b.MinLat, -90)
+		b.MaxLat = math.Min(b.MaxLat, 90)
+		b.MinLon, b.MaxLon = -180, 180
+		return b
+	}
+
+	dlon := math.Asin(math.Sin(r)/math.Cos(lat*rad)) / rad
+	b.MinLon = lon - dlon
+	b.MaxLon = lon + dlon
+	if b.MaxLon-b.MinLon >= 360 {
+		b.MinLon, b.MaxLon = -180, 180
+		return b
+	}
+	if b.MinLon < -180 {
+		b.MinLon += 360
+	}
+	if b.MaxLon > 180 {
+		b.MaxLon -= 360
+	}
+	return b
 }
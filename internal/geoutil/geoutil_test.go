@@ -42,3 +42,77 @@ func TestDistance(t *testing.T) {
 		})
 	}
 }
+
+func TestBBox_Contains(t *testing.T) {
+	cases := []struct {
+		BBox     BBox
+		Lat, Lon float64
+		Want     bool
+	}{
+		{BBox{52, 13, 53, 14}, 52.518898, 13.401797, true},
+		{BBox{52, 13, 53, 14}, 52.518898, 14.401797, false},
+		{BBox{52, 13, 53, 14}, 51.518898, 13.401797, false},
+		// crosses the antimeridian
+		{BBox{-10, 170, 10, -170}, 0, 175, true},
+		{BBox{-10, 170, 10, -170}, 0, -175, true},
+		{BBox{-10, 170, 10, -170}, 0, 0, false},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			if got := tc.BBox.Contains(tc.Lat, tc.Lon); tc.Want != got {
+				t.Fatalf("want %v got %v", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestBBoxAround(t *testing.T) {
+	cases := []struct {
+		Lat, Lon float64
+		Distance float64
+	}{
+		{52.518898, 13.401797, 0.5},
+		{0, 179.999, 10},
+		{89.99, 0, 10},
+		{-33.8688, 151.2093, 100},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			b := BBoxAround(tc.Lat, tc.Lon, tc.Distance)
+			if !b.Contains(tc.Lat, tc.Lon) {
+				t.Fatalf("%+v doesn't contain the center", b)
+			}
+			// the points at the distance in every direction are inside the box
+			for i := 0; i < 360; i += 15 {
+				lat, lon := Destination(tc.Lat, tc.Lon, float64(i), tc.Distance*0.999)
+				if !b.Contains(lat, lon) {
+					t.Errorf("%+v doesn't contain the point %v, %v at bearing %d", b, lat, lon, i)
+				}
+			}
+		})
+	}
+}
+
+func TestRandLatLonNearby(t *testing.T) {
+	for _, lat0 := range []float64{0, 52.518898, -60, 80, 89.9} {
+		t.Run(fmt.Sprintf("lat=%v", lat0), func(t *testing.T) {
+			var maxDistance float64
+			for i := 0; i < 1000; i++ {
+				lat1, lon1 := RandLatLonNearby(lat0, 13.401797, 100)
+				d := Distance(lat0, 13.401797, lat1, lon1) * 1000
+				if d > 100+1e-6 {
+					t.Fatalf("point %v, %v is %v m away, want within 100 m", lat1, lon1, d)
+				}
+				if d > maxDistance {
+					maxDistance = d
+				}
+			}
+			// the points spread over the whole disk
+			if maxDistance < 90 {
+				t.Fatalf("max distance %v m, want close to 100 m", maxDistance)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package geoutil
+
+import (
+	"math"
+	"time"
+)
+
+// initialSpeedVariance is the variance of the speed in (m/s)², the filter starts with: the point's speed
+// is unknown, until the filter sees a few positions.
+const initialSpeedVariance = 30 * 30
+
+// KalmanFilter smooths the track of a moving point, e.g. a vehicle, with a constant velocity model.
+// The filter estimates the point's position and velocity in the plane, tangent to the Earth at the latest
+// estimated position, so the east and the north axes are filtered independently.
+// Refer to https://en.wikipedia.org/wiki/Kalman_filter#Example_application,_technical
+type KalmanFilter struct {
+	// accuracy is the variance of the measured positions in m²
+	accuracy float64
+	// acceleration is the variance of the point's acceleration in (m/s²)²
+	acceleration float64
+
+	ts       time.Time
+	lat, lon float64
+	// east and north are the state of the filter along the axes
+	east, north kalmanAxis
+}
+
+// kalmanAxis is the point's velocity in m/s along the axis, and the covariance of the estimated offset
+// and velocity. The offset along the axis is always zero, since the plane moves with the estimated position.
+type kalmanAxis struct {
+	v             float64
+	p00, p01, p11 float64
+}
+
+// KalmanState is the estimated position of the point, its speed in km/h, and its heading in degrees,
+// clockwise from the north.
+type KalmanState struct {
+	Lat, Lon float64
+	Speed    float64
+	Heading  float64
+}
+
+// NewKalmanFilter returns the filter for the positions, measured with the accuracy (the standard deviation)
+// in meters, of the point, that accelerates with the standard deviation in m/s².
+func NewKalmanFilter(accuracy, acceleration float64) *KalmanFilter {
+	return &KalmanFilter{
+		accuracy:     accuracy * accuracy,
+		acceleration: acceleration * acceleration,
+	}
+}
+
+// Update adds the position lat, lon, measured at the time ts, and returns the point's estimated state.
+// The first position initializes the filter, with the point standing still.
+func (f *KalmanFilter) Update(ts time.Time, lat, lon float64) KalmanState {
+	if f.ts.IsZero() {
+		f.ts, f.lat, f.lon = ts, lat, lon
+		f.east = kalmanAxis{p00: f.accuracy, p11: initialSpeedVariance}
+		f.north = f.east
+		return f.state()
+	}
+
+	// the measured offset from the estimated position in meters
+	dlon := lon - f.lon
+	if dlon > 180 {
+		dlon -= 360
+	} else if dlon < -180 {
+		dlon += 360
+	}
+	x := dlon * rad * math.Cos(f.lat*rad) * earthKm * 1000
+	y := (lat - f.lat) * rad * earthKm * 1000
+
+	var dt float64
+	if ts.After(f.ts) {
+		dt = ts.Sub(f.ts).Seconds()
+		f.ts = ts
+	}
+	x = f.east.update(x, dt, f.accuracy, f.acceleration)
+	y = f.north.update(y, dt, f.accuracy, f.acceleration)
+
+	bearing := math.Atan2(x, y) / rad
+	f.lat, f.lon = Destination(f.lat, f.lon, bearing, math.Hypot(x, y)/1000)
+
+	return f.state()
+}
+
+func (f *KalmanFilter) state() KalmanState {
+	return KalmanState{
+		Lat:     f.lat,
+		Lon:     f.lon,
+		Speed:   math.Hypot(f.east.v, f.north.v) * 3.6,
+		Heading: normalizeBearing(math.Atan2(f.east.v, f.north.v) / rad),
+	}
+}
+
+// update predicts the state of the axis after dt seconds, corrects it with the measured offset z,
+// and returns the estimated offset.
+func (a *kalmanAxis) update(z, dt, accuracy, acceleration float64) float64 {
+	// predict
+	x := a.v * dt
+	dt2 := dt * dt
+	a.p00 += 2*dt*a.p01 + dt2*a.p11 + acceleration*dt2*dt2/4
+	a.p01 += dt*a.p11 + acceleration*dt2*dt/2
+	a.p11 += acceleration * dt2
+
+	// correct
+	s := a.p00 + accuracy
+	k0, k1 := a.p00/s, a.p01/s
+	y := z - x
+	x += k0 * y
+	a.v += k1 * y
+	a.p11 -= k1 * a.p01
+	a.p00 *= 1 - k0
+	a.p01 *= 1 - k0
+
+	return x
+}
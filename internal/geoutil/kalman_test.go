@@ -0,0 +1,109 @@
+package geoutil
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestKalmanFilter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	f := NewKalmanFilter(10, 1)
+
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	// Berlin, Cathedral
+	lat, lon := 52.518898, 13.401797
+
+	// the point moves 30 meters to the north-east every 2 seconds, at 54 km/h, and its positions
+	// are measured within 10 meters around it
+	var (
+		prevLat, prevLon float64
+		rawErr, speedErr float64
+		headingErr       float64
+		posErr           float64
+		n                int
+	)
+	for i := 0; i < 300; i++ {
+		ts = ts.Add(2 * time.Second)
+		lat, lon = Destination(lat, lon, 45, 0.030)
+		mlat, mlon := Destination(lat, lon, 360*rnd.Float64(), 0.010*rnd.Float64())
+
+		state := f.Update(ts, mlat, mlon)
+		rawSpeed := Distance(prevLat, prevLon, mlat, mlon) / (2 * time.Second).Hours()
+		prevLat, prevLon = mlat, mlon
+
+		// skip the first positions, until the filter learns the point's velocity
+		if i < 20 {
+			continue
+		}
+		n++
+		rawErr += (rawSpeed - 54) * (rawSpeed - 54)
+		speedErr += (state.Speed - 54) * (state.Speed - 54)
+		headingErr += (state.Heading - 45) * (state.Heading - 45)
+		posErr += math.Pow(Distance(lat, lon, state.Lat, state.Lon)*1000, 2)
+	}
+	rawErr, speedErr = math.Sqrt(rawErr/float64(n)), math.Sqrt(speedErr/float64(n))
+	headingErr, posErr = math.Sqrt(headingErr/float64(n)), math.Sqrt(posErr/float64(n))
+
+	// the root-mean-square errors of the filtered track
+	if speedErr > rawErr/3 {
+		t.Errorf("speed: want error below %v got %v", rawErr/3, speedErr)
+	}
+	if speedErr > 5 {
+		t.Errorf("speed: want error below 5 km/h got %v", speedErr)
+	}
+	if headingErr > 5 {
+		t.Errorf("heading: want error below 5 degrees got %v", headingErr)
+	}
+	if posErr > 7 {
+		t.Errorf("position: want error below 7 meters got %v", posErr)
+	}
+}
+
+func TestKalmanFilter_Standing(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	f := NewKalmanFilter(10, 1)
+
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	lat, lon := 52.518898, 13.401797
+
+	state := f.Update(ts, lat, lon)
+	if state.Lat != lat || state.Lon != lon || state.Speed != 0 {
+		t.Fatalf("first: want the position standing still got %+v", state)
+	}
+
+	// the point stands still, and its positions jitter by up to 10 meters
+	for i := 0; i < 60; i++ {
+		ts = ts.Add(time.Second)
+		mlat, mlon := Destination(lat, lon, 360*rnd.Float64(), 0.010*rnd.Float64())
+		state = f.Update(ts, mlat, mlon)
+	}
+	if state.Speed > 5 {
+		t.Errorf("speed: want below 5 got %v", state.Speed)
+	}
+	if d := Distance(lat, lon, state.Lat, state.Lon) * 1000; d > 10 {
+		t.Errorf("position: want within 10 meters got %v", d)
+	}
+}
+
+func TestKalmanFilter_Antimeridian(t *testing.T) {
+	f := NewKalmanFilter(10, 1)
+
+	ts := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	lat, lon := 0.0, 179.999
+
+	var state KalmanState
+	for i := 0; i < 20; i++ {
+		state = f.Update(ts, lat, lon)
+		ts = ts.Add(10 * time.Second)
+		lat, lon = Destination(lat, lon, 90, 0.150)
+	}
+	if state.Lon > 0 {
+		t.Errorf("lon: want across the antimeridian got %v", state.Lon)
+	}
+	assertNear(t, "heading", 90, state.Heading, 1)
+	assertNear(t, "speed", 54, state.Speed, 1)
+}
@@ -0,0 +1,45 @@
+package geoutil
+
+import (
+	"math"
+)
+
+// The functions below treat the coordinates as planar, which is accurate enough for the polygons
+// of a city's scale. A polygon can't cross the antimeridian.
+
+// PointInPolygon reports whether the point lat, lon is inside the polygon. The polygon is a closed ring
+// of vertices, in either order; the last vertex connects to the first one, and doesn't need to repeat it.
+// The points on the polygon's edges may be reported either inside or outside.
+// Refer to https://wrf.ecse.rpi.edu/Research/Short_Notes/pnpoly.html
+func PointInPolygon(lat, lon float64, polygon []Point) bool {
+	var inside bool
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		pi, pj := polygon[i], polygon[j]
+		// count the edges, that the ray from the point towards the east crosses
+		if (pi.Lat > lat) != (pj.Lat > lat) &&
+			lon < (pj.Lon-pi.Lon)*(lat-pi.Lat)/(pj.Lat-pi.Lat)+pi.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// PolygonBBox returns the smallest box, that contains all vertices of the polygon.
+func PolygonBBox(polygon []Point) BBox {
+	if len(polygon) == 0 {
+		return BBox{}
+	}
+	b := BBox{
+		MinLat: polygon[0].Lat,
+		MinLon: polygon[0].Lon,
+		MaxLat: polygon[0].Lat,
+		MaxLon: polygon[0].Lon,
+	}
+	for _, p := range polygon[1:] {
+		b.MinLat = math.Min(b.MinLat, p.Lat)
+		b.MinLon = math.Min(b.MinLon, p.Lon)
+		b.MaxLat = math.Max(b.MaxLat, p.Lat)
+		b.MaxLon = math.Max(b.MaxLon, p.Lon)
+	}
+	return b
+}
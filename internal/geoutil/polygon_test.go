@@ -0,0 +1,80 @@
+package geoutil
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPointInPolygon(t *testing.T) {
+	// (Berlin, Alexanderplatz)
+	square := []Point{
+		{52.520, 13.410},
+		{52.520, 13.420},
+		{52.530, 13.420},
+		{52.530, 13.410},
+	}
+	// a "C"-shaped polygon, open to the east
+	concave := []Point{
+		{0, 0},
+		{0, 3},
+		{1, 3},
+		{1, 1},
+		{2, 1},
+		{2, 3},
+		{3, 3},
+		{3, 0},
+	}
+
+	cases := []struct {
+		Polygon  []Point
+		Lat, Lon float64
+		Want     bool
+	}{
+		{square, 52.525, 13.415, true},
+		{square, 52.5201, 13.4199, true},
+		{square, 52.515, 13.415, false},
+		{square, 52.525, 13.425, false},
+		{square, 52.525, 13.405, false},
+		{concave, 0.5, 2, true},
+		{concave, 2.5, 2, true},
+		{concave, 1.5, 0.5, true},
+		{concave, 1.5, 2, false},
+		{concave, 1.5, 4, false},
+		// the ray passes through a vertex
+		{concave, 1, -1, false},
+		{nil, 0, 0, false},
+		{[]Point{{0, 0}, {1, 1}}, 0.5, 0.5, false},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			if got := PointInPolygon(tc.Lat, tc.Lon, tc.Polygon); got != tc.Want {
+				t.Fatalf("PointInPolygon(%v, %v): want %v got %v", tc.Lat, tc.Lon, tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestPointInPolygon_Order(t *testing.T) {
+	// the same triangle, clockwise and counter-clockwise
+	cw := []Point{{0, 0}, {1, 1}, {0, 2}}
+	ccw := []Point{{0, 2}, {1, 1}, {0, 0}}
+	for _, p := range []Point{{0.5, 1}, {0.1, 0.5}, {0.9, 1.5}, {0.9, 0.5}} {
+		if PointInPolygon(p.Lat, p.Lon, cw) != PointInPolygon(p.Lat, p.Lon, ccw) {
+			t.Fatalf("%v: the order of the vertices changed the result", p)
+		}
+	}
+}
+
+func TestPolygonBBox(t *testing.T) {
+	polygon := []Point{{52.52, 13.41}, {52.51, 13.42}, {52.53, 13.40}}
+	want := BBox{MinLat: 52.51, MinLon: 13.40, MaxLat: 52.53, MaxLon: 13.42}
+	if got := PolygonBBox(polygon); got != want {
+		t.Fatalf("want %v got %v", want, got)
+	}
+	for _, p := range polygon {
+		if !want.Contains(p.Lat, p.Lon) {
+			t.Fatalf("box %v doesn't contain %v", want, p)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package geoutil
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// polylineFactor is the precision of the encoded polyline, 5 decimal digits (~1 m).
+const polylineFactor = 1e5
+
+// Point is a pair Lat, Lon.
+type Point struct {
+	Lat, Lon float64
+}
+
+var errBadPolyline = errors.New("malformed polyline")
+
+// EncodePolyline encodes the points with the Google's encoded polyline algorithm, with the precision
+// of 5 decimal digits.
+// Refer to https://developers.google.com/maps/documentation/utilities/polylinealgorithm
+func EncodePolyline(points []Point) string {
+	var (
+		buf              strings.Builder
+		prevLat, prevLon int64
+	)
+	for _, p := range points {
+		lat := int64(math.Round(p.Lat * polylineFactor))
+		lon := int64(math.Round(p.Lon * polylineFactor))
+		encodePolylineValue(&buf, lat-prevLat)
+		encodePolylineValue(&buf, lon-prevLon)
+		prevLat, prevLon = lat, lon
+	}
+	return buf.String()
+}
+
+func encodePolylineValue(buf *strings.Builder, v int64) {
+	u := uint64(v) << 1
+	if v < 0 {
+		u = ^u
+	}
+	for u >= 0x20 {
+		buf.WriteByte(byte(0x20|u&0x1f) + 63)
+		u >>= 5
+	}
+	buf.WriteByte(byte(u) + 63)
+}
+
+// DecodePolyline decodes the points from the Google's encoded polyline. See EncodePolyline.
+func DecodePolyline(s string) ([]Point, error) {
+	var (
+		points   []Point
+		lat, lon int64
+	)
+	for i := 0; i < len(s); {
+		dlat, n, err := decodePolylineValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+
+		dlon, n, err := decodePolylineValue(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+
+		lat += dlat
+		lon += dlon
+		points = append(points, Point{
+			Lat: float64(lat) / polylineFactor,
+			Lon: float64(lon) / polylineFactor,
+		})
+	}
+	return points, nil
+}
+
+func decodePolylineValue(s string) (v int64, n int, err error) {
+	var (
+		u     uint64
+		shift uint
+	)
+	for {
+		if n >= len(s) || shift > 63 {
+			return 0, 0, errBadPolyline
+		}
+		c := s[n]
+		if c < 63 || c > 63+0x3f {
+			return 0, 0, errBadPolyline
+		}
+		b := uint64(c - 63)
+		n++
+
+		u |= (b & 0x1f) << shift
+		shift += 5
+		if b < 0x20 {
+			break
+		}
+	}
+
+	v = int64(u >> 1)
+	if u&1 != 0 {
+		v = ^v
+	}
+	return v, n, nil
+}
@@ -0,0 +1,61 @@
+package geoutil
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodePolyline(t *testing.T) {
+	// the example from the algorithm's description
+	points := []Point{
+		{38.5, -120.2},
+		{40.7, -120.95},
+		{43.252, -126.453},
+	}
+	want := "_p~iF~ps|U_ulLnnqC_mqNvxq`@"
+
+	if got := EncodePolyline(points); want != got {
+		t.Fatalf("EncodePolyline: want %q got %q", want, got)
+	}
+
+	got, err := DecodePolyline(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(points, got) {
+		t.Fatalf("DecodePolyline: want %v got %v", points, got)
+	}
+}
+
+func TestDecodePolyline_RoundTrip(t *testing.T) {
+	points := make([]Point, 0, 1000)
+	lat, lon := 52.518898, 13.401797
+	for i := 0; i < cap(points); i++ {
+		lat, lon = RandLatLonNearby(lat, lon, 100)
+		points = append(points, Point{lat, lon})
+	}
+	points = append(points, Point{-90, -180}, Point{90, 180}, Point{0, 0})
+
+	got, err := DecodePolyline(EncodePolyline(points))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(got) {
+		t.Fatalf("points: want %d got %d", len(points), len(got))
+	}
+	for i := range points {
+		// the precision is 5 decimal digits
+		if math.Abs(points[i].Lat-got[i].Lat) > 0.5e-5 || math.Abs(points[i].Lon-got[i].Lon) > 0.5e-5 {
+			t.Fatalf("point %d: want %v got %v", i, points[i], got[i])
+		}
+	}
+}
+
+func TestDecodePolyline_Invalid(t *testing.T) {
+	for _, s := range []string{"_p~iF", "_p~iF~ps|", "_p~iF~ps|U\x00"} {
+		if _, err := DecodePolyline(s); err == nil {
+			t.Errorf("%q: want error, got nil", s)
+		}
+	}
+}
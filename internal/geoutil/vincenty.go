@@ -0,0 +1,86 @@
+package geoutil
+
+import (
+	"math"
+)
+
+// WGS84 ellipsoid.
+const (
+	wgs84A = 6378137.0         // semi-major axis in meters
+	wgs84F = 1 / 298.257223563 // flattening
+	wgs84B = (1 - wgs84F) * wgs84A
+
+	vincentyMaxIterations = 200
+	vincentyPrecision     = 1e-12
+)
+
+// DistanceFunc calculates the distance in km between two Lat, Lon coordinates.
+type DistanceFunc func(lat0, lon0, lat1, lon1 float64) float64
+
+var _ DistanceFunc = Distance
+
+// VincentyDistance calculates the distance in km between two Lat, Lon coordinates on the WGS84 ellipsoid,
+// using the Vincenty's inverse formula. It's accurate to ~1 mm, while the spherical Distance errs up to ~0.5%.
+// The formula doesn't converge for nearly antipodal points; for these VincentyDistance falls back to Distance.
+// Refer to https://www.movable-type.co.uk/scripts/latlong-vincenty.html
+func VincentyDistance(lat0, lon0, lat1, lon1 float64) float64 {
+	L := (lon1 - lon0) * rad
+	tanU1 := (1 - wgs84F) * math.Tan(lat0*rad)
+	cosU1 := 1 / math.Sqrt(1+tanU1*tanU1)
+	sinU1 := tanU1 * cosU1
+	tanU2 := (1 - wgs84F) * math.Tan(lat1*rad)
+	cosU2 := 1 / math.Sqrt(1+tanU2*tanU2)
+	sinU2 := tanU2 * cosU2
+
+	var (
+		lambda                         = L
+		sinSigma, cosSigma, sigma      float64
+		cosSqAlpha, cos2SigmaM         float64
+		sinLambda, cosLambda, lambdaP1 float64
+	)
+	for i := 0; ; i++ {
+		if i == vincentyMaxIterations {
+			return Distance(lat0, lon0, lat1, lon1)
+		}
+
+		sinLambda, cosLambda = math.Sin(lambda), math.Cos(lambda)
+		x := cosU2 * sinLambda
+		y := cosU1*sinU2 - sinU1*cosU2*cosLambda
+		sinSigma = math.Sqrt(x*x + y*y)
+		if sinSigma == 0 {
+			// coincident points
+			return 0
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 {
+			// otherwise, the geodesic follows the equator
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+
+		C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		lambdaP1 = lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda-lambdaP1) <= vincentyPrecision {
+			break
+		}
+		if math.Abs(lambda) > math.Pi {
+			// nearly antipodal points
+			return Distance(lat0, lon0, lat1, lon1)
+		}
+	}
+
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+
+	s := wgs84B * A * (sigma - deltaSigma)
+	return s / 1000
+}
@@ -0,0 +1,100 @@
+package geoutil
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestVincentyDistance(t *testing.T) {
+	cases := []struct {
+		Lat0, Lon0 float64
+		Lat1, Lon1 float64
+		Want       float64 // km
+	}{
+		{
+			0, 0,
+			0, 0,
+			0,
+		},
+		{
+			// along the equator, the geodesic's length is a * dlon
+			0, 0,
+			0, 1,
+			111.31949079327357,
+		},
+		{
+			// the WGS84 meridian quadrant
+			0, 0,
+			90, 0,
+			10001.965729,
+		},
+		{
+			// Flinders Peak to Buninyong, the example from Vincenty's paper
+			-37.95103342, 144.42486789,
+			-37.65282114, 143.92649554,
+			54.972271,
+		},
+		{
+			// the WGS84 meridian arc from the equator to 45 degrees
+			0, 0,
+			45, 0,
+			4984.944378,
+		},
+	}
+
+	for n, tc := range cases {
+		t.Run(fmt.Sprintf("case=%d", n), func(t *testing.T) {
+			// the reference values are precise to 1 mm
+			d := VincentyDistance(tc.Lat0, tc.Lon0, tc.Lat1, tc.Lon1)
+			if math.Abs(tc.Want-d) > 1e-6 {
+				t.Fatalf("want %v got %v", tc.Want, d)
+			}
+			if d1 := VincentyDistance(tc.Lat1, tc.Lon1, tc.Lat0, tc.Lon0); math.Abs(d-d1) > 1e-9 {
+				t.Fatalf("reverse: want %v got %v", d, d1)
+			}
+		})
+	}
+}
+
+func TestVincentyDistance_Antipodal(t *testing.T) {
+	// the formula doesn't converge; the spherical distance is used instead
+	want := Distance(0, 0, 0.5, 179.7)
+	if got := VincentyDistance(0, 0, 0.5, 179.7); want != got {
+		t.Fatalf("want %v got %v", want, got)
+	}
+}
+
+func TestVincentyDistance_Haversine(t *testing.T) {
+	// the spherical distance errs within ~0.5%
+	for i := 0; i < 1000; i++ {
+		lat0, lon0 := RandLatLon()
+		lat1, lon1 := RandLatLonNearby(lat0, lon0, 1000000)
+
+		d0 := VincentyDistance(lat0, lon0, lat1, lon1)
+		d1 := Distance(lat0, lon0, lat1, lon1)
+		if math.Abs(d0-d1) > d0*0.006 {
+			t.Fatalf("%v, %v - %v, %v: vincenty %v, haversine %v", lat0, lon0, lat1, lon1, d0, d1)
+		}
+	}
+}
+
+var benchDistance float64
+
+func benchmarkDistance(b *testing.B, distance DistanceFunc) {
+	lat0, lon0 := 52.518898, 13.401797 // Berlin, Cathedral
+	lat1, lon1 := 52.520645, 13.409779 // Berlin, Fernsehturm
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchDistance = distance(lat0, lon0, lat1, lon1)
+	}
+}
+
+func BenchmarkDistance(b *testing.B) {
+	benchmarkDistance(b, Distance)
+}
+
+func BenchmarkVincentyDistance(b *testing.B) {
+	benchmarkDistance(b, VincentyDistance)
+}
@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"time"
 )
@@ -53,3 +55,15 @@ func (r *responseWriter) Flush() {
 		f.Flush()
 	}
 }
+
+func (r *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		r.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
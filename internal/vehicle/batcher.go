@@ -0,0 +1,91 @@
+package vehicle
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Batcher collects the positions of vehicles and sends them to the server in batches.
+// A batch is sent when it reaches the max size, or when the flush interval passes, whichever comes first.
+type Batcher struct {
+	client   *FleetStateClient
+	size     int
+	interval time.Duration
+
+	mu  sync.Mutex
+	buf []Position
+	// signals Run that the buffer reached the max batch size
+	full chan struct{}
+}
+
+// NewBatcher creates a Batcher. Zero size means the batch doesn't have a max size;
+// zero interval means the batch is only sent when it reaches the max size.
+func NewBatcher(client *FleetStateClient, size int, interval time.Duration) *Batcher {
+	return &Batcher{
+		client:   client,
+		size:     size,
+		interval: interval,
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// Add adds the position to the current batch.
+func (b *Batcher) Add(pos Position) {
+	b.mu.Lock()
+	b.buf = append(b.buf, pos)
+	full := b.size > 0 && len(b.buf) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run sends the batches until the context is canceled. Before it returns, Run tries to send
+// whatever positions are left in the current batch.
+func (b *Batcher) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if b.interval > 0 {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			b.flush(ctx)
+		case <-b.full:
+			b.flush(ctx)
+		case <-ctx.Done():
+			// the top-most context is already canceled, give the last batch a chance to reach the server
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			b.flush(ctx)
+			cancel()
+			return
+		}
+	}
+}
+
+func (b *Batcher) flush(ctx context.Context) {
+	b.mu.Lock()
+	batch := b.buf
+	b.buf = nil
+	b.mu.Unlock()
+
+	for len(batch) > 0 {
+		n := len(batch)
+		if b.size > 0 && n > b.size {
+			n = b.size
+		}
+		if err := b.client.UpdatePositions(ctx, batch[:n]); err != nil {
+			log.Printf("failed to report %d positions: %s", n, err)
+		}
+		batch = batch[n:]
+	}
+}
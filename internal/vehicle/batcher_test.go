@@ -0,0 +1,104 @@
+package vehicle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]Position
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []Position
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		batches = append(batches, batch)
+		mu.Unlock()
+
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer ts.Close()
+
+	client := NewFleetStateClient(ts.URL)
+	client.Client = ts.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	batcher := NewBatcher(client, 2, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		batcher.Run(ctx)
+	}()
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		batcher.Add(Position{VIN: "THE1VIN", Telemetry: Telemetry{Ts: now.Add(time.Duration(i) * time.Second)}})
+	}
+
+	// give batcher some time to send the full batches
+	time.Sleep(100 * time.Millisecond)
+
+	// the remaining position is sent, when the batcher stops
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var total int
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("batch: want max size 2 got %d", len(batch))
+		}
+		total += len(batch)
+	}
+	if want := 5; want != total {
+		t.Fatalf("positions: want %d got %d", want, total)
+	}
+}
+
+func TestBatcher_Interval(t *testing.T) {
+	sent := make(chan []Position, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []Position
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		sent <- batch
+
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer ts.Close()
+
+	client := NewFleetStateClient(ts.URL)
+	client.Client = ts.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	batcher := NewBatcher(client, 0, 50*time.Millisecond)
+	go batcher.Run(ctx)
+
+	batcher.Add(Position{VIN: "THE1VIN", Telemetry: Telemetry{Ts: time.Now().UTC()}})
+
+	select {
+	case batch := <-sent:
+		if want, got := 1, len(batch); want != got {
+			t.Fatalf("batch: want size %d got %d", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch wasn't sent after the interval")
+	}
+}
@@ -1,7 +1,9 @@
 package vehicle
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -43,7 +45,106 @@ func (c *FleetStateClient) UpdatePosition(ctx context.Context, vin VIN, lat, lon
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+		return decodeAPIError(resp)
+	}
+
+	return nil
+}
+
+// UpdateTelemetry sends the vehicle's telemetry, with the optional fields the vehicle reports.
+// Zero t.Ts means the server uses its own time. Zero t.Version means the latest version of the schema.
+func (c *FleetStateClient) UpdateTelemetry(ctx context.Context, vin VIN, t Telemetry) error {
+	if t.Version == 0 {
+		t.Version = TelemetryVersion
+	}
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	surl := c.baseUrl + "/vehicle/" + string(vin)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, surl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return decodeAPIError(resp)
+	}
+
+	return nil
+}
+
+// Position is the telemetry of a vehicle in a batch.
+type Position struct {
+	VIN VIN `json:"vin"`
+	Telemetry
+}
+
+// BatchError is returned by UpdatePositions, when the server couldn't store some of the positions of the batch.
+type BatchError struct {
+	// Errors maps the index of a failed position in the batch to its error.
+	Errors map[int]*APIError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("failed to update %d positions", len(e.Errors))
+}
+
+// UpdatePositions sends a batch of positions in a single request.
+func (c *FleetStateClient) UpdatePositions(ctx context.Context, positions []Position) error {
+	body, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	surl := c.baseUrl + "/vehicles/positions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, surl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeAPIError(resp)
+	}
+
+	var batchResp struct {
+		Results []struct {
+			Status int       `json:"status"`
+			Error  *APIError `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+		return fmt.Errorf("could not decode response: %w", err)
+	}
+
+	batchErr := &BatchError{
+		Errors: make(map[int]*APIError),
+	}
+	for n, res := range batchResp.Results {
+		if res.Status == http.StatusCreated {
+			continue
+		}
+		if res.Error == nil {
+			res.Error = &APIError{}
+		}
+		res.Error.StatusCode = res.Status
+		batchErr.Errors[n] = res.Error
+	}
+	if len(batchErr.Errors) > 0 {
+		return batchErr
 	}
 
 	return nil
@@ -2,9 +2,13 @@ package vehicle
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestFleetStateClient_UpdatePosition(t *testing.T) {
@@ -39,6 +43,55 @@ func TestFleetStateClient_UpdatePosition(t *testing.T) {
 	<-done
 }
 
+func TestFleetStateClient_UpdateTelemetry(t *testing.T) {
+	want := Telemetry{
+		Version: TelemetryVersion,
+		Ts:      time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC),
+		Lat:     52.520008,
+		Lon:     13.401797,
+		TelemetryFields: TelemetryFields{
+			Battery:    Float64(87),
+			Altitude:   Float64(34.5),
+			Locked:     Bool(false),
+			Attributes: map[string]string{"firmware": "1.2.3"},
+		},
+	}
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+
+		if want, got := "/vehicle/THE1VIN", r.URL.Path; want != got {
+			t.Errorf("url: want %s got %s", want, r.URL.Path)
+		}
+		if want, got := "application/json", r.Header.Get("Content-Type"); want != got {
+			t.Errorf("content-type: want %s got %s", want, got)
+		}
+		var got Telemetry
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("telemetry: want %+v got %+v", want, got)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	client := NewFleetStateClient(ts.URL)
+	client.Client = ts.Client()
+
+	// the client sets the version of the schema it reports
+	tel := want
+	tel.Version = 0
+	if err := client.UpdateTelemetry(context.Background(), "THE1VIN", tel); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+}
+
 func TestFleetStateClient_UpdatePosition_BadStatus(t *testing.T) {
 	done := make(chan struct{})
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -57,3 +110,81 @@ func TestFleetStateClient_UpdatePosition_BadStatus(t *testing.T) {
 
 	<-done
 }
+
+func TestFleetStateClient_UpdatePosition_APIError(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":"bad_request","message":"bad lat: invalid syntax","field":"lat"}}`))
+
+		close(done)
+	}))
+	defer ts.Close()
+
+	client := NewFleetStateClient(ts.URL)
+	client.Client = ts.Client()
+
+	err := client.UpdatePosition(context.Background(), "THE1VIN", 52.520008, 13.401797)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("UpdatePosition: want APIError got %v", err)
+	}
+	want := &APIError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "bad_request",
+		Message:    "bad lat: invalid syntax",
+		Field:      "lat",
+	}
+	if !reflect.DeepEqual(want, apiErr) {
+		t.Fatalf("UpdatePosition: want %+v got %+v", want, apiErr)
+	}
+
+	<-done
+}
+
+func TestFleetStateClient_UpdatePositions(t *testing.T) {
+	now := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	positions := []Position{
+		{VIN: "THE1VIN", Telemetry: Telemetry{Ts: now, Lat: 52.520008, Lon: 13.401797}},
+		{VIN: "THE2VIN", Telemetry: Telemetry{Ts: now, Lat: 52.518898, Lon: 13.401797, TelemetryFields: TelemetryFields{
+			Battery:    Float64(87),
+			Locked:     Bool(true),
+			Attributes: map[string]string{"firmware": "1.2.3"},
+		}}},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, got := "/vehicles/positions", r.URL.Path; want != got {
+			t.Errorf("url: want %s got %s", want, got)
+		}
+
+		var got []Position
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(positions, got) {
+			t.Errorf("positions: want %v got %v", positions, got)
+		}
+
+		w.Write([]byte(`{"results":[{"status":201},{"status":409,"error":{"code":"conflict","message":"old record"}}]}`))
+	}))
+	defer ts.Close()
+
+	client := NewFleetStateClient(ts.URL)
+	client.Client = ts.Client()
+
+	err := client.UpdatePositions(context.Background(), positions)
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("UpdatePositions: want BatchError got %v", err)
+	}
+	if want, got := 1, len(batchErr.Errors); want != got {
+		t.Fatalf("UpdatePositions: want %d errors got %d", want, got)
+	}
+	if got := batchErr.Errors[1]; got == nil || got.StatusCode != http.StatusConflict || got.Code != "conflict" {
+		t.Fatalf("UpdatePositions: want conflict error for position 1 got %+v", got)
+	}
+}
@@ -0,0 +1,48 @@
+package vehicle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// APIError is an error, the fleet state server responded with.
+type APIError struct {
+	// StatusCode is the status of the response.
+	StatusCode int
+	// Code is the machine-readable code of the error, e.g. "bad_request".
+	Code string `json:"code"`
+	// Message is the human-readable description of the error.
+	Message string `json:"message"`
+	// Field is the name of the request's field, the error is about, if any.
+	Field string `json:"field"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected response status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected response status %d: %s", e.StatusCode, e.Message)
+}
+
+// decodeAPIError decodes the error from the body of the response. If the body isn't an error object,
+// the returned error only has the response's status.
+func decodeAPIError(resp *http.Response) error {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+	}
+
+	var errResp struct {
+		Error *APIError `json:"error"`
+	}
+	errResp.Error = apiErr
+	body := io.LimitReader(resp.Body, 1<<20)
+	if err := json.NewDecoder(body).Decode(&errResp); err != nil {
+		// drain the body, so the connection can be reused
+		io.Copy(ioutil.Discard, body)
+	}
+
+	return apiErr
+}
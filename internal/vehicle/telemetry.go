@@ -0,0 +1,51 @@
+package vehicle
+
+import (
+	"time"
+)
+
+// TelemetryVersion is the latest version of the telemetry schema.
+const TelemetryVersion = 1
+
+// Telemetry is a report of a vehicle at the time Ts. Every report has the vehicle's position;
+// the other fields are optional, since not every vehicle reports them.
+type Telemetry struct {
+	// Version is the version of the schema, the report follows. Zero value means the latest version.
+	Version int       `json:"version,omitempty"`
+	Ts      time.Time `json:"ts"`
+	Lat     float64   `json:"lat"`
+	Lon     float64   `json:"lon"`
+	TelemetryFields
+}
+
+// TelemetryFields are the optional fields of the telemetry. Nil field means the vehicle didn't report it.
+type TelemetryFields struct {
+	// Battery is the charge of the vehicle's battery in percent.
+	Battery *float64 `json:"battery,omitempty"`
+	// Altitude is the altitude in meters above the sea level.
+	Altitude *float64 `json:"altitude,omitempty"`
+	// Accuracy is the accuracy of the position in meters, as the vehicle's GPS estimated it.
+	Accuracy *float64 `json:"accuracy,omitempty"`
+	// Odometer is the total distance in meters, the vehicle counted.
+	Odometer *float64 `json:"odometer,omitempty"`
+	// Locked reports whether the vehicle is locked.
+	Locked *bool `json:"locked,omitempty"`
+	// Attributes are the free-form attributes, e.g. the firmware version.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// IsZero reports whether the vehicle didn't report any of the fields.
+func (f TelemetryFields) IsZero() bool {
+	return f.Battery == nil && f.Altitude == nil && f.Accuracy == nil && f.Odometer == nil &&
+		f.Locked == nil && len(f.Attributes) == 0
+}
+
+// Float64 returns the pointer to v, to set the optional fields.
+func Float64(v float64) *float64 {
+	return &v
+}
+
+// Bool returns the pointer to v, to set the optional fields.
+func Bool(v bool) *bool {
+	return &v
+}
@@ -34,12 +34,17 @@ func GenerateVIN() VIN {
 	return vin
 }
 
+// maxTurn is the max change of the vehicle's heading in degrees per move.
+const maxTurn = 30
+
 type Vehicle struct {
 	client *FleetStateClient
 
 	VIN VIN
 	Lat float64
 	Lon float64
+	// Heading is the bearing in degrees, the vehicle moves along.
+	Heading float64
 }
 
 func NewVehicle(client *FleetStateClient) *Vehicle {
@@ -51,9 +56,10 @@ func VehicleInLatLon(client *FleetStateClient, lat, lon float64) *Vehicle {
 	return &Vehicle{
 		client: client,
 
-		VIN: GenerateVIN(),
-		Lat: lat,
-		Lon: lon,
+		VIN:     GenerateVIN(),
+		Lat:     lat,
+		Lon:     lon,
+		Heading: 360 * rand.Float64(),
 	}
 }
 
@@ -61,10 +67,32 @@ func (vc *Vehicle) String() string {
 	return fmt.Sprintf("Vehicle %s (%.6f %.6f)", vc.VIN, vc.Lat, vc.Lon)
 }
 
+// MoveNearby moves the vehicle to a random point within d meters.
 func (vc *Vehicle) MoveNearby(d float64) {
 	vc.Lat, vc.Lon = geoutil.RandLatLonNearby(vc.Lat, vc.Lon, d)
 }
 
+// Move moves the vehicle d meters ahead, turning it slightly first, so the vehicle follows a smooth track.
+func (vc *Vehicle) Move(d float64) {
+	heading := vc.Heading + maxTurn*(2*rand.Float64()-1)
+	lat, lon := geoutil.Destination(vc.Lat, vc.Lon, heading, d/1000)
+	// the heading changes along the great circle; keep the one the vehicle arrived with
+	vc.Heading = geoutil.FinalBearing(vc.Lat, vc.Lon, lat, lon)
+	vc.Lat, vc.Lon = lat, lon
+}
+
+// Position returns the current position of the vehicle at the time ts.
+func (vc *Vehicle) Position(ts time.Time) Position {
+	return Position{
+		VIN: vc.VIN,
+		Telemetry: Telemetry{
+			Ts:  ts,
+			Lat: vc.Lat,
+			Lon: vc.Lon,
+		},
+	}
+}
+
 func (vc *Vehicle) ReportPosition(ctx context.Context) error {
 	return vc.client.UpdatePosition(ctx, vc.VIN, vc.Lat, vc.Lon)
 }
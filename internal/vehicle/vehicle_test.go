@@ -2,7 +2,10 @@ package vehicle
 
 import (
 	"fmt"
+	"math"
 	"testing"
+
+	"github.com/narqo/ree-fleet-sim/internal/geoutil"
 )
 
 func TestVINFromString(t *testing.T) {
@@ -49,3 +52,25 @@ func TestVINFromString(t *testing.T) {
 		})
 	}
 }
+
+func TestVehicle_Move(t *testing.T) {
+	for _, lat := range []float64{0, 52.518898, -60, 85} {
+		t.Run(fmt.Sprintf("lat=%v", lat), func(t *testing.T) {
+			vc := VehicleInLatLon(nil, lat, 13.401797)
+
+			for i := 0; i < 100; i++ {
+				lat0, lon0, heading0 := vc.Lat, vc.Lon, vc.Heading
+				vc.Move(10)
+
+				if d := geoutil.Distance(lat0, lon0, vc.Lat, vc.Lon) * 1000; math.Abs(d-10) > 1e-3 {
+					t.Fatalf("move %d: want 10 m, got %v m", i, d)
+				}
+				// the vehicle turns at most by maxTurn degrees per move
+				turn := math.Abs(math.Mod(geoutil.InitialBearing(lat0, lon0, vc.Lat, vc.Lon)-heading0+540, 360) - 180)
+				if turn > maxTurn+1e-6 {
+					t.Fatalf("move %d: turned by %v degrees, want at most %v", i, turn, maxTurn)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+package webhook
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	subscriptionsFile = "subscriptions.json"
+
+	defaultWorkers     = 4
+	defaultMaxAttempts = 10
+	defaultMinBackoff  = time.Second
+	defaultMaxBackoff  = 10 * time.Minute
+	defaultTimeout     = 10 * time.Second
+	defaultLogSize     = 1000
+
+	// maxResponseSize is how much of the subscriber's response is read, before the connection is reused
+	maxResponseSize = 64 << 10
+)
+
+// Options configures Dispatcher. Zero value of a field means its default value.
+type Options struct {
+	// Dir is the directory, the subscriptions and the queue of pending deliveries are persisted in.
+	// Empty Dir means the dispatcher keeps everything in memory.
+	Dir string
+	// Workers is the number of the concurrent deliveries.
+	Workers int
+	// MaxAttempts is the number of the attempts to deliver an event, after which the dispatcher gives up.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. Every following retry doubles the delay, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Timeout is the timeout of a single request to the subscriber.
+	Timeout time.Duration
+	// LogSize is the number of the latest delivery attempts, the dispatcher keeps for inspection.
+	LogSize int
+	// Client is the client, the requests are sent with.
+	Client *http.Client
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.LogSize <= 0 {
+		opts.LogSize = defaultLogSize
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return opts
+}
+
+// Attempt is a single attempt to deliver the event to the subscription.
+type Attempt struct {
+	// DeliveryID identifies the delivery of the event to the subscription, that may take several attempts.
+	DeliveryID     string    `json:"delivery"`
+	SubscriptionID string    `json:"subscription"`
+	EventID        string    `json:"event"`
+	EventType      string    `json:"type"`
+	URL            string    `json:"url"`
+	Attempt        int       `json:"attempt"`
+	Ts             time.Time `json:"ts"`
+	// Duration is the duration of the request in seconds.
+	Duration float64 `json:"duration"`
+	// Status is the status of the subscriber's response; zero if the request failed.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Delivered reports the event was delivered; otherwise, NextAt is the time of the next attempt,
+	// or zero if the dispatcher gave up.
+	Delivered bool      `json:"delivered"`
+	NextAt    time.Time `json:"next_at,omitempty"`
+}
+
+// AttemptsQuery selects the delivery attempts. Zero value of a field matches all attempts.
+type AttemptsQuery struct {
+	SubscriptionID string
+	EventID        string
+	// Limit is the max number of the latest attempts to return.
+	Limit int
+}
+
+func (q AttemptsQuery) match(a Attempt) bool {
+	return (q.SubscriptionID == "" || q.SubscriptionID == a.SubscriptionID) && (q.EventID == "" || q.EventID == a.EventID)
+}
+
+// Dispatcher delivers the published events to the matching subscriptions in the background. A delivery,
+// that failed, is retried with exponential backoff. The pending deliveries survive the restarts,
+// so an event is delivered at least once, unless the dispatcher gives up.
+type Dispatcher struct {
+	opts Options
+
+	mu   sync.Mutex
+	subs map[string]Subscription
+	// queue are the pending deliveries, ordered by the time of their next attempts
+	queue deliveryQueue
+	// inflight are the deliveries, the workers are attempting
+	inflight map[string]*delivery
+	journal  *journal
+	// attempts is the ring buffer of the latest delivery attempts
+	attempts []Attempt
+	// seq is the number of the delivery attempts ever made
+	seq uint64
+
+	// wake notifies the workers about new deliveries
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Open opens the dispatcher, restoring the subscriptions and the pending deliveries from opts.Dir, and starts
+// delivering the events. Caller must call Close after the dispatcher is no longer used.
+func Open(opts Options) (*Dispatcher, error) {
+	opts = opts.withDefaults()
+
+	d := &Dispatcher{
+		opts:     opts,
+		subs:     make(map[string]Subscription),
+		inflight: make(map[string]*delivery),
+		journal:  &journal{},
+		attempts: make([]Attempt, opts.LogSize),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if opts.Dir != "" {
+		subs, err := loadSubscriptions(opts.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not load subscriptions: %w", err)
+		}
+		for _, sub := range subs {
+			d.subs[sub.ID] = sub
+		}
+
+		j, pending, err := openJournal(opts.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not open queue: %w", err)
+		}
+		d.journal = j
+		for _, dv := range pending {
+			heap.Push(&d.queue, dv)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	for i := 0; i < opts.Workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.work(ctx)
+		}()
+	}
+
+	return d, nil
+}
+
+// Close stops the delivery. The deliveries in progress are interrupted, and are retried after the dispatcher
+// is opened again.
+func (d *Dispatcher) Close() error {
+	d.cancel()
+	d.wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.journal.Close()
+}
+
+func loadSubscriptions(dir string) ([]Subscription, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var subs []Subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// saveSubscriptions persists the subscriptions. The caller must hold d.mu.
+func (d *Dispatcher) saveSubscriptions() error {
+	if d.opts.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(d.opts.Dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(d.subscriptions())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(d.opts.Dir, subscriptionsFile), data)
+}
+
+// Subscribe adds the subscription, assigning it a new id. If the subscription doesn't have a secret,
+// Subscribe generates a random one.
+func (d *Dispatcher) Subscribe(sub Subscription) (Subscription, error) {
+	sub.ID = newID()
+	if sub.Secret == "" {
+		sub.Secret = NewSecret()
+	}
+	sub.CreatedAt = time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.subs[sub.ID] = sub
+	if err := d.saveSubscriptions(); err != nil {
+		delete(d.subs, sub.ID)
+		return sub, fmt.Errorf("could not save subscriptions: %w", err)
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription. Its pending deliveries are dropped.
+func (d *Dispatcher) Unsubscribe(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, ok := d.subs[id]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownSubscription, id)
+	}
+	delete(d.subs, id)
+	if err := d.saveSubscriptions(); err != nil {
+		d.subs[id] = sub
+		return fmt.Errorf("could not save subscriptions: %w", err)
+	}
+	return nil
+}
+
+func (d *Dispatcher) Subscription(id string) (Subscription, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, ok := d.subs[id]
+	if !ok {
+		return sub, fmt.Errorf("%w %s", ErrUnknownSubscription, id)
+	}
+	return sub, nil
+}
+
+// Subscriptions returns all subscriptions, in the order they were created.
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.subscriptions()
+}
+
+func (d *Dispatcher) subscriptions() []Subscription {
+	subs := make([]Subscription, 0, len(d.subs))
+	for _, sub := range d.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+		}
+		return subs[i].ID < subs[j].ID
+	})
+	return subs
+}
+
+// Publish queues the event for the delivery to every subscription, that matches its type. The deliveries
+// are journaled together: if Publish fails, the event isn't queued for any subscription.
+func (d *Dispatcher) Publish(ev Event) error {
+	if ev.ID == "" {
+		ev.ID = newID()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var dvs []*delivery
+	for _, sub := range d.subs {
+		if !sub.match(ev.Type) {
+			continue
+		}
+		dvs = append(dvs, &delivery{
+			ID:             newID(),
+			SubscriptionID: sub.ID,
+			Event:          ev,
+			NextAt:         now,
+		})
+	}
+	if len(dvs) == 0 {
+		return nil
+	}
+
+	if err := d.journal.Add(dvs...); err != nil {
+		return fmt.Errorf("could not queue event %s: %w", ev.ID, err)
+	}
+	for _, dv := range dvs {
+		heap.Push(&d.queue, dv)
+	}
+	d.notify()
+	return nil
+}
+
+// Pending returns the number of the pending deliveries.
+func (d *Dispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queue.Len()
+}
+
+// Attempts returns the latest delivery attempts, that match the query, oldest first.
+func (d *Dispatcher) Attempts(q AttemptsQuery) []Attempt {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var oldest uint64
+	if size := uint64(len(d.attempts)); d.seq > size {
+		oldest = d.seq - size
+	}
+
+	var attempts []Attempt
+	for seq := d.seq; seq > oldest; seq-- {
+		a := d.attempts[(seq-1)%uint64(len(d.attempts))]
+		if !q.match(a) {
+			continue
+		}
+		attempts = append(attempts, a)
+		if q.Limit > 0 && len(attempts) == q.Limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(attempts)-1; i < j; i, j = i+1, j-1 {
+		attempts[i], attempts[j] = attempts[j], attempts[i]
+	}
+	return attempts
+}
+
+// notify wakes up a worker, that waits for the deliveries. The caller must hold d.mu.
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for ctx.Err() == nil {
+		dv, wait := d.next(time.Now())
+		if dv != nil {
+			d.deliver(ctx, dv)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-timeout:
+		}
+	}
+}
+
+// next pops the delivery, that is due at the time now. Otherwise, it returns how long to wait for the next one;
+// zero if there are no deliveries.
+func (d *Dispatcher) next(now time.Time) (*delivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.queue.Len() == 0 {
+		return nil, 0
+	}
+	if wait := d.queue[0].NextAt.Sub(now); wait > 0 {
+		return nil, wait
+	}
+
+	dv := heap.Pop(&d.queue).(*delivery)
+	d.inflight[dv.ID] = dv
+	if d.queue.Len() > 0 {
+		// let another worker pick up the next delivery
+		d.notify()
+	}
+	return dv, 0
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, dv *delivery) {
+	d.mu.Lock()
+	sub, ok := d.subs[dv.SubscriptionID]
+	if !ok {
+		// the subscription was removed, after the event was queued
+		delete(d.inflight, dv.ID)
+		err := d.journal.Done(dv)
+		d.mu.Unlock()
+		if err != nil {
+			log.Printf("webhook: failed to drop delivery %s: %s", dv.ID, err)
+		}
+		return
+	}
+	d.mu.Unlock()
+
+	a := Attempt{
+		DeliveryID:     dv.ID,
+		SubscriptionID: sub.ID,
+		EventID:        dv.Event.ID,
+		EventType:      dv.Event.Type,
+		URL:            sub.URL,
+		Attempt:        dv.Attempt + 1,
+		Ts:             time.Now().UTC(),
+	}
+
+	status, err := d.send(ctx, sub, dv.Event)
+	a.Duration = time.Since(a.Ts).Seconds()
+	a.Status = status
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.inflight, dv.ID)
+	if err != nil && ctx.Err() != nil {
+		// the dispatcher is closing; the delivery stays in the journal, and is retried after the restart
+		heap.Push(&d.queue, dv)
+		return
+	}
+
+	var jerr error
+	if err == nil {
+		a.Delivered = true
+		jerr = d.journal.Done(dv)
+	} else {
+		a.Error = err.Error()
+		dv.Attempt++
+		if dv.Attempt >= d.opts.MaxAttempts {
+			jerr = d.journal.Done(dv)
+		} else {
+			dv.NextAt = time.Now().Add(d.backoff(dv.Attempt))
+			a.NextAt = dv.NextAt.UTC()
+			jerr = d.journal.Retry(dv)
+			heap.Push(&d.queue, dv)
+			d.notify()
+		}
+	}
+	if jerr != nil {
+		log.Printf("webhook: failed to update queue for delivery %s: %s", dv.ID, jerr)
+	}
+
+	d.attempts[d.seq%uint64(len(d.attempts))] = a
+	d.seq++
+
+	if d.journal.needsCompact(d.queue.Len() + len(d.inflight)) {
+		pending := make([]*delivery, 0, d.queue.Len()+len(d.inflight))
+		pending = append(pending, d.queue...)
+		for _, dv := range d.inflight {
+			pending = append(pending, dv)
+		}
+		if err := d.journal.compact(pending); err != nil {
+			log.Printf("webhook: failed to compact queue: %s", err)
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, after the number of the failed attempts.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.opts.MinBackoff
+	for i := 1; i < attempt && delay < d.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.opts.MaxBackoff {
+		delay = d.opts.MaxBackoff
+	}
+	return delay
+}
+
+// send sends the signed event to the subscriber. It returns the status of the response,
+// and an error, if the event wasn't accepted.
+func (d *Dispatcher) send(ctx context.Context, sub Subscription, ev Event) (int, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, ev.Type)
+	req.Header.Set(HeaderID, ev.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, now, body))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliveryQueue is a min-heap of the deliveries, ordered by the time of their next attempts.
+type deliveryQueue []*delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+
+func (q deliveryQueue) Less(i, j int) bool { return q[i].NextAt.Before(q[j].NextAt) }
+
+func (q deliveryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *deliveryQueue) Push(x interface{}) {
+	*q = append(*q, x.(*delivery))
+}
+
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	dv := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return dv
+}
@@ -0,0 +1,320 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReceiver is the subscriber's endpoint, that records the events it accepted.
+type testReceiver struct {
+	t      *testing.T
+	secret string
+
+	mu sync.Mutex
+	// fail is the number of the following requests, the receiver fails
+	fail int
+	// hang makes the receiver hang up, until the client cancels the request
+	hang   bool
+	events []Event
+	// received notifies about every request
+	received chan struct{}
+}
+
+func newTestReceiver(t *testing.T) (*testReceiver, *httptest.Server) {
+	rcv := &testReceiver{
+		t:        t,
+		received: make(chan struct{}, 100),
+	}
+	srv := httptest.NewServer(rcv)
+	t.Cleanup(srv.Close)
+	return rcv, srv
+}
+
+func (rcv *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		rcv.received <- struct{}{}
+	}()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rcv.t.Error(err)
+		return
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	if rcv.hang {
+		rcv.mu.Unlock()
+		<-r.Context().Done()
+		rcv.mu.Lock()
+		return
+	}
+	if rcv.secret != "" {
+		if err := Verify(rcv.secret, r.Header, body, time.Minute); err != nil {
+			rcv.t.Errorf("receiver: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if rcv.fail > 0 {
+		rcv.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		rcv.t.Errorf("receiver: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if got := r.Header.Get(HeaderEvent); got != ev.Type {
+		rcv.t.Errorf("receiver: want header %s %q got %q", HeaderEvent, ev.Type, got)
+	}
+	rcv.events = append(rcv.events, ev)
+}
+
+func (rcv *testReceiver) Events() []Event {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]Event(nil), rcv.events...)
+}
+
+// waitRequests waits for n requests to the receiver.
+func (rcv *testReceiver) waitRequests(n int) {
+	rcv.t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rcv.received:
+		case <-time.After(5 * time.Second):
+			rcv.t.Fatalf("timed out waiting for request %d of %d", i+1, n)
+		}
+	}
+}
+
+func testOpenDispatcher(t *testing.T, opts Options) *Dispatcher {
+	t.Helper()
+
+	d, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+func testNewEvent(t *testing.T, typ string) Event {
+	t.Helper()
+
+	ev, err := NewEvent(typ, time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC), map[string]string{"vin": "THE1VIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestDispatcher_Publish(t *testing.T) {
+	rcv, srv := newTestReceiver(t)
+	d := testOpenDispatcher(t, Options{})
+
+	sub, err := d.Subscribe(Subscription{URL: srv.URL, Events: []string{"vehicle.new"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Secret == "" {
+		t.Fatal("Subscribe: want generated secret")
+	}
+	rcv.secret = sub.Secret
+
+	ev := testNewEvent(t, "vehicle.new")
+	if err := d.Publish(testNewEvent(t, "vehicle.offline")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Publish(ev); err != nil {
+		t.Fatal(err)
+	}
+	rcv.waitRequests(1)
+
+	events := rcv.Events()
+	if len(events) != 1 || events[0].ID != ev.ID || string(events[0].Data) != `{"vin":"THE1VIN"}` {
+		t.Fatalf("receiver: want event %+v got %+v", ev, events)
+	}
+
+	// the attempt is logged after the response is received
+	time.Sleep(100 * time.Millisecond)
+
+	attempts := d.Attempts(AttemptsQuery{SubscriptionID: sub.ID})
+	if len(attempts) != 1 {
+		t.Fatalf("Attempts: want 1 got %+v", attempts)
+	}
+	if a := attempts[0]; !a.Delivered || a.Status != http.StatusOK || a.EventID != ev.ID || a.Attempt != 1 {
+		t.Fatalf("Attempts: unexpected attempt %+v", a)
+	}
+	if n := d.Pending(); n != 0 {
+		t.Fatalf("Pending: want 0 got %d", n)
+	}
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	rcv, srv := newTestReceiver(t)
+	rcv.fail = 2
+
+	d := testOpenDispatcher(t, Options{
+		MinBackoff: 10 * time.Millisecond,
+	})
+	sub, err := d.Subscribe(Subscription{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := testNewEvent(t, "vehicle.new")
+	if err := d.Publish(ev); err != nil {
+		t.Fatal(err)
+	}
+	rcv.waitRequests(3)
+	time.Sleep(100 * time.Millisecond)
+
+	if events := rcv.Events(); len(events) != 1 || events[0].ID != ev.ID {
+		t.Fatalf("receiver: want event %+v got %+v", ev, events)
+	}
+
+	attempts := d.Attempts(AttemptsQuery{EventID: ev.ID})
+	if len(attempts) != 3 {
+		t.Fatalf("Attempts: want 3 got %+v", attempts)
+	}
+	for i, a := range attempts {
+		if a.Attempt != i+1 || a.SubscriptionID != sub.ID {
+			t.Fatalf("attempt %d: unexpected attempt %+v", i, a)
+		}
+		if wantDelivered := i == 2; a.Delivered != wantDelivered {
+			t.Fatalf("attempt %d: want delivered %v got %+v", i, wantDelivered, a)
+		}
+		if !a.Delivered && (a.Status != http.StatusServiceUnavailable || a.NextAt.IsZero()) {
+			t.Fatalf("attempt %d: unexpected failed attempt %+v", i, a)
+		}
+	}
+	// the backoff doubles
+	if d0, d1 := attempts[0].NextAt.Sub(attempts[0].Ts), attempts[1].NextAt.Sub(attempts[1].Ts); d1 < d0 {
+		t.Fatalf("want growing backoff, got %v then %v", d0, d1)
+	}
+}
+
+func TestDispatcher_MaxAttempts(t *testing.T) {
+	rcv, srv := newTestReceiver(t)
+	rcv.fail = 100
+
+	d := testOpenDispatcher(t, Options{
+		MaxAttempts: 2,
+		MinBackoff:  10 * time.Millisecond,
+	})
+	if _, err := d.Subscribe(Subscription{URL: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Publish(testNewEvent(t, "vehicle.new")); err != nil {
+		t.Fatal(err)
+	}
+	rcv.waitRequests(2)
+	time.Sleep(100 * time.Millisecond)
+
+	attempts := d.Attempts(AttemptsQuery{})
+	if len(attempts) != 2 {
+		t.Fatalf("Attempts: want 2 got %+v", attempts)
+	}
+	if a := attempts[1]; a.Delivered || !a.NextAt.IsZero() {
+		t.Fatalf("Attempts: want the dispatcher gave up, got %+v", a)
+	}
+	if n := d.Pending(); n != 0 {
+		t.Fatalf("Pending: want 0 got %d", n)
+	}
+}
+
+func TestDispatcher_Persistence(t *testing.T) {
+	rcv, srv := newTestReceiver(t)
+	rcv.hang = true
+
+	opts := Options{
+		Dir: t.TempDir(),
+	}
+
+	d, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := d.Subscribe(Subscription{URL: srv.URL, Events: []string{"vehicle.new"}, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := testNewEvent(t, "vehicle.new")
+	if err := d.Publish(ev); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delivery is in progress, when the dispatcher is closed
+	time.Sleep(100 * time.Millisecond)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rcv.waitRequests(1)
+
+	rcv.mu.Lock()
+	rcv.hang = false
+	rcv.secret = "secret"
+	rcv.mu.Unlock()
+
+	d = testOpenDispatcher(t, opts)
+
+	subs := d.Subscriptions()
+	if len(subs) != 1 || subs[0].ID != sub.ID || subs[0].Secret != "secret" {
+		t.Fatalf("Subscriptions: want %+v got %+v", sub, subs)
+	}
+
+	rcv.waitRequests(1)
+	if events := rcv.Events(); len(events) != 1 || events[0].ID != ev.ID {
+		t.Fatalf("receiver: want event %v got %+v", ev.ID, events)
+	}
+}
+
+func TestDispatcher_Unsubscribe(t *testing.T) {
+	rcv, srv := newTestReceiver(t)
+	d := testOpenDispatcher(t, Options{})
+
+	sub0, err := d.Subscribe(Subscription{URL: srv.URL + "/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub1, err := d.Subscribe(Subscription{URL: srv.URL + "/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Unsubscribe(sub0.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unsubscribe(sub0.ID); err == nil {
+		t.Fatal("Unsubscribe: want err got nil")
+	}
+	if _, err := d.Subscription(sub0.ID); err == nil {
+		t.Fatal("Subscription: want err got nil")
+	}
+	if subs := d.Subscriptions(); len(subs) != 1 || subs[0].ID != sub1.ID {
+		t.Fatalf("Subscriptions: want %v got %+v", sub1.ID, subs)
+	}
+
+	if err := d.Publish(testNewEvent(t, "vehicle.new")); err != nil {
+		t.Fatal(err)
+	}
+	rcv.waitRequests(1)
+	time.Sleep(100 * time.Millisecond)
+
+	if attempts := d.Attempts(AttemptsQuery{}); len(attempts) != 1 || attempts[0].URL != srv.URL+"/1" {
+		t.Fatalf("Attempts: want single attempt to %s got %+v", sub1.URL, attempts)
+	}
+}
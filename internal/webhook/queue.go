@@ -0,0 +1,249 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The queue of the pending deliveries is kept in a journal file: a sequence of JSON-encoded operations,
+// one per line. Opening the journal replays the operations, and compacts the journal down to the pending deliveries.
+const (
+	queueFile = "queue.log"
+
+	opAdd   = "add"
+	opRetry = "retry"
+	opDone  = "done"
+
+	// the journal is compacted, once it has compactThreshold entries more than twice the pending deliveries
+	compactThreshold = 1000
+)
+
+// delivery is the event, pending the delivery to the subscription.
+type delivery struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription"`
+	Event          Event  `json:"event"`
+	// Attempt is the number of the failed attempts to deliver the event.
+	Attempt int       `json:"attempt"`
+	NextAt  time.Time `json:"next_at"`
+}
+
+type journalEntry struct {
+	Op       string    `json:"op"`
+	Delivery *delivery `json:"delivery,omitempty"`
+	ID       string    `json:"id,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	NextAt   time.Time `json:"next_at,omitempty"`
+}
+
+// journal is the persistent log of the queue's operations. Zero journal, with no file, keeps nothing.
+// It's not safe for concurrent use.
+type journal struct {
+	path string
+	f    *os.File
+	// size is the size of the file, the appends, that failed, are rolled back to
+	size int64
+	// entries is the number of the entries in the file
+	entries int
+}
+
+// openJournal opens the journal in the directory dir, and returns the pending deliveries, found in the journal.
+// A torn entry at the end of the journal, e.g. after a crash in the middle of a write, is dropped.
+func openJournal(dir string) (*journal, map[string]*delivery, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	j := &journal{
+		path: filepath.Join(dir, queueFile),
+	}
+
+	pending, err := replayJournal(j.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries := make([]*delivery, 0, len(pending))
+	for _, d := range pending {
+		deliveries = append(deliveries, d)
+	}
+	if err := j.compact(deliveries); err != nil {
+		return nil, nil, err
+	}
+
+	return j, pending, nil
+}
+
+func replayJournal(path string) (map[string]*delivery, error) {
+	pending := make(map[string]*delivery)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// the last line without the newline is a torn entry
+			return pending, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("corrupted journal %s: %w", path, err)
+		}
+		switch entry.Op {
+		case opAdd:
+			if entry.Delivery != nil {
+				pending[entry.Delivery.ID] = entry.Delivery
+			}
+		case opRetry:
+			if d := pending[entry.ID]; d != nil {
+				d.Attempt = entry.Attempt
+				d.NextAt = entry.NextAt
+			}
+		case opDone:
+			delete(pending, entry.ID)
+		}
+	}
+}
+
+// append writes the entries with a single write and fsync. If it fails, the journal is rolled back,
+// so either all entries are in the journal, or none.
+func (j *journal) append(entries ...journalEntry) error {
+	if j.f == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	_, err := j.f.Write(buf.Bytes())
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		// a torn entry in the middle of the journal would make it unreadable
+		if terr := j.f.Truncate(j.size); terr != nil {
+			return fmt.Errorf("%v, could not roll back: %v", err, terr)
+		}
+		return err
+	}
+	j.size += int64(buf.Len())
+	j.entries += len(entries)
+	return nil
+}
+
+// Add appends the deliveries of an event.
+func (j *journal) Add(ds ...*delivery) error {
+	entries := make([]journalEntry, 0, len(ds))
+	for _, d := range ds {
+		entries = append(entries, journalEntry{Op: opAdd, Delivery: d})
+	}
+	return j.append(entries...)
+}
+
+func (j *journal) Retry(d *delivery) error {
+	return j.append(journalEntry{Op: opRetry, ID: d.ID, Attempt: d.Attempt, NextAt: d.NextAt})
+}
+
+func (j *journal) Done(d *delivery) error {
+	return j.append(journalEntry{Op: opDone, ID: d.ID})
+}
+
+// needsCompact reports whether the journal has grown much larger, than the number of pending deliveries.
+func (j *journal) needsCompact(pending int) bool {
+	return j.f != nil && j.entries > 2*pending+compactThreshold
+}
+
+// compact rewrites the journal, so it only has the pending deliveries. The new journal replaces
+// the old one atomically; if compact fails, the journal goes on with the old one.
+func (j *journal) compact(pending []*delivery) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range pending {
+		if err := enc.Encode(journalEntry{Op: opAdd, Delivery: d}); err != nil {
+			return err
+		}
+	}
+	f, err := replaceFile(j.path, buf.Bytes())
+	if f == nil {
+		return err
+	}
+
+	// the old file is replaced, even if syncing the directory failed
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	j.size = int64(buf.Len())
+	j.entries = len(pending)
+	return err
+}
+
+func (j *journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// writeFileAtomic replaces the file at path with the data.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := replaceFile(path, data)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// replaceFile replaces the file at path with the data, and returns the new file, open for appending.
+// The file is nil, if the old file wasn't replaced.
+func replaceFile(path string, data []byte) (*os.File, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testPendingIDs(pending map[string]*delivery) []string {
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	j, pending, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("want no pending deliveries got %v", testPendingIDs(pending))
+	}
+
+	nextAt := time.Date(2020, 10, 6, 10, 0, 0, 0, time.UTC)
+	d1 := &delivery{ID: "1", SubscriptionID: "sub", Event: Event{ID: "ev1", Type: "vehicle.new"}}
+	d2 := &delivery{ID: "2", SubscriptionID: "sub", Event: Event{ID: "ev2", Type: "vehicle.new"}}
+	d3 := &delivery{ID: "3", SubscriptionID: "sub", Event: Event{ID: "ev3", Type: "vehicle.new"}}
+	for _, d := range []*delivery{d1, d2, d3} {
+		if err := j.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d2.Attempt, d2.NextAt = 1, nextAt
+	if err := j.Retry(d2); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Done(d3); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate the crash in the middle of a write
+	f, err := os.OpenFile(filepath.Join(dir, queueFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"done","id":"1`)
+	f.Close()
+
+	j, pending, err = openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if want, got := []string{"1", "2"}, testPendingIDs(pending); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want pending %v got %v", want, got)
+	}
+	if got := pending["2"]; got.Attempt != 1 || !got.NextAt.Equal(nextAt) || got.Event.ID != "ev2" {
+		t.Fatalf("want retried delivery %+v got %+v", d2, got)
+	}
+	// the journal is compacted down to the pending deliveries
+	if j.entries != 2 {
+		t.Fatalf("want 2 entries got %d", j.entries)
+	}
+}
+
+func TestJournal_CompactFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	j, _, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d1 := &delivery{ID: "1", SubscriptionID: "sub", Event: Event{ID: "ev1", Type: "vehicle.new"}}
+	d2 := &delivery{ID: "2", SubscriptionID: "sub", Event: Event{ID: "ev1", Type: "vehicle.new"}}
+	if err := j.Add(d1, d2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new journal can't be written
+	tmpPath := filepath.Join(dir, queueFile+".tmp")
+	if err := os.Mkdir(tmpPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.compact([]*delivery{d1, d2}); err == nil {
+		t.Fatal("compact: want error got nil")
+	}
+
+	// the journal goes on with the old file
+	if err := j.Done(d1); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tmpPath); err != nil {
+		t.Fatal(err)
+	}
+
+	j, pending, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if want, got := []string{"2"}, testPendingIDs(pending); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want pending %v got %v", want, got)
+	}
+}
@@ -0,0 +1,131 @@
+// Package webhook delivers the events to the subscribers' HTTP endpoints.
+//
+// Every event is POST-ed to the subscriber's URL as a JSON object. The request is signed with the subscriber's
+// secret: the "X-Webhook-Signature" header is the hex-encoded HMAC-SHA256 of the "X-Webhook-Timestamp" header,
+// followed by a dot and the request's body. See Sign and Verify.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderID        = "X-Webhook-ID"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrUnknownSubscription = errors.New("unknown subscription")
+	ErrBadSignature        = errors.New("bad signature")
+)
+
+// Event is the payload of a webhook request.
+type Event struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Ts   time.Time       `json:"ts"`
+	Data json.RawMessage `json:"data"`
+}
+
+// NewEvent returns the event of the type, with the data encoded as JSON.
+func NewEvent(typ string, ts time.Time, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:   newID(),
+		Type: typ,
+		Ts:   ts,
+		Data: raw,
+	}, nil
+}
+
+// Subscription is the subscriber's endpoint, the events of the types are delivered to.
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events are the types of the events, the subscriber receives. Empty Events means all types.
+	Events []string `json:"events,omitempty"`
+	// Secret is the key, the requests are signed with.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (sub Subscription) match(typ string) bool {
+	if len(sub.Events) == 0 {
+		return true
+	}
+	for _, t := range sub.Events {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature of the request's body, sent at the time ts.
+func Sign(secret string, ts time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature in the request's header matches its body. If tolerance isn't zero,
+// Verify also rejects the requests with timestamps further than tolerance from the time now,
+// to protect the receiver from the replayed requests.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	sec, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp: %v", ErrBadSignature, err)
+	}
+	ts := time.Unix(sec, 0)
+	if tolerance > 0 {
+		if d := time.Since(ts); d > tolerance || d < -tolerance {
+			return fmt.Errorf("%w: timestamp %s is out of tolerance", ErrBadSignature, ts.UTC().Format(time.RFC3339))
+		}
+	}
+
+	sig := header.Get(HeaderSignature)
+	if !strings.HasPrefix(sig, signaturePrefix) {
+		return fmt.Errorf("%w: unknown scheme", ErrBadSignature)
+	}
+	if !hmac.Equal([]byte(sig), []byte(Sign(secret, ts, body))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// newID returns a random identifier.
+func newID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("webhook: could not read random: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// NewSecret returns a random secret, to sign the requests with.
+func NewSecret() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("webhook: could not read random: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// printf '1601978400.{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=ecd0e2ed3f61248634ca624b2964cd566b5bf98694663823dfc5a13503729fe2"
+	got := Sign("secret", time.Unix(1601978400, 0), []byte("{}"))
+	if want != got {
+		t.Fatalf("Sign: want %q got %q", want, got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1","type":"vehicle.new"}`)
+	now := time.Now()
+
+	header := func(secret string, ts time.Time, body []byte) http.Header {
+		h := make(http.Header)
+		h.Set(HeaderTimestamp, strconv.FormatInt(ts.Unix(), 10))
+		h.Set(HeaderSignature, Sign(secret, ts, body))
+		return h
+	}
+
+	cases := []struct {
+		name    string
+		header  http.Header
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			header: header("secret", now, body),
+		},
+		{
+			name:    "wrong secret",
+			header:  header("other", now, body),
+			wantErr: true,
+		},
+		{
+			name:    "other body",
+			header:  header("secret", now, []byte(`{}`)),
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			header:  header("secret", now.Add(-time.Hour), body),
+			wantErr: true,
+		},
+		{
+			name:    "no signature",
+			header:  http.Header{HeaderTimestamp: []string{strconv.FormatInt(now.Unix(), 10)}},
+			wantErr: true,
+		},
+		{
+			name:    "no timestamp",
+			header:  http.Header{HeaderSignature: []string{Sign("secret", now, body)}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify("secret", tc.header, body, 5*time.Minute)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want err %v got %v", tc.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrBadSignature) {
+				t.Fatalf("want err %v got %v", ErrBadSignature, err)
+			}
+		})
+	}
+}
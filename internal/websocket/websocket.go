@@ -0,0 +1,330 @@
+// Package websocket implements the subset of the WebSocket protocol (RFC 6455), that the server and its clients need:
+// the opening handshake, text and binary messages, fragmentation, ping/pong and the closing handshake.
+// Extensions and subprotocols aren't supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finalBit = 0x80
+	maskBit  = 0x80
+
+	maxControlPayloadSize = 125
+
+	DefaultMaxMessageSize = 1 << 20
+)
+
+// Close codes, refer to https://tools.ietf.org/html/rfc6455#section-7.4.1
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseMessageTooBig   = 1009
+	CloseInternalErr     = 1011
+	closeAbnormalClosure = 1006
+)
+
+var (
+	ErrMessageTooBig = errors.New("message too big")
+	// ErrCloseSent is returned by the write methods, after the connection started the closing handshake.
+	ErrCloseSent = errors.New("close sent")
+	errProtocol  = errors.New("protocol error")
+)
+
+// CloseError is returned by ReadMessage, after the peer started the closing handshake.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Text)
+}
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Conn is a WebSocket connection. Concurrent calls to the write methods are safe; ReadMessage must be
+// called from a single goroutine.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	// MaxMessageSize is the max size of a message, the connection reads.
+	MaxMessageSize int64
+
+	wmu       sync.Mutex
+	closeSent bool
+	wbuf      []byte
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		client:         client,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// ReadMessage reads the next data message. It replies to pings and handles the closing handshake;
+// after the peer closed the connection, ReadMessage returns CloseError. If the peer broke the protocol,
+// or sent a message larger than MaxMessageSize, ReadMessage starts the closing handshake with the matching code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	typ, msg, err := c.readMessage()
+	if errors.Is(err, errProtocol) {
+		c.closeWith(CloseProtocolError, "")
+	} else if errors.Is(err, ErrMessageTooBig) {
+		c.closeWith(CloseMessageTooBig, "")
+	}
+	return typ, msg, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		typ MessageType
+		msg []byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+			}
+			// complete the closing handshake
+			c.closeWith(closeErr.Code, "")
+			return 0, nil, closeErr
+		case opText, opBinary:
+			if typ != 0 {
+				return 0, nil, fmt.Errorf("%w: new message inside fragmented message", errProtocol)
+			}
+			typ = MessageType(op)
+		case opContinuation:
+			if typ == 0 {
+				return 0, nil, fmt.Errorf("%w: continuation frame without message", errProtocol)
+			}
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown opcode %d", errProtocol, op)
+		}
+
+		if int64(len(msg)+len(payload)) > c.MaxMessageSize {
+			return 0, nil, ErrMessageTooBig
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return typ, msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&finalBit != 0
+	op = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits are set", errProtocol)
+	}
+
+	masked := header[1]&maskBit != 0
+	if masked == c.client {
+		// client must mask the frames it sends; server must not
+		return false, 0, nil, fmt.Errorf("%w: unexpected frame masking", errProtocol)
+	}
+
+	size := int64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+		if size < 0 {
+			return false, 0, nil, fmt.Errorf("%w: bad payload size", errProtocol)
+		}
+	}
+
+	if op >= opClose && (!fin || size > maxControlPayloadSize) {
+		return false, 0, nil, fmt.Errorf("%w: bad control frame", errProtocol)
+	}
+	if size > c.MaxMessageSize {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+
+	return fin, op, payload, nil
+}
+
+// WriteMessage writes the data as a single message of type typ.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	return c.writeFrame(byte(typ), data)
+}
+
+// Ping sends a ping to the peer. The pong is consumed by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(opPing, data)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	buf := c.wbuf[:0]
+	buf = append(buf, finalBit|op)
+
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch size := len(payload); {
+	case size <= 125:
+		buf = append(buf, maskFlag|byte(size))
+	case size <= 0xffff:
+		buf = append(buf, maskFlag|126, byte(size>>8), byte(size))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		buf = append(buf, maskFlag|127)
+		buf = append(buf, ext[:]...)
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(mask, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+	c.wbuf = buf
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Conn) closeWith(code int, text string) error {
+	payload := make([]byte, 2, 2+len(text))
+	if code == CloseNoStatus || code == closeAbnormalClosure {
+		// these codes must not be sent over the wire
+		payload = payload[:0]
+	} else {
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, text...)
+	}
+	if len(payload) > maxControlPayloadSize {
+		payload = payload[:maxControlPayloadSize]
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return c.writeFrame(opClose, payload)
+}
+
+// CloseWith starts the closing handshake with the close code and the reason text, and closes the connection.
+func (c *Conn) CloseWith(code int, text string) error {
+	err := c.closeWith(code, text)
+	if cerr := c.conn.Close(); err == nil || errors.Is(err, ErrCloseSent) {
+		err = cerr
+	}
+	return err
+}
+
+// Close closes the connection with the normal closure code.
+func (c *Conn) Close() error {
+	return c.CloseWith(CloseNormalClosure, "")
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455, section 1.3
+	if want, got := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); want != got {
+		t.Errorf("acceptKey: want %q got %q", want, got)
+	}
+}
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			var herr *HandshakeError
+			if errors.As(err, &herr) {
+				http.Error(w, herr.Message, herr.Status)
+			}
+			return
+		}
+		defer conn.Close()
+
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestConn_Echo(t *testing.T) {
+	ts := newEchoServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msgs := []struct {
+		typ  MessageType
+		data string
+	}{
+		{TextMessage, "hello"},
+		{BinaryMessage, "\x00\x01\x02"},
+		{TextMessage, strings.Repeat("x", 300)},
+		{TextMessage, strings.Repeat("y", 70000)},
+	}
+	for _, m := range msgs {
+		if err := conn.WriteMessage(m.typ, []byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Ping([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.typ != typ {
+			t.Errorf("message type: want %d got %d", m.typ, typ)
+		}
+		if m.data != string(data) {
+			t.Errorf("message: want %d bytes got %d", len(m.data), len(data))
+		}
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	closed := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			closed <- err
+			return
+		}
+		_, _, err = conn.ReadMessage()
+		closed <- err
+	}))
+	defer ts.Close()
+
+	conn, err := Dial(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.CloseWith(CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-closed:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("ReadMessage: want CloseError, got %v", err)
+		}
+		if closeErr.Code != CloseGoingAway || closeErr.Text != "bye" {
+			t.Errorf("CloseError: want %d %q, got %d %q", CloseGoingAway, "bye", closeErr.Code, closeErr.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't see the close")
+	}
+
+	if err := conn.WriteMessage(TextMessage, []byte("hello")); !errors.Is(err, ErrCloseSent) {
+		t.Errorf("WriteMessage after close: want %v, got %v", ErrCloseSent, err)
+	}
+}
+
+func TestConn_MessageTooBig(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.MaxMessageSize = 10
+		conn.ReadMessage()
+	}))
+	defer ts.Close()
+
+	conn, err := Dial(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(TextMessage, []byte(strings.Repeat("x", 11))); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseMessageTooBig {
+		t.Errorf("ReadMessage: want close %d, got %v", CloseMessageTooBig, err)
+	}
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	ts := newEchoServer(t)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want, got := http.StatusBadRequest, resp.StatusCode; want != got {
+		t.Errorf("status: want %d got %d", want, got)
+	}
+}
+
+func TestConn_ProtocolError(t *testing.T) {
+	ts := newEchoServer(t)
+
+	conn, err := Dial(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a continuation frame, that doesn't continue any message
+	if err := conn.writeFrame(opContinuation, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseProtocolError {
+		t.Errorf("ReadMessage: want close %d, got %v", CloseProtocolError, err)
+	}
+}